@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a category of log line gets logBurst lines every logWindow, anything
+// past that is counted instead of written
+const (
+	logWindow = 10 * time.Second
+	logBurst  = 10
+)
+
+// logLimiter keeps the same kind of line from flooding the log during an
+// attack or a retry storm.
+type logLimiter struct {
+	mu         sync.Mutex
+	categories map[string]*logCategory
+}
+
+type logCategory struct {
+	start   time.Time
+	count   int
+	pending uint64 // suppressed since the last line that got through
+	total   uint64
+}
+
+var noisyLogs = &logLimiter{categories: map[string]*logCategory{}}
+
+func (l *logLimiter) category(name string) *logCategory {
+	c, ok := l.categories[name]
+	if !ok {
+		c = &logCategory{}
+		l.categories[name] = c
+	}
+	return c
+}
+
+// logLimited logs a line unless its category has been chatty lately. the
+// next line to get through says how many were held back.
+func logLimited(category, format string, args ...interface{}) {
+	noisyLogs.mu.Lock()
+	c := noisyLogs.category(category)
+	now := time.Now()
+	if now.Sub(c.start) >= logWindow {
+		c.start = now
+		c.count = 0
+	}
+	if c.count >= logBurst {
+		c.pending++
+		c.total++
+		noisyLogs.mu.Unlock()
+		return
+	}
+	c.count++
+	pending := c.pending
+	c.pending = 0
+	noisyLogs.mu.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+	if pending > 0 {
+		msg += fmt.Sprintf(" (%d similar lines suppressed)", pending)
+	}
+	log.Print(msg)
+}
+
+// skip counts a line left out on purpose, like a sampled out access log.
+func (l *logLimiter) skip(category string) {
+	l.mu.Lock()
+	l.category(category).total++
+	l.mu.Unlock()
+}
+
+// suppressedCount is how many lines a category has lost since we started.
+type suppressedCount struct {
+	Category string
+	Lines    uint64
+}
+
+func (l *logLimiter) suppressed() []suppressedCount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := make([]suppressedCount, 0, len(l.categories))
+	for name, c := range l.categories {
+		counts = append(counts, suppressedCount{Category: name, Lines: c.total})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Category < counts[j].Category })
+	return counts
+}
+
+// accessWriter notes what a response turned out to be for the access log.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	geo    *geoInfo // nil without a geoip database
+}
+
+func (a *accessWriter) WriteHeader(code int) {
+	if a.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessWriter) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.bytes += int64(n)
+	return n, err
+}
+
+func (a *accessWriter) ReadFrom(r io.Reader) (int64, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := io.Copy(a.ResponseWriter, r)
+	a.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack underneath.
+func (a *accessWriter) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+// accessLogged reports whether requests for a route (nil when there's no
+// route for the domain) go in the access log.
+func (app *App) accessLogged(route *Proxy) bool {
+	if route != nil && route.AccessLog != nil {
+		return *route.AccessLog
+	}
+	return app.AccessLog
+}
+
+// logAccess writes the access log line for a finished request, if the
+// route's filters let it through. errors are always logged unless the
+// route says otherwise, successful responses are sampled.
+func (app *App) logAccess(a *accessWriter, r *http.Request, domain string, route *Proxy, start time.Time) {
+	status := a.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	sample, seq := app.AccessLogSample, &app.accessSeq
+	if route != nil {
+		for _, pattern := range route.AccessLogExclude {
+			if matchPathPattern(pattern, r.URL.Path) {
+				return
+			}
+		}
+		if status < route.AccessLogMinStatus {
+			return
+		}
+		if route.AccessLogSample > 0 {
+			sample, seq = route.AccessLogSample, &route.accessSeq
+		}
+	}
+	if status < 400 && sample > 1 && seq.Add(1)%uint64(sample) != 0 {
+		noisyLogs.skip("access-sampled")
+		return
+	}
+
+	var geo string
+	if a.geo != nil {
+		geo = a.geo.logFields()
+	}
+	log.Printf("Access: %s %s %q %d %d %s%s", clientIP(r), domain, r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+		status, a.bytes, time.Since(start).Round(time.Microsecond), geo)
+}
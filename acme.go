@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeChallengePrefix is where http-01 challenge tokens are fetched from.
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// acmeWebrootHandler answers http-01 challenges from files an outside acme
+// client wrote under dir, the same layout certbot's webroot plugin uses.
+// everything else, including tokens that aren't there, goes on to next so
+// autocert still gets its own challenges and the https redirect.
+func acmeWebrootHandler(dir string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, acmeChallengePrefix)
+		// tokens are base64url, anything with a slash or dot isn't one
+		if !ok || token == "" || strings.ContainsAny(token, "/.\\") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(acmeChallengePrefix), token))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(data)
+	})
+}
+
+// certEvents is autocert's cache with an event for every certificate it
+// stores, which is how we learn one was issued or renewed.
+type certEvents struct {
+	autocert.Cache
+}
+
+func (c certEvents) Put(ctx context.Context, key string, data []byte) error {
+	// the account key and http-01 tokens go through here too
+	domain := strings.TrimSuffix(key, "+rsa")
+	isCert := !strings.HasPrefix(key, "acme_account") && !strings.HasSuffix(key, "+http-01")
+	renewed := false
+	if isCert {
+		_, err := c.Cache.Get(ctx, key)
+		renewed = err == nil
+	}
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	if isCert {
+		typ := eventCertIssued
+		if renewed {
+			typ = eventCertRenewed
+		}
+		emitEvent(typ, map[string]interface{}{"domain": domain})
+	}
+	return nil
+}
+
+// noteCertFailures wraps autocert's GetCertificate to keep track of
+// domains whose certificate can't be had, emitting cert.failed and backing
+// off before asking acme again. autocert would otherwise place a new order
+// on every handshake, and let's encrypt only allows so many failures.
+func (app *App) noteCertFailures(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// unknown names and scanners fail all day, that's not news,
+		// tls-alpn challenges are part of an attempt already under way and
+		// grouped domains are tracked with their group
+		domain := NormalizeDomain(hello.ServerName)
+		if domain == "" || !app.routeTable().wantsCert(domain) || isALPNChallenge(hello) || app.Groups.groupOf(domain) != "" {
+			return get(hello)
+		}
+		if err, waiting := app.certTries.waiting(domain); waiting {
+			return nil, err
+		}
+		tried := time.Now()
+		cert, err := get(hello)
+		if err == nil {
+			if failures := app.certTries.succeeded(domain); failures > 0 {
+				log.Printf("Got a certificate for %s after %d failed attempts", displayDomain(domain), failures)
+			}
+			return cert, nil
+		}
+		// handshakes waiting on the same attempt all get its error, it's
+		// only counted once
+		if retry, counted := app.certTries.failed(domain, err, tried); counted {
+			log.Printf("Failed to get a certificate for %s: %v, trying again in %s", displayDomain(domain), err, retry)
+			emitEvent(eventCertFailed, map[string]interface{}{"domain": domain, "error": err.Error()})
+		}
+		return nil, err
+	}
+}
+
+// isALPNChallenge reports whether a handshake is the acme server checking a
+// tls-alpn-01 challenge.
+func isALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			return true
+		}
+	}
+	return false
+}
+
+// certProvisioning caps how many new routes get their certificates at
+// once, loading a routes file full of new domains shouldn't open dozens
+// of acme orders in the same second.
+var certProvisioning = make(chan struct{}, 4)
+
+// provisionCert gets a newly added route its certificate straight away,
+// rather than leaving the first visitor's handshake to wait on acme.
+// wildcard routes are on demand, there's no telling which names they'll
+// be asked for.
+func (app *App) provisionCert(key string) {
+	host, _, _ := strings.Cut(key, "/")
+	if app.Certs == nil || strings.HasPrefix(host, "*") || !app.routeTable().wantsCert(host) || app.Groups.groupOf(host) != "" {
+		return
+	}
+	go func() {
+		certProvisioning <- struct{}{}
+		defer func() { <-certProvisioning }()
+
+		// a path route on a domain that's already served has nothing to
+		// wait for
+		if _, err := app.Certs.Cache.Get(context.Background(), host); err == nil {
+			return
+		}
+		start := time.Now()
+		// failures are logged and retried on the way through
+		_, err := app.noteCertFailures(app.Certs.GetCertificate)(&tls.ClientHelloInfo{
+			ServerName:       host,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		})
+		if err != nil {
+			return
+		}
+		log.Printf("Got a certificate for %s in %s", displayDomain(host), time.Since(start).Round(time.Millisecond))
+	}()
+}
+
+// acmeCAs are the names -acme-ca knows, anything else has to be the url of
+// an acme directory.
+var acmeCAs = map[string]string{
+	"letsencrypt":         acme.LetsEncryptURL,
+	"letsencrypt-staging": "https://acme-staging-v02.api.letsencrypt.org/directory",
+	"zerossl":             "https://acme.zerossl.com/v2/DV90",
+	"google":              "https://dv.acme-v02.api.pki.goog/directory",
+}
+
+// eabRequired are the cas that won't make an account without external
+// account binding, and where to get the keys.
+var eabRequired = map[string]string{
+	"https://acme.zerossl.com/v2/DV90":           "the developer section of zerossl's dashboard",
+	"https://dv.acme-v02.api.pki.goog/directory": "`gcloud publicca external-account-keys create`",
+}
+
+// acmeDirectory turns -acme-ca into a directory url.
+func acmeDirectory(ca string) (string, error) {
+	if url, ok := acmeCAs[strings.ToLower(ca)]; ok {
+		return url, nil
+	}
+	if !strings.HasPrefix(ca, "https://") && !strings.HasPrefix(ca, "http://") {
+		return "", fmt.Errorf("%q isn't a known ca or a directory url, use letsencrypt, letsencrypt-staging, zerossl, google or https://...", ca)
+	}
+	return ca, nil
+}
+
+// parseEAB builds the external account binding from its key id and the
+// base64url hmac key the ca hands out with it, nil when there's neither.
+func parseEAB(kid, hmacKey string) (*acme.ExternalAccountBinding, error) {
+	if kid == "" && hmacKey == "" {
+		return nil, nil
+	}
+	if kid == "" || hmacKey == "" {
+		return nil, errors.New("external account binding needs both the key id and the hmac key")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(hmacKey, "="))
+	if err != nil {
+		// some cas show it in standard base64
+		if key, err = base64.StdEncoding.DecodeString(hmacKey); err != nil {
+			return nil, errors.New("the hmac key isn't base64")
+		}
+	}
+	return &acme.ExternalAccountBinding{KID: kid, Key: key}, nil
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// serveAdmin runs the admin api on addr. every request needs a bearer token
+// from `appserve token create`.
+func (app *App) serveAdmin(addr string) {
+	handler := app.adminHandler()
+	if app.AdminCA != nil {
+		config, err := app.AdminCA.serverConfig(addr)
+		if err != nil {
+			log.Fatalf("Failed to set up the admin api certificate: %v", err)
+		}
+		ln, err := app.bind(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server := &http.Server{Handler: handler, TLSConfig: config}
+		log.Printf("Serving the admin api on %s, client certificates required", addr)
+		log.Fatal(server.ServeTLS(ln, "", ""))
+	}
+
+	if tokens, err := app.Tokens.current(); err != nil {
+		log.Fatalf("Invalid tokens file: %v", err)
+	} else if len(tokens) == 0 {
+		log.Printf("No admin tokens in %s yet, create one with: appserve token create <name>", app.Tokens.file)
+	}
+	ln, err := app.bind(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Serving the admin api on %s", addr)
+	log.Fatal(http.Serve(ln, handler))
+}
+
+// adminHandler is every admin api endpoint behind the guard and
+// authentication.
+func (app *App) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/logs", app.adminLogs(http.HandlerFunc(serveLogs)))
+	mux.Handle("/logs/ws", app.adminLogs(logsWebSocket))
+	mux.Handle("/events", app.eventsWebSocket())
+	mux.HandleFunc("/routes", app.adminRoutes)
+	mux.HandleFunc("/routes/", app.adminRoute)
+	mux.HandleFunc("/stats", app.adminStats)
+	mux.HandleFunc("/certs", app.adminCerts)
+	mux.HandleFunc("/traffic", app.adminTraffic)
+	mux.HandleFunc("/history", app.adminHistory)
+	mux.HandleFunc("/purge", app.adminPurge)
+	return app.adminGuard(app.adminAuth(mux))
+}
+
+// authenticateAdmin finds the token behind a request, from its client
+// certificate in mtls mode or its bearer token otherwise.
+func (app *App) authenticateAdmin(r *http.Request) (*adminToken, bool) {
+	if app.AdminCA != nil {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return nil, false
+		}
+		return app.AdminCA.token(r.TLS.PeerCertificates[0])
+	}
+	return app.Tokens.authenticate(r)
+}
+
+// adminAuth turns away requests without a valid token, or with a read only
+// one for anything but a read.
+func (app *App) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := app.authenticateAdmin(r)
+		if !ok {
+			securityEvent(eventAuthFailure, clientIP(r), "admin", "bad or missing admin credentials")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="appserve"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		noteAuditToken(r, token)
+		if token.role() == roleTunnel {
+			writeJSONError(w, http.StatusForbidden, "token "+token.Name+" can only open tunnels")
+			return
+		}
+		if !token.allows(r) {
+			writeJSONError(w, http.StatusForbidden, "token "+token.Name+" is read only")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminTokenKey{}, token)))
+	})
+}
+
+// ownsDomain reports whether a token may see what goes on at a domain, the
+// domain of a route the token owns or a host one of them answers for.
+func (app *App) ownsDomain(token *adminToken, domain string) bool {
+	if token.Tenant == "" {
+		return true
+	}
+	if domain == "" {
+		return false
+	}
+	_, route, found := app.routeTable().match(domain, "/")
+	return found && token.owns(route)
+}
+
+// adminLogs keeps tenant tokens to the logs of their own domains, they have
+// to ask for one.
+func (app *App) adminLogs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain := NormalizeDomain(r.URL.Query().Get("domain"))
+		if !app.ownsDomain(tokenFrom(r), domain) {
+			writeJSONError(w, http.StatusForbidden, "tenant tokens have to ask for the logs of one of their domains with ?domain=")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminRoutes lists every route, GET /routes, or replaces them all with a
+// routes file bundle, PUT /routes.
+func (app *App) adminRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		app.adminBundle(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	token := tokenFrom(r)
+	app.Mu.RLock()
+	routes := make([]DomainRoute, 0, len(app.Routes))
+	filter := queryFilter(r.URL.Query())
+	for domain, proxy := range app.Routes {
+		if token.owns(proxy) && filter.matches(domain, &proxy.RouteOptions) {
+			routes = append(routes, proxy.config(domain))
+		}
+	}
+	app.Mu.RUnlock()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Domain < routes[j].Domain })
+	writeJSON(w, http.StatusOK, routes)
+}
+
+// adminRoute reads, replaces or removes one route:
+//
+//	GET    /routes/example.com
+//	PUT    /routes/example.com  {"port": "3000", ...} as in the routes file
+//	PATCH  /routes/example.com  {"tags": [...], "owner": "...", "notes": "..."}
+//	DELETE /routes/example.com
+func (app *App) adminRoute(w http.ResponseWriter, r *http.Request) {
+	domain := NormalizeDomain(strings.TrimPrefix(r.URL.Path, "/routes/"))
+	if domain == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := tokenFrom(r)
+	if app.RoutesKey != nil && (r.Method == http.MethodPut || r.Method == http.MethodPatch || r.Method == http.MethodDelete) {
+		writeJSONError(w, http.StatusForbidden, errSignedRoutes.Error())
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		app.Mu.RLock()
+		proxy, ok := app.Routes[domain]
+		app.Mu.RUnlock()
+		if !ok || !token.owns(proxy) {
+			writeJSONError(w, http.StatusNotFound, "no such domain")
+			return
+		}
+		writeJSON(w, http.StatusOK, proxy.config(domain))
+
+	case http.MethodPut:
+		var route DomainRoute
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&route); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		route.Domain = domain
+		if token.Tenant != "" {
+			if route.Tenant != "" && route.Tenant != token.Tenant {
+				writeJSONError(w, http.StatusForbidden, "token "+token.Name+" can only manage routes of tenant "+token.Tenant)
+				return
+			}
+			route.Tenant = token.Tenant
+		}
+		if err := app.putRoute(token, route); errors.Is(err, errNotOwned) || errors.Is(err, errTenantLimit) {
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Admin api set route for domain: %s", domain)
+		writeJSON(w, http.StatusOK, route)
+
+	case http.MethodPatch:
+		app.adminPatchRoute(w, r, token, domain)
+
+	case http.MethodDelete:
+		if err := app.removeRoute(token, domain); errors.Is(err, errNoSuchDomain) {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Admin api removed route for domain: %s", domain)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// adminBundle replaces every route with a whole routes file, signed when
+// -routes-pubkey is set:
+//
+//	PUT /routes  {"routes": "<routes file>", "signature": "<routes file .minisig>"}
+//
+// the file is saved as it came, signature and all, so a later load still
+// checks out.
+func (app *App) adminBundle(w http.ResponseWriter, r *http.Request) {
+	token := tokenFrom(r)
+	if token.Tenant != "" {
+		writeJSONError(w, http.StatusForbidden, "tenant tokens can't replace every route")
+		return
+	}
+	var bundle struct {
+		Routes    string `json:"routes"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&bundle); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	data, sig := []byte(bundle.Routes), []byte(bundle.Signature)
+	if app.RoutesKey != nil {
+		if err := app.RoutesKey.verify(data, sig); err != nil {
+			securityEvent(eventBadSignature, clientIP(r), "admin", "routes bundle from token "+token.Name+": "+err.Error())
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	routes, err := decodeRoutes(bytes.NewReader(data), "bundle")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	changes, err := app.replaceRoutes(routes)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if app.Store != nil {
+		app.Mu.RLock()
+		err = app.Store.saveRoutes(app.Routes, changedBy(token))
+		app.Mu.RUnlock()
+	} else {
+		if err = saveBundle(app.RoutesFile, data, sig); err == nil {
+			err = app.recordRoutes(changedBy(token))
+		}
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// the whole table was just saved, nothing's waiting any more
+	app.unsaved.take()
+	log.Printf("Admin api loaded a routes bundle (%d added, %d changed, %d removed, %d unchanged)",
+		changes.added, changes.changed, changes.removed, changes.unchanged)
+	writeJSON(w, http.StatusOK, map[string]int{
+		"added": changes.added, "changed": changes.changed, "removed": changes.removed, "unchanged": changes.unchanged,
+	})
+}
+
+// routeStatsJSON is a domain's counters as the admin api shows them.
+type routeStatsJSON struct {
+	Domain       string  `json:"domain"`
+	Requests     uint64  `json:"requests"`
+	BytesIn      uint64  `json:"bytes_in"`
+	BytesOut     uint64  `json:"bytes_out"`
+	ClientErrors uint64  `json:"client_errors"`
+	ServerErrors uint64  `json:"server_errors"`
+	CacheHits    uint64  `json:"cache_hits"`
+	CacheStale   uint64  `json:"cache_stale"`
+	CacheMisses  uint64  `json:"cache_misses"`
+	CacheBytes   uint64  `json:"cache_bytes"`
+	HitRatio     float64 `json:"hit_ratio"`
+}
+
+// adminStats is the stats command for tooling, GET /stats.
+func (app *App) adminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	type errorJSON struct {
+		Class  string `json:"class"`
+		Reason string `json:"reason"`
+		Count  uint64 `json:"count"`
+	}
+	out := struct {
+		Domains []routeStatsJSON `json:"domains"`
+		Errors  []errorJSON      `json:"errors"`
+	}{Domains: []routeStatsJSON{}, Errors: []errorJSON{}}
+
+	token := tokenFrom(r)
+	for _, d := range app.Stats.Domains() {
+		if !app.ownsDomain(token, d) {
+			continue
+		}
+		rs := app.Stats.Route(d)
+		out.Domains = append(out.Domains, routeStatsJSON{
+			Domain:       d,
+			Requests:     rs.Requests.Load(),
+			BytesIn:      rs.BytesIn.Load(),
+			BytesOut:     rs.BytesOut.Load(),
+			ClientErrors: rs.ClientErrors.Load(),
+			ServerErrors: rs.ServerErrors.Load(),
+			CacheHits:    rs.CacheHits.Load(),
+			CacheStale:   rs.CacheStale.Load(),
+			CacheMisses:  rs.CacheMisses.Load(),
+			CacheBytes:   rs.CacheBytes.Load(),
+			HitRatio:     rs.hitRatio(),
+		})
+	}
+	if token.Tenant == "" {
+		// error counts are for the whole server, not any one tenant's
+		for _, c := range requestErrors.snapshot() {
+			out.Errors = append(out.Errors, errorJSON{c.Class, c.Reason, c.Count})
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// adminPurge is the purge command for tooling, dropping a domain's cached
+// responses after a deploy:
+//
+//	POST /purge  {"domain": "example.com", "pattern": "/blog/*"}
+//
+// without a pattern everything cached for the domain goes. the domain is a
+// host or, for a wildcard route or one with a path, the route's key.
+func (app *App) adminPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Domain  string `json:"domain"`
+		Pattern string `json:"pattern"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	domain := NormalizeDomain(req.Domain)
+	if domain == "" {
+		writeJSONError(w, http.StatusBadRequest, "a domain to purge is needed")
+		return
+	}
+	routeKey, host := purgeScope(domain)
+	token := tokenFrom(r)
+	owned := app.ownsDomain(token, host)
+	if routeKey != "" {
+		app.Mu.RLock()
+		route, ok := app.Routes[routeKey]
+		owned = token.Tenant == "" || ok && token.owns(route)
+		app.Mu.RUnlock()
+	}
+	if !owned {
+		writeJSONError(w, http.StatusForbidden, "token "+token.Name+" can only purge its own domains")
+		return
+	}
+	n := app.Cache.Purge(routeKey, host, req.Pattern)
+	log.Printf("Admin api purged %d cached responses for domain: %s", n, domain)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+var errNotOwned = errors.New("the domain belongs to another tenant")
+
+// putRoute adds or replaces a route from a full routes file entry and saves
+// the routes. a route belonging to another tenant than token's is left
+// alone.
+func (app *App) putRoute(token *adminToken, route DomainRoute) error {
+	app.Mu.Lock()
+	defer app.Mu.Unlock()
+	previous, existed := app.Routes[route.Domain]
+	if existed && token != nil && !token.owns(previous) {
+		return errNotOwned
+	}
+	if token != nil && token.Tenant != "" {
+		if err := app.checkTenantRoute(token, route); err != nil {
+			return err
+		}
+	}
+
+	// only build it once it's allowed, building sets up a transport for
+	// the backend and starts resolving its host
+	proxy, err := newRouteProxy(route)
+	if err != nil {
+		return err
+	}
+	app.Routes[route.Domain] = proxy
+	app.publishRoutes()
+	if existed && previous.Port != proxy.Port {
+		app.purgeChangedRoute(route.Domain)
+	}
+	return app.saveRoutes(changedBy(token))
+}
+
+var errNoSuchDomain = errors.New("no such domain")
+
+// removeRoute drops a route and saves the routes, token is nil from the
+// shell.
+func (app *App) removeRoute(token *adminToken, domain string) error {
+	app.Mu.Lock()
+	defer app.Mu.Unlock()
+	if proxy, exists := app.Routes[domain]; !exists || (token != nil && !token.owns(proxy)) {
+		return errNoSuchDomain
+	}
+	delete(app.Routes, domain)
+	app.publishRoutes()
+	return app.saveRoutes(changedBy(token))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// adminGuard is what stands in front of the admin api before a token is even
+// looked at: an allow list of client addresses, a rate limit per address and
+// an audit log of every call.
+type adminGuard struct {
+	// allow is who may connect at all, anyone when it's empty.
+	allow []*net.IPNet
+
+	// rate is how many calls a second each address may make, with a
+	// burst of twice that. 0 for no limit.
+	rate float64
+
+	// audit is nil unless -admin-audit-log is set.
+	audit *securityLog
+
+	mu       sync.Mutex
+	limiters map[string]*adminLimiter
+}
+
+type adminLimiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+// parseAllowList reads a comma separated list of addresses and cidr ranges.
+func parseAllowList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q isn't an address or cidr range", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't an address or cidr range", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (g *adminGuard) allowed(ip string) bool {
+	if len(g.allow) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	for _, n := range g.allow {
+		if parsed != nil && n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// take uses up one call of ip's rate, reporting false when it's out.
+func (g *adminGuard) take(ip string) bool {
+	if g.rate <= 0 {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if g.limiters == nil {
+		g.limiters = make(map[string]*adminLimiter)
+	}
+	if len(g.limiters) > 10000 {
+		// forget addresses that have gone quiet, their bucket is full again
+		for k, l := range g.limiters {
+			if now.Sub(l.lastSeen) > 10*time.Minute {
+				delete(g.limiters, k)
+			}
+		}
+	}
+	l, ok := g.limiters[ip]
+	if !ok {
+		burst := int(g.rate * 2)
+		if burst < 1 {
+			burst = 1
+		}
+		l = &adminLimiter{Limiter: rate.NewLimiter(rate.Limit(g.rate), burst)}
+		g.limiters[ip] = l
+	}
+	l.lastSeen = now
+	return l.Allow()
+}
+
+type auditKey struct{}
+
+// auditRecord is filled in as a call is handled, adminAuth adds who made it.
+type auditRecord struct {
+	token string
+}
+
+// noteAuditToken records the token a call was made with for the audit log.
+func noteAuditToken(r *http.Request, token *adminToken) {
+	if rec, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		rec.token = token.Name
+	}
+}
+
+// adminGuard checks the allow list and rate limit and writes each call to
+// the audit log once it's done:
+//
+//	2023-10-01T12:00:00Z appserve audit: token=ci ip=10.0.0.5 method=PUT path=/routes/example.com status=200 duration=3ms
+func (app *App) adminGuard(next http.Handler) http.Handler {
+	g := app.AdminGuard
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !g.allowed(ip) {
+			securityEvent(eventAdminDenied, ip, "admin", "address not in -admin-allow")
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		rec := &auditRecord{}
+		aw := &auditWriter{accessWriter: accessWriter{ResponseWriter: w}}
+		start := time.Now()
+		if g.audit != nil {
+			defer func() {
+				status := aw.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				token := rec.token
+				if token == "" {
+					token = "-"
+				}
+				g.audit.write(fmt.Sprintf("%s appserve audit: token=%s ip=%s method=%s path=%s status=%d duration=%s\n",
+					start.UTC().Format(time.RFC3339), logField(token), ip, logField(r.Method), logField(r.URL.RequestURI()), status, time.Since(start).Round(time.Millisecond)))
+			}()
+		}
+
+		if !g.take(ip) {
+			logLimited("limit", "Too many admin api calls from %s, rejecting", ip)
+			securityEvent(eventRateLimit, ip, "admin", "too many admin api calls from this ip")
+			aw.Header().Set("Retry-After", "1")
+			writeJSONError(aw, http.StatusTooManyRequests, "too many requests, slow down")
+			return
+		}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+	})
+}
+
+// auditWriter is an accessWriter the websocket endpoints can still take the
+// connection over through, the websocket package asks for a Hijacker
+// directly rather than unwrapping.
+type auditWriter struct {
+	accessWriter
+}
+
+func (a *auditWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(a.ResponseWriter).Hijack()
+	if err == nil {
+		a.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the admin api can take client certificates instead of tokens. appserve
+// runs its own small ca for them in a directory:
+//
+//	ca.pem, ca-key.pem          the ca, made the first time it's needed
+//	server.pem, server-key.pem  the admin listener's certificate
+//	issued.json                 every client certificate handed out
+//
+// a certificate carries its token's name as the common name, the role as
+// the organizational unit and the tenant, if any, as the organization.
+const (
+	adminCAFile      = "ca.pem"
+	adminCAKeyFile   = "ca-key.pem"
+	adminServerFile  = "server.pem"
+	adminServerKey   = "server-key.pem"
+	adminIssuedFile  = "issued.json"
+	adminCertDefault = "admin-tls"
+)
+
+// issuedCert is the record kept of a client certificate so it can be
+// listed and revoked.
+type issuedCert struct {
+	Name    string    `json:"name"`
+	Serial  string    `json:"serial"`
+	Role    string    `json:"role"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Revoked bool      `json:"revoked,omitempty"`
+}
+
+// adminCA issues and checks admin client certificates.
+type adminCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	mu      sync.Mutex
+	modTime time.Time
+	issued  map[string]issuedCert // by serial
+}
+
+// openAdminCA loads the ca in dir, making one if there isn't one yet.
+func openAdminCA(dir string) (*adminCA, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	ca := &adminCA{dir: dir}
+	certPEM, err := os.ReadFile(filepath.Join(dir, adminCAFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return ca, ca.create()
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, adminCAKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	if ca.cert, ca.key, err = parseCertAndKey(certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	return ca, nil
+}
+
+func (ca *adminCA) create() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: "appserve admin ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		return err
+	}
+	ca.key = key
+	return writeCertAndKey(filepath.Join(ca.dir, adminCAFile), filepath.Join(ca.dir, adminCAKeyFile), der, key)
+}
+
+// issue signs a certificate for key, a client one or the listener's own.
+func (ca *adminCA) issue(tmpl *x509.Certificate, key *ecdsa.PrivateKey) ([]byte, error) {
+	tmpl.SerialNumber = newSerial()
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	return x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+}
+
+// serverConfig is the tls config for the admin listener: a certificate for
+// the addresses it listens on, and client certificates from this ca
+// required.
+func (ca *adminCA) serverConfig(addr string) (*tls.Config, error) {
+	certFile := filepath.Join(ca.dir, adminServerFile)
+	keyFile := filepath.Join(ca.dir, adminServerKey)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		var leaf *x509.Certificate
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().After(leaf.NotAfter.Add(-30*24*time.Hour)) {
+			err = errors.New("expiring")
+		}
+	}
+	if err != nil {
+		// missing or close to expiring, make a fresh one
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		tmpl := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "appserve admin"},
+			NotAfter:    time.Now().AddDate(1, 0, 0),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			DNSNames:    []string{"localhost"},
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		}
+		for _, a := range strings.Split(addr, ",") {
+			if host, _, err := net.SplitHostPort(strings.TrimSpace(a)); err == nil && host != "" {
+				if ip := net.ParseIP(host); ip != nil {
+					tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+				} else {
+					tmpl.DNSNames = append(tmpl.DNSNames, host)
+				}
+			}
+		}
+		if name, err := os.Hostname(); err == nil {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+		der, err := ca.issue(tmpl, key)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeCertAndKey(certFile, keyFile, der, key); err != nil {
+			return nil, err
+		}
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// token turns a verified client certificate into the token it stands for,
+// if it hasn't been revoked.
+func (ca *adminCA) token(cert *x509.Certificate) (*adminToken, bool) {
+	issued, err := ca.current()
+	if err != nil {
+		logLimited("admin", "Error reading %s: %v", filepath.Join(ca.dir, adminIssuedFile), err)
+		return nil, false
+	}
+	rec, ok := issued[cert.SerialNumber.Text(16)]
+	if !ok || rec.Revoked {
+		return nil, false
+	}
+	return &adminToken{Name: rec.Name, Role: rec.Role, Tenant: rec.Tenant, Created: rec.Created}, true
+}
+
+// current is the issued list, re-read when `appserve admin-cert` changes it.
+func (ca *adminCA) current() (map[string]issuedCert, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	file := filepath.Join(ca.dir, adminIssuedFile)
+	info, err := os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.ModTime().Equal(ca.modTime) {
+		list, err := readIssued(file)
+		if err != nil {
+			return nil, err
+		}
+		ca.issued = make(map[string]issuedCert, len(list))
+		for _, rec := range list {
+			ca.issued[rec.Serial] = rec
+		}
+		ca.modTime = info.ModTime()
+	}
+	return ca.issued, nil
+}
+
+func readIssued(file string) ([]issuedCert, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []issuedCert
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return list, nil
+}
+
+func writeIssued(file string, list []issuedCert) error {
+	data, err := json.MarshalIndent(list, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func newSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
+
+func parseCertAndKey(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cb, _ := pem.Decode(certPEM)
+	kb, _ := pem.Decode(keyPEM)
+	if cb == nil || kb == nil {
+		return nil, nil, errors.New("no pem data")
+	}
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(kb.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func writeCertAndKey(certFile, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// runAdminCert hands out and revokes admin api client certificates,
+// `appserve admin-cert create ci`.
+func runAdminCert(args []string) {
+	fs := flag.NewFlagSet("admin-cert", flag.ExitOnError)
+	dir := fs.String("dir", adminCertDefault, "directory holding the admin ca")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appserve admin-cert [-dir dir] create [-role read|write] [-tenant name] [-days n] [-out dir] <name> | list | revoke <name>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	ca, err := openAdminCA(*dir)
+	if err != nil {
+		fail(err)
+	}
+	issuedFile := filepath.Join(*dir, adminIssuedFile)
+	issued, err := readIssued(issuedFile)
+	if err != nil {
+		fail(err)
+	}
+
+	switch {
+	case fs.NArg() >= 2 && fs.Arg(0) == "create":
+		cfs := flag.NewFlagSet("admin-cert create", flag.ExitOnError)
+		role := cfs.String("role", roleWrite, "read to only look at routes, stats and logs, write to change routes too")
+		tenant := cfs.String("tenant", "", "only let the certificate see and manage this tenant's routes")
+		days := cfs.Int("days", 365, "how long the certificate is good for")
+		out := cfs.String("out", ".", "directory to write the certificate and key to")
+		cfs.Usage = fs.Usage
+		cfs.Parse(fs.Args()[1:])
+		if cfs.NArg() != 1 || (*role != roleRead && *role != roleWrite) || *days < 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		name := cfs.Arg(0)
+		for _, rec := range issued {
+			if rec.Name == name && !rec.Revoked {
+				fail(fmt.Errorf("there's already a certificate called %s, revoke it first", name))
+			}
+		}
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			fail(err)
+		}
+		subject := pkix.Name{CommonName: name, OrganizationalUnit: []string{*role}}
+		if *tenant != "" {
+			subject.Organization = []string{*tenant}
+		}
+		tmpl := &x509.Certificate{
+			Subject:     subject,
+			NotAfter:    time.Now().AddDate(0, 0, *days),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := ca.issue(tmpl, key)
+		if err != nil {
+			fail(err)
+		}
+		certFile := filepath.Join(*out, name+".pem")
+		keyFile := filepath.Join(*out, name+"-key.pem")
+		if err := writeCertAndKey(certFile, keyFile, der, key); err != nil {
+			fail(err)
+		}
+		issued = append(issued, issuedCert{
+			Name:    name,
+			Serial:  tmpl.SerialNumber.Text(16),
+			Role:    *role,
+			Tenant:  *tenant,
+			Created: time.Now().UTC(),
+			Expires: tmpl.NotAfter.UTC(),
+		})
+		if err := writeIssued(issuedFile, issued); err != nil {
+			fail(err)
+		}
+		fmt.Printf("Created %s certificate %s: %s and %s, trust %s to reach the admin api\n",
+			*role, name, certFile, keyFile, filepath.Join(*dir, adminCAFile))
+
+	case fs.NArg() == 1 && fs.Arg(0) == "list":
+		if len(issued) == 0 {
+			fmt.Println("No certificates.")
+		}
+		for _, rec := range issued {
+			status := "expires " + rec.Expires.Format("2006-01-02")
+			if rec.Revoked {
+				status = "revoked"
+			}
+			tenant := rec.Tenant
+			if tenant == "" {
+				tenant = "all"
+			}
+			fmt.Printf("Certificate: %s, Role: %s, Tenant: %s, %s\n", rec.Name, rec.Role, tenant, status)
+		}
+
+	case fs.NArg() == 2 && fs.Arg(0) == "revoke":
+		found := false
+		for i := range issued {
+			if issued[i].Name == fs.Arg(1) && !issued[i].Revoked {
+				issued[i].Revoked = true
+				found = true
+			}
+		}
+		if !found {
+			fail(fmt.Errorf("no certificate called %s", fs.Arg(1)))
+		}
+		if err := writeIssued(issuedFile, issued); err != nil {
+			fail(err)
+		}
+		fmt.Printf("Revoked certificate %s\n", fs.Arg(1))
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
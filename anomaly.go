@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a domain is compared against what it usually sees once it has this many
+// minutes of history, each new minute weighing in at anomalyWeight
+const (
+	anomalyWarmup = 10
+	anomalyWeight = 0.1
+)
+
+// below these a minute is too quiet to say anything about: unique client
+// counts need anomalyMinIPs, and client error ratios need the
+// -anomaly-min-requests and have to reach anomalyErrorRatio, at least
+// anomalyErrorJump over normal.
+const (
+	anomalyMinIPs     = 20
+	anomalyErrorRatio = 0.5
+	anomalyErrorJump  = 0.25
+)
+
+// what an anomaly can be in
+const (
+	anomalyRequests     = "requests"
+	anomalyUniqueIPs    = "unique_ips"
+	anomalyClientErrors = "client_errors"
+)
+
+// anomalyDetector watches each domain's request rate, unique clients and
+// share of 4xx responses a minute at a time, and raises an alert when one
+// jumps well past what the domain normally sees.
+type anomalyDetector struct {
+	factor      float64
+	minRequests int
+
+	mu        sync.Mutex
+	current   map[string]*anomalyMinute
+	baselines map[string]*anomalyBaseline
+}
+
+// anomalyMinute is what a domain saw in the minute so far.
+type anomalyMinute struct {
+	requests     int
+	clientErrors int
+	ips          map[string]struct{}
+}
+
+// anomalyBaseline is what a domain normally sees in a minute, and which of
+// its alerts are up.
+type anomalyBaseline struct {
+	requests   float64
+	ips        float64
+	errorRatio float64
+	minutes    int
+	alerting   map[string]bool
+}
+
+func newAnomalyDetector(factor float64, minRequests int) *anomalyDetector {
+	if factor <= 0 {
+		return nil
+	}
+	return &anomalyDetector{
+		factor:      factor,
+		minRequests: minRequests,
+		current:     map[string]*anomalyMinute{},
+		baselines:   map[string]*anomalyBaseline{},
+	}
+}
+
+// observe counts a finished request.
+func (d *anomalyDetector) observe(domain, ip string, status int) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.current[domain]
+	if !ok {
+		m = &anomalyMinute{ips: map[string]struct{}{}}
+		d.current[domain] = m
+	}
+	m.requests++
+	if status >= 400 && status < 500 {
+		m.clientErrors++
+	}
+	m.ips[ip] = struct{}{}
+}
+
+// anomalyChange is an alert going up or coming down.
+type anomalyChange struct {
+	domain   string
+	kind     string
+	raised   bool
+	value    float64
+	baseline float64
+}
+
+// tick closes the minute, returning the alerts that went up or came down.
+func (d *anomalyDetector) tick() []anomalyChange {
+	d.mu.Lock()
+	minutes := d.current
+	d.current = map[string]*anomalyMinute{}
+	var changes []anomalyChange
+	for domain := range minutes {
+		if _, ok := d.baselines[domain]; !ok {
+			d.baselines[domain] = &anomalyBaseline{alerting: map[string]bool{}}
+		}
+	}
+	for domain, base := range d.baselines {
+		m, ok := minutes[domain]
+		if !ok {
+			m = &anomalyMinute{}
+		}
+		changes = append(changes, d.check(domain, m, base)...)
+	}
+	d.mu.Unlock()
+	sort.Slice(changes, func(i, j int) bool { return changes[i].domain < changes[j].domain })
+	return changes
+}
+
+// check compares a domain's minute to its baseline, then folds the minute
+// into the baseline unless it's alerting, so an attack doesn't become the
+// new normal.
+func (d *anomalyDetector) check(domain string, m *anomalyMinute, base *anomalyBaseline) []anomalyChange {
+	requests, ips := float64(m.requests), float64(len(m.ips))
+	var ratio float64
+	if m.requests > 0 {
+		ratio = float64(m.clientErrors) / requests
+	}
+	var changes []anomalyChange
+	if base.minutes >= anomalyWarmup {
+		for _, c := range []struct {
+			kind     string
+			value    float64
+			baseline float64
+			odd      bool
+		}{
+			{anomalyRequests, requests, base.requests, m.requests >= d.minRequests && requests > d.factor*base.requests},
+			{anomalyUniqueIPs, ips, base.ips, len(m.ips) >= anomalyMinIPs && ips > d.factor*base.ips},
+			{anomalyClientErrors, ratio, base.errorRatio, m.requests >= d.minRequests && ratio >= anomalyErrorRatio && ratio >= base.errorRatio+anomalyErrorJump},
+		} {
+			if c.odd != base.alerting[c.kind] {
+				base.alerting[c.kind] = c.odd
+				changes = append(changes, anomalyChange{domain, c.kind, c.odd, c.value, c.baseline})
+			}
+		}
+	}
+	for _, up := range base.alerting {
+		if up {
+			return changes
+		}
+	}
+	if base.minutes == 0 {
+		base.requests, base.ips, base.errorRatio = requests, ips, ratio
+	} else {
+		base.requests += anomalyWeight * (requests - base.requests)
+		base.ips += anomalyWeight * (ips - base.ips)
+		if m.requests > 0 {
+			base.errorRatio += anomalyWeight * (ratio - base.errorRatio)
+		}
+	}
+	base.minutes++
+	return changes
+}
+
+// alerts lists the alerts up right now, by domain.
+func (d *anomalyDetector) alerts() map[string][]string {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	alerts := map[string][]string{}
+	for domain, base := range d.baselines {
+		for kind, up := range base.alerting {
+			if up {
+				alerts[domain] = append(alerts[domain], kind)
+			}
+		}
+		sort.Strings(alerts[domain])
+	}
+	return alerts
+}
+
+// runAnomalies closes each minute, logging alerts and sending them as
+// events.
+func (app *App) runAnomalies() {
+	for range time.Tick(time.Minute) {
+		for _, c := range app.Anomalies.tick() {
+			data := map[string]interface{}{"domain": c.domain, "metric": c.kind, "value": c.value, "baseline": c.baseline}
+			if c.raised {
+				log.Printf("Unusual traffic on %s: %s", c.domain, describeAnomaly(c))
+				emitEvent(eventTrafficAnomaly, data)
+			} else {
+				log.Printf("Traffic on %s is back to normal (%s)", c.domain, c.kind)
+				emitEvent(eventTrafficNormal, data)
+			}
+		}
+	}
+}
+
+func describeAnomaly(c anomalyChange) string {
+	switch c.kind {
+	case anomalyRequests:
+		return fmt.Sprintf("%.0f requests in the last minute, usually %.0f", c.value, c.baseline)
+	case anomalyUniqueIPs:
+		return fmt.Sprintf("%.0f different clients in the last minute, usually %.0f", c.value, c.baseline)
+	default:
+		return fmt.Sprintf("%.0f%% of requests in the last minute got a 4xx, usually %.0f%%", c.value*100, c.baseline*100)
+	}
+}
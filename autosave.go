@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// autosavePolicy is when route changes get saved: on every change, every
+// so often, or only with save.
+type autosavePolicy struct {
+	every time.Duration // 0 for every change
+	off   bool
+}
+
+// parseAutosave reads -autosave, "change", "off" or how often to save
+// like "5m".
+func parseAutosave(s string) (autosavePolicy, error) {
+	switch s {
+	case "", "change":
+		return autosavePolicy{}, nil
+	case "off":
+		return autosavePolicy{off: true}, nil
+	}
+	every, err := time.ParseDuration(s)
+	if err != nil || every <= 0 {
+		return autosavePolicy{}, fmt.Errorf("%q should be change, off or how often to save, like 5m", s)
+	}
+	return autosavePolicy{every: every}, nil
+}
+
+func (p autosavePolicy) String() string {
+	switch {
+	case p.off:
+		return "only with save"
+	case p.every > 0:
+		return "every " + p.every.String()
+	}
+	return "on every change"
+}
+
+// unsavedRoutes tracks route changes made in memory that haven't been
+// saved yet.
+type unsavedRoutes struct {
+	mu      sync.Mutex
+	changes int
+	since   time.Time
+	by      []string
+}
+
+func (u *unsavedRoutes) add(by ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.changes == 0 {
+		u.since = time.Now()
+	}
+	u.changes++
+	u.note(by)
+}
+
+func (u *unsavedRoutes) note(by []string) {
+next:
+	for _, name := range by {
+		for _, b := range u.by {
+			if b == name {
+				continue next
+			}
+		}
+		u.by = append(u.by, name)
+	}
+}
+
+// take clears the unsaved changes, returning how many there were, since
+// when and who made them.
+func (u *unsavedRoutes) take() (int, time.Time, []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n, since, by := u.changes, u.since, u.by
+	u.changes, u.by = 0, nil
+	return n, since, by
+}
+
+// restore puts changes back after a save that failed.
+func (u *unsavedRoutes) restore(n int, since time.Time, by []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.changes == 0 || since.Before(u.since) {
+		u.since = since
+	}
+	u.changes += n
+	u.note(by)
+}
+
+func (u *unsavedRoutes) state() (int, time.Time, []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.changes, u.since, append([]string(nil), u.by...)
+}
+
+// saveRoutes is called after every change to the routes, with app.Mu held.
+// it saves them straight away or leaves them for later, going by
+// -autosave. by is who made the change, for the history.
+func (app *App) saveRoutes(by string) error {
+	if app.Store == nil && app.RoutesFile == "" {
+		return nil
+	}
+	if app.Autosave.every == 0 && !app.Autosave.off {
+		return app.writeRoutes(by)
+	}
+	app.unsaved.add(by)
+	return nil
+}
+
+// flushRoutes saves any unsaved route changes, with app.Mu held at least
+// for reading.
+func (app *App) flushRoutes() error {
+	n, since, by := app.unsaved.take()
+	who := strings.Join(by, ", ")
+	if n == 0 {
+		who = "shell"
+	}
+	if err := app.writeRoutes(who); err != nil {
+		app.unsaved.restore(n, since, by)
+		return err
+	}
+	return nil
+}
+
+// saveUnsaved takes app.Mu to save any unsaved route changes.
+func (app *App) saveUnsaved() error {
+	app.Mu.RLock()
+	defer app.Mu.RUnlock()
+	return app.flushRoutes()
+}
+
+// runAutosave saves the routes every -autosave when they've changed.
+func (app *App) runAutosave() {
+	for range time.Tick(app.Autosave.every) {
+		if n, _, _ := app.unsaved.state(); n == 0 {
+			continue
+		}
+		if err := app.saveUnsaved(); err != nil {
+			logLimited("autosave", "Error saving routes to %s: %v", app.routesLocation(), err)
+		}
+	}
+}
+
+// handleStatusCommand shows where the routes are kept, how they're saved,
+// and whether there are changes that aren't saved yet.
+func (app *App) handleStatusCommand() {
+	app.Mu.RLock()
+	routes := len(app.Routes)
+	app.Mu.RUnlock()
+	fmt.Printf("Routes: %d\n", routes)
+	if app.Store == nil && app.RoutesFile == "" {
+		fmt.Println("Saved: never, the routes only live in memory")
+		return
+	}
+	fmt.Printf("Saved to: %s, %s\n", app.routesLocation(), app.Autosave)
+	n, since, by := app.unsaved.state()
+	if n == 0 {
+		fmt.Println("Unsaved changes: none")
+		return
+	}
+	fmt.Printf("Unsaved changes: %d since %s by %s (dirty, run save to keep them)\n",
+		n, since.Format("15:04:05"), strings.Join(by, ", "))
+}
+
+// dropUnsaved forgets unsaved changes a load just replaced.
+func (app *App) dropUnsaved() {
+	if n, _, _ := app.unsaved.take(); n > 0 {
+		fmt.Printf("Dropped %d unsaved route changes.\n", n)
+	}
+}
+
+// confirmExit reports whether it's alright to exit, warning about unsaved
+// route changes the first time with -autosave off.
+func (app *App) confirmExit(warned *bool) bool {
+	n, _, _ := app.unsaved.state()
+	if n == 0 {
+		return true
+	}
+	if !app.Autosave.off {
+		if err := app.saveUnsaved(); err != nil {
+			log.Printf("Error saving routes: %v", err)
+		}
+		return true
+	}
+	if *warned {
+		return true
+	}
+	*warned = true
+	fmt.Printf("Error: %d route changes aren't saved. run save first, or exit again to drop them.\n", n)
+	return false
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// backupVersion is the layout of a backup, in its manifest.
+const backupVersion = 1
+
+// maxBackupFile is the largest entry a restore takes, routes and tokens
+// files included.
+const maxBackupFile = 64 << 20
+
+// backupManifest says what's in a backup and where it's from.
+type backupManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Host    string    `json:"host,omitempty"`
+	Routes  int       `json:"routes"`
+	Certs   int       `json:"certs"`
+	Tokens  int       `json:"tokens"`
+}
+
+// backup is what's in a backup file, everything checked before any of it
+// is restored.
+type backup struct {
+	manifest  backupManifest
+	routes    []DomainRoute
+	tokens    []adminToken
+	hasTokens bool
+	certs     []certFile
+}
+
+// certNames lists the entries in a certificate cache worth backing up.
+func certNames(ctx context.Context, cache autocert.Cache) ([]string, error) {
+	switch c := cache.(type) {
+	case autocert.DirCache:
+		entries, err := os.ReadDir(string(c))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, e := range entries {
+			if e.Type().IsRegular() && !isTransientCertFile(e.Name()) {
+				names = append(names, e.Name())
+			}
+		}
+		return names, nil
+	case *vaultCache:
+		all, err := c.list(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range all {
+			if !isTransientCertFile(name) {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+	return nil, fmt.Errorf("certificates in a %T can't be listed", cache)
+}
+
+// writeBackup puts the routes, admin tokens, certificates and acme account
+// in a .tar.gz, readable by us alone as it holds private keys.
+func (app *App) writeBackup(file string) (backupManifest, error) {
+	m := backupManifest{Version: backupVersion, Created: time.Now().UTC()}
+	m.Host, _ = os.Hostname()
+
+	app.Mu.RLock()
+	saved := savedRoutes(app.Routes)
+	app.Mu.RUnlock()
+	routes, err := json.MarshalIndent(saved, "", "    ")
+	if err != nil {
+		return m, err
+	}
+	m.Routes = len(saved)
+
+	var tokens []byte
+	if app.Tokens != nil {
+		current, err := app.Tokens.current()
+		if err != nil {
+			return m, err
+		}
+		if len(current) > 0 {
+			if tokens, err = json.MarshalIndent(current, "", "    "); err != nil {
+				return m, err
+			}
+			m.Tokens = len(current)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cache := app.certCache()
+	names, err := certNames(ctx, cache)
+	if err != nil {
+		return m, err
+	}
+	sort.Strings(names)
+	certs := map[string][]byte{}
+	for _, name := range names {
+		data, err := cache.Get(ctx, name)
+		if errors.Is(err, autocert.ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			return m, fmt.Errorf("certificate %s: %w", name, err)
+		}
+		certs[name] = data
+	}
+	m.Certs = len(certs)
+
+	manifest, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return m, err
+	}
+
+	tmp := file + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return m, err
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: m.Created, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	err = add("manifest.json", manifest)
+	if err == nil {
+		err = add("routes.json", routes)
+	}
+	if err == nil && tokens != nil {
+		err = add("tokens.json", tokens)
+	}
+	for _, name := range names {
+		if data, ok := certs[name]; ok && err == nil {
+			err = add("certs/"+name, data)
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return m, err
+	}
+	return m, os.Rename(tmp, file)
+}
+
+// readBackup reads a backup and checks every entry in it.
+func readBackup(file string) (*backup, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a .tar.gz: %w", file, err)
+	}
+	tr := tar.NewReader(gz)
+	b := &backup{}
+	var sawManifest, sawRoutes bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := hdr.Name
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s isn't a regular file", name)
+		}
+		if hdr.Size > maxBackupFile {
+			return nil, fmt.Errorf("%s is too big", name)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxBackupFile))
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case name == "manifest.json":
+			if err := json.Unmarshal(data, &b.manifest); err != nil {
+				return nil, fmt.Errorf("manifest.json: %w", err)
+			}
+			if b.manifest.Version > backupVersion {
+				return nil, fmt.Errorf("%s was made by a newer appserve (version %d)", file, b.manifest.Version)
+			}
+			sawManifest = true
+		case name == "routes.json":
+			if b.routes, err = decodeRoutes(bytes.NewReader(data), "routes.json"); err != nil {
+				return nil, err
+			}
+			sawRoutes = true
+		case name == "tokens.json":
+			if err := json.Unmarshal(data, &b.tokens); err != nil {
+				return nil, fmt.Errorf("tokens.json: %w", err)
+			}
+			b.hasTokens = true
+		case strings.HasPrefix(name, "certs/"):
+			base := strings.TrimPrefix(name, "certs/")
+			if base == "" || base != path.Base(base) || base == "." || base == ".." {
+				return nil, fmt.Errorf("%q isn't a plain file name", name)
+			}
+			if isTransientCertFile(base) {
+				continue
+			}
+			f, err := checkCertFile(base, data)
+			if err != nil {
+				return nil, err
+			}
+			b.certs = append(b.certs, f)
+		default:
+			return nil, fmt.Errorf("%s doesn't belong in a backup", name)
+		}
+	}
+	if !sawManifest || !sawRoutes {
+		return nil, fmt.Errorf("%s isn't an appserve backup, it has no manifest.json or routes.json", file)
+	}
+	return b, nil
+}
+
+// restored is what a restore did.
+type restored struct {
+	routes routeChanges
+	tokens int
+	certs  int
+	kept   int // certificates already there that run out later
+}
+
+// restoreBackup puts everything in a backup back: the routes replace the
+// ones there are and are saved, the tokens replace the tokens file, and
+// the certificates and acme account go in the certificate store, keeping
+// certificates there that run out later than the backup's. nothing is
+// changed unless the whole backup checks out.
+func (app *App) restoreBackup(file string) (restored, error) {
+	var r restored
+	if app.RoutesKey != nil {
+		return r, errSignedRoutes
+	}
+	b, err := readBackup(file)
+	if err != nil {
+		return r, err
+	}
+
+	// every route has to build before anything's touched
+	app.Mu.RLock()
+	_, _, err = stageRoutes(b.routes, app.Routes)
+	app.Mu.RUnlock()
+	if err != nil {
+		return r, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cache := app.certCache()
+	for _, f := range b.certs {
+		if !f.expires.IsZero() {
+			if current, err := cache.Get(ctx, f.name); err == nil {
+				if expires, err := certExpiry(current); err == nil && expires.After(f.expires) {
+					r.kept++
+					continue
+				}
+			}
+		}
+		if err := cache.Put(ctx, f.name, f.data); err != nil {
+			return r, fmt.Errorf("certificate %s: %w", f.name, err)
+		}
+		r.certs++
+	}
+	if app.Groups != nil {
+		app.Groups.forget()
+	}
+
+	if b.hasTokens && app.Tokens != nil && app.Tokens.file != "" {
+		if err := writeTokens(app.Tokens.file, b.tokens); err != nil {
+			return r, fmt.Errorf("tokens: %w", err)
+		}
+		r.tokens = len(b.tokens)
+	}
+
+	if r.routes, err = app.replaceRoutes(b.routes); err != nil {
+		return r, err
+	}
+	// a restore is saved straight away whatever -autosave says, it's
+	// meant to be the state of things from now on
+	app.Mu.RLock()
+	app.unsaved.take()
+	err = app.writeRoutes("restore " + file)
+	app.Mu.RUnlock()
+	return r, err
+}
+
+// handleBackupCommand writes a backup of everything needed to bring this
+// server back, or up somewhere else.
+func (app *App) handleBackupCommand(file string) {
+	m, err := app.writeBackup(file)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Backed up %d routes, %d tokens and %d certificate files to %s, it holds private keys, keep it safe.\n",
+		m.Routes, m.Tokens, m.Certs, file)
+}
+
+// handleRestoreCommand brings back a backup made with backup.
+func (app *App) handleRestoreCommand(file string) {
+	r, err := app.restoreBackup(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("%s doesn't exist", file)
+		}
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Restored %s: routes %d added, %d changed, %d removed, %d unchanged, %d tokens, %d certificate files%s.\n",
+		file, r.routes.added, r.routes.changed, r.routes.removed, r.routes.unchanged, r.tokens, r.certs, keptNote(r.kept))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// throttleChunk is the most we hand to the client in one go while throttled,
+// smaller chunks keep the rate smooth.
+const throttleChunk = 32 << 10
+
+// parseSize reads sizes like "512", "64KB", "2MB" or "1.5GB" as bytes.
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	mult := float64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   float64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			mult = unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(n * mult), nil
+}
+
+// bandwidthLimiter is a token bucket counting bytes, with a second's worth
+// of burst.
+type bandwidthLimiter struct {
+	*rate.Limiter
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	burst := int(bytesPerSecond)
+	if burst < throttleChunk {
+		burst = throttleChunk
+	}
+	return &bandwidthLimiter{rate.NewLimiter(rate.Limit(bytesPerSecond), burst)}
+}
+
+// connLimiter hands out the per-connection limiter for a route, creating it
+// the first time the connection asks.
+func (ci *connInfo) connLimiter(domain string, bytesPerSecond int64) *bandwidthLimiter {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if ci.limiters == nil {
+		ci.limiters = make(map[string]*bandwidthLimiter)
+	}
+	l, ok := ci.limiters[domain]
+	if !ok {
+		l = newBandwidthLimiter(bytesPerSecond)
+		ci.limiters[domain] = l
+	}
+	return l
+}
+
+// throttledWriter paces writes through every limiter it holds.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*bandwidthLimiter
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > throttleChunk {
+			n = throttleChunk
+		}
+		for _, l := range t.limiters {
+			if err := l.WaitN(t.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := t.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack underneath.
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// benchResult is one request made by the bench command.
+type benchResult struct {
+	status  int
+	bytes   int64
+	latency time.Duration
+	err     error
+}
+
+// runBench drives load at a domain through the appserve running on this
+// machine and reports how it held up, `appserve bench example.com`.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	concurrency := fs.Int("c", 10, "requests in flight at once")
+	duration := fs.Duration("d", 10*time.Second, "how long to keep the load up")
+	requests := fs.Int("n", 0, "stop after this many requests instead of after -d")
+	addr := fs.String("addr", "127.0.0.1:443", "address appserve is listening on")
+	path := fs.String("path", "/", "path to request")
+	acceptEncoding := fs.String("accept-encoding", "", "Accept-Encoding to send, e.g. br,gzip to exercise compression")
+	http1 := fs.Bool("http1", false, "stick to http/1.1 instead of negotiating http/2")
+	insecure := fs.Bool("insecure", false, "don't check the certificate, for domains without a real one yet")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appserve bench [flags] <domain>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	domain := fs.Arg(0)
+
+	// every connection goes to the local listener whatever the domain
+	// resolves to, with the domain as sni and Host
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, *addr)
+		},
+		TLSClientConfig:     &tls.Config{ServerName: domain, InsecureSkipVerify: *insecure},
+		ForceAttemptHTTP2:   !*http1,
+		MaxIdleConnsPerHost: *concurrency,
+		DisableCompression:  true,
+	}
+	if *http1 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	url := "https://" + domain + *path
+
+	ctx := context.Background()
+	if *requests == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	// handing out request numbers keeps -n exact across the workers
+	next := make(chan struct{})
+	go func() {
+		defer close(next)
+		for i := 0; *requests == 0 || i < *requests; i++ {
+			select {
+			case next <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	fmt.Printf("Benchmarking %s through %s with %d concurrent requests...\n", url, *addr, *concurrency)
+
+	var mu sync.Mutex
+	var results []benchResult
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range next {
+				res := benchRequest(ctx, client, url, *acceptEncoding)
+				if ctx.Err() != nil && res.err != nil {
+					// cut off by the end of the run, not a real failure
+					return
+				}
+				mu.Lock()
+				results = append(results, res)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	printBenchReport(results, elapsed, transport)
+}
+
+func benchRequest(ctx context.Context, client *http.Client, url, acceptEncoding string) benchResult {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return benchResult{err: err}
+	}
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return benchResult{err: err, latency: time.Since(start)}
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return benchResult{status: resp.StatusCode, bytes: n, latency: time.Since(start), err: err}
+}
+
+func printBenchReport(results []benchResult, elapsed time.Duration, transport *http.Transport) {
+	var latencies []time.Duration
+	var bytes int64
+	statuses := map[int]int{}
+	errors := map[string]int{}
+	for _, res := range results {
+		if res.err != nil {
+			errors[res.err.Error()]++
+			continue
+		}
+		latencies = append(latencies, res.latency)
+		bytes += res.bytes
+		statuses[res.status]++
+	}
+	transport.CloseIdleConnections()
+
+	seconds := elapsed.Seconds()
+	fmt.Printf("\n%d requests in %s, %d failed\n", len(results), elapsed.Round(time.Millisecond), len(results)-len(latencies))
+	fmt.Printf("Throughput: %.1f req/s, %s/s\n", float64(len(latencies))/seconds, formatSize(uint64(float64(bytes)/seconds)))
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Println("Latency:")
+		for _, p := range []float64{50, 90, 99} {
+			fmt.Printf("  %-4s %s\n", fmt.Sprintf("p%g", p), percentile(latencies, p).Round(time.Microsecond))
+		}
+		fmt.Printf("  %-4s %s\n", "max", latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+
+	if len(statuses) > 0 {
+		codes := make([]int, 0, len(statuses))
+		for code := range statuses {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		fmt.Println("Status codes:")
+		for _, code := range codes {
+			fmt.Printf("  %d: %d\n", code, statuses[code])
+		}
+	}
+	if len(errors) > 0 {
+		fmt.Println("Errors:")
+		for msg, n := range errors {
+			fmt.Printf("  %dx %s\n", n, msg)
+		}
+	}
+}
+
+// percentile picks the p-th percentile out of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
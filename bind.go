@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// network is the network to listen on for base ("tcp" or "udp"), kept to
+// one ip version when -ip-version asks. go listens dual stack on a
+// wildcard address otherwise.
+func (app *App) network(base string) string {
+	switch app.IPVersion {
+	case "4":
+		return base + "4"
+	case "6":
+		return base + "6"
+	}
+	return base
+}
+
+// parseIPVersion checks -ip-version, "dual", "4" or "6".
+func parseIPVersion(v string) (string, error) {
+	switch strings.TrimPrefix(strings.ToLower(v), "ipv") {
+	case "", "dual", "both":
+		return "", nil
+	case "4":
+		return "4", nil
+	case "6":
+		return "6", nil
+	}
+	return "", fmt.Errorf("expected dual, 4 or 6, got %q", v)
+}
+
+// bind listens on every address in addrs, a comma separated list like
+// "203.0.113.7:443,[2001:db8::7]:443", as one listener.
+func (app *App) bind(addrs string) (net.Listener, error) {
+	var lns []net.Listener
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		ln, err := net.Listen(app.network("tcp"), addr)
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	switch len(lns) {
+	case 0:
+		return nil, fmt.Errorf("no address to listen on in %q", addrs)
+	case 1:
+		return lns[0], nil
+	}
+	return newMultiListener(lns), nil
+}
+
+// multiListener accepts from several listeners at once.
+type multiListener struct {
+	lns   []net.Listener
+	conns chan net.Conn
+	errs  chan error
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newMultiListener(lns []net.Listener) *multiListener {
+	m := &multiListener{lns: lns, conns: make(chan net.Conn), errs: make(chan error), closed: make(chan struct{})}
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					select {
+					case m.errs <- err:
+					case <-m.closed:
+						return
+					}
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						continue
+					}
+					return
+				}
+				select {
+				case m.conns <- conn:
+				case <-m.closed:
+					conn.Close()
+					return
+				}
+			}
+		}(ln)
+	}
+	return m
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.once.Do(func() {
+		close(m.closed)
+		for _, ln := range m.lns {
+			ln.Close()
+		}
+	})
+	return nil
+}
+
+// Addr is the first address, servers only use it for logging and such.
+func (m *multiListener) Addr() net.Addr {
+	return m.lns[0].Addr()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBadBots are user agents nobody wants, vulnerability scanners and
+// scrapers that ignore robots.txt. matched the same way as a rule's
+// user_agents.
+var defaultBadBots = []string{
+	"sqlmap", "nikto", "nmap", "masscan", "zgrab", "nuclei", "wpscan", "dirbuster", "gobuster",
+	"feroxbuster", "ffuf", "acunetix", "netsparker", "jorgee", "mj12bot", "dotbot", "blexbot",
+	"petalbot", "bytespider", "megaindex", "seekport", "dataforseobot", "serpstatbot",
+}
+
+// BotRule blocks or challenges requests by their User-Agent.
+type BotRule struct {
+	// Name labels the rule's hit counter, "rule 1" and so on without it.
+	Name string `json:"name,omitempty"`
+
+	// UserAgents are matched anywhere in the User-Agent, ignoring case.
+	// Missing matches requests without one and KnownBad the shared list
+	// of bad bots.
+	UserAgents []string `json:"user_agents,omitempty"`
+	Missing    bool     `json:"missing,omitempty"`
+	KnownBad   bool     `json:"known_bad,omitempty"`
+
+	// Action is "block" for a 403 or "challenge" for a page that only lets
+	// clients running javascript through.
+	Action string `json:"action"`
+}
+
+// botRule is a BotRule with its patterns lowercased.
+type botRule struct {
+	name     string
+	agents   []string
+	missing  bool
+	knownBad bool
+	action   string
+}
+
+func compileBotRules(rules []BotRule) ([]botRule, error) {
+	var compiled []botRule
+	for i, rule := range rules {
+		c := botRule{name: rule.Name, missing: rule.Missing, knownBad: rule.KnownBad, action: strings.ToLower(rule.Action)}
+		if c.name == "" {
+			c.name = fmt.Sprintf("rule %d", i+1)
+		}
+		if c.action != "block" && c.action != "challenge" {
+			return nil, fmt.Errorf("bot_rules: %s: action %q should be block or challenge", c.name, rule.Action)
+		}
+		for _, agent := range rule.UserAgents {
+			if agent = strings.ToLower(strings.TrimSpace(agent)); agent != "" {
+				c.agents = append(c.agents, agent)
+			}
+		}
+		if len(c.agents) == 0 && !c.missing && !c.knownBad {
+			return nil, fmt.Errorf("bot_rules: %s: no user_agents, missing or known_bad", c.name)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// matches reports whether a request with the user agent ua falls under
+// the rule.
+func (c *botRule) matches(ua string, badBots []string) bool {
+	if ua == "" {
+		return c.missing
+	}
+	ua = strings.ToLower(ua)
+	for _, agent := range c.agents {
+		if strings.Contains(ua, agent) {
+			return true
+		}
+	}
+	if c.knownBad {
+		for _, agent := range badBots {
+			if strings.Contains(ua, agent) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadBadBots reads extra bad bot patterns for -bad-bots, one a line, #
+// starting a comment.
+func loadBadBots(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var bots []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.ToLower(strings.TrimSpace(line)); line != "" {
+			bots = append(bots, line)
+		}
+	}
+	return bots, scanner.Err()
+}
+
+// botHits counts the requests each of a domain's bot rules caught.
+type botHits struct {
+	mu   sync.Mutex
+	hits map[string]uint64
+}
+
+func (b *botHits) add(rule string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.hits == nil {
+		b.hits = map[string]uint64{}
+	}
+	b.hits[rule]++
+}
+
+type botHitCount struct {
+	Rule string
+	Hits uint64
+}
+
+// counts lists the rules that caught anything, by name.
+func (b *botHits) counts() []botHitCount {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counts := make([]botHitCount, 0, len(b.hits))
+	for rule, n := range b.hits {
+		counts = append(counts, botHitCount{rule, n})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Rule < counts[j].Rule })
+	return counts
+}
+
+// botCheckCookie carries a passed challenge.
+const botCheckCookie = "appserve_bot_check"
+
+// botCheckKey signs challenge cookies. it's made fresh each start, so a
+// restart sends everyone through the challenge again.
+var botCheckKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// botCheckToken is the cookie value a client passing the challenge on a
+// given day gets, tied to its address and user agent.
+func botCheckToken(ip, ua string, day int64) string {
+	mac := hmac.New(sha256.New, botCheckKey)
+	fmt.Fprintf(mac, "%s\n%s\n%d", ip, ua, day)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// passedBotCheck reports whether the request carries a cookie from a
+// challenge passed today or yesterday.
+func passedBotCheck(r *http.Request) bool {
+	c, err := r.Cookie(botCheckCookie)
+	if err != nil {
+		return false
+	}
+	ip, ua := clientIP(r), r.UserAgent()
+	day := time.Now().Unix() / 86400
+	for _, d := range []int64{day, day - 1} {
+		if hmac.Equal([]byte(c.Value), []byte(botCheckToken(ip, ua, d))) {
+			return true
+		}
+	}
+	return false
+}
+
+var botChallengeTemplate = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Just a moment</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center; color: #777; background: #fafafa; }
+</style>
+</head>
+<body>
+<p>checking your browser, this needs javascript</p>
+<script>
+document.cookie = {{.Cookie}} + "; path=/; max-age=172800; SameSite=Lax";
+location.reload();
+</script>
+</body>
+</html>
+`))
+
+// checkBots applies the route's bot rules to a request, answering it and
+// returning false when a rule blocks it or it has a challenge to pass.
+func (app *App) checkBots(w http.ResponseWriter, r *http.Request, domain string, route *Proxy, stats *RouteStats) bool {
+	ua := r.UserAgent()
+	for i := range route.botRules {
+		rule := &route.botRules[i]
+		if !rule.matches(ua, app.BadBots) {
+			continue
+		}
+		if rule.action == "challenge" && passedBotCheck(r) {
+			return true
+		}
+		stats.Bots.add(rule.name)
+		if rule.action == "block" {
+			securityEvent(eventBlockedBot, clientIP(r), domain, fmt.Sprintf("user agent %q caught by %s", ua, rule.name))
+			if !app.Tarpit.serve(w, r, "blocked-bot", http.StatusForbidden) {
+				clientError(w, "blocked-bot", http.StatusForbidden)
+			}
+			return false
+		}
+		serveBotChallenge(w, r)
+		return false
+	}
+	return true
+}
+
+func serveBotChallenge(w http.ResponseWriter, r *http.Request) {
+	requestErrors.add(errorClient, "bot-challenge")
+	token := botCheckToken(clientIP(r), r.UserAgent(), time.Now().Unix()/86400)
+	var buf strings.Builder
+	err := botChallengeTemplate.Execute(&buf, struct{ Cookie string }{botCheckCookie + "=" + token})
+	if err != nil {
+		internalError(w, r, "template", err)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write([]byte(buf.String()))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// signed routes files use minisign's formats, so a bundle can be signed with
+// minisign itself or with `appserve bundle sign`, and checked with either.
+//
+// a public key is two lines, the second base64 of "Ed", an 8 byte key id
+// and the 32 byte ed25519 key. a signature is four:
+//
+//	untrusted comment: ...
+//	base64("ED" or "Ed", key id, 64 byte signature of the file)
+//	trusted comment: ...
+//	base64(64 byte signature of the file signature and the trusted comment)
+//
+// "ED" signs the blake2b-512 hash of the file, "Ed" the file itself.
+
+// routesKey is the public key routes bundles have to be signed with.
+type routesKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// readRoutesKey reads a minisign public key file, or the base64 line from
+// one on its own.
+func readRoutesKey(file string) (*routesKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	line := ""
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "untrusted comment:") {
+			line = l
+			break
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return nil, fmt.Errorf("%s isn't a minisign public key", file)
+	}
+	k := &routesKey{key: ed25519.PublicKey(raw[10:])}
+	copy(k.id[:], raw[2:10])
+	return k, nil
+}
+
+// verify checks sig, the contents of a .minisig file, is k's signature of
+// data.
+func (k *routesKey) verify(data, sig []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) < 4 {
+		return errors.New("the signature isn't in minisign format")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return errors.New("the signature isn't in minisign format")
+	}
+	if !bytes.Equal(raw[2:10], k.id[:]) {
+		return errors.New("the bundle was signed with a different key")
+	}
+	signed := data
+	switch string(raw[:2]) {
+	case "ED":
+		sum := blake2b.Sum512(data)
+		signed = sum[:]
+	case "Ed":
+	default:
+		return errors.New("the signature isn't in minisign format")
+	}
+	if !ed25519.Verify(k.key, signed, raw[10:]) {
+		return errors.New("bad signature")
+	}
+
+	// the trusted comment is signed too, so it can't be swapped out
+	trusted, ok := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !ok {
+		return errors.New("the signature has no trusted comment")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || !ed25519.Verify(k.key, append(raw[10:len(raw):len(raw)], trusted...), global) {
+		return errors.New("bad signature on the trusted comment")
+	}
+	return nil
+}
+
+// signRoutes makes a minisign signature of data with priv, the second half
+// of a key made by `appserve bundle keygen`.
+func signRoutes(id [8]byte, priv ed25519.PrivateKey, data []byte, name string) []byte {
+	sum := blake2b.Sum512(data)
+	sig := ed25519.Sign(priv, sum[:])
+	trusted := "timestamp:" + strconv.FormatInt(time.Now().Unix(), 10) + "\tfile:" + name + "\thashed"
+	global := ed25519.Sign(priv, append(sig[:len(sig):len(sig)], trusted...))
+
+	raw := append(append([]byte("ED"), id[:]...), sig...)
+	return []byte("untrusted comment: signature from appserve bundle sign\n" +
+		base64.StdEncoding.EncodeToString(raw) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+// readSigningKey reads a secret key written by `appserve bundle keygen`.
+// minisign's own secret keys are encrypted, sign with minisign for those.
+func readSigningKey(file string) ([8]byte, ed25519.PrivateKey, error) {
+	var id [8]byte
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return id, nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil || len(raw) != 2+8+ed25519.PrivateKeySize || string(raw[:2]) != "Ed" {
+		return id, nil, fmt.Errorf("%s isn't an appserve bundle signing key", file)
+	}
+	copy(id[:], raw[2:10])
+	return id, ed25519.PrivateKey(raw[10:]), nil
+}
+
+// runBundle makes keys for and signs routes files, for -routes-pubkey:
+//
+//	appserve bundle keygen [-out routes-key]
+//	appserve bundle sign [-key routes-key] routes.json
+//	appserve bundle verify [-pubkey routes-key.pub] routes.json
+func runBundle(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: appserve bundle keygen [-out file] | sign [-key file] <routes file> | verify [-pubkey file] <routes file>")
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	fs := flag.NewFlagSet("bundle "+args[0], flag.ExitOnError)
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "keygen":
+		out := fs.String("out", "routes-key", "where to write the secret key, the public key goes next to it with .pub on the end")
+		fs.Parse(args[1:])
+		if fs.NArg() != 0 {
+			usage()
+		}
+		if _, err := os.Stat(*out); err == nil {
+			fail(fmt.Errorf("%s already exists", *out))
+		}
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fail(err)
+		}
+		var id [8]byte
+		rand.Read(id[:])
+		secret := "untrusted comment: appserve bundle signing key, keep it secret\n" +
+			base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id[:]...), priv...)) + "\n"
+		public := fmt.Sprintf("untrusted comment: minisign public key %016X\n", binary.LittleEndian.Uint64(id[:])) +
+			base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id[:]...), pub...)) + "\n"
+		if err := os.WriteFile(*out, []byte(secret), 0o600); err != nil {
+			fail(err)
+		}
+		if err := os.WriteFile(*out+".pub", []byte(public), 0o644); err != nil {
+			fail(err)
+		}
+		fmt.Printf("Wrote %s and %s, run appserve with -routes-pubkey %s\n", *out, *out+".pub", *out+".pub")
+
+	case "sign":
+		keyFile := fs.String("key", "routes-key", "secret key from appserve bundle keygen")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			usage()
+		}
+		id, priv, err := readSigningKey(*keyFile)
+		if err != nil {
+			fail(err)
+		}
+		file := fs.Arg(0)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fail(err)
+		}
+		if err := os.WriteFile(file+".minisig", signRoutes(id, priv, data, filepath.Base(file)), 0o644); err != nil {
+			fail(err)
+		}
+		fmt.Printf("Signed %s, signature in %s\n", file, file+".minisig")
+
+	case "verify":
+		pubFile := fs.String("pubkey", "routes-key.pub", "public key to check the signature against")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			usage()
+		}
+		key, err := readRoutesKey(*pubFile)
+		if err != nil {
+			fail(err)
+		}
+		if _, err := readSignedRoutes(fs.Arg(0), key); err != nil {
+			fail(err)
+		}
+		fmt.Printf("%s is signed by %s\n", fs.Arg(0), *pubFile)
+
+	default:
+		usage()
+	}
+}
+
+var errSignedRoutes = errors.New("routes can only be changed with a signed bundle, PUT /routes, or a signed routes file and load")
+
+// signedOnlyCommands are the shell commands that change the routes, turned
+// away with -routes-pubkey as they'd save them without a signature.
+var signedOnlyCommands = map[string]bool{
+	"add": true, "add-static": true, "park": true, "edit": true, "remove": true, "save": true, "restore": true,
+}
+
+// saveBundle writes a routes file as it was signed, with its signature next
+// to it, or without one when sig is empty.
+func saveBundle(file string, data, sig []byte) error {
+	if file == "" {
+		return nil
+	}
+	if len(sig) > 0 {
+		if err := writeFileAtomic(file+".minisig", sig); err != nil {
+			return err
+		}
+	} else if err := os.Remove(file + ".minisig"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeFileAtomic(file, data)
+}
+
+// writeFileAtomic replaces file with data without a half written file ever
+// being there to read.
+func writeFileAtomic(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// readSignedRoutes reads a routes file, checking it against the signature
+// next to it when key isn't nil.
+func readSignedRoutes(file string, key *routesKey) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil || key == nil {
+		return data, err
+	}
+	sig, err := os.ReadFile(file + ".minisig")
+	if err != nil {
+		return nil, fmt.Errorf("routes have to be signed with the -routes-pubkey key: %w", err)
+	}
+	if err := key.verify(data, sig); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return data, nil
+}
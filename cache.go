@@ -0,0 +1,1026 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheableStatus are the response codes we're willing to store.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+}
+
+// negativeStatus are the error responses a route can opt in to caching
+// for a short while.
+var negativeStatus = map[int]bool{
+	http.StatusNotFound:            true,
+	http.StatusGone:                true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// cacheEntry is one stored response.
+type cacheEntry struct {
+	key     string
+	route   string // the route key it was served under, see Purge
+	domain  string // the request's host
+	path    string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+
+	// how long past expires the entry may still be served while a fresh
+	// copy is fetched, or in place of an error from the backend
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	// file holds the body instead of body for entries in the disk tier
+	file   string
+	length int64
+
+	// hits counts how often the entry was served, updated atomically
+	hits uint64
+}
+
+// bodySize is the length of the body wherever it lives.
+func (e *cacheEntry) bodySize() int64 {
+	if e.file != "" {
+		return e.length
+	}
+	return int64(len(e.body))
+}
+
+func (e *cacheEntry) size() int64 {
+	n := len(e.key) + len(e.body)
+	for k, vv := range e.header {
+		n += len(k)
+		for _, v := range vv {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// usable reports whether the entry can still be served in some form.
+func (e *cacheEntry) usable(now time.Time) bool {
+	stale := e.staleWhileRevalidate
+	if e.staleIfError > stale {
+		stale = e.staleIfError
+	}
+	return now.Before(e.expires.Add(stale))
+}
+
+// ResponseCache is a size bounded LRU of responses shared by every route
+// that has caching turned on. with a disk tier enabled, entries pushed out
+// of memory spill to disk and responses too big for memory go straight
+// there.
+type ResponseCache struct {
+	MaxSize   int64
+	MaxObject int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	disk *diskCache
+
+	refreshMu  sync.Mutex
+	refreshing map[string]bool
+
+	// flight makes concurrent misses for one key wait on a single fetch
+	flight singleflight.Group
+
+	// varies remembers which request headers each url's responses vary on
+	// and variants how many entries there are for each of those urls in
+	// either tier, so a url is forgotten once the last of them goes.
+	// guarded by mu
+	varies   map[string][]string
+	variants map[string]int
+}
+
+func NewResponseCache(maxSize, maxObject int64) *ResponseCache {
+	return &ResponseCache{
+		MaxSize:   maxSize,
+		MaxObject: maxObject,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+// EnableDisk adds a disk tier under dir, picking up anything a previous
+// run left there.
+func (c *ResponseCache) EnableDisk(dir string, maxSize, maxObject int64) error {
+	d, err := newDiskCache(dir, maxSize, maxObject)
+	if err != nil {
+		return err
+	}
+	c.disk = d
+
+	// entries from a previous run still know what they vary on
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range d.entries {
+		c.addVariant(el.Value.(*cacheEntry))
+	}
+	d.cache = c
+	return nil
+}
+
+// maxRecord is the biggest body worth recording for the cache.
+func (c *ResponseCache) maxRecord() int64 {
+	if c.disk != nil && c.disk.maxObject > c.MaxObject {
+		return c.disk.maxObject
+	}
+	return c.MaxObject
+}
+
+func (c *ResponseCache) Get(key string) *cacheEntry {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry)
+	}
+	c.mu.Unlock()
+
+	if c.disk == nil {
+		return nil
+	}
+	e := c.disk.get(key)
+	if e == nil || e.length > c.MaxObject {
+		return e
+	}
+
+	// small enough to live in memory again
+	body, err := os.ReadFile(e.file)
+	if err != nil {
+		return nil
+	}
+	promoted := *e
+	promoted.body = body
+	promoted.file = ""
+	c.putMemory(&promoted)
+	return &promoted
+}
+
+func (c *ResponseCache) Put(e *cacheEntry) {
+	if e.size() > c.MaxObject || e.size() > c.MaxSize {
+		if c.disk != nil {
+			c.disk.put(e)
+		}
+		return
+	}
+	c.putMemory(e)
+}
+
+// putFile stores an entry whose body was recorded into a temp file.
+func (c *ResponseCache) putFile(e *cacheEntry, tempBody string) {
+	if c.disk == nil {
+		os.Remove(tempBody)
+		return
+	}
+	c.disk.putFile(e, tempBody)
+}
+
+func (c *ResponseCache) putMemory(e *cacheEntry) {
+	c.mu.Lock()
+	if el, ok := c.entries[e.key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size()
+	c.addVariant(e)
+
+	var evicted []*cacheEntry
+	for c.size > c.MaxSize {
+		evicted = append(evicted, c.removeElement(c.lru.Back()))
+	}
+	c.mu.Unlock()
+
+	if c.disk == nil {
+		return
+	}
+	now := time.Now()
+	for _, old := range evicted {
+		if old.usable(now) && c.disk.get(old.key) == nil {
+			go c.disk.put(old)
+		}
+	}
+}
+
+func (c *ResponseCache) removeElement(el *list.Element) *cacheEntry {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+	c.dropVariant(e)
+	return e
+}
+
+// defaultCacheVary are the request headers a response may vary on and still
+// be cached, routes can allow more.
+var defaultCacheVary = []string{"Accept-Encoding"}
+
+// cacheKey identifies a url, HEAD shares its entry with GET. responses that
+// vary get the varying request header values tacked on after a NUL, which
+// can't turn up in a request uri.
+func cacheKey(domain string, r *http.Request) string {
+	return domain + r.URL.RequestURI()
+}
+
+// variantKey is the key a request should look up, given what we've learned
+// the url's responses vary on.
+func (c *ResponseCache) variantKey(base string, r *http.Request) string {
+	c.mu.Lock()
+	fields := c.varies[base]
+	c.mu.Unlock()
+	return withVariant(base, fields, r)
+}
+
+func withVariant(base string, fields []string, r *http.Request) string {
+	if len(fields) == 0 {
+		return base
+	}
+	values := make([]string, 0, len(fields))
+	for _, field := range fields {
+		values = append(values, field+"="+normalizeVaryValue(field, r.Header.Values(field)))
+	}
+	return base + "\x00" + strings.Join(values, "&")
+}
+
+// normalizeVaryValue squashes equivalent header values together so that
+// "gzip, br" and "br,gzip" share a cache entry.
+func normalizeVaryValue(field string, values []string) string {
+	joined := strings.ToLower(strings.Join(values, ","))
+	if field != "Accept-Encoding" {
+		return strings.TrimSpace(joined)
+	}
+	var codings []string
+	for _, part := range strings.Split(joined, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+				continue
+			}
+		}
+		if name = strings.TrimSpace(name); name != "" {
+			codings = append(codings, name)
+		}
+	}
+	sort.Strings(codings)
+	return strings.Join(codings, ",")
+}
+
+// varyFields lists the canonical header names a response varies on.
+func varyFields(h http.Header) []string {
+	var fields []string
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// varies reports whether a response already varies on a header.
+func varies(h http.Header, field string) bool {
+	for _, f := range varyFields(h) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// setVaries records what a url varies on, c.mu must be held.
+func (c *ResponseCache) setVaries(base string, fields []string) {
+	if c.varies == nil {
+		c.varies = make(map[string][]string)
+	}
+	c.varies[base] = fields
+}
+
+// addVariant remembers what an entry's url varies on as it's stored in
+// either tier, c.mu must be held.
+func (c *ResponseCache) addVariant(e *cacheEntry) {
+	base, _, varied := strings.Cut(e.key, "\x00")
+	fields := varyFields(e.header)
+	if !varied || len(fields) == 0 {
+		return
+	}
+	if c.variants == nil {
+		c.variants = make(map[string]int)
+	}
+	c.variants[base]++
+	c.setVaries(base, fields)
+}
+
+// dropVariant forgets what a url varies on once the last of its entries
+// has left both tiers, c.mu must be held.
+func (c *ResponseCache) dropVariant(e *cacheEntry) {
+	base, _, varied := strings.Cut(e.key, "\x00")
+	if !varied || c.variants[base] == 0 {
+		return
+	}
+	if c.variants[base]--; c.variants[base] == 0 {
+		delete(c.variants, base)
+		delete(c.varies, base)
+	}
+}
+
+// storeKey works out the key a response should be stored under, or false if
+// it varies on something we can't key on. what the url varies on is only
+// remembered once a response is stored.
+func (c *ResponseCache) storeKey(base string, r *http.Request, h http.Header, allowed []string) (string, bool) {
+	fields := varyFields(h)
+	for _, field := range fields {
+		if field == "*" || !containsFold(allowed, field) {
+			return "", false
+		}
+	}
+
+	if len(fields) == 0 {
+		c.mu.Lock()
+		delete(c.varies, base)
+		c.mu.Unlock()
+	}
+	return withVariant(base, fields, r), true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheableRequest says whether a request may be answered from, or stored
+// in, a shared cache.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noStore := cc["no-store"]
+	_, noCache := cc["no-cache"]
+	return !noStore && !noCache && r.Header.Get("Pragma") != "no-cache"
+}
+
+// parseCacheControl splits a Cache-Control header into its directives.
+func parseCacheControl(header string) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return cc
+}
+
+// freshnessLifetime works out how long a response may be served from the
+// cache. override, when set, replaces whatever the backend asked for. zero
+// means don't store it at all.
+func freshnessLifetime(status int, h http.Header, override time.Duration, now time.Time) time.Duration {
+	if !cacheableStatus[status] {
+		return 0
+	}
+	if h.Get("Set-Cookie") != "" {
+		return 0
+	}
+
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := cc[directive]; ok {
+			return 0
+		}
+	}
+	if override > 0 {
+		return override
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		return t.Sub(date)
+	}
+	return 0
+}
+
+// staleWindows reads how long the backend lets us serve a response past its
+// expiry, from the stale-while-revalidate and stale-if-error directives.
+func staleWindows(h http.Header) (whileRevalidate, ifError time.Duration) {
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	for _, directive := range []string{"must-revalidate", "proxy-revalidate"} {
+		if _, ok := cc[directive]; ok {
+			return 0, 0
+		}
+	}
+	seconds := func(directive string) time.Duration {
+		secs, err := strconv.Atoi(cc[directive])
+		if err != nil || secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	return seconds("stale-while-revalidate"), seconds("stale-if-error")
+}
+
+// notModifiedHeaders are the ones that go out with a 304.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Vary"}
+
+// notModified checks a request's conditional headers against a cached
+// response, If-None-Match winning over If-Modified-Since.
+func (e *cacheEntry) notModified(r *http.Request) bool {
+	if e.status != http.StatusOK {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, e.header.Get("ETag"))
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// etagMatches does the weak comparison If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCacheEntry answers a request from the cache, with a 304 when the
+// client's copy is still good. state ends up in the X-Cache header. it
+// returns how much of the body was sent.
+func serveCacheEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, now time.Time, state string) int64 {
+	atomic.AddUint64(&e.hits, 1)
+
+	h := w.Header()
+	for k := range h {
+		delete(h, k)
+	}
+
+	age := strconv.Itoa(int(now.Sub(e.stored).Seconds()))
+	if e.notModified(r) {
+		for _, k := range notModifiedHeaders {
+			for _, v := range e.header.Values(k) {
+				h.Add(k, v)
+			}
+		}
+		h.Set("Age", age)
+		h.Set("X-Cache", state)
+		w.WriteHeader(http.StatusNotModified)
+		return 0
+	}
+
+	for k, vv := range e.header {
+		h[k] = append([]string(nil), vv...)
+	}
+	h.Set("Age", age)
+	h.Set("X-Cache", state)
+	if e.file != "" {
+		h.Set("Content-Length", strconv.FormatInt(e.length, 10))
+	}
+	w.WriteHeader(e.status)
+	if r.Method == http.MethodHead {
+		return 0
+	}
+	if e.file == "" {
+		n, _ := w.Write(e.body)
+		return int64(n)
+	}
+
+	f, err := os.Open(e.file)
+	if err != nil {
+		// evicted between lookup and now, nothing to do but cut it short
+		log.Printf("Error opening cached body %s: %v", e.file, err)
+		return 0
+	}
+	defer f.Close()
+	n, _ := io.Copy(w, f)
+	return n
+}
+
+// cacheRecorder passes a response through to the client while keeping a
+// copy of it, giving up on the copy once it grows past max. bodies bigger
+// than memMax move to a temp file from the disk tier, if there is one.
+type cacheRecorder struct {
+	http.ResponseWriter
+	max      int64
+	memMax   int64
+	disk     *diskCache
+	status   int
+	header   http.Header
+	body     []byte
+	file     *os.File
+	written  int64
+	tooLarge bool
+
+	// hash of the body so far, for entries the backend gave no ETag
+	hash hash.Hash64
+}
+
+func (c *cacheRecorder) WriteHeader(code int) {
+	if c.status == 0 && code >= 200 {
+		c.status = code
+		c.header = c.ResponseWriter.Header().Clone()
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheRecorder) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.tooLarge {
+		c.record(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *cacheRecorder) record(b []byte) {
+	c.hash.Write(b)
+	c.written += int64(len(b))
+	if c.written > c.max {
+		c.abandon()
+		return
+	}
+	if c.file == nil && c.written > c.memMax {
+		if c.disk == nil {
+			c.abandon()
+			return
+		}
+		f, err := c.disk.tempFile()
+		if err != nil {
+			log.Printf("Error creating cache temp file: %v", err)
+			c.abandon()
+			return
+		}
+		c.file = f
+		if _, err := f.Write(c.body); err != nil {
+			c.abandon()
+			return
+		}
+		c.body = nil
+	}
+	if c.file != nil {
+		if _, err := c.file.Write(b); err != nil {
+			c.abandon()
+		}
+		return
+	}
+	c.body = append(c.body, b...)
+}
+
+// abandon stops recording and throws away what we have.
+func (c *cacheRecorder) abandon() {
+	c.tooLarge = true
+	c.body = nil
+	c.cleanup()
+}
+
+// cleanup gets rid of the temp file if it wasn't handed to the cache.
+func (c *cacheRecorder) cleanup() {
+	if c.file != nil {
+		c.file.Close()
+		os.Remove(c.file.Name())
+		c.file = nil
+	}
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack underneath.
+func (c *cacheRecorder) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// serveProxy sends a request on to the route's backend, going through the
+// response cache when the route has it turned on. routeKey is the key route
+// is under in app.Routes, domain the request's host, stats are the route's.
+func (app *App) serveProxy(w http.ResponseWriter, r *http.Request, routeKey, domain string, route *Proxy, stats *RouteStats) {
+	if !route.Cache || app.Cache == nil || !cacheableRequest(r) {
+		route.handler.ServeHTTP(w, r)
+		return
+	}
+
+	base := cacheKey(domain, r)
+	key := app.Cache.variantKey(base, r)
+	now := time.Now()
+	e := app.Cache.Get(key)
+	if e != nil {
+		if e.fresh(now) {
+			stats.CacheHits.Add(1)
+			stats.CacheBytes.Add(uint64(serveCacheEntry(w, r, e, now, "HIT")))
+			return
+		}
+		if now.Before(e.expires.Add(e.staleWhileRevalidate)) {
+			stats.CacheStale.Add(1)
+			stats.CacheBytes.Add(uint64(serveCacheEntry(w, r, e, now, "STALE")))
+			app.revalidate(r, key, base, routeKey, domain, route)
+			return
+		}
+	}
+
+	stats.CacheMisses.Add(1)
+	w.Header().Set("X-Cache", "MISS")
+	out := w
+	var guard *errorGuard
+	if e != nil && now.Before(e.expires.Add(e.staleIfError)) {
+		// we've got something to fall back on if the backend is having a
+		// bad day
+		guard = &errorGuard{ResponseWriter: w}
+		out = guard
+	}
+
+	if !app.fetchOnce(out, r, key, base, routeKey, domain, route, now) {
+		// someone else was already fetching this, use what they got
+		key = app.Cache.variantKey(base, r)
+		if fetched := app.Cache.Get(key); fetched != nil && fetched.fresh(time.Now()) {
+			stats.CacheBytes.Add(uint64(serveCacheEntry(w, r, fetched, time.Now(), "HIT")))
+			return
+		}
+		app.fetch(out, r, base, routeKey, domain, route, now)
+	}
+
+	if guard != nil && guard.failed {
+		logLimited("stale", "Backend for %s failed, serving stale %s", domain, r.URL.RequestURI())
+		stats.CacheStale.Add(1)
+		stats.CacheBytes.Add(uint64(serveCacheEntry(w, r, e, now, "STALE")))
+	}
+}
+
+// errFetchAborted is what requests waiting on a fetch get when the client
+// it was for went away part way through.
+var errFetchAborted = errors.New("fetch aborted")
+
+// fetchOnce fetches a missing key unless another request is already doing
+// so, in which case it waits for that one to finish and reports false.
+func (app *App) fetchOnce(w http.ResponseWriter, r *http.Request, key, base, routeKey, domain string, route *Proxy, now time.Time) bool {
+	leader := false
+	_, err, _ := app.Cache.flight.Do(key, func() (_ interface{}, err error) {
+		leader = true
+		// the reverse proxy aborts when our client hangs up, that's ours
+		// alone and mustn't take the requests waiting on us down too
+		defer func() {
+			if v := recover(); v == http.ErrAbortHandler {
+				err = errFetchAborted
+			} else if v != nil {
+				panic(v)
+			}
+		}()
+		app.fetch(w, r, base, routeKey, domain, route, now)
+		return nil, nil
+	})
+	if leader && err == errFetchAborted {
+		panic(http.ErrAbortHandler)
+	}
+	return leader
+}
+
+// fetch proxies a request to the backend, storing the response in the cache
+// on the way through if it's allowed to be. base is the request's cache key
+// before any variant is added.
+func (app *App) fetch(w http.ResponseWriter, r *http.Request, base, routeKey, domain string, route *Proxy, now time.Time) {
+	rec := &cacheRecorder{
+		ResponseWriter: w,
+		max:            app.Cache.maxRecord(),
+		memMax:         app.Cache.MaxObject,
+		disk:           app.Cache.disk,
+		hash:           fnv.New64a(),
+	}
+	defer rec.cleanup()
+	route.handler.ServeHTTP(rec, r)
+
+	// a HEAD response has no body to keep, and a client that went away may
+	// have left us with half of one
+	if r.Method != http.MethodGet || rec.status == 0 || rec.tooLarge || r.Context().Err() != nil {
+		return
+	}
+	if cl := rec.header.Get("Content-Length"); cl != "" && cl != strconv.FormatInt(rec.written, 10) {
+		return
+	}
+
+	key, ok := app.Cache.storeKey(base, r, rec.header, route.cacheVary)
+	if !ok {
+		return
+	}
+
+	var ttl time.Duration
+	if negativeStatus[rec.status] {
+		ttl = app.negativeLifetime(key, rec.header, route, now)
+	} else {
+		override, skip := route.cacheOverride(rec.header.Get("Content-Type"))
+		if skip {
+			return
+		}
+		ttl = freshnessLifetime(rec.status, rec.header, override, now)
+	}
+	if ttl <= 0 {
+		return
+	}
+	rec.header.Del("X-Cache")
+
+	// give the entry validators so clients can revalidate against us
+	// without the backend being bothered
+	if rec.status == http.StatusOK && rec.header.Get("ETag") == "" {
+		rec.header.Set("ETag", fmt.Sprintf(`"%016x"`, rec.hash.Sum64()))
+	}
+	if rec.status == http.StatusOK && rec.header.Get("Last-Modified") == "" {
+		rec.header.Set("Last-Modified", now.UTC().Format(http.TimeFormat))
+	}
+
+	e := &cacheEntry{
+		key:     key,
+		route:   routeKey,
+		domain:  domain,
+		path:    r.URL.Path,
+		status:  rec.status,
+		header:  rec.header,
+		body:    rec.body,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	e.staleWhileRevalidate, e.staleIfError = staleWindows(rec.header)
+	if route.staleWhileRevalidate > 0 {
+		e.staleWhileRevalidate = route.staleWhileRevalidate
+	}
+	if route.staleIfError > 0 {
+		e.staleIfError = route.staleIfError
+	}
+
+	if rec.file != nil {
+		if err := rec.file.Close(); err != nil {
+			return
+		}
+		name := rec.file.Name()
+		rec.file = nil
+		app.Cache.putFile(e, name)
+		return
+	}
+	app.Cache.Put(e)
+}
+
+// negativeLifetime is how long an error response may be cached, which is
+// only ever when the route asks for it. an error never replaces a copy we
+// could still be serving instead.
+func (app *App) negativeLifetime(key string, h http.Header, route *Proxy, now time.Time) time.Duration {
+	if route.cacheErrors <= 0 || h.Get("Set-Cookie") != "" {
+		return 0
+	}
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return 0
+	}
+	if existing := app.Cache.Get(key); existing != nil && existing.usable(now) && !negativeStatus[existing.status] {
+		return 0
+	}
+	return route.cacheErrors
+}
+
+// revalidate refreshes a stale entry in the background, once per key no
+// matter how many requests are being served the stale copy meanwhile.
+func (app *App) revalidate(r *http.Request, key, base, routeKey, domain string, route *Proxy) {
+	c := app.Cache
+	c.refreshMu.Lock()
+	if c.refreshing[key] {
+		c.refreshMu.Unlock()
+		return
+	}
+	if c.refreshing == nil {
+		c.refreshing = make(map[string]bool)
+	}
+	c.refreshing[key] = true
+	c.refreshMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	req := r.Clone(ctx)
+	req.Method = http.MethodGet
+	// we want the whole thing back, not a 304 meant for the client
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	go func() {
+		defer cancel()
+		defer func() {
+			c.refreshMu.Lock()
+			delete(c.refreshing, key)
+			c.refreshMu.Unlock()
+		}()
+		app.fetch(&discardWriter{header: http.Header{}}, req, base, routeKey, domain, route, time.Now())
+	}()
+}
+
+// errorGuard holds back a 5xx from the backend so a stale copy can be sent
+// in its place.
+type errorGuard struct {
+	http.ResponseWriter
+	failed bool
+}
+
+func (g *errorGuard) WriteHeader(code int) {
+	if code >= 500 {
+		g.failed = true
+		return
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *errorGuard) Write(b []byte) (int, error) {
+	if g.failed {
+		return len(b), nil
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack underneath.
+func (g *errorGuard) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// discardWriter is a ResponseWriter for background fetches nobody is
+// waiting on.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+// Purge drops every entry served under the route key route whose path
+// matches pattern, in both tiers, and says how many went. a host narrows it
+// down to the requests for that host, say one name under a wildcard route,
+// and without a route it's everything cached for the host. an empty pattern
+// matches everything, and a trailing * matches anything below it.
+func (c *ResponseCache) Purge(route, host, pattern string) int {
+	purged := 0
+	matches := func(e *cacheEntry) bool {
+		return (route == "" || e.route == route) && (host == "" || e.domain == host) &&
+			matchPathPattern(pattern, e.path)
+	}
+
+	c.mu.Lock()
+	for _, el := range c.entries {
+		e := el.Value.(*cacheEntry)
+		if matches(e) {
+			c.removeElement(el)
+			purged++
+		}
+	}
+	c.mu.Unlock()
+
+	if c.disk != nil {
+		c.disk.mu.Lock()
+		for _, el := range c.disk.entries {
+			e := el.Value.(*cacheEntry)
+			if matches(e) {
+				c.disk.removeElement(el)
+				purged++
+			}
+		}
+		c.disk.mu.Unlock()
+	}
+
+	return purged
+}
+
+// matchPathPattern matches a request path against a purge pattern.
+func matchPathPattern(pattern, p string) bool {
+	if pattern == "" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(p, prefix) {
+		return true
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// cachedKey is one line of the top keys report.
+type cachedKey struct {
+	Path string
+	Hits uint64
+	Size int64
+}
+
+// TopKeys lists the most served cached paths of a stats account across both
+// tiers, that's everything cached by the routes on its host (see
+// trafficAccount). paths from another host than the account's, under a
+// wildcard, come with their host.
+func (c *ResponseCache) TopKeys(account string, n int) []cachedKey {
+	var keys []cachedKey
+	collect := func(entries map[string]*list.Element) {
+		for _, el := range entries {
+			e := el.Value.(*cacheEntry)
+			if trafficAccount(e.route) == account {
+				// the key is the host and request uri, with any variant
+				// after a \x00
+				path := strings.Replace(strings.TrimPrefix(e.key, e.domain), "\x00", " ", 1)
+				if e.domain != account {
+					path = e.domain + path
+				}
+				keys = append(keys, cachedKey{
+					Path: path,
+					Hits: atomic.LoadUint64(&e.hits),
+					Size: e.bodySize(),
+				})
+			}
+		}
+	}
+
+	c.mu.Lock()
+	collect(c.entries)
+	c.mu.Unlock()
+	if c.disk != nil {
+		c.disk.mu.Lock()
+		collect(c.disk.entries)
+		c.disk.mu.Unlock()
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Hits > keys[j].Hits })
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// Usage reports how many entries each tier holds and how much room they
+// take up.
+func (c *ResponseCache) Usage() (memEntries int, memSize int64, diskEntries int, diskSize int64) {
+	c.mu.Lock()
+	memEntries, memSize = len(c.entries), c.size
+	c.mu.Unlock()
+	if c.disk != nil {
+		c.disk.mu.Lock()
+		diskEntries, diskSize = len(c.disk.entries), c.disk.size
+		c.disk.mu.Unlock()
+	}
+	return
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache is the second tier of the response cache. each entry is a pair
+// of files named after the hash of its key, <hash>.meta holding the status
+// and headers as json and <hash>.body holding the body, so big assets can
+// be streamed straight off the disk. only the metadata is kept in memory.
+type diskCache struct {
+	dir       string
+	maxSize   int64
+	maxObject int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// cache is told about entries coming and going to keep track of what
+	// their urls vary on, taking its lock under ours
+	cache *ResponseCache
+}
+
+// diskMeta is what goes into a .meta file.
+type diskMeta struct {
+	Key     string      `json:"key"`
+	Route   string      `json:"route"`
+	Domain  string      `json:"domain"`
+	Path    string      `json:"path"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         time.Duration `json:"stale_if_error,omitempty"`
+}
+
+func newDiskCache(dir string, maxSize, maxObject int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	d := &diskCache{
+		dir:       dir,
+		maxSize:   maxSize,
+		maxObject: maxObject,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+	d.load()
+	return d, nil
+}
+
+// load rebuilds the index from whatever a previous run left behind, oldest
+// entries at the back so they go first.
+func (d *diskCache) load() {
+	// half written bodies from a run that didn't finish
+	if temps, err := filepath.Glob(filepath.Join(d.dir, "tmp-*")); err == nil {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}
+
+	metas, err := filepath.Glob(filepath.Join(d.dir, "*.meta"))
+	if err != nil {
+		log.Printf("Error scanning cache directory %s: %v", d.dir, err)
+		return
+	}
+
+	var loaded []*cacheEntry
+	for _, metaFile := range metas {
+		e, err := readDiskEntry(metaFile)
+		if err != nil {
+			log.Printf("Dropping unreadable cache entry %s: %v", metaFile, err)
+			os.Remove(metaFile)
+			os.Remove(strings.TrimSuffix(metaFile, ".meta") + ".body")
+			continue
+		}
+		loaded = append(loaded, e)
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].stored.Before(loaded[j].stored) })
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range loaded {
+		d.entries[e.key] = d.lru.PushFront(e)
+		d.size += e.length
+	}
+	d.trim()
+	log.Printf("Loaded %d cached responses from %s", len(d.entries), d.dir)
+}
+
+func readDiskEntry(metaFile string) (*cacheEntry, error) {
+	data, err := os.ReadFile(metaFile)
+	if err != nil {
+		return nil, err
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	bodyFile := strings.TrimSuffix(metaFile, ".meta") + ".body"
+	info, err := os.Stat(bodyFile)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Route == "" {
+		// saved before entries knew their route, most routes are a host
+		meta.Route = meta.Domain
+	}
+	return &cacheEntry{
+		key:     meta.Key,
+		route:   meta.Route,
+		domain:  meta.Domain,
+		path:    meta.Path,
+		status:  meta.Status,
+		header:  meta.Header,
+		stored:  meta.Stored,
+		expires: meta.Expires,
+		file:    bodyFile,
+		length:  info.Size(),
+
+		staleWhileRevalidate: meta.StaleWhileRevalidate,
+		staleIfError:         meta.StaleIfError,
+	}, nil
+}
+
+// base is the path of an entry's files without the extension.
+func (d *diskCache) base(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+func (d *diskCache) get(key string) *cacheEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	el, ok := d.entries[key]
+	if !ok {
+		return nil
+	}
+	d.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// put writes an entry whose body is in memory out to disk.
+func (d *diskCache) put(e *cacheEntry) {
+	f, err := d.tempFile()
+	if err != nil {
+		log.Printf("Error spilling cache entry to disk: %v", err)
+		return
+	}
+	_, err = f.Write(e.body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Error spilling cache entry to disk: %v", err)
+		os.Remove(f.Name())
+		return
+	}
+	d.putFile(e, f.Name())
+}
+
+// putFile moves a body that was written to a temp file into the cache along
+// with its metadata. the temp file is consumed either way.
+func (d *diskCache) putFile(e *cacheEntry, tempBody string) {
+	info, err := os.Stat(tempBody)
+	if err != nil || info.Size() > d.maxObject || info.Size() > d.maxSize {
+		os.Remove(tempBody)
+		return
+	}
+
+	base := d.base(e.key)
+	meta, err := json.Marshal(diskMeta{
+		Key:     e.key,
+		Route:   e.route,
+		Domain:  e.domain,
+		Path:    e.path,
+		Status:  e.status,
+		Header:  e.header,
+		Stored:  e.stored,
+		Expires: e.expires,
+
+		StaleWhileRevalidate: e.staleWhileRevalidate,
+		StaleIfError:         e.staleIfError,
+	})
+	if err == nil {
+		err = os.Rename(tempBody, base+".body")
+	}
+	if err == nil {
+		err = os.WriteFile(base+".meta", meta, 0600)
+	}
+	if err != nil {
+		log.Printf("Error writing cache entry %s to disk: %v", e.key, err)
+		os.Remove(tempBody)
+		return
+	}
+
+	stored := *e
+	stored.body = nil
+	stored.file = base + ".body"
+	stored.length = info.Size()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var old *cacheEntry
+	if el, ok := d.entries[e.key]; ok {
+		// the files were just replaced, only drop the old index entry
+		old = d.lru.Remove(el).(*cacheEntry)
+		delete(d.entries, old.key)
+		d.size -= old.length
+	}
+	if d.cache != nil {
+		d.cache.mu.Lock()
+		if old != nil {
+			d.cache.dropVariant(old)
+		}
+		d.cache.addVariant(&stored)
+		d.cache.mu.Unlock()
+	}
+	d.entries[e.key] = d.lru.PushFront(&stored)
+	d.size += stored.length
+	d.trim()
+}
+
+// tempFile is where a body is written before it becomes an entry. it lives
+// in the cache directory so the final rename stays on one filesystem.
+func (d *diskCache) tempFile() (*os.File, error) {
+	return os.CreateTemp(d.dir, "tmp-*")
+}
+
+// trim evicts from the back until we're under budget, d.mu must be held.
+func (d *diskCache) trim() {
+	for d.size > d.maxSize && d.lru.Len() > 0 {
+		d.removeElement(d.lru.Back())
+	}
+}
+
+func (d *diskCache) removeElement(el *list.Element) {
+	e := d.lru.Remove(el).(*cacheEntry)
+	delete(d.entries, e.key)
+	d.size -= e.length
+	if d.cache != nil {
+		d.cache.mu.Lock()
+		d.cache.dropVariant(e)
+		d.cache.mu.Unlock()
+	}
+	// anyone still streaming the body keeps their open file
+	os.Remove(e.file)
+	os.Remove(strings.TrimSuffix(e.file, ".body") + ".meta")
+}
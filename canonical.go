@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// checkCanonicalOptions checks a route's path canonicalization options.
+func checkCanonicalOptions(opts RouteOptions) error {
+	switch opts.TrailingSlash {
+	case "", "add", "remove":
+		return nil
+	}
+	return fmt.Errorf("trailing_slash: %q should be add or remove", opts.TrailingSlash)
+}
+
+// canonicalPath is the escaped path a route wants the request at, the
+// same path when it's already canonical.
+func (p *Proxy) canonicalPath(escaped string) string {
+	if p.MergeSlashes {
+		for strings.Contains(escaped, "//") {
+			escaped = strings.ReplaceAll(escaped, "//", "/")
+		}
+	}
+	if p.CleanDots && hasDotSegment(escaped) {
+		trailing := strings.HasSuffix(escaped, "/") || strings.HasSuffix(escaped, "/.") || strings.HasSuffix(escaped, "/..")
+		cleaned := path.Clean("/" + escaped)
+		if trailing && cleaned != "/" {
+			cleaned += "/"
+		}
+		escaped = cleaned
+	}
+	switch p.TrailingSlash {
+	case "add":
+		// files keep their names, /app.js isn't a directory
+		if !strings.HasSuffix(escaped, "/") && !strings.Contains(path.Base(escaped), ".") {
+			escaped += "/"
+		}
+	case "remove":
+		if escaped != "/" {
+			escaped = strings.TrimRight(escaped, "/")
+			if escaped == "" {
+				escaped = "/"
+			}
+		}
+	}
+	return escaped
+}
+
+// hasDotSegment reports whether an escaped path has a . or .. segment.
+func hasDotSegment(escaped string) bool {
+	for _, segment := range strings.Split(escaped, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectCanonical sends a request for a path that isn't canonical to
+// the one that is, returning false when it already was. GET and HEAD get a
+// 301 for search engines to take note of, anything else a 308 so the
+// method and body survive.
+func (p *Proxy) redirectCanonical(w http.ResponseWriter, r *http.Request) bool {
+	if !p.MergeSlashes && !p.CleanDots && p.TrailingSlash == "" {
+		return false
+	}
+	escaped := r.URL.EscapedPath()
+	canonical := p.canonicalPath(escaped)
+	if canonical == escaped {
+		return false
+	}
+	// a path starting // would send the client to another host
+	if strings.HasPrefix(canonical, "//") {
+		canonical = "/" + strings.TrimLeft(canonical, "/")
+	}
+	target := canonical
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	// set by hand, http.Redirect would clean the path again
+	w.Header().Set("Location", target)
+	w.WriteHeader(status)
+	return true
+}
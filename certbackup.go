@@ -0,0 +1,300 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// maxCertFile is the largest cache entry an import takes, certificates and
+// keys are a few kilobytes.
+const maxCertFile = 1 << 20
+
+// certFile is an entry of a certificate backup, checked before anything is
+// written.
+type certFile struct {
+	name    string
+	mode    fs.FileMode
+	data    []byte
+	expires time.Time // zero for the account key
+}
+
+// isTransientCertFile reports whether a cache entry only matters during an
+// order, challenge tokens aren't worth moving.
+func isTransientCertFile(name string) bool {
+	return strings.HasSuffix(name, "+http-01") || strings.HasSuffix(name, "+token")
+}
+
+// exportCerts writes the certificates and acme account in dir to a
+// .tar.gz, keeping their permissions.
+func exportCerts(dir, file string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	n := 0
+	for _, e := range entries {
+		if !e.Type().IsRegular() || isTransientCertFile(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			out.Close()
+			return n, err
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			out.Close()
+			return n, err
+		}
+		hdr := &tar.Header{Name: e.Name(), Mode: int64(info.Mode().Perm()), Size: int64(len(data)), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			out.Close()
+			return n, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			out.Close()
+			return n, err
+		}
+		n++
+	}
+	if err := tw.Close(); err != nil {
+		out.Close()
+		return n, err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return n, err
+	}
+	return n, out.Close()
+}
+
+// readCertBackup reads and checks every entry of a backup, the account key
+// has to be a key and everything else a certificate with its key.
+func readCertBackup(file string) ([]certFile, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a .tar.gz: %w", file, err)
+	}
+	tr := tar.NewReader(gz)
+	var files []certFile
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := hdr.Name
+		switch {
+		case hdr.Typeflag != tar.TypeReg:
+			return nil, fmt.Errorf("%s isn't a regular file", name)
+		case name == "" || name != filepath.Base(name) || name == "." || name == "..":
+			return nil, fmt.Errorf("%q isn't a plain file name", name)
+		case hdr.Size > maxCertFile:
+			return nil, fmt.Errorf("%s is too big to be a certificate", name)
+		case isTransientCertFile(name):
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxCertFile))
+		if err != nil {
+			return nil, err
+		}
+		f, err := checkCertFile(name, data)
+		if err != nil {
+			return nil, err
+		}
+		f.mode = fs.FileMode(hdr.Mode).Perm()
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("there are no certificates in %s", file)
+	}
+	return files, nil
+}
+
+// checkCertFile checks a cache entry from a backup, the account key has to
+// be a key and everything else a certificate with its key.
+func checkCertFile(name string, data []byte) (certFile, error) {
+	f := certFile{name: name, data: data}
+	if strings.HasPrefix(name, "acme_account") {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return f, fmt.Errorf("%s isn't a pem key", name)
+		}
+		if _, err := x509.ParseECPrivateKey(block.Bytes); err != nil {
+			if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+				return f, fmt.Errorf("%s isn't an acme account key", name)
+			}
+		}
+		return f, nil
+	}
+	leaf, err := certExpiry(data)
+	if err != nil {
+		return f, fmt.Errorf("%s isn't a certificate with its key: %w", name, err)
+	}
+	f.expires = leaf
+	return f, nil
+}
+
+// certExpiry is when the certificate in a cache entry runs out.
+func certExpiry(data []byte) (time.Time, error) {
+	pair, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return leaf.NotAfter, nil
+}
+
+// importCerts puts the certificates and account from a backup into dir,
+// once every one of them checks out. a certificate already there that runs
+// out later than the one in the backup is kept.
+func importCerts(dir, file string) (imported, kept int, err error) {
+	files, err := readCertBackup(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, 0, err
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if !f.expires.IsZero() {
+			if current, err := os.ReadFile(path); err == nil {
+				if expires, err := certExpiry(current); err == nil && expires.After(f.expires) {
+					kept++
+					continue
+				}
+			}
+		}
+		mode := f.mode
+		if mode == 0 {
+			mode = 0600
+		}
+		tmp := path + ".import"
+		if err := os.WriteFile(tmp, f.data, mode); err != nil {
+			return imported, kept, err
+		}
+		// WriteFile's mode goes through the umask
+		if err := os.Chmod(tmp, mode); err != nil {
+			os.Remove(tmp)
+			return imported, kept, err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return imported, kept, err
+		}
+		imported++
+	}
+	return imported, kept, nil
+}
+
+// runCerts exports and imports certificates without a server running,
+// `appserve certs export backup.tar.gz` on the old machine and
+// `appserve certs import backup.tar.gz` on the new one.
+func runCerts(args []string) {
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	dir := fs.String("cert-dir", "tls", "directory certificates are cached in")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appserve certs [-cert-dir dir] export <file.tar.gz> | import <file.tar.gz>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch fs.Arg(0) {
+	case "export":
+		n, err := exportCerts(*dir, fs.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Exported %d files from %s to %s, it holds private keys, keep it safe.\n", n, *dir, fs.Arg(1))
+	case "import":
+		imported, kept, err := importCerts(*dir, fs.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %d files into %s%s.\n", imported, *dir, keptNote(kept))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+func keptNote(kept int) string {
+	if kept == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", kept %d newer certificates already there", kept)
+}
+
+// handleCertsBackupCommand is certs export and certs import in the shell.
+// imported certificates are served from the next handshake that needs them.
+func (app *App) handleCertsBackupCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Error: Incorrect number of arguments. Expected: certs export <file.tar.gz> | certs import <file.tar.gz>")
+		return
+	}
+	dir, ok := app.certCache().(autocert.DirCache)
+	if !ok {
+		fmt.Println("Error: Certificates are kept in vault, back them up and move them there.")
+		return
+	}
+	switch args[0] {
+	case "export":
+		n, err := exportCerts(string(dir), args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Exported %d files to %s, it holds private keys, keep it safe.\n", n, args[1])
+	case "import":
+		imported, kept, err := importCerts(string(dir), args[1])
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				err = fmt.Errorf("%s doesn't exist", args[1])
+			}
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if app.Groups != nil {
+			app.Groups.forget()
+		}
+		fmt.Printf("Imported %d files%s.\n", imported, keptNote(kept))
+	default:
+		fmt.Println("Error: Unknown certs command, expected export or import.")
+	}
+}
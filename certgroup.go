@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// maxGroupNames is the most names a certificate can hold at let's
+	// encrypt, and most other cas.
+	maxGroupNames = 100
+
+	// groupRenewBefore is how long before it runs out a group's
+	// certificate is renewed, as autocert does for the rest.
+	groupRenewBefore = 30 * 24 * time.Hour
+
+	// groupSettle is how long route changes are left to settle before a
+	// group is reissued, so a load moving a dozen domains is one order.
+	groupSettle = 5 * time.Second
+)
+
+// validGroupName keeps group names usable in cache file names.
+var validGroupName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// certGroups puts the domains of routes sharing a cert_group on one
+// certificate between them, instead of one each. a ca counts certificates
+// against its rate limits, so hundreds of small vanity domains fit in a few
+// dozen orders. autocert can only ask for one name at a time, so groups
+// talk acme themselves, with http-01 challenges answered on :80.
+type certGroups struct {
+	cache autocert.Cache
+
+	mu      sync.Mutex
+	members map[string]string           // domain -> group, from the routes
+	certs   map[string]*tls.Certificate // group -> its certificate
+	tokens  map[string]string           // challenge path -> key authorization
+	client  *acme.Client
+
+	tries certTracker // keyed by group
+	kick  chan struct{}
+}
+
+func newCertGroups(cache autocert.Cache) *certGroups {
+	return &certGroups{
+		cache:   cache,
+		members: map[string]string{},
+		certs:   map[string]*tls.Certificate{},
+		tokens:  map[string]string{},
+		kick:    make(chan struct{}, 1),
+	}
+}
+
+// update takes the group of each route's domain, reissuing whichever
+// groups changed. wildcards can't be had over http-01 and http only routes
+// have no certificate, neither is grouped. app.Mu must be held.
+func (g *certGroups) update(routes map[string]*Proxy) {
+	members := map[string]string{}
+	for key, proxy := range routes {
+		host, _, _ := strings.Cut(key, "/")
+		if proxy.CertGroup == "" || proxy.HTTPOnly || strings.HasPrefix(host, "*") {
+			continue
+		}
+		members[host] = proxy.CertGroup
+	}
+	g.mu.Lock()
+	changed := len(members) != len(g.members)
+	for host, group := range members {
+		if g.members[host] != group {
+			changed = true
+		}
+	}
+	g.members = members
+	g.mu.Unlock()
+	if changed {
+		select {
+		case g.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// groupOf is the cert group a domain's certificate comes with, empty when
+// it gets its own.
+func (g *certGroups) groupOf(domain string) string {
+	if g == nil {
+		return ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.members[domain]
+}
+
+// certificate finds the group certificate for a domain, nil while its
+// group doesn't have one covering it yet.
+func (g *certGroups) certificate(domain string) *tls.Certificate {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, ok := g.members[domain]
+	if !ok {
+		return nil
+	}
+	cert := g.certs[group]
+	if cert == nil || time.Now().After(cert.Leaf.NotAfter) || cert.Leaf.VerifyHostname(domain) != nil {
+		return nil
+	}
+	return cert
+}
+
+// groups lists each group's domains, sorted.
+func (g *certGroups) groups() map[string][]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	groups := map[string][]string{}
+	for host, group := range g.members {
+		groups[group] = append(groups[group], host)
+	}
+	for _, names := range groups {
+		sort.Strings(names)
+	}
+	return groups
+}
+
+// status fills in where a grouped domain's certificate stands, from its
+// group's.
+func (g *certGroups) status(s *certStatus) {
+	if cert := g.certificate(s.Domain); cert != nil {
+		expires := cert.Leaf.NotAfter
+		s.Expires = &expires
+	}
+	g.tries.mu.Lock()
+	defer g.tries.mu.Unlock()
+	if a, ok := g.tries.domains[s.Group]; ok {
+		s.Failures = a.failures
+		s.LastError = a.lastError
+		lastTry, nextTry := a.lastTry, a.nextTry
+		s.LastTry = &lastTry
+		s.NextTry = &nextTry
+	}
+}
+
+// forget drops the certificates and account held in memory, for when the
+// cache has changed under them.
+func (g *certGroups) forget() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.certs = map[string]*tls.Certificate{}
+	g.client = nil
+}
+
+// groupCertificates wraps GetCertificate to answer for grouped domains with
+// their group's certificate. until the group has one, a certificate the
+// domain had on its own is still served.
+func (app *App) groupCertificates(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if app.Groups == nil {
+		return get
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if !isALPNChallenge(hello) {
+			if cert := app.Groups.certificate(NormalizeDomain(hello.ServerName)); cert != nil {
+				return cert, nil
+			}
+		}
+		return get(hello)
+	}
+}
+
+// challenges answers http-01 challenges for group orders, everything else
+// goes on to next.
+func (g *certGroups) challenges(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		keyAuth, ok := g.tokens[r.URL.Path]
+		g.mu.Unlock()
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// runCertGroups keeps every group's certificate covering its domains and
+// renewed, checking each minute and whenever the routes change.
+func (app *App) runCertGroups() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		app.syncCertGroups()
+		select {
+		case <-ticker.C:
+		case <-app.Groups.kick:
+			time.Sleep(groupSettle)
+		}
+	}
+}
+
+// syncCertGroups orders a certificate for each group that has none, one
+// that no longer lists exactly its domains, or one due for renewal.
+func (app *App) syncCertGroups() {
+	g := app.Groups
+	groups := g.groups()
+	g.mu.Lock()
+	for group := range g.certs {
+		if _, ok := groups[group]; !ok {
+			delete(g.certs, group)
+		}
+	}
+	g.mu.Unlock()
+
+	for group, names := range groups {
+		cert := g.loadCert(group)
+		if cert != nil && sameNames(cert.Leaf.DNSNames, names) && time.Until(cert.Leaf.NotAfter) > groupRenewBefore {
+			continue
+		}
+		if _, waiting := g.tries.waiting(group); waiting {
+			continue
+		}
+		tried := time.Now()
+		fresh, err := app.orderGroupCert(group, names)
+		if err != nil {
+			retry, _ := g.tries.failed(group, err, tried)
+			log.Printf("Failed to get the certificate for cert group %s: %v, trying again in %s", group, err, retry)
+			for _, name := range names {
+				emitEvent(eventCertFailed, map[string]interface{}{"domain": name, "group": group, "error": err.Error()})
+			}
+			continue
+		}
+		g.tries.succeeded(group)
+		g.mu.Lock()
+		g.certs[group] = fresh
+		g.mu.Unlock()
+		log.Printf("Got the certificate for cert group %s, covering %d domains until %s", group, len(names), fresh.Leaf.NotAfter.Format("2006-01-02"))
+		typ := eventCertIssued
+		if cert != nil {
+			typ = eventCertRenewed
+		}
+		for _, name := range names {
+			emitEvent(typ, map[string]interface{}{"domain": name, "group": group})
+		}
+	}
+}
+
+// loadCert is a group's certificate, from memory or the cache.
+func (g *certGroups) loadCert(group string) *tls.Certificate {
+	g.mu.Lock()
+	cert := g.certs[group]
+	g.mu.Unlock()
+	if cert != nil {
+		return cert
+	}
+	data, err := g.cache.Get(context.Background(), "group+"+group)
+	if err != nil {
+		return nil
+	}
+	// the key and the chain are in the one entry, as autocert keeps them
+	pair, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil
+	}
+	if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return nil
+	}
+	g.mu.Lock()
+	g.certs[group] = &pair
+	g.mu.Unlock()
+	return &pair
+}
+
+// orderGroupCert gets a certificate naming every domain in the group.
+func (app *App) orderGroupCert(group string, names []string) (*tls.Certificate, error) {
+	if len(names) > maxGroupNames {
+		return nil, fmt.Errorf("it has %d domains, a certificate can only hold %d", len(names), maxGroupNames)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	client, err := app.groupClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range order.AuthzURLs {
+		if err := app.Groups.authorize(ctx, client, url); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, b := range der {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	if err := app.Groups.cache.Put(ctx, "group+"+group, buf.Bytes()); err != nil {
+		log.Printf("Error caching the certificate for cert group %s: %v", group, err)
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// authorize proves control of one of the order's domains over http-01.
+func (g *certGroups) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s: the ca offered no http-01 challenge", authz.Identifier.Value)
+	}
+	keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	path := client.HTTP01ChallengePath(chal.Token)
+	g.mu.Lock()
+	g.tokens[path] = keyAuth
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.tokens, path)
+		g.mu.Unlock()
+	}()
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// groupClient is the acme client for group orders, using the account
+// autocert uses when there is one.
+func (app *App) groupClient(ctx context.Context) (*acme.Client, error) {
+	g := app.Groups
+	g.mu.Lock()
+	client := g.client
+	g.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	const accountKey = "acme_account+key"
+	var key *ecdsa.PrivateKey
+	if data, err := g.cache.Get(ctx, accountKey); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("the cached acme account key isn't pem")
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("the cached acme account key: %w", err)
+		}
+	} else {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.cache.Put(ctx, accountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return nil, err
+		}
+	}
+
+	client = &acme.Client{Key: key, DirectoryURL: app.ACMEDirectory}
+	account := &acme.Account{ExternalAccountBinding: app.ACMEEAB}
+	if app.ACMEEmail != "" {
+		account.Contact = []string{"mailto:" + app.ACMEEmail}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, err
+	}
+	g.mu.Lock()
+	g.client = client
+	g.mu.Unlock()
+	return client, nil
+}
+
+// sameNames reports whether a certificate names exactly the domains, in
+// any order.
+func sameNames(have, want []string) bool {
+	if len(have) != len(want) {
+		return false
+	}
+	seen := make(map[string]bool, len(have))
+	for _, name := range have {
+		seen[name] = true
+	}
+	for _, name := range want {
+		if !seen[name] {
+			return false
+		}
+	}
+	return true
+}
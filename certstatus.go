@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a domain whose certificate can't be had waits a minute before acme is
+// asked again, then twice as long after every failure, up to an hour
+const (
+	certRetryMin = time.Minute
+	certRetryMax = time.Hour
+)
+
+// certTracker remembers the domains whose last certificate attempt failed,
+// and when they may try again.
+type certTracker struct {
+	mu      sync.Mutex
+	domains map[string]*certAttempts
+}
+
+type certAttempts struct {
+	failures  int
+	lastError string
+	lastTry   time.Time
+	nextTry   time.Time
+}
+
+// waiting gives back the last error while a domain is backing off.
+func (t *certTracker) waiting(domain string) (error, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.domains[domain]
+	if !ok || !time.Now().Before(a.nextTry) {
+		return nil, false
+	}
+	return fmt.Errorf("%s (trying again in %s)", a.lastError, time.Until(a.nextTry).Round(time.Second)), true
+}
+
+// failed notes an attempt started at tried failing, unless it's already
+// been counted, and says how long until the next one.
+func (t *certTracker) failed(domain string, err error, tried time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.domains == nil {
+		t.domains = map[string]*certAttempts{}
+	}
+	a, ok := t.domains[domain]
+	if !ok {
+		a = &certAttempts{}
+		t.domains[domain] = a
+	}
+	if a.lastTry.After(tried) {
+		return time.Until(a.nextTry), false
+	}
+	a.failures++
+	backoff := certRetryMin
+	for i := 1; i < a.failures && backoff < certRetryMax; i++ {
+		backoff *= 2
+	}
+	if backoff > certRetryMax {
+		backoff = certRetryMax
+	}
+	a.lastError = err.Error()
+	a.lastTry = time.Now()
+	a.nextTry = a.lastTry.Add(backoff)
+	return backoff, true
+}
+
+// succeeded forgets a domain's failures, returning how many there were.
+func (t *certTracker) succeeded(domain string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.domains[domain]
+	if !ok {
+		return 0
+	}
+	delete(t.domains, domain)
+	return a.failures
+}
+
+// certStatus is where a domain's certificate stands, for certs and the
+// admin api.
+type certStatus struct {
+	Domain    string     `json:"domain"`
+	Group     string     `json:"group,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Failures  int        `json:"failures,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	LastTry   *time.Time `json:"last_attempt,omitempty"`
+	NextTry   *time.Time `json:"next_attempt,omitempty"`
+}
+
+// certStatuses covers every domain with a route of its own, a certificate
+// in the cache or a failing attempt, sorted by name.
+func (app *App) certStatuses() []certStatus {
+	names := map[string]bool{}
+	app.Mu.RLock()
+	for key := range app.Routes {
+		host, _, _ := strings.Cut(key, "/")
+		if !strings.HasPrefix(host, "*") {
+			names[host] = true
+		}
+	}
+	app.Mu.RUnlock()
+	table := app.routeTable()
+	for name := range names {
+		if !table.wantsCert(name) {
+			delete(names, name)
+		}
+	}
+	for _, name := range cachedCertNames(app.certCache())() {
+		names[name] = true
+	}
+	app.certTries.mu.Lock()
+	failing := make(map[string]certAttempts, len(app.certTries.domains))
+	for name, a := range app.certTries.domains {
+		names[name] = true
+		failing[name] = *a
+	}
+	app.certTries.mu.Unlock()
+
+	statuses := make([]certStatus, 0, len(names))
+	for name := range names {
+		status := certStatus{Domain: name, Group: app.Groups.groupOf(name)}
+		if status.Group != "" {
+			app.Groups.status(&status)
+			statuses = append(statuses, status)
+			continue
+		}
+		if expires, err := app.certExpiry(name); err == nil {
+			status.Expires = &expires
+		}
+		if a, ok := failing[name]; ok {
+			status.Failures = a.failures
+			status.LastError = a.lastError
+			status.LastTry = &a.lastTry
+			status.NextTry = &a.nextTry
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Domain < statuses[j].Domain })
+	return statuses
+}
+
+// certExpiry reads when the cached certificate for a domain runs out.
+func (app *App) certExpiry(domain string) (time.Time, error) {
+	data, err := app.Certs.Cache.Get(context.Background(), domain)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the cache holds the private key, then the chain
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return time.Time{}, errors.New("no certificate in the cache entry")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return cert.NotAfter, nil
+	}
+}
+
+// handleCertsCommand shows each domain's certificate, or why it hasn't got
+// one.
+func (app *App) handleCertsCommand() {
+	if app.Certs == nil {
+		fmt.Println("Error: There are no certificates in dev mode.")
+		return
+	}
+	statuses := app.certStatuses()
+	if len(statuses) == 0 {
+		fmt.Println("No certificates yet.")
+		return
+	}
+	for _, s := range statuses {
+		var state string
+		switch {
+		case s.Expires != nil && time.Now().After(*s.Expires):
+			state = "Expired " + s.Expires.Format("2006-01-02")
+		case s.Expires != nil:
+			state = fmt.Sprintf("Valid until %s (%d days)", s.Expires.Format("2006-01-02"), int(time.Until(*s.Expires).Hours()/24))
+		case s.Failures == 0 && s.Group != "":
+			state = "No certificate yet, its group's is being requested"
+		case s.Failures == 0:
+			state = "No certificate yet, it's requested on the first visit"
+		default:
+			state = "No certificate"
+		}
+		if s.Group != "" {
+			state += ", in cert group " + s.Group
+		}
+		fmt.Printf("Domain: %s, %s\n", listedDomain(s.Domain), state)
+		if s.Failures > 0 {
+			fmt.Printf("  failing: %s\n", s.LastError)
+			next := "now"
+			if wait := time.Until(*s.NextTry); wait > 0 {
+				next = "in " + wait.Round(time.Second).String()
+			}
+			fmt.Printf("  %d failed attempts, the last %s ago, next %s\n", s.Failures, time.Since(*s.LastTry).Round(time.Second), next)
+		}
+	}
+}
+
+// adminCerts lists where each domain's certificate stands, GET /certs.
+func (app *App) adminCerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := []certStatus{}
+	if app.Certs != nil {
+		token := tokenFrom(r)
+		for _, s := range app.certStatuses() {
+			if app.ownsDomain(token, s.Domain) {
+				statuses = append(statuses, s)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultCompressTypes are the media types worth compressing when a route
+// doesn't say otherwise. anything text/* is always included.
+var defaultCompressTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+// compressEncodings in order of preference when a client accepts several.
+var compressEncodings = []string{"br", "zstd", "gzip"}
+
+var (
+	gzipPool   sync.Pool
+	brotliPool sync.Pool
+	zstdPool   sync.Pool
+)
+
+// newEncoder hands out a pooled encoder for the encoding writing into w.
+func newEncoder(encoding string, w io.Writer) io.WriteCloser {
+	switch encoding {
+	case "br":
+		if bw, ok := brotliPool.Get().(*brotli.Writer); ok {
+			bw.Reset(w)
+			return bw
+		}
+		return brotli.NewWriterLevel(w, 4)
+	case "zstd":
+		if zw, ok := zstdPool.Get().(*zstd.Encoder); ok {
+			zw.Reset(w)
+			return zw
+		}
+		zw, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return zw
+	default:
+		if gw, ok := gzipPool.Get().(*gzip.Writer); ok {
+			gw.Reset(w)
+			return gw
+		}
+		gw, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		return gw
+	}
+}
+
+func putEncoder(enc io.WriteCloser) {
+	switch e := enc.(type) {
+	case *brotli.Writer:
+		brotliPool.Put(e)
+	case *zstd.Encoder:
+		zstdPool.Put(e)
+	case *gzip.Writer:
+		gzipPool.Put(e)
+	}
+}
+
+// negotiateEncoding picks our favourite encoding out of an Accept-Encoding
+// header, or "" if the client doesn't take any of them.
+func negotiateEncoding(accept string) string {
+	accepted := acceptedEncodings(accept)
+	for _, enc := range compressEncodings {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// acceptedEncodings reads an Accept-Encoding header into the set of our
+// encodings the client takes.
+func acceptedEncodings(accept string) map[string]bool {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if name == "*" {
+			for _, enc := range compressEncodings {
+				if _, seen := accepted[enc]; !seen {
+					accepted[enc] = q > 0
+				}
+			}
+			continue
+		}
+		accepted[name] = q > 0
+	}
+	return accepted
+}
+
+// compressible reports whether a Content-Type is on the list.
+func compressible(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	for _, t := range types {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter compresses a response on the fly once it knows the body is
+// eligible. when the backend doesn't say how big the body is we hold on to
+// the first minSize bytes before deciding.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding     string
+	minSize      int
+	compressible func(contentType string) bool
+
+	status  int
+	pending bool // headers held back until we know if we're compressing
+	decided bool
+	buf     []byte
+	enc     io.WriteCloser
+}
+
+func newCompressWriter(w http.ResponseWriter, encoding string, minSize int, compressible func(string) bool) *compressWriter {
+	return &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize, compressible: compressible}
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided || c.pending {
+		return
+	}
+	// informational responses (and 101 upgrades) go straight through
+	if code >= 100 && code < 200 {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	c.status = code
+	h := c.Header()
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent ||
+		h.Get("Content-Encoding") != "" || !c.compressible(h.Get("Content-Type")) {
+		c.plain()
+		return
+	}
+
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n < c.minSize {
+			c.plain()
+			return
+		}
+		c.compress()
+		return
+	}
+
+	c.pending = true
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.decided && !c.pending {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.pending {
+		c.buf = append(c.buf, b...)
+		if len(c.buf) < c.minSize {
+			return len(b), nil
+		}
+		c.compress()
+		return len(b), c.flushBuf()
+	}
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) plain() {
+	c.pending = false
+	c.decided = true
+	c.ResponseWriter.WriteHeader(c.status)
+}
+
+func (c *compressWriter) compress() {
+	c.pending = false
+	c.decided = true
+	h := c.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	if !varies(h, "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	// the bytes are different now, a strong validator would be a lie
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	c.enc = newEncoder(c.encoding, c.ResponseWriter)
+}
+
+func (c *compressWriter) flushBuf() error {
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if c.enc != nil {
+		_, err := c.enc.Write(buf)
+		return err
+	}
+	_, err := c.ResponseWriter.Write(buf)
+	return err
+}
+
+// ReadFrom hands big uncompressed bodies straight through so the server can
+// use sendfile, anything else goes the usual way through Write.
+func (c *compressWriter) ReadFrom(r io.Reader) (int64, error) {
+	if c.decided && c.enc == nil && len(c.buf) == 0 {
+		return io.Copy(c.ResponseWriter, r)
+	}
+	return io.Copy(struct{ io.Writer }{c}, r)
+}
+
+// Flush pushes out whatever we have, a handler flushing is a good sign it's
+// streaming so we commit to compressing.
+func (c *compressWriter) Flush() {
+	if c.pending {
+		c.compress()
+		c.flushBuf()
+	}
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Close finishes the response, it must be called once the handler is done.
+func (c *compressWriter) Close() error {
+	if c.pending {
+		// never reached the threshold, send it as is
+		c.Header().Set("Content-Length", strconv.Itoa(len(c.buf)))
+		c.plain()
+	}
+	if err := c.flushBuf(); err != nil {
+		return err
+	}
+	if c.enc == nil {
+		return nil
+	}
+	err := c.enc.Close()
+	putEncoder(c.enc)
+	c.enc = nil
+	return err
+}
+
+// Unwrap lets http.ResponseController reach Hijack underneath.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+type connInfoKey struct{}
+
+// connInfo is state tied to one client connection, shared by every request
+// that arrives on it. http.Server.ConnContext puts it in each request's
+// context.
+type connInfo struct {
+	mu       sync.Mutex
+	limiters map[string]*bandwidthLimiter
+
+	// hello has the connection's TLS fingerprint once the handshake is
+	// done, nil for plain http
+	hello *helloConn
+
+	// listener is the name of the listener the connection came in on,
+	// empty where every route is served
+	listener string
+
+	// tlsHeaders is set on listeners that tell backends about the tls
+	// connection
+	tlsHeaders bool
+}
+
+// withConnInfo is used as http.Server.ConnContext.
+func withConnInfo(ctx context.Context, c net.Conn) context.Context {
+	ci := &connInfo{}
+	if tc, ok := c.(*tls.Conn); ok {
+		ci.hello, _ = tc.NetConn().(*helloConn)
+	}
+	return context.WithValue(ctx, connInfoKey{}, ci)
+}
+
+// connInfoFrom returns the state for the connection a request came in on,
+// or nil if the server wasn't set up to track it.
+func connInfoFrom(ctx context.Context) *connInfo {
+	ci, _ := ctx.Value(connInfoKey{}).(*connInfo)
+	return ci
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
+)
+
+// tunnelSilence is how long a tunnel can go without hearing from the edge
+// before it's taken for dead. the edge pings every 30 seconds.
+const tunnelSilence = 90 * time.Second
+
+// errTunnelRefused is an answer from the edge that trying again won't
+// change, a bad token or one that isn't for the domain.
+var errTunnelRefused = errors.New("refused")
+
+// runConnect serves a local port through a remote appserve's tunnels,
+// `appserve connect wss://edge.example.com --domain app.example.com --port 3000`.
+func runConnect(args []string) {
+	fs := flag.NewFlagSet("connect", flag.ExitOnError)
+	domain := fs.String("domain", "", "the domain to serve, the token has to be for it")
+	port := fs.String("port", "", "the local port, or host:port, to send requests to")
+	token := fs.String("token", "", "the tunnel token, $APPSERVE_TUNNEL_TOKEN by default")
+	quiet := fs.Bool("quiet", false, "don't log every request")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appserve connect <wss://edge> -domain <domain> -port <port> [-token token]")
+		fs.PrintDefaults()
+	}
+	// the edge can come before the flags
+	var edge string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		edge, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if edge == "" && fs.NArg() == 1 {
+		edge = fs.Arg(0)
+	} else if fs.NArg() > 0 {
+		edge = ""
+	}
+	if *token == "" {
+		*token = os.Getenv("APPSERVE_TUNNEL_TOKEN")
+	}
+	if edge == "" || *domain == "" || *port == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *token == "" {
+		fmt.Fprintln(os.Stderr, "Error: No token, pass -token or set APPSERVE_TUNNEL_TOKEN.")
+		os.Exit(2)
+	}
+	if !strings.Contains(edge, "://") {
+		edge = "wss://" + edge
+	}
+	edgeURL, err := url.Parse(edge)
+	if err != nil || (edgeURL.Scheme != "wss" && edgeURL.Scheme != "ws") || edgeURL.Host == "" {
+		fmt.Fprintf(os.Stderr, "Error: invalid edge %q, expected wss://host\n", edge)
+		os.Exit(2)
+	}
+
+	target := backendAddr(*port)
+	handler := tunnelHandler(target, *quiet)
+	*domain = NormalizeDomain(*domain)
+
+	// keep the tunnel up, backing off while the edge can't be reached
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := connectTunnel(edgeURL, *domain, *token, func() {
+			log.Printf("Tunnel up, https://%s is served from %s", *domain, target)
+		}, handler)
+		if errors.Is(err, errTunnelRefused) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("Tunnel down: %v, reconnecting in %s", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// connectTunnel opens one tunnel and serves requests down it until it
+// drops.
+func connectTunnel(edge *url.URL, domain, token string, up func(), handler http.Handler) error {
+	origin := "https://" + edge.Host
+	if edge.Scheme == "ws" {
+		origin = "http://" + edge.Host
+	}
+	cfg, err := websocket.NewConfig(edge.String(), origin)
+	if err != nil {
+		return err
+	}
+	cfg.Header.Set("Authorization", "Bearer "+token)
+	cfg.Header.Set(tunnelDomainHeader, domain)
+	// the edge has to take the connection over, which http/2 can't do
+	cfg.TlsConfig = &tls.Config{ServerName: edge.Hostname(), NextProtos: []string{"http/1.1"}}
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		var de *websocket.DialError
+		if errors.As(err, &de) && de.Err == websocket.ErrBadStatus {
+			return explainRejection(edge, domain, token)
+		}
+		return err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	up()
+
+	conn := &watchedConn{Conn: ws}
+	conn.heard.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if now.Sub(time.Unix(0, conn.heard.Load())) > tunnelSilence {
+					ws.Close()
+					return
+				}
+			}
+		}
+	}()
+	(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+	if time.Since(time.Unix(0, conn.heard.Load())) > tunnelSilence {
+		return errors.New("the edge stopped answering")
+	}
+	return errors.New("the edge closed the tunnel")
+}
+
+// explainRejection asks the edge again without the upgrade to find out why
+// it turned the tunnel down, the websocket package only says the status
+// was wrong.
+func explainRejection(edge *url.URL, domain, token string) error {
+	u := *edge
+	u.Scheme = "https"
+	if edge.Scheme == "ws" {
+		u.Scheme = "http"
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(tunnelDomainHeader, domain)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	reason := strings.TrimSpace(string(body))
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("the edge %w the tunnel: %s", errTunnelRefused, reason)
+	case http.StatusNotFound:
+		return fmt.Errorf("the edge %w the tunnel, is it running with -tunnel-host %s?", errTunnelRefused, edge.Hostname())
+	}
+	return fmt.Errorf("the edge answered %s: %s", resp.Status, reason)
+}
+
+// watchedConn notes when anything last came in from the edge.
+type watchedConn struct {
+	net.Conn
+	heard atomic.Int64
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.heard.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// tunnelHandler passes requests from the tunnel on to the local app,
+// logging each one.
+func tunnelHandler(target string, quiet bool) http.Handler {
+	rp := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: target})
+	rp.Transport = upstreams.plain
+	rp.BufferPool = proxyBuffers
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Error reaching %s for %s: %v", target, r.URL.RequestURI(), err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	if quiet {
+		return rp
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		rp.ServeHTTP(aw, r)
+		log.Printf("%s %s %d %d bytes %s", r.Method, r.URL.RequestURI(), aw.status, aw.bytes, time.Since(start).Round(time.Millisecond))
+	})
+}
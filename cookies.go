@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// rewriteCookies fixes up the Domain and Path attributes on cookies coming
+// back from the backend, for apps that have no idea what hostname or prefix
+// they're actually being served from.
+func (opts RouteOptions) rewriteCookies(resp *http.Response) error {
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	resp.Header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		resp.Header.Add("Set-Cookie", opts.rewriteCookie(cookie))
+	}
+	return nil
+}
+
+// rewriteCookie works on the raw header text so attributes we don't know
+// about (Partitioned, Priority, ...) pass through untouched.
+func (opts RouteOptions) rewriteCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+
+	// the first part is always name=value, only look at the attributes
+	out := []string{parts[0]}
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			if opts.CookieDomain == nil {
+				break
+			}
+			replacement, ok := opts.CookieDomain[strings.ToLower(strings.TrimPrefix(value, "."))]
+			if !ok {
+				replacement, ok = opts.CookieDomain["*"]
+			}
+			if !ok {
+				break
+			}
+			if replacement == "" {
+				continue
+			}
+			part = " " + name + "=" + replacement
+		case "path":
+			if replacement, ok := rewritePathPrefix(opts.CookiePath, value); ok {
+				part = " " + name + "=" + replacement
+			}
+		}
+		out = append(out, part)
+	}
+
+	return strings.Join(out, ";")
+}
+
+// rewritePathPrefix swaps the longest matching prefix in rules for its
+// replacement.
+func rewritePathPrefix(rules map[string]string, path string) (string, bool) {
+	var best string
+	found := false
+	for prefix := range rules {
+		if strings.HasPrefix(path, prefix) && (!found || len(prefix) > len(best)) {
+			best = prefix
+			found = true
+		}
+	}
+	if !found {
+		return path, false
+	}
+	return rules[best] + strings.TrimPrefix(path, best), true
+}
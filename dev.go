@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// devSuffixes are the names dev mode answers for on top of the routes
+// themselves: .localhost always points at this machine and .test is kept
+// for testing, neither can ever get a real certificate.
+var devSuffixes = []string{".localhost", ".test"}
+
+// devDomain finds the route a dev mode request is for. a name with a route
+// of its own is left alone, otherwise example.com.localhost and
+// example.com.test stand in for example.com so the production routes file
+// works unchanged.
+func (app *App) devDomain(domain string) string {
+	table := app.routeTable()
+	if table.hasHost(domain) {
+		return domain
+	}
+	for _, suffix := range devSuffixes {
+		if name, ok := strings.CutSuffix(domain, suffix); ok && table.hasHost(name) {
+			return name
+		}
+	}
+	return domain
+}
+
+// startDevServer serves every route over plain http on addr, with no acme
+// and no privileged ports, for running the routes file on a laptop.
+func (app *App) startDevServer(addr string) {
+	ln, err := app.listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Dev mode: serving routes over http on %s, try http://<domain>.localhost%s/", addr, addr[strings.LastIndex(addr, ":"):])
+	server := &http.Server{Handler: app.Handler(), ConnContext: withConnInfo}
+	log.Fatal(server.Serve(ln))
+}
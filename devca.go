@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// devCADefault is where dev mode keeps its own ca when mkcert isn't there
+// to lend us one.
+const devCADefault = "dev-ca"
+
+// devCA hands out certificates for dev mode's https listener, signed by
+// mkcert's ca when mkcert is installed (so `mkcert -install` is all it takes
+// for browsers to trust them) or by a ca of our own otherwise.
+type devCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	file string // the ca certificate, for telling people what to trust
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// openDevCA finds mkcert's ca, or loads or makes one in dir.
+func openDevCA(dir string) (*devCA, error) {
+	if root := mkcertRoot(); root != "" {
+		ca, err := loadDevCA(filepath.Join(root, "rootCA.pem"), filepath.Join(root, "rootCA-key.pem"))
+		if err == nil {
+			return ca, nil
+		}
+		log.Printf("Not using mkcert's ca in %s: %v", root, err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, adminCAFile), filepath.Join(dir, adminCAKeyFile)
+	if ca, err := loadDevCA(certFile, keyFile); !errors.Is(err, os.ErrNotExist) {
+		return ca, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	ca, key, err := newDevCA()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCertAndKey(certFile, keyFile, ca.cert.Raw, key); err != nil {
+		return nil, err
+	}
+	ca.file = certFile
+	log.Printf("Made a dev ca in %s, trust %s (or install mkcert and run mkcert -install) for browsers to accept dev https", dir, certFile)
+	return ca, nil
+}
+
+// newDevCA makes a fresh ca, only in memory until it's written out.
+func newDevCA() (*devCA, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: "appserve dev ca " + host, Organization: []string{"appserve development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &devCA{cert: cert, key: key, file: "memory", certs: map[string]*tls.Certificate{}}, key, nil
+}
+
+// mkcertRoot is the directory mkcert keeps its ca in, empty without mkcert.
+func mkcertRoot() string {
+	if _, err := exec.LookPath("mkcert"); err != nil {
+		return ""
+	}
+	out, err := exec.Command("mkcert", "-CAROOT").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func loadDevCA(certFile, keyFile string) (*devCA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cb, _ := pem.Decode(certPEM)
+	kb, _ := pem.Decode(keyPEM)
+	if cb == nil || kb == nil {
+		return nil, fmt.Errorf("%s: no pem data", certFile)
+	}
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// ours are ec keys, mkcert's are pkcs8 rsa
+	var key crypto.Signer
+	if kb.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(kb.Bytes)
+	} else {
+		var parsed interface{}
+		if parsed, err = x509.ParsePKCS8PrivateKey(kb.Bytes); err == nil {
+			var ok bool
+			if key, ok = parsed.(crypto.Signer); !ok {
+				err = errors.New("unsupported key type")
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	return &devCA{cert: cert, key: key, file: certFile, certs: map[string]*tls.Certificate{}}, nil
+}
+
+// devName reports whether dev mode should make a certificate for name: the
+// dev names themselves, or a route's own name pointed here in a hosts file.
+func (app *App) devName(name string) bool {
+	if name == "localhost" || app.routeTable().hasHost(name) {
+		return true
+	}
+	for _, suffix := range devSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCertificate issues a certificate for the name asked for the first time
+// it's seen, they're only kept in memory.
+func (ca *devCA) getCertificate(app *App) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if name == "" {
+			name = "localhost"
+		}
+		if !app.devName(name) {
+			return nil, fmt.Errorf("dev mode: no certificate for %q", name)
+		}
+
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		if cert, ok := ca.certs[name]; ok {
+			return cert, nil
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: newSerial(),
+			Subject:      pkix.Name{CommonName: name, Organization: []string{"appserve development"}},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().AddDate(1, 0, 0),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			DNSNames:     []string{name},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+		if err != nil {
+			return nil, err
+		}
+		cert := &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}
+		ca.certs[name] = cert
+		return cert, nil
+	}
+}
+
+// startDevTLSServer serves every route over https on addr with
+// certificates from ca, for browser features that need a secure context.
+func (app *App) startDevTLSServer(addr string, ca *devCA) {
+	ln, err := app.listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Dev mode: serving routes over https on %s, certificates signed by %s", addr, ca.file)
+	server := &http.Server{
+		Handler:     app.Handler(),
+		ConnContext: withConnInfo,
+		TLSConfig:   &tls.Config{GetCertificate: ca.getCertificate(app), MinVersion: tls.VersionTLS12},
+	}
+	log.Fatal(server.ServeTLS(ln, "", ""))
+}
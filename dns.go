@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendAddr turns a route's port into the address to dial. a bare port
+// is a local backend, anything with a host in it is taken as is.
+func backendAddr(port string) string {
+	if strings.Contains(port, ":") {
+		return port
+	}
+	return "localhost:" + port
+}
+
+// backendHosts remembers what the hostnames backends are reached by last
+// resolved to. pooled connections stay with the address they were opened
+// to, so when a name moves (dynamic dns, cloud load balancers) the idle
+// ones are dropped and new requests dial the new address.
+var backendHosts = &hostWatcher{addrs: map[string]string{}}
+
+type hostWatcher struct {
+	mu    sync.Mutex
+	addrs map[string]string
+}
+
+// watch starts keeping an eye on a backend's host, ip addresses and
+// localhost never move so they're left alone.
+func (w *hostWatcher) watch(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "localhost" || net.ParseIP(host) != nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.addrs[host]; !ok {
+		w.addrs[host] = ""
+	}
+}
+
+// run re-resolves every watched host each ttl until ctx is done.
+func (w *hostWatcher) run(ctx context.Context, ttl time.Duration) {
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.refresh(ctx, ttl)
+		}
+	}
+}
+
+func (w *hostWatcher) refresh(ctx context.Context, timeout time.Duration) {
+	w.mu.Lock()
+	hosts := make([]string, 0, len(w.addrs))
+	for host := range w.addrs {
+		hosts = append(hosts, host)
+	}
+	w.mu.Unlock()
+
+	changed := false
+	for _, host := range hosts {
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		addrs, err := net.DefaultResolver.LookupHost(lookupCtx, host)
+		cancel()
+		if err != nil {
+			// keep what we had, a flaky resolver shouldn't drop connections
+			log.Printf("Error resolving backend host %s: %v", host, err)
+			continue
+		}
+		sort.Strings(addrs)
+		resolved := strings.Join(addrs, ",")
+
+		w.mu.Lock()
+		previous := w.addrs[host]
+		w.addrs[host] = resolved
+		w.mu.Unlock()
+
+		if previous != "" && previous != resolved {
+			log.Printf("Backend host %s moved from %s to %s", host, previous, resolved)
+			changed = true
+		}
+	}
+
+	if changed {
+		closeAllIdle()
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// doctor keeps track of what runDoctor found.
+type doctor struct {
+	failed, warned int
+}
+
+func (d *doctor) ok(check, msg string) {
+	fmt.Printf("ok    %s: %s\n", check, msg)
+}
+
+func (d *doctor) warn(check, msg, fix string) {
+	d.warned++
+	fmt.Printf("warn  %s: %s\n", check, msg)
+	if fix != "" {
+		fmt.Printf("      fix: %s\n", fix)
+	}
+}
+
+func (d *doctor) fail(check, msg, fix string) {
+	d.failed++
+	fmt.Printf("FAIL  %s: %s\n", check, msg)
+	if fix != "" {
+		fmt.Printf("      fix: %s\n", fix)
+	}
+}
+
+// runDoctor checks the things that get in the way of appserve getting
+// certificates and serving, `appserve doctor`, and says what to do about
+// each problem.
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	routesFile := fs.String("routes", "routes.json", "path to the routes file")
+	certDir := fs.String("cert-dir", "tls", "directory certificates are cached in")
+	ipService := fs.String("ip-service", defaultIPService, "url that answers with the ip address a request came from, for finding our public ipv4 address")
+	ip6Service := fs.String("ip6-service", defaultIP6Service, "the same for ipv6, empty to skip")
+	acmeCA := fs.String("acme-ca", "letsencrypt", "the ca appserve gets certificates from, as for its -acme-ca")
+	fs.Parse(args)
+	directory, err := acmeDirectory(*acmeCA)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	d := &doctor{}
+	d.checkPorts()
+	d.checkACME(directory)
+	d.checkCertDir(*certDir)
+	d.checkDNS(*routesFile, *ipService, *ip6Service)
+
+	fmt.Printf("\n%d problems, %d warnings.\n", d.failed, d.warned)
+	if d.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// checkPorts tries to listen on 80 and 443 the way the server would.
+func (d *doctor) checkPorts() {
+	for _, port := range []string{"80", "443"} {
+		check := "port " + port
+		ln, err := net.Listen("tcp", ":"+port)
+		switch {
+		case err == nil:
+			ln.Close()
+			d.ok(check, "can listen")
+		case errors.Is(err, syscall.EADDRINUSE):
+			d.warn(check, "something is already listening",
+				"fine if it's appserve itself, otherwise find it with the ports command or `sudo lsof -i :"+port+"` and stop it")
+		case errors.Is(err, syscall.EACCES) || errors.Is(err, os.ErrPermission):
+			fix := "run appserve as root"
+			if runtime.GOOS == "linux" {
+				fix = "run as root, or let the binary bind low ports with `sudo setcap cap_net_bind_service=+ep " + executable() + "`"
+			}
+			d.fail(check, "not allowed to listen", fix)
+		default:
+			d.fail(check, err.Error(), "")
+		}
+	}
+}
+
+func executable() string {
+	if exe, err := os.Executable(); err == nil {
+		return exe
+	}
+	return "./appserve"
+}
+
+// checkACME reaches the ca's directory, let's encrypt's by default, and
+// uses its clock to check ours, certificates aren't valid yet (or already
+// expired) to a machine whose time is off.
+func (d *doctor) checkACME(directory string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, directory, nil)
+	if err != nil {
+		d.fail("acme", err.Error(), "")
+		return
+	}
+	name, host := "let's encrypt", req.URL.Hostname()
+	if directory != acme.LetsEncryptURL {
+		name = host
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		d.fail("acme", "can't reach "+directory+": "+err.Error(),
+			"let outbound https to "+host+" through the firewall, and check dns resolution works")
+		d.warn("clock", "not checked, needs the acme server", "")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fix := "try again later"
+		if directory == acme.LetsEncryptURL {
+			fix += ", see https://letsencrypt.status.io"
+		}
+		d.fail("acme", directory+" answered "+resp.Status, fix)
+	} else {
+		d.ok("acme", "reached "+name+" in "+time.Since(start).Round(time.Millisecond).String())
+	}
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		d.warn("clock", "the acme server didn't say what time it is", "")
+		return
+	}
+	skew := time.Until(date)
+	if skew < 0 {
+		skew = -skew
+	}
+	// the Date header only has whole seconds
+	if skew > time.Minute {
+		d.fail("clock", fmt.Sprintf("off by %s", skew.Round(time.Second)),
+			"turn on time sync, e.g. `sudo timedatectl set-ntp true`")
+	} else {
+		d.ok("clock", fmt.Sprintf("within %s of %s's", (skew+time.Second).Round(time.Second), name))
+	}
+}
+
+// checkCertDir makes sure certificates can be stored and aren't readable
+// by anyone else.
+func (d *doctor) checkCertDir(dir string) {
+	check := "cert cache"
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		parent := filepath.Dir(dir)
+		if f, err := os.CreateTemp(parent, ".appserve-doctor-*"); err != nil {
+			d.fail(check, dir+" doesn't exist and can't be made in "+parent, "run appserve from a directory it can write to, or as its owner")
+		} else {
+			f.Close()
+			os.Remove(f.Name())
+			d.ok(check, dir+" will be made on the first certificate")
+		}
+		return
+	}
+	if err != nil {
+		d.fail(check, err.Error(), "")
+		return
+	}
+	if !info.IsDir() {
+		d.fail(check, dir+" isn't a directory", "move it out of the way")
+		return
+	}
+	f, err := os.CreateTemp(dir, ".appserve-doctor-*")
+	if err != nil {
+		d.fail(check, "can't write to "+dir, "`sudo chown -R $(whoami) "+dir+"` or run appserve as the user that owns it")
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	if runtime.GOOS == "windows" {
+		d.ok(check, dir+" is writable")
+		return
+	}
+	var open []string
+	if info.Mode().Perm()&0o077 != 0 {
+		open = append(open, dir)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if fi, err := e.Info(); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm()&0o077 != 0 {
+			open = append(open, filepath.Join(dir, e.Name()))
+		}
+	}
+	if len(open) > 0 {
+		d.warn(check, "readable by other users: "+strings.Join(open, ", "), "`chmod -R go-rwx "+dir+"`, it holds private keys")
+		return
+	}
+	d.ok(check, dir+" is writable and private")
+}
+
+// checkDNS compares every domain's A and AAAA records with the addresses
+// this machine reaches the internet from, let's encrypt has to find us at
+// them.
+func (d *doctor) checkDNS(routesFile, ipService, ip6Service string) {
+	routes, err := readRoutes(routesFile)
+	if err != nil {
+		d.warn("dns", "no routes to check: "+err.Error(), "")
+		return
+	}
+	public := findPublicIPs(ipService, ip6Service)
+	if len(public) == 0 {
+		d.warn("dns", "couldn't find this machine's public address from "+ipService, "check outbound https, or pass -ip-service")
+		return
+	}
+	addrs := make([]string, 0, len(public))
+	for a := range public {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+	d.ok("public ip", strings.Join(addrs, ", "))
+
+	seen := map[string]bool{}
+	for _, route := range routes {
+		host := dnsCheckHost(route.Domain)
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		check := "dns " + host
+
+		res := checkHostDNS(context.Background(), host, public)
+		switch {
+		case !res.resolved:
+			d.fail(check, "doesn't resolve", "add an A record for "+host+" pointing at "+addrs[0])
+		case !res.matched:
+			d.fail(check, "points at "+strings.Join(res.elsewhere, ", ")+", not here",
+				"point its A/AAAA records at "+strings.Join(addrs, ", ")+", or ignore this if a load balancer or cdn sits in front")
+		case len(res.elsewhere) > 0:
+			d.warn(check, "also points at "+strings.Join(res.elsewhere, ", "),
+				"some visitors and certificate checks will go there instead, remove those records unless they're meant to be there")
+		default:
+			d.ok(check, "points here")
+		}
+	}
+}
+
+// services that answer with the address a request came from, for finding
+// this machine's public addresses
+const (
+	defaultIPService  = "https://api.ipify.org"
+	defaultIP6Service = "https://api6.ipify.org"
+)
+
+// findPublicIPs asks the services for this machine's public addresses,
+// skipping any that don't answer.
+func findPublicIPs(services ...string) map[string]bool {
+	public := map[string]bool{}
+	for _, service := range services {
+		if service == "" {
+			continue
+		}
+		if ip, err := publicIP(service); err == nil {
+			public[ip.String()] = true
+		}
+	}
+	return public
+}
+
+// dnsCheckHost is the name to look up for a route's domain. a wildcard can
+// only be looked up through one of its names.
+func dnsCheckHost(domain string) string {
+	host, _, _ := strings.Cut(domain, "/")
+	return strings.Replace(host, "*.", "appserve-doctor.", 1)
+}
+
+// hostDNS is what a name's A/AAAA records say about this machine.
+type hostDNS struct {
+	resolved  bool
+	matched   bool     // at least one record is one of our addresses
+	elsewhere []string // the records that aren't
+}
+
+func checkHostDNS(ctx context.Context, host string, public map[string]bool) hostDNS {
+	var res hostDNS
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(ips) == 0 {
+		return res
+	}
+	res.resolved = true
+	for _, ip := range ips {
+		if public[ip.IP.String()] {
+			res.matched = true
+		} else {
+			res.elsewhere = append(res.elsewhere, ip.IP.String())
+		}
+	}
+	return res
+}
+
+func publicIP(service string) (net.IP, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(service)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s didn't answer with an address", service)
+	}
+	return ip, nil
+}
+
+// preflightDNS warns, with -check-dns, when a domain the shell just added
+// doesn't point here. acme can't issue its certificate until it does, and
+// that's the usual reason it fails.
+func (app *App) preflightDNS(domain string) {
+	host := dnsCheckHost(NormalizeDomain(domain))
+	// nothing to check when the add failed
+	if !app.CheckDNS || app.Dev || !app.routeTable().hasHost(host) {
+		return
+	}
+	public := app.publicIPs()
+	if len(public) == 0 {
+		fmt.Println("Warning: Couldn't find this machine's public address to check dns against, set -public-ip.")
+		return
+	}
+	addrs := make([]string, 0, len(public))
+	for a := range public {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := checkHostDNS(ctx, host, public)
+	switch {
+	case !res.resolved:
+		fmt.Printf("Warning: %s doesn't resolve, add an A record pointing at %s. There's no certificate for it until then.\n", host, addrs[0])
+	case !res.matched:
+		fmt.Printf("Warning: %s points at %s, not here (%s). There's no certificate for it until it does, unless a load balancer or cdn sits in front.\n",
+			host, strings.Join(res.elsewhere, ", "), strings.Join(addrs, ", "))
+	case len(res.elsewhere) > 0:
+		fmt.Printf("Warning: %s also points at %s, some visitors and certificate checks will go there instead.\n", host, strings.Join(res.elsewhere, ", "))
+	}
+}
+
+// publicIPs are the addresses from -public-ip, or else looked up once.
+func (app *App) publicIPs() map[string]bool {
+	app.publicOnce.Do(func() {
+		if len(app.PublicIPs) > 0 {
+			app.public = map[string]bool{}
+			for _, ip := range app.PublicIPs {
+				app.public[ip] = true
+			}
+			return
+		}
+		app.public = findPublicIPs(defaultIPService, defaultIP6Service)
+	})
+	return app.public
+}
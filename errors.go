@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// errors get sorted by whose fault they were, so a user closing a tab
+// doesn't look like a backend falling over:
+//
+//	client    the request went wrong on the client's end, nothing to fix
+//	upstream  the backend refused, timed out or hung up
+//	internal  we broke, a bad template, unreadable files or a panic
+const (
+	errorClient   = "client"
+	errorUpstream = "upstream"
+	errorInternal = "internal"
+)
+
+// errorCounter counts errors by class and reason since we started.
+type errorCounter struct {
+	mu     sync.Mutex
+	counts map[errorKind]uint64
+}
+
+type errorKind struct {
+	Class  string
+	Reason string
+}
+
+var requestErrors = &errorCounter{counts: map[errorKind]uint64{}}
+
+func (c *errorCounter) add(class, reason string) {
+	c.mu.Lock()
+	c.counts[errorKind{class, reason}]++
+	c.mu.Unlock()
+}
+
+// errorCount is how many errors of a kind there have been.
+type errorCount struct {
+	errorKind
+	Count uint64
+}
+
+func (c *errorCounter) snapshot() []errorCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make([]errorCount, 0, len(c.counts))
+	for kind, n := range c.counts {
+		counts = append(counts, errorCount{kind, n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Class != counts[j].Class {
+			return counts[i].Class < counts[j].Class
+		}
+		return counts[i].Reason < counts[j].Reason
+	})
+	return counts
+}
+
+// classifyProxyError works out whose fault a failed proxy request was and
+// the status to answer with.
+func classifyProxyError(r *http.Request, err error) (class, reason string, status int) {
+	// the client going away cancels the request context, whatever error the
+	// transport happened to surface for it
+	if r.Context().Err() != nil || errors.Is(err, context.Canceled) {
+		return errorClient, "canceled", 499
+	}
+
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorUpstream, "timeout", http.StatusGatewayTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorUpstream, "refused", http.StatusBadGateway
+	case errors.As(err, &dnsErr):
+		return errorUpstream, "dns", http.StatusBadGateway
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorUpstream, "reset", http.StatusBadGateway
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr), errors.As(err, &recordErr):
+		return errorUpstream, "tls", http.StatusBadGateway
+	case errors.As(err, &netErr):
+		return errorUpstream, "network", http.StatusBadGateway
+	}
+	// not a network problem, something about how we made the request
+	return errorInternal, "proxy", http.StatusBadGateway
+}
+
+// proxyError answers for a backend that couldn't be reached, with the log
+// line rate limited so a dead backend under load doesn't bury everything
+// else. clients hanging up get counted but not logged.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	class, reason, status := classifyProxyError(r, err)
+	requestErrors.add(class, reason)
+	if class != errorClient {
+		logLimited(class, "%s error (%s) proxying %s%s: %v", errorLabel(class), reason, r.Host, r.URL.RequestURI(), err)
+	}
+	w.WriteHeader(status)
+}
+
+// clientError answers a request that was the client's fault, like one for
+// a host we don't serve.
+func clientError(w http.ResponseWriter, reason string, status int) {
+	requestErrors.add(errorClient, reason)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// internalError answers with a 500 for something that went wrong on our
+// side and logs why.
+func internalError(w http.ResponseWriter, r *http.Request, reason string, err error) {
+	requestErrors.add(errorInternal, reason)
+	logLimited(errorInternal, "Internal error (%s) serving %s%s: %v", reason, r.Host, r.URL.RequestURI(), err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// recoverPanic counts and logs a panicking handler before letting net/http
+// drop the connection as it would have anyway.
+func recoverPanic(r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		// a deliberate abort, the reverse proxy does this when a backend
+		// dies mid body
+		panic(v)
+	}
+	requestErrors.add(errorInternal, "panic")
+	log.Printf("Internal error (panic) serving %s%s: %v\n%s", r.Host, r.URL.RequestURI(), v, debug.Stack())
+	panic(http.ErrAbortHandler)
+}
+
+func errorLabel(class string) string {
+	switch class {
+	case errorUpstream:
+		return "Upstream"
+	case errorInternal:
+		return "Internal"
+	}
+	return "Client"
+}
+
+func (k errorKind) String() string {
+	return fmt.Sprintf("%s/%s", k.Class, k.Reason)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// kinds of event
+const (
+	eventRouteAdded     = "route.added"
+	eventRouteChanged   = "route.changed"
+	eventRouteRemoved   = "route.removed"
+	eventRouteScheduled = "route.scheduled"
+	eventCertIssued     = "cert.issued"
+	eventCertRenewed    = "cert.renewed"
+	eventCertFailed     = "cert.failed"
+	eventQuotaWarning   = "quota.warning"
+	eventQuotaExceeded  = "quota.exceeded"
+	eventTrafficAnomaly = "traffic.anomaly"
+	eventTrafficNormal  = "traffic.normal"
+	eventBackendDown    = "backend.down"
+	eventBackendUp      = "backend.up"
+	eventStatsTick      = "stats.tick"
+)
+
+// event is something that happened that other systems might want to hear
+// about, sent to webhooks and the admin api's /events.
+type event struct {
+	ID   string                 `json:"id"`
+	Type string                 `json:"type"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// eventBus hands events to whoever is listening. like the log hub a slow
+// listener misses events rather than holding anything up.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan event]struct{}
+}
+
+var appEvents = &eventBus{subs: map[chan event]struct{}{}}
+
+func newEvent(typ string, data map[string]interface{}) event {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return event{ID: hex.EncodeToString(id), Type: typ, Time: time.Now().UTC(), Data: data}
+}
+
+// emitEvent sends an event of typ to every listener.
+func emitEvent(typ string, data map[string]interface{}) {
+	e := newEvent(typ, data)
+	appEvents.mu.Lock()
+	defer appEvents.mu.Unlock()
+	for ch := range appEvents.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// eventMatches reports whether typ is one of patterns, names or a prefix
+// ending in *. no patterns matches everything.
+func eventMatches(patterns []string, typ string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(typ, prefix) {
+			return true
+		}
+		if pattern == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe delivers events on ch until the returned func is called.
+func (b *eventBus) subscribe(ch chan event) func() {
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// noteRouteChanges compares the routes with what was last published and
+// emits an event for each one added, changed or removed, and starts getting
+// added ones their certificates. it runs from
+// publishRoutes so every way of changing routes is covered. app.Mu must be
+// held.
+func (app *App) noteRouteChanges() {
+	current := make(map[string]DomainRoute, len(app.Routes))
+	for domain, proxy := range app.Routes {
+		current[domain] = proxy.config(domain)
+	}
+	previous := app.published
+	app.published = current
+	if app.Groups != nil {
+		app.Groups.update(app.Routes)
+	}
+	if previous == nil {
+		// starting up, nothing has changed yet
+		return
+	}
+
+	for domain, route := range current {
+		old, existed := previous[domain]
+		switch {
+		case !existed:
+			emitEvent(eventRouteAdded, map[string]interface{}{"domain": domain, "route": route})
+			app.provisionCert(domain)
+		case !sameRoute(old, route):
+			emitEvent(eventRouteChanged, map[string]interface{}{"domain": domain, "route": route, "previous": old})
+		}
+	}
+	for domain, old := range previous {
+		if _, ok := current[domain]; !ok {
+			emitEvent(eventRouteRemoved, map[string]interface{}{"domain": domain, "previous": old})
+		}
+	}
+}
+
+// eventsWebSocket streams events on the admin api's /events as json, the
+// same ones webhooks get plus a stats.tick every second with each domain's
+// requests per second. ?types=route.*,backend.* narrows them down, and
+// tenant tokens only hear about their own routes.
+func (app *App) eventsWebSocket() http.Handler {
+	return websocket.Server{
+		// as for /logs/ws, the admin api decides who gets in
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			token := tokenFrom(ws.Request())
+			var types []string
+			if v := ws.Request().URL.Query().Get("types"); v != "" {
+				types = strings.Split(v, ",")
+			}
+			ch := make(chan event, 256)
+			stop := appEvents.subscribe(ch)
+			defer stop()
+
+			gone := make(chan struct{})
+			go func() {
+				defer close(gone)
+				var discard string
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+			}()
+
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			seen := app.requestCounts(token)
+			for {
+				select {
+				case e := <-ch:
+					if !eventMatches(types, e.Type) || !app.eventVisible(token, e) {
+						continue
+					}
+					if err := websocket.JSON.Send(ws, e); err != nil {
+						return
+					}
+				case <-ticker.C:
+					if !eventMatches(types, eventStatsTick) {
+						continue
+					}
+					counts := app.requestCounts(token)
+					perDomain := map[string]uint64{}
+					var total uint64
+					for domain, n := range counts {
+						if rate := n - seen[domain]; rate > 0 {
+							perDomain[domain] = rate
+							total += rate
+						}
+					}
+					seen = counts
+					tick := newEvent(eventStatsTick, map[string]interface{}{"requests_per_second": perDomain, "total": total})
+					if err := websocket.JSON.Send(ws, tick); err != nil {
+						return
+					}
+				case <-gone:
+					return
+				}
+			}
+		},
+	}
+}
+
+// requestCounts is the request counter of every domain token may see.
+func (app *App) requestCounts(token *adminToken) map[string]uint64 {
+	counts := map[string]uint64{}
+	for _, domain := range app.Stats.Domains() {
+		if app.ownsDomain(token, domain) {
+			counts[domain] = app.Stats.Route(domain).Requests.Load()
+		}
+	}
+	return counts
+}
+
+// eventVisible reports whether token may hear about e. route events carry
+// the route, which says whose it is even once it's gone, the rest go by
+// domain.
+func (app *App) eventVisible(token *adminToken, e event) bool {
+	if token.Tenant == "" {
+		return true
+	}
+	if route, ok := e.Data["route"].(DomainRoute); ok {
+		return route.Tenant == token.Tenant
+	}
+	if route, ok := e.Data["previous"].(DomainRoute); ok {
+		return route.Tenant == token.Tenant
+	}
+	domain, _ := e.Data["domain"].(string)
+	return app.ownsDomain(token, domain)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fastcgi record types, from the spec
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder  = 1
+	fcgiMaxContent = 65535
+)
+
+// fastcgiTransport sends requests to a fastcgi server like php-fpm, one
+// connection per request, and reads the cgi response back as http.
+type fastcgiTransport struct {
+	network, addr string
+	root          string
+	index         string
+	params        map[string]string
+	dialer        net.Dialer
+}
+
+// newFastCGITransport talks to addr, a host:port or unix:/path/to.sock,
+// running scripts out of opts.FastCGIRoot.
+func newFastCGITransport(addr string, opts RouteOptions, cfg transportConfig) (*fastcgiTransport, error) {
+	if opts.FastCGIRoot == "" {
+		return nil, errors.New("backend_protocol fastcgi needs a fastcgi_root")
+	}
+	root, err := filepath.Abs(opts.FastCGIRoot)
+	if err != nil {
+		return nil, err
+	}
+	t := &fastcgiTransport{network: "tcp", addr: addr, root: root, index: opts.FastCGIIndex, params: opts.FastCGIParams}
+	if socket, ok := strings.CutPrefix(addr, "unix:"); ok {
+		t.network, t.addr = "unix", socket
+	}
+	if t.index == "" {
+		t.index = "index.php"
+	}
+	t.dialer.Timeout = cfg.DialTimeout
+	return t, nil
+}
+
+// script splits a request path into the script to run and the path info
+// after it. paths without a script go to the index, the front controller
+// most php apps route everything through.
+func (t *fastcgiTransport) script(p string) (script, pathInfo string) {
+	lower := strings.ToLower(p)
+	for i := 0; ; {
+		j := strings.Index(lower[i:], ".php")
+		if j < 0 {
+			break
+		}
+		end := i + j + len(".php")
+		if end == len(p) || p[end] == '/' {
+			return p[:end], p[end:]
+		}
+		i = end
+	}
+	if strings.HasSuffix(p, "/") {
+		if _, err := os.Stat(filepath.Join(t.root, filepath.FromSlash(p), t.index)); err == nil {
+			return p + t.index, ""
+		}
+	}
+	return "/" + t.index, ""
+}
+
+// env builds the cgi environment for r.
+func (t *fastcgiTransport) env(r *http.Request) map[string]string {
+	p := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+		p += "/"
+	}
+	script, pathInfo := t.script(p)
+
+	env := cgiEnv(r)
+	env["DOCUMENT_ROOT"] = t.root
+	env["DOCUMENT_URI"] = script
+	env["SCRIPT_NAME"] = script
+	env["SCRIPT_FILENAME"] = filepath.Join(t.root, filepath.FromSlash(script))
+	env["PATH_INFO"] = pathInfo
+	if pathInfo != "" {
+		env["PATH_TRANSLATED"] = filepath.Join(t.root, filepath.FromSlash(pathInfo))
+	}
+	for name, value := range t.params {
+		env[name] = value
+	}
+	return env
+}
+
+// cgiEnv is the part of the cgi environment that's the same whatever runs
+// the request, fastcgi or uwsgi.
+func cgiEnv(r *http.Request) map[string]string {
+	host, port := r.Host, "80"
+	if r.TLS != nil {
+		port = "443"
+	}
+	if h, p, err := net.SplitHostPort(r.Host); err == nil {
+		host, port = h, p
+	}
+	remoteHost, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip := clientIP(r); ip != "" {
+		remoteHost = ip
+	}
+
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "appserve",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"REMOTE_ADDR":       remoteHost,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+	}
+	if r.ContentLength > 0 {
+		env["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if r.TLS != nil {
+		env["HTTPS"] = "on"
+	}
+	for name, values := range r.Header {
+		// Proxy is left out, apps would take it as HTTP_PROXY (httpoxy)
+		if name == "Proxy" || name == "Content-Type" || name == "Content-Length" {
+			continue
+		}
+		env["HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = strings.Join(values, ", ")
+	}
+	return env
+}
+
+func (t *fastcgiTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	conn, err := t.dialer.DialContext(r.Context(), t.network, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	stdout := &fcgiReader{conn: conn, r: bufio.NewReader(conn), addr: t.addr, done: make(chan struct{})}
+	// a cancelled request takes the connection with it
+	go func() {
+		select {
+		case <-r.Context().Done():
+			conn.Close()
+		case <-stdout.done:
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	writeRecord(w, fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0})
+	var params bytes.Buffer
+	for name, value := range t.env(r) {
+		writePairLength(&params, len(name))
+		writePairLength(&params, len(value))
+		params.WriteString(name)
+		params.WriteString(value)
+	}
+	writeStream(w, fcgiParams, params.Bytes())
+	writeRecord(w, fcgiParams, nil)
+	if err := w.Flush(); err != nil {
+		stdout.Close()
+		return nil, err
+	}
+
+	// the body goes while the response comes back, php can start
+	// answering before it's read everything
+	go func() {
+		sw := bufio.NewWriter(conn)
+		if r.Body != nil {
+			buf := make([]byte, fcgiMaxContent)
+			for {
+				n, err := r.Body.Read(buf)
+				if n > 0 {
+					writeRecord(sw, fcgiStdin, buf[:n])
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		writeRecord(sw, fcgiStdin, nil)
+		sw.Flush()
+	}()
+
+	br := bufio.NewReader(stdout)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		stdout.Close()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("fastcgi: %s sent no response", t.addr)
+		}
+		return nil, fmt.Errorf("fastcgi: %w", err)
+	}
+
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header(header),
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{br, stdout},
+		ContentLength: -1,
+		Request:       r,
+	}
+	if status := header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.Fields(status + " ")[0])
+		if err != nil || code < 100 || code > 999 {
+			stdout.Close()
+			return nil, fmt.Errorf("fastcgi: invalid Status %q", status)
+		}
+		resp.StatusCode, resp.Status = code, status
+		resp.Header.Del("Status")
+	} else if header.Get("Location") != "" {
+		resp.StatusCode, resp.Status = http.StatusFound, "302 Found"
+	}
+	if cl, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = cl
+	}
+	return resp, nil
+}
+
+// fcgiReader reads the stdout stream out of the records the server sends,
+// logging stderr, until the request ends.
+type fcgiReader struct {
+	conn net.Conn
+	r    *bufio.Reader
+	addr string
+
+	left    int // of the current stdout record
+	padding int
+	ended   bool
+	done    chan struct{} // closed with the reader
+	once    sync.Once
+}
+
+func (f *fcgiReader) Read(p []byte) (int, error) {
+	for f.left == 0 {
+		if f.ended {
+			return 0, io.EOF
+		}
+		if f.padding > 0 {
+			if _, err := f.r.Discard(f.padding); err != nil {
+				return 0, err
+			}
+			f.padding = 0
+		}
+		var h [8]byte
+		if _, err := io.ReadFull(f.r, h[:]); err != nil {
+			return 0, unexpected(err)
+		}
+		typ := h[1]
+		length := int(binary.BigEndian.Uint16(h[4:6]))
+		padding := int(h[6])
+		switch typ {
+		case fcgiStdout:
+			f.left, f.padding = length, padding
+		case fcgiStderr:
+			msg := make([]byte, length+padding)
+			if _, err := io.ReadFull(f.r, msg); err != nil {
+				return 0, unexpected(err)
+			}
+			logLimited("fastcgi", "FastCGI %s: %s", f.addr, strings.TrimSpace(string(msg[:length])))
+		case fcgiEndRequest:
+			f.ended = true
+			f.r.Discard(length + padding)
+		default:
+			f.r.Discard(length + padding)
+		}
+	}
+	if len(p) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= n
+	return n, unexpected(err)
+}
+
+func (f *fcgiReader) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+		f.conn.Close()
+	})
+	return nil
+}
+
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func writeRecord(w *bufio.Writer, typ byte, content []byte) {
+	padding := (8 - len(content)%8) % 8
+	h := [8]byte{1, typ, 0, 1}
+	binary.BigEndian.PutUint16(h[4:6], uint16(len(content)))
+	h[6] = byte(padding)
+	w.Write(h[:])
+	w.Write(content)
+	w.Write(make([]byte, padding))
+}
+
+// writeStream splits content over as many records as it takes.
+func writeStream(w *bufio.Writer, typ byte, content []byte) {
+	for len(content) > 0 {
+		n := len(content)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		writeRecord(w, typ, content[:n])
+		content = content[n:]
+	}
+}
+
+func writePairLength(b *bytes.Buffer, n int) {
+	if n < 128 {
+		b.WriteByte(byte(n))
+		return
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(n)|1<<31)
+	b.Write(l[:])
+}
+
+// fastcgiFiles serves files that exist under the root straight from disk,
+// so stylesheets and images don't go through php, and everything else to
+// the fastcgi server. scripts and dotfiles are never sent as they are.
+func fastcgiFiles(root string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		if !strings.HasSuffix(strings.ToLower(p), ".php") && !strings.Contains(p, "/.") {
+			file := filepath.Join(root, filepath.FromSlash(p))
+			if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+				http.ServeFile(w, r, file)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// maxHelloSize is as much of a connection as we'll hold on to looking for
+// the ClientHello, real ones are a few hundred bytes to a couple of KB.
+const maxHelloSize = 64 << 10
+
+// tlsFingerprint identifies the TLS library a client uses from the shape of
+// its ClientHello. the same bot tends to keep the same fingerprint however
+// many ips and user agents it goes through.
+type tlsFingerprint struct {
+	JA3 string // md5 of the ja3 string, the form blocklists use
+	JA4 string // e.g. t13d1516h2_8daaf6152771_e5627efa2ab1
+}
+
+// helloListener records the ClientHello of every connection on the way
+// through to crypto/tls.
+type helloListener struct {
+	net.Listener
+	logFingerprints bool
+}
+
+func (l *helloListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &helloConn{Conn: c, log: l.logFingerprints}, nil
+}
+
+// helloConn keeps a copy of what it reads until it has the whole
+// ClientHello, then stops.
+type helloConn struct {
+	net.Conn
+	log  bool
+	buf  []byte
+	done bool
+
+	fingerprint atomic.Pointer[tlsFingerprint]
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.done && n > 0 {
+		c.buf = append(c.buf, b[:n]...)
+		c.parse()
+	}
+	return n, err
+}
+
+func (c *helloConn) parse() {
+	hello, complete := handshakeMessage(c.buf)
+	if !complete {
+		if len(c.buf) > maxHelloSize {
+			c.done, c.buf = true, nil
+		}
+		return
+	}
+	c.done, c.buf = true, nil
+	if hello == nil {
+		return
+	}
+	fp, ok := fingerprintHello(hello)
+	if !ok {
+		return
+	}
+	c.fingerprint.Store(fp)
+	if c.log {
+		log.Printf("TLS fingerprint: %s ja3=%s ja4=%s", c.RemoteAddr(), fp.JA3, fp.JA4)
+	}
+}
+
+// handshakeMessage pulls the first handshake message out of the records at
+// the start of a connection, which may be split across several. it reports
+// false while more data is needed and a nil message for a connection that
+// isn't TLS.
+func handshakeMessage(data []byte) ([]byte, bool) {
+	var hs []byte
+	for len(data) >= 5 {
+		if data[0] != 22 { // handshake
+			return nil, true
+		}
+		n := int(data[3])<<8 | int(data[4])
+		if len(data) < 5+n {
+			break
+		}
+		hs = append(hs, data[5:5+n]...)
+		data = data[5+n:]
+
+		if len(hs) >= 4 {
+			if hs[0] != 1 { // client_hello
+				return nil, true
+			}
+			size := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+			if len(hs) >= 4+size {
+				return hs[4 : 4+size], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// isGREASE reports whether a value is one of the reserved ones clients send
+// at random to keep servers honest, fingerprints leave them out.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// fingerprintHello works out the ja3 and ja4 fingerprints of a
+// ClientHello body.
+func fingerprintHello(body []byte) (*tlsFingerprint, bool) {
+	s := cryptobyte.String(body)
+	var version uint16
+	var random, sessionID, suites, compression cryptobyte.String
+	if !s.ReadUint16(&version) || !s.ReadBytes((*[]byte)(&random), 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || !s.ReadUint16LengthPrefixed(&suites) ||
+		!s.ReadUint8LengthPrefixed(&compression) {
+		return nil, false
+	}
+
+	var ciphers []uint16
+	for !suites.Empty() {
+		var c uint16
+		if !suites.ReadUint16(&c) {
+			return nil, false
+		}
+		if !isGREASE(c) {
+			ciphers = append(ciphers, c)
+		}
+	}
+
+	var extensions, groups, sigAlgs, versions []uint16
+	var points []uint8
+	var alpn string
+	sni := false
+
+	var exts cryptobyte.String
+	if !s.Empty() && !s.ReadUint16LengthPrefixed(&exts) {
+		return nil, false
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			return nil, false
+		}
+		if isGREASE(typ) {
+			continue
+		}
+		extensions = append(extensions, typ)
+
+		switch typ {
+		case 0: // server_name
+			sni = true
+		case 10: // supported_groups
+			groups = readUint16List(data, true)
+		case 11: // ec_point_formats
+			var list cryptobyte.String
+			if data.ReadUint8LengthPrefixed(&list) {
+				points = append(points, list...)
+			}
+		case 13: // signature_algorithms
+			sigAlgs = readUint16List(data, true)
+		case 16: // application_layer_protocol_negotiation
+			var list, proto cryptobyte.String
+			if data.ReadUint16LengthPrefixed(&list) && list.ReadUint8LengthPrefixed(&proto) {
+				alpn = string(proto)
+			}
+		case 43: // supported_versions
+			var list cryptobyte.String
+			if data.ReadUint8LengthPrefixed(&list) {
+				versions = readUint16List(list, false)
+			}
+		}
+	}
+
+	// ja3: version,ciphers,extensions,groups,point formats in decimal,
+	// hashed
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinUint16(ciphers, "-", false),
+		joinUint16(extensions, "-", false),
+		joinUint16(groups, "-", false),
+		joinUint8(points, "-"),
+	}, ",")
+	ja3Sum := md5.Sum([]byte(ja3))
+
+	// ja4: a readable prefix, then hashes of the sorted ciphers and of the
+	// sorted extensions with the signature algorithms in their own order
+	best := version
+	for _, v := range versions {
+		if v > best {
+			best = v
+		}
+	}
+	sniFlag := "i"
+	if sni {
+		sniFlag = "d"
+	}
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(best), sniFlag, cap99(len(ciphers)), cap99(len(extensions)), ja4ALPN(alpn))
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+
+	var sortedExts []uint16
+	for _, e := range extensions {
+		if e != 0 && e != 16 {
+			sortedExts = append(sortedExts, e)
+		}
+	}
+	sort.Slice(sortedExts, func(i, j int) bool { return sortedExts[i] < sortedExts[j] })
+	extString := joinUint16(sortedExts, ",", true)
+	if len(sigAlgs) > 0 {
+		extString += "_" + joinUint16(sigAlgs, ",", true)
+	}
+
+	return &tlsFingerprint{
+		JA3: hex.EncodeToString(ja3Sum[:]),
+		JA4: prefix + "_" + ja4Hash(joinUint16(sortedCiphers, ",", true), len(sortedCiphers)) + "_" + ja4Hash(extString, len(sortedExts)),
+	}, true
+}
+
+func readUint16List(data cryptobyte.String, lengthPrefixed bool) []uint16 {
+	if lengthPrefixed {
+		var list cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return nil
+		}
+		data = list
+	}
+	var values []uint16
+	for !data.Empty() {
+		var v uint16
+		if !data.ReadUint16(&v) {
+			return values
+		}
+		if !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func joinUint16(values []uint16, sep string, hexFormat bool) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		if hexFormat {
+			parts[i] = fmt.Sprintf("%04x", v)
+		} else {
+			parts[i] = strconv.Itoa(int(v))
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+func joinUint8(values []uint8, sep string) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, sep)
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// ja4ALPN is the first and last character of the first ALPN protocol, or
+// of its hex when those aren't plain letters and digits.
+func ja4ALPN(alpn string) string {
+	if alpn == "" {
+		return "00"
+	}
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if !isAlnum(first) || !isAlnum(last) {
+		h := hex.EncodeToString([]byte(alpn))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func cap99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func ja4Hash(s string, n int) string {
+	if n == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// fingerprintOf returns the TLS fingerprint of the connection a request came
+// in on, nil for plain http or a hello we couldn't make sense of.
+func fingerprintOf(r *http.Request) *tlsFingerprint {
+	ci := connInfoFrom(r.Context())
+	if ci == nil || ci.hello == nil {
+		return nil
+	}
+	return ci.hello.fingerprint.Load()
+}
+
+// fingerprintBlocked reports whether a fingerprint is on the global
+// blocklist or the route's.
+func (app *App) fingerprintBlocked(fp *tlsFingerprint, route *Proxy) bool {
+	if app.BlockedFingerprints[fp.JA3] || app.BlockedFingerprints[fp.JA4] {
+		return true
+	}
+	if route != nil {
+		for _, blocked := range route.BlockTLSFingerprints {
+			if blocked == fp.JA3 || blocked == fp.JA4 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadFingerprints reads a blocklist file, one ja3 hash or ja4 fingerprint
+// a line, # for comments.
+func loadFingerprints(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	blocked := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			blocked[line] = true
+		}
+	}
+	return blocked, scanner.Err()
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fleetNode is a remote appserve managed through its admin api, from the
+// fleet file:
+//
+//	[{"name": "edge1", "url": "http://10.0.0.1:2019", "token": "appserve_..."},
+//	 {"name": "edge2", "url": "https://10.0.0.2:2019", "ca": "ca.pem", "cert": "me.pem", "key": "me-key.pem"}]
+type fleetNode struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"`
+
+	// CA, Cert and Key are for nodes running -admin-auth mtls.
+	CA   string `json:"ca,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	client *http.Client
+}
+
+func loadFleet(file string) ([]*fleetNode, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*fleetNode
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for _, node := range nodes {
+		if node.Name == "" {
+			node.Name = node.URL
+		}
+		if u, err := url.Parse(node.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: node %s has to have an http:// or https:// url", file, node.Name)
+		}
+		node.URL = strings.TrimSuffix(node.URL, "/")
+		if node.client, err = node.newClient(); err != nil {
+			return nil, fmt.Errorf("%s: node %s: %w", file, node.Name, err)
+		}
+	}
+	return nodes, nil
+}
+
+func (n *fleetNode) newClient() (*http.Client, error) {
+	config := &tls.Config{}
+	if n.CA != "" {
+		pem, err := os.ReadFile(n.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", n.CA)
+		}
+	}
+	if n.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(n.Cert, n.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: config},
+	}, nil
+}
+
+// call makes an admin api request of the node, decoding a json answer into
+// out when it isn't nil.
+func (n *fleetNode) call(method, path string, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(context.Background(), method, n.URL+path, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if n.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+n.Token)
+		}
+		if resp, err = n.client.Do(req); err != nil {
+			return err
+		}
+		// applying a big routes file runs into the node's -admin-rate
+		if resp.StatusCode != http.StatusTooManyRequests || attempt == 10 {
+			break
+		}
+		resp.Body.Close()
+		time.Sleep(time.Second)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+		}
+		return errors.New(resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// onFleet runs do against every node at once and reports how each one went,
+// in fleet file order. it returns how many failed.
+func onFleet(nodes []*fleetNode, do func(*fleetNode) (string, error)) int {
+	type result struct {
+		msg string
+		err error
+	}
+	results := make([]result, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *fleetNode) {
+			defer wg.Done()
+			msg, err := do(node)
+			results[i] = result{msg, err}
+		}(i, node)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Printf("%s: Error: %v\n", nodes[i].Name, r.err)
+			continue
+		}
+		fmt.Printf("%s: %s\n", nodes[i].Name, r.msg)
+	}
+	return failed
+}
+
+// runFleet applies the same route changes to every node in the fleet file,
+// `appserve fleet add example.com 3000`.
+func runFleet(args []string) {
+	fs := flag.NewFlagSet("fleet", flag.ExitOnError)
+	file := fs.String("fleet", "fleet.json", "path to the fleet file listing the nodes and how to reach their admin api")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appserve fleet [-fleet file] status | add <domain> <port> | remove <domain> | apply <routes file> | push <routes file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	nodes, err := loadFleet(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(nodes) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No nodes in %s.\n", *file)
+		os.Exit(1)
+	}
+
+	var failed int
+	switch {
+	case fs.NArg() == 1 && fs.Arg(0) == "status":
+		failed = onFleet(nodes, func(n *fleetNode) (string, error) {
+			var routes []DomainRoute
+			if err := n.call(http.MethodGet, "/routes", nil, &routes); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("ok, %d routes", len(routes)), nil
+		})
+
+	case fs.NArg() == 3 && fs.Arg(0) == "add":
+		domain := NormalizeDomain(fs.Arg(1))
+		route := DomainRoute{Domain: domain, Port: fs.Arg(2)}
+		failed = onFleet(nodes, func(n *fleetNode) (string, error) {
+			return "added " + domain, n.call(http.MethodPut, "/routes/"+domain, route, nil)
+		})
+
+	case fs.NArg() == 2 && fs.Arg(0) == "remove":
+		domain := NormalizeDomain(fs.Arg(1))
+		failed = onFleet(nodes, func(n *fleetNode) (string, error) {
+			return "removed " + domain, n.call(http.MethodDelete, "/routes/"+domain, nil, nil)
+		})
+
+	case fs.NArg() == 2 && fs.Arg(0) == "push":
+		// the whole file replaces every route, with its signature for nodes
+		// running -routes-pubkey
+		data, err := os.ReadFile(fs.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		sig, err := os.ReadFile(fs.Arg(1) + ".minisig")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		bundle := map[string]string{"routes": string(data), "signature": string(sig)}
+		failed = onFleet(nodes, func(n *fleetNode) (string, error) {
+			var changes map[string]int
+			if err := n.call(http.MethodPut, "/routes", bundle, &changes); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("pushed, %d added, %d changed, %d removed, %d unchanged",
+				changes["added"], changes["changed"], changes["removed"], changes["unchanged"]), nil
+		})
+
+	case fs.NArg() == 2 && fs.Arg(0) == "apply":
+		// every route in the file is added or replaced, routes the nodes have
+		// that aren't in it are left alone
+		routes, err := readRoutes(fs.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		failed = onFleet(nodes, func(n *fleetNode) (string, error) {
+			for i, route := range routes {
+				if err := n.call(http.MethodPut, "/routes/"+route.Domain, route, nil); err != nil {
+					return "", fmt.Errorf("%s, after applying %d of %d routes: %w", route.Domain, i, len(routes), err)
+				}
+			}
+			return fmt.Sprintf("applied %d routes", len(routes)), nil
+		})
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d nodes failed.\n", failed, len(nodes))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Forward is an entry in the forwards file: a whole port passed through to
+// somewhere else, for services that don't speak http.
+type Forward struct {
+	// Listen is the port, or address and port, to accept connections on.
+	Listen string `json:"listen"`
+
+	// Target is where connections go, a local port or host:port. with SNI
+	// it's where connections that match none of the names go, or empty to
+	// hang up on them.
+	Target string `json:"target,omitempty"`
+
+	// TLS terminates tls with a certificate for this name before passing
+	// the plain connection on, the certificate is issued like a route's.
+	TLS string `json:"tls,omitempty"`
+
+	// SNI sends tls connections to a target by the name in their
+	// ClientHello, so one port can serve many domains' daemons. names can
+	// be *.wildcards. the tls goes through untouched unless Terminate.
+	SNI map[string]string `json:"sni,omitempty"`
+
+	// Terminate has appserve terminate tls for the SNI names with their
+	// own certificates and pass the plain connection on.
+	Terminate bool `json:"terminate,omitempty"`
+
+	// ProxyProtocol starts each connection to the target with a PROXY
+	// protocol header, "v1" or "v2", so it knows who the client is.
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+
+	// Protocol is tcp, the default, or udp to relay datagrams.
+	Protocol string `json:"protocol,omitempty"`
+
+	// IdleTimeout is how long a udp client can go without sending or
+	// getting a packet before its session with the target is dropped, 1m
+	// by default.
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+}
+
+// key tells forwards apart, tcp and udp can share a port.
+func (f Forward) key() string {
+	if f.Protocol == "udp" {
+		return "udp " + f.Listen
+	}
+	return f.Listen
+}
+
+// runningForward is a forward that's listening, with its counters.
+type runningForward struct {
+	Forward
+	ln net.Listener   // tcp
+	pc net.PacketConn // udp
+
+	// terminates tls for sni forwards that ask
+	sniTLS *tls.Config
+
+	conns    atomic.Int64 // connections, or udp sessions
+	active   atomic.Int64
+	bytesIn  atomic.Int64 // from clients to the target
+	bytesOut atomic.Int64
+
+	// udp only
+	idle       time.Duration
+	packetsIn  atomic.Int64
+	packetsOut atomic.Int64
+	sessionsMu sync.Mutex
+	sessions   map[string]*udpSession
+}
+
+// close stops listening, tcp connections already going carry on.
+func (rf *runningForward) close() {
+	if rf.pc != nil {
+		rf.pc.Close()
+		return
+	}
+	rf.ln.Close()
+}
+
+// forwardSet holds the forwards that are running, by listen address.
+type forwardSet struct {
+	file string
+
+	mu      sync.Mutex
+	running map[string]*runningForward
+}
+
+// normalizeListen makes a bare port listen on every address.
+func normalizeListen(listen string) string {
+	if !strings.Contains(listen, ":") {
+		return ":" + listen
+	}
+	return listen
+}
+
+// loadForwards reads the forwards file, none when it doesn't exist.
+func loadForwards(file string) ([]Forward, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var forwards []Forward
+	if err := json.Unmarshal(data, &forwards); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return forwards, nil
+}
+
+// save writes the running forwards back to the file.
+func (fs *forwardSet) save() error {
+	if fs.file == "" {
+		return nil
+	}
+	forwards := make([]Forward, 0, len(fs.running))
+	for _, f := range fs.running {
+		forwards = append(forwards, f.Forward)
+	}
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].Listen < forwards[j].Listen })
+	data, err := json.MarshalIndent(forwards, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs.file, append(data, '\n'))
+}
+
+// hasTLSName reports whether a forward terminates tls for name, so it can
+// have a certificate.
+func (fs *forwardSet) hasTLSName(name string) bool {
+	if fs == nil {
+		return false
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, f := range fs.running {
+		if f.TLS == name {
+			return true
+		}
+		if _, ok := f.sniMatch(name); ok && f.Terminate {
+			return true
+		}
+	}
+	return false
+}
+
+// start listens for a forward and passes its connections on, replacing any
+// forward already on the same address.
+func (app *App) startForward(f Forward) error {
+	f.Listen = normalizeListen(f.Listen)
+	switch f.Protocol {
+	case "", "udp":
+	case "tcp":
+		f.Protocol = ""
+	default:
+		return fmt.Errorf("%s: protocol has to be tcp or udp", f.Listen)
+	}
+	var err error
+	if f.ProxyProtocol, err = parseProxyProtocolVersion(f.ProxyProtocol); err != nil {
+		return fmt.Errorf("%s: proxy_protocol: %w", f.Listen, err)
+	}
+	if f.Protocol == "udp" {
+		if f.TLS != "" || len(f.SNI) > 0 {
+			return fmt.Errorf("%s: udp has no tls to terminate or route by name", f.Listen)
+		}
+		if f.ProxyProtocol != "" {
+			return fmt.Errorf("%s: the PROXY protocol is only sent over tcp", f.Listen)
+		}
+		return app.startUDPForward(f)
+	}
+	if len(f.SNI) > 0 {
+		switch {
+		case f.TLS != "":
+			return fmt.Errorf("%s: use terminate to terminate tls on an sni forward", f.Listen)
+		case f.Terminate && f.Target != "":
+			return fmt.Errorf("%s: a terminating sni forward can only go by name, there's no certificate for connections that don't match", f.Listen)
+		}
+		names := make(map[string]string, len(f.SNI))
+		for name, target := range f.SNI {
+			if name = NormalizeDomain(name); name == "" || target == "" {
+				return fmt.Errorf("%s: every sni name needs a target", f.Listen)
+			}
+			names[name] = target
+		}
+		f.SNI = names
+	} else if f.Target == "" {
+		return fmt.Errorf("%s: a forward needs a target", f.Listen)
+	} else if f.Terminate {
+		return fmt.Errorf("%s: terminate only goes with sni, use tls for a single name", f.Listen)
+	}
+	if f.TLS != "" {
+		f.TLS = NormalizeDomain(f.TLS)
+	}
+	if (f.TLS != "" || f.Terminate) && app.Certs == nil {
+		return fmt.Errorf("%s: tls needs certificates, which dev mode doesn't get", f.Listen)
+	}
+
+	fs := app.Forwards
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// the old one has to let go of the port first
+	old := fs.running[f.key()]
+	if old != nil {
+		old.close()
+	}
+	ln, err := net.Listen(app.network("tcp"), f.Listen)
+	if err != nil {
+		if old != nil {
+			delete(fs.running, f.key())
+			return fmt.Errorf("%w, the forward to %s that was there has stopped", err, old.Target)
+		}
+		return err
+	}
+	if f.TLS != "" {
+		name := f.TLS
+		ln = tls.NewListener(ln, &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				// clients that connect by ip send no name
+				if hello.ServerName == "" {
+					hello.ServerName = name
+				}
+				return app.Certs.GetCertificate(hello)
+			},
+		})
+	}
+	rf := &runningForward{Forward: f, ln: ln}
+	if f.Terminate {
+		rf.sniTLS = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: app.Certs.GetCertificate,
+		}
+	}
+	if fs.running == nil {
+		fs.running = make(map[string]*runningForward)
+	}
+	fs.running[f.key()] = rf
+	go app.acceptForward(rf)
+	return nil
+}
+
+// stopForward stops the forward with key, connections already going carry
+// on.
+func (app *App) stopForward(key string) bool {
+	fs := app.Forwards
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	rf, ok := fs.running[key]
+	if ok {
+		rf.close()
+		delete(fs.running, key)
+	}
+	return ok
+}
+
+func (app *App) acceptForward(rf *runningForward) {
+	if len(rf.SNI) > 0 {
+		log.Printf("Forwarding %s by server name: %s", rf.Listen, rf.sniNames())
+	} else {
+		log.Printf("Forwarding %s to %s", rf.Listen, backendAddr(rf.Target))
+	}
+	for {
+		conn, err := rf.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error accepting on %s: %v", rf.Listen, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go rf.serve(conn)
+	}
+}
+
+// serve passes one connection through, closing each direction as its end
+// finishes so protocols that half close still work.
+func (rf *runningForward) serve(client net.Conn) {
+	defer client.Close()
+	rf.conns.Add(1)
+	rf.active.Add(1)
+	defer rf.active.Add(-1)
+
+	if tc, ok := client.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tc.Handshake(); err != nil {
+			logLimited("forward", "TLS handshake from %s on %s failed: %v", client.RemoteAddr(), rf.Listen, err)
+			return
+		}
+		tc.SetDeadline(time.Time{})
+	}
+
+	to := rf.Target
+	var hello []byte
+	if len(rf.SNI) > 0 {
+		name, data, err := readClientHello(client)
+		if err != nil {
+			logLimited("forward", "No ClientHello from %s on %s: %v", client.RemoteAddr(), rf.Listen, err)
+			return
+		}
+		if to = rf.sniTarget(name); to == "" {
+			logLimited("forward", "No sni forward on %s for %q from %s", rf.Listen, name, client.RemoteAddr())
+			return
+		}
+		hello = data
+		if rf.sniTLS != nil {
+			tc := tls.Server(&replayConn{Conn: client, data: hello}, rf.sniTLS)
+			tc.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := tc.Handshake(); err != nil {
+				logLimited("forward", "TLS handshake from %s on %s failed: %v", client.RemoteAddr(), rf.Listen, err)
+				return
+			}
+			tc.SetDeadline(time.Time{})
+			client, hello = tc, nil
+		}
+	}
+
+	target, err := net.DialTimeout("tcp", backendAddr(to), 10*time.Second)
+	if err != nil {
+		logLimited("forward", "Error connecting to %s for %s: %v", to, rf.Listen, err)
+		return
+	}
+	defer target.Close()
+	if rf.ProxyProtocol != "" {
+		if _, err := target.Write(proxyHeader(rf.ProxyProtocol, client.RemoteAddr(), client.LocalAddr())); err != nil {
+			return
+		}
+	}
+	// what was read looking for the name goes first
+	if _, err := target.Write(hello); err != nil {
+		return
+	}
+	rf.bytesIn.Add(int64(len(hello)))
+
+	done := make(chan struct{})
+	go func() {
+		n, _ := io.Copy(target, client)
+		rf.bytesIn.Add(n)
+		closeWrite(target)
+		close(done)
+	}()
+	n, _ := io.Copy(client, target)
+	rf.bytesOut.Add(n)
+	closeWrite(client)
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// handleForwardCommand adds, removes or lists forwards:
+//
+//	forward add 5432 15432
+//	forward add 6379 10.0.0.5:6379 --tls redis.example.com
+//	forward add 27015 10.0.0.7:27015 --udp --idle 5m
+//	forward add 993 --sni mail.a.com=10.0.0.2:993 --sni mail.b.com=1993
+//	forward remove 5432
+//	forward
+func (app *App) handleForwardCommand(args []string) {
+	if len(args) == 0 {
+		app.Forwards.mu.Lock()
+		defer app.Forwards.mu.Unlock()
+		if len(app.Forwards.running) == 0 {
+			fmt.Println("No forwards.")
+		}
+		keys := make([]string, 0, len(app.Forwards.running))
+		for key := range app.Forwards.running {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			rf := app.Forwards.running[key]
+			if rf.Protocol == "udp" {
+				fmt.Printf("Forward: udp %s -> %s, Sessions: %d (%d open), In: %d packets %d bytes, Out: %d packets %d bytes\n",
+					rf.Listen, backendAddr(rf.Target), rf.conns.Load(), rf.active.Load(),
+					rf.packetsIn.Load(), rf.bytesIn.Load(), rf.packetsOut.Load(), rf.bytesOut.Load())
+				continue
+			}
+			to := backendAddr(rf.Target)
+			if len(rf.SNI) > 0 {
+				to = "by name (" + rf.sniNames()
+				if rf.Target != "" {
+					to += ", anything else -> " + backendAddr(rf.Target)
+				}
+				to += ")"
+			}
+			tlsInfo := ""
+			if rf.TLS != "" {
+				tlsInfo = ", TLS: " + rf.TLS
+			} else if rf.Terminate {
+				tlsInfo = ", TLS: terminated"
+			}
+			if rf.ProxyProtocol != "" {
+				tlsInfo += ", PROXY " + rf.ProxyProtocol
+			}
+			fmt.Printf("Forward: %s -> %s%s, Connections: %d (%d open), In: %d bytes, Out: %d bytes\n",
+				rf.Listen, to, tlsInfo, rf.conns.Load(), rf.active.Load(), rf.bytesIn.Load(), rf.bytesOut.Load())
+		}
+		return
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("forward", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		tlsName := fs.String("tls", "", "")
+		udp := fs.Bool("udp", false, "")
+		idle := fs.String("idle", "", "")
+		terminate := fs.Bool("terminate", false, "")
+		proxyProtocol := fs.String("proxy-protocol", "", "")
+		sni := map[string]string{}
+		fs.Func("sni", "", func(v string) error {
+			name, target, ok := strings.Cut(v, "=")
+			if !ok {
+				return errors.New("expected name=target")
+			}
+			sni[name] = target
+			return nil
+		})
+		if len(args) < 2 {
+			args = append(args, "")
+		}
+		// the target is optional when going by name
+		rest, target := args[2:], ""
+		if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+			rest, target = rest[1:], rest[0]
+		}
+		if args[1] == "" || fs.Parse(rest) != nil || fs.NArg() > 0 || (target == "" && len(sni) == 0) {
+			fmt.Println("Error: Expected: forward add <listen port> <target port or host:port> [--tls domain] [--udp [--idle DURATION]] [--proxy-protocol v1|v2] or forward add <listen port> [other target] --sni name=target... [--terminate]")
+			return
+		}
+		f := Forward{Listen: args[1], Target: target, TLS: *tlsName, IdleTimeout: *idle, Terminate: *terminate, ProxyProtocol: *proxyProtocol}
+		if len(sni) > 0 {
+			f.SNI = sni
+		}
+		if *udp {
+			f.Protocol = "udp"
+		}
+		if err := app.startForward(f); err != nil {
+			fmt.Printf("Error adding forward: %v\n", err)
+			return
+		}
+		f.Listen = normalizeListen(f.Listen)
+		if len(f.SNI) > 0 {
+			fmt.Printf("Added forward from %s by server name: %s\n", f.key(), f.sniNames())
+		} else {
+			fmt.Printf("Added forward from %s to %s\n", f.key(), backendAddr(f.Target))
+		}
+	case "remove":
+		fs := flag.NewFlagSet("forward", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		udp := fs.Bool("udp", false, "")
+		if len(args) < 2 || fs.Parse(args[2:]) != nil || fs.NArg() > 0 {
+			fmt.Println("Error: Expected: forward remove <listen port> [--udp]")
+			return
+		}
+		f := Forward{Listen: normalizeListen(args[1])}
+		if *udp {
+			f.Protocol = "udp"
+		}
+		if !app.stopForward(f.key()) {
+			fmt.Printf("Error: No forward on %s.\n", f.key())
+			return
+		}
+		fmt.Printf("Removed the forward on %s\n", f.key())
+	default:
+		fmt.Println("Error: Expected: forward add <listen> <target> [--tls domain] [--udp] [--sni name=target], forward remove <listen> [--udp] or forward")
+		return
+	}
+
+	app.Forwards.mu.Lock()
+	defer app.Forwards.mu.Unlock()
+	if err := app.Forwards.save(); err != nil {
+		log.Println("Failed to save forwards:", err)
+		fmt.Printf("Error: %v\n", err)
+	}
+}
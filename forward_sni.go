@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// sniTarget picks where a connection goes from the name in its
+// ClientHello, the forward's target when no name matches (which can be
+// empty, to hang up).
+func (rf *runningForward) sniTarget(name string) string {
+	if target, ok := rf.sniMatch(name); ok {
+		return target
+	}
+	return rf.Target
+}
+
+// sniMatch finds name in the forward's sni names, an exact match first,
+// then the closest *.wildcard.
+func (rf *runningForward) sniMatch(name string) (string, bool) {
+	name = NormalizeDomain(name)
+	if name == "" || len(rf.SNI) == 0 {
+		return "", false
+	}
+	if target, ok := rf.SNI[name]; ok {
+		return target, true
+	}
+	for rest := name; ; {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			return "", false
+		}
+		rest = rest[i+1:]
+		if target, ok := rf.SNI["*."+rest]; ok {
+			return target, true
+		}
+	}
+}
+
+// sniNames lists the names a forward routes, for showing.
+func (f Forward) sniNames() string {
+	names := make([]string, 0, len(f.SNI))
+	for name, target := range f.SNI {
+		names = append(names, name+" -> "+backendAddr(target))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// readClientHello reads from conn until it has the ClientHello and gives
+// back the name asked for along with every byte read, which still has to
+// go to whoever handles the tls.
+func readClientHello(conn net.Conn) (string, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var data []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		data = append(data, buf[:n]...)
+		hello, complete := handshakeMessage(data)
+		if complete {
+			if hello == nil {
+				return "", data, errors.New("not a tls connection")
+			}
+			return helloServerName(hello), data, nil
+		}
+		if err != nil {
+			return "", data, err
+		}
+		if len(data) > maxHelloSize {
+			return "", data, errors.New("no ClientHello in the first 64KB")
+		}
+	}
+}
+
+// helloServerName pulls the server_name extension out of a ClientHello
+// body, empty when the client didn't send one.
+func helloServerName(body []byte) string {
+	s := cryptobyte.String(body)
+	var version uint16
+	var random, sessionID, suites, compression, exts cryptobyte.String
+	if !s.ReadUint16(&version) || !s.ReadBytes((*[]byte)(&random), 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || !s.ReadUint16LengthPrefixed(&suites) ||
+		!s.ReadUint8LengthPrefixed(&compression) || !s.ReadUint16LengthPrefixed(&exts) {
+		return ""
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			return ""
+		}
+		if typ != 0 { // server_name
+			continue
+		}
+		var list cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return ""
+		}
+		for !list.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !list.ReadUint8(&nameType) || !list.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return string(name)
+			}
+		}
+	}
+	return ""
+}
+
+// replayConn hands back bytes already read off the connection before
+// reading any more, so crypto/tls gets the ClientHello we peeked at.
+type replayConn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.data) > 0 {
+		n := copy(b, c.data)
+		c.data = c.data[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// defaultUDPIdle is how long a udp session lasts without packets when the
+// forward doesn't say.
+const defaultUDPIdle = time.Minute
+
+// udpSession is one client's traffic through a udp forward. each client
+// gets its own socket to the target, so replies can be told apart.
+type udpSession struct {
+	client   net.Addr
+	upstream net.Conn
+	last     atomic.Int64 // unix nanoseconds of the latest packet either way
+}
+
+func (app *App) startUDPForward(f Forward) error {
+	idle := defaultUDPIdle
+	if f.IdleTimeout != "" {
+		d, err := time.ParseDuration(f.IdleTimeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%s: invalid idle_timeout %q", f.Listen, f.IdleTimeout)
+		}
+		idle = d
+	}
+
+	fs := app.Forwards
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	old := fs.running[f.key()]
+	if old != nil {
+		old.close()
+	}
+	pc, err := net.ListenPacket(app.network("udp"), f.Listen)
+	if err != nil {
+		if old != nil {
+			delete(fs.running, f.key())
+			return fmt.Errorf("%w, the forward to %s that was there has stopped", err, old.Target)
+		}
+		return err
+	}
+	rf := &runningForward{Forward: f, pc: pc, idle: idle, sessions: map[string]*udpSession{}}
+	if fs.running == nil {
+		fs.running = make(map[string]*runningForward)
+	}
+	fs.running[f.key()] = rf
+	go rf.relayUDP()
+	return nil
+}
+
+// relayUDP passes packets from clients to the target until the forward is
+// removed, which ends every session.
+func (rf *runningForward) relayUDP() {
+	log.Printf("Forwarding udp %s to %s", rf.Listen, backendAddr(rf.Target))
+	done := make(chan struct{})
+	defer close(done)
+	go rf.expireSessions(done)
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := rf.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				rf.sessionsMu.Lock()
+				for key, s := range rf.sessions {
+					s.upstream.Close()
+					delete(rf.sessions, key)
+				}
+				rf.sessionsMu.Unlock()
+				return
+			}
+			log.Printf("Error reading on udp %s: %v", rf.Listen, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s, err := rf.session(addr)
+		if err != nil {
+			logLimited("forward", "Error connecting to udp %s for %s: %v", rf.Target, rf.Listen, err)
+			continue
+		}
+		s.last.Store(time.Now().UnixNano())
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			continue
+		}
+		rf.packetsIn.Add(1)
+		rf.bytesIn.Add(int64(n))
+	}
+}
+
+// session finds the client's session, or opens one.
+func (rf *runningForward) session(client net.Addr) (*udpSession, error) {
+	key := client.String()
+	rf.sessionsMu.Lock()
+	defer rf.sessionsMu.Unlock()
+	if s, ok := rf.sessions[key]; ok {
+		return s, nil
+	}
+	upstream, err := net.Dial("udp", backendAddr(rf.Target))
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSession{client: client, upstream: upstream}
+	rf.sessions[key] = s
+	rf.conns.Add(1)
+	rf.active.Add(1)
+	go rf.replies(s)
+	return s, nil
+}
+
+// replies sends what the target answers back to the client, until the
+// session is closed.
+func (rf *runningForward) replies(s *udpSession) {
+	defer rf.active.Add(-1)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			// an icmp unreachable from the target shows up as a read
+			// error, the session stays until it goes idle
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.last.Store(time.Now().UnixNano())
+		if _, err := rf.pc.WriteTo(buf[:n], s.client); err != nil {
+			continue
+		}
+		rf.packetsOut.Add(1)
+		rf.bytesOut.Add(int64(n))
+	}
+}
+
+// expireSessions drops sessions that have gone quiet, udp has no close to
+// tell us a client has gone.
+func (rf *runningForward) expireSessions(done chan struct{}) {
+	every := rf.idle / 2
+	if every < time.Second {
+		every = time.Second
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			rf.sessionsMu.Lock()
+			for key, s := range rf.sessions {
+				if now.Sub(time.Unix(0, s.last.Load())) > rf.idle {
+					s.upstream.Close()
+					delete(rf.sessions, key)
+				}
+			}
+			rf.sessionsMu.Unlock()
+		}
+	}
+}
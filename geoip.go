@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// maxTrackedASNs bounds how many networks a route keeps counts for, the
+// long tail past it is counted together.
+const maxTrackedASNs = 1000
+
+// geoDB looks up where client ips are, from maxmind format databases like
+// GeoLite2-Country and GeoLite2-ASN, or one that has both.
+type geoDB struct {
+	readers []*maxminddb.Reader
+}
+
+// geoInfo is what we know about where a client is.
+type geoInfo struct {
+	Country string // iso code, e.g. NL
+	ASN     uint
+	ASOrg   string
+}
+
+// geoRecord covers the fields we want from the country, city and asn
+// databases, whichever ones they turn out to be.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+func openGeoDB(files ...string) (*geoDB, error) {
+	db := &geoDB{}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		r, err := maxminddb.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// lookup finds what the databases know about ip, the zero geoInfo if
+// they've never heard of it.
+func (db *geoDB) lookup(ip string) geoInfo {
+	var info geoInfo
+	addr := net.ParseIP(ip)
+	if db == nil || addr == nil {
+		return info
+	}
+	for _, r := range db.readers {
+		var rec geoRecord
+		if err := r.Lookup(addr, &rec); err != nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = rec.Country.ISOCode
+		}
+		if info.ASN == 0 {
+			info.ASN, info.ASOrg = rec.ASN, rec.ASOrg
+		}
+	}
+	return info
+}
+
+// logFields is what goes on the end of an access log line.
+func (g geoInfo) logFields() string {
+	country, asn := g.Country, "-"
+	if country == "" {
+		country = "-"
+	}
+	if g.ASN != 0 {
+		asn = fmt.Sprintf("AS%d", g.ASN)
+	}
+	return fmt.Sprintf(" country=%s asn=%s", country, asn)
+}
+
+// geoStats counts a route's requests by country and network.
+type geoStats struct {
+	mu        sync.Mutex
+	countries map[string]uint64
+	asns      map[uint]uint64
+	asOrgs    map[uint]string
+}
+
+func (gs *geoStats) add(g geoInfo) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.countries == nil {
+		gs.countries = make(map[string]uint64)
+		gs.asns = make(map[uint]uint64)
+		gs.asOrgs = make(map[uint]string)
+	}
+
+	country := g.Country
+	if country == "" {
+		country = "unknown"
+	}
+	gs.countries[country]++
+
+	asn := g.ASN
+	if _, ok := gs.asns[asn]; !ok && len(gs.asns) >= maxTrackedASNs {
+		asn = 0
+	}
+	gs.asns[asn]++
+	if asn != 0 {
+		gs.asOrgs[asn] = g.ASOrg
+	}
+}
+
+// geoCount is one country or network and how many requests came from it.
+type geoCount struct {
+	Name     string
+	Requests uint64
+}
+
+// top returns the countries and networks with the most requests, all of
+// them when n is 0.
+func (gs *geoStats) top(n int) (countries, networks []geoCount) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for c, reqs := range gs.countries {
+		countries = append(countries, geoCount{c, reqs})
+	}
+	for asn, reqs := range gs.asns {
+		name := "other"
+		if asn != 0 {
+			name = fmt.Sprintf("AS%d %s", asn, gs.asOrgs[asn])
+		}
+		networks = append(networks, geoCount{name, reqs})
+	}
+	return topCounts(countries, n), topCounts(networks, n)
+}
+
+func topCounts(counts []geoCount, n int) []geoCount {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Requests != counts[j].Requests {
+			return counts[i].Requests > counts[j].Requests
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if n > 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
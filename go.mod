@@ -2,9 +2,16 @@ module github.com/donuts-are-good/appserve
 
 go 1.20
 
-require golang.org/x/crypto v0.12.0
-
 require (
-	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/text v0.12.0 // indirect
+	github.com/andybalholm/brotli v1.0.6
+	github.com/klauspost/compress v1.17.0
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/oschwald/maxminddb-golang v1.12.0
+	golang.org/x/crypto v0.12.0
+	golang.org/x/net v0.10.0
+	golang.org/x/sync v0.3.0
+	golang.org/x/sys v0.13.0
+	golang.org/x/time v0.3.0
 )
+
+require golang.org/x/text v0.12.0 // indirect
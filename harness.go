@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"time"
+)
+
+// harness is an appserve for integration tests: http, https and the admin
+// api on free loopback ports, certificates from a ca that only exists in
+// memory, routes that are never saved and an admin token made up on the
+// spot. nothing touches :80, :443 or the disk, so every test can have its
+// own. `appserve -harness` prints one as json and runs until it's killed.
+type harness struct {
+	HTTP  string `json:"http"`
+	HTTPS string `json:"https"`
+	Admin string `json:"admin"`
+	Token string `json:"token"`
+	CA    string `json:"ca"` // pem, to trust the https listener's certificates
+
+	listeners []net.Listener
+}
+
+// startHarness serves app on fresh ports, routes go in through the admin
+// api with Token.
+func (app *App) startHarness() (*harness, error) {
+	app.RoutesFile = ""
+	app.Traffic.file = ""
+	app.AdminCA = nil
+	if app.AdminGuard == nil {
+		app.AdminGuard = &adminGuard{}
+	}
+	ca, _, err := newDevCA()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newTokenSecret()
+	if err != nil {
+		return nil, err
+	}
+	app.Tokens = &tokenStore{tokens: []adminToken{{Name: "harness", Hash: hashToken(secret), Role: roleWrite, Created: time.Now().UTC()}}}
+
+	h := &harness{Token: secret, CA: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))}
+	servers := []struct {
+		addr   *string
+		server *http.Server
+	}{
+		{&h.HTTP, &http.Server{Handler: app.Handler(), ConnContext: withConnInfo}},
+		{&h.HTTPS, &http.Server{Handler: app.Handler(), ConnContext: withConnInfo,
+			TLSConfig: &tls.Config{GetCertificate: ca.getCertificate(app)}}},
+		{&h.Admin, &http.Server{Handler: app.adminHandler()}},
+	}
+	for _, s := range servers {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		h.listeners = append(h.listeners, ln)
+		*s.addr = ln.Addr().String()
+	}
+	for i, s := range servers {
+		if s.server.TLSConfig != nil {
+			go s.server.ServeTLS(h.listeners[i], "", "")
+		} else {
+			go s.server.Serve(h.listeners[i])
+		}
+	}
+	return h, nil
+}
+
+// Close stops listening, requests already going carry on.
+func (h *harness) Close() {
+	for _, ln := range h.listeners {
+		ln.Close()
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testHarness starts a harness on an app with just what serving needs.
+func testHarness(t *testing.T) (*App, *harness) {
+	t.Helper()
+	app := &App{
+		Routes:   make(map[string]*Proxy),
+		Cache:    NewResponseCache(64<<20, 1<<20),
+		Tokens:   &tokenStore{},
+		Forwards: &forwardSet{},
+	}
+	app.Traffic, _ = loadTrafficLedger("")
+	app.publishRoutes()
+	h, err := app.startHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return app, h
+}
+
+// addTenantToken makes a write token for tenant, returning its secret.
+func addTenantToken(app *App, tenant string) string {
+	secret := tenant + "-secret"
+	app.Tokens.tokens = append(app.Tokens.tokens, adminToken{
+		Name: tenant, Hash: hashToken(secret), Role: roleWrite, Tenant: tenant, Created: time.Now().UTC(),
+	})
+	return secret
+}
+
+// admin makes an admin api request with token, decoding the answer into out
+// when it's given.
+func (h *harness) admin(t *testing.T, token, method, path string, body, out interface{}) int {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://"+h.Admin+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// get requests path from host through the harness' http listener.
+func (h *harness) get(t *testing.T, host, path string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "http://"+h.HTTP+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+// countingBackend answers everything cacheably and counts what reaches it.
+func countingBackend(t *testing.T) (string, *atomic.Int64) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprintf(w, "%s%s", r.Host, r.URL.Path)
+	}))
+	t.Cleanup(backend.Close)
+	return strings.TrimPrefix(backend.URL, "http://"), &hits
+}
+
+func TestHarnessTenantIsolation(t *testing.T) {
+	app, h := testHarness(t)
+	addr, _ := countingBackend(t)
+	app.TenantBackends, _ = parseBackendRules("127.0.0.1")
+	teamA, teamB := addTenantToken(app, "a"), addTenantToken(app, "b")
+
+	if code := h.admin(t, teamA, http.MethodPut, "/routes/a.example.com", DomainRoute{Port: addr}, nil); code != http.StatusOK {
+		t.Fatalf("tenant a putting its route: %d", code)
+	}
+	if resp := h.get(t, "a.example.com", "/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("a.example.com through the harness: %d", resp.StatusCode)
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         interface{}
+		want         int
+	}{
+		{"taking over another tenant's route", http.MethodPut, "/routes/a.example.com", DomainRoute{Port: addr}, http.StatusForbidden},
+		{"a path under another tenant's host", http.MethodPut, "/routes/a.example.com/api", DomainRoute{Port: addr}, http.StatusForbidden},
+		{"a wildcard over another tenant", http.MethodPut, "/routes/*.example.com", DomainRoute{Port: addr}, http.StatusForbidden},
+		{"a backend off the allow list", http.MethodPut, "/routes/b.example.com", DomainRoute{Port: "10.0.0.1:80"}, http.StatusForbidden},
+		{"a unix socket backend", http.MethodPut, "/routes/b.example.com", DomainRoute{Port: "unix:/var/run/docker.sock"}, http.StatusForbidden},
+		{"reading another tenant's route", http.MethodGet, "/routes/a.example.com", nil, http.StatusNotFound},
+		{"deleting another tenant's route", http.MethodDelete, "/routes/a.example.com", nil, http.StatusNotFound},
+		{"another tenant's logs", http.MethodGet, "/logs?domain=a.example.com", nil, http.StatusForbidden},
+		{"purging another tenant's cache", http.MethodPost, "/purge", map[string]string{"domain": "a.example.com"}, http.StatusForbidden},
+		{"its own route", http.MethodPut, "/routes/b.example.com", DomainRoute{Port: addr}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := h.admin(t, teamB, tt.method, tt.path, tt.body, nil); code != tt.want {
+			t.Errorf("tenant b %s: %d, want %d", tt.name, code, tt.want)
+		}
+	}
+
+	var routes []DomainRoute
+	if code := h.admin(t, teamB, http.MethodGet, "/routes", nil, &routes); code != http.StatusOK {
+		t.Fatalf("listing tenant b's routes: %d", code)
+	}
+	if len(routes) != 1 || routes[0].Domain != "b.example.com" {
+		t.Errorf("tenant b sees %+v, want only b.example.com", routes)
+	}
+	app.Mu.RLock()
+	owner := app.Routes["a.example.com"].Tenant
+	app.Mu.RUnlock()
+	if owner != "a" {
+		t.Errorf("a.example.com belongs to %q after tenant b's tries, want a", owner)
+	}
+}
+
+func TestHarnessCachePurge(t *testing.T) {
+	app, h := testHarness(t)
+	addr, hits := countingBackend(t)
+	for _, domain := range []string{"example.com", "example.com/api", "*.example.net"} {
+		if code := h.admin(t, h.Token, http.MethodPut, "/routes/"+domain, DomainRoute{Port: addr, RouteOptions: RouteOptions{Cache: true}}, nil); code != http.StatusOK {
+			t.Fatalf("putting %s: %d", domain, code)
+		}
+	}
+	app.PurgeOnChange = true
+
+	warm := func(host, path string) {
+		t.Helper()
+		h.get(t, host, path)
+		if resp := h.get(t, host, path); resp.Header.Get("X-Cache") != "HIT" {
+			t.Fatalf("%s%s wasn't cached: X-Cache %q", host, path, resp.Header.Get("X-Cache"))
+		}
+	}
+	cached := func(host, path string) bool {
+		t.Helper()
+		before := hits.Load()
+		h.get(t, host, path)
+		return hits.Load() == before
+	}
+
+	tests := []struct {
+		name    string
+		purge   map[string]string
+		purged  int
+		dropped []string // host and path, what the purge should drop
+		kept    []string
+	}{
+		{"a host", map[string]string{"domain": "example.com", "pattern": "/blog/*"}, 1,
+			[]string{"example.com /blog/a"}, []string{"example.com /", "example.com /api/users"}},
+		{"a route with a path", map[string]string{"domain": "example.com/api"}, 1,
+			[]string{"example.com /api/users"}, []string{"example.com /"}},
+		{"a wildcard route", map[string]string{"domain": "*.example.net"}, 2,
+			[]string{"a.example.net /", "b.example.net /"}, []string{"example.com /"}},
+		{"one host under a wildcard", map[string]string{"domain": "a.example.net"}, 1,
+			[]string{"a.example.net /"}, []string{"b.example.net /"}},
+	}
+	for _, tt := range tests {
+		app.Cache.Purge("", "", "")
+		for _, hp := range append(append([]string{}, tt.dropped...), tt.kept...) {
+			host, path, _ := strings.Cut(hp, " ")
+			warm(host, path)
+		}
+		var out map[string]int
+		if code := h.admin(t, h.Token, http.MethodPost, "/purge", tt.purge, &out); code != http.StatusOK {
+			t.Fatalf("purging %s: %d", tt.name, code)
+		}
+		if out["purged"] != tt.purged {
+			t.Errorf("purging %s: purged %d, want %d", tt.name, out["purged"], tt.purged)
+		}
+		for _, hp := range tt.dropped {
+			if host, path, _ := strings.Cut(hp, " "); cached(host, path) {
+				t.Errorf("purging %s left %s%s cached", tt.name, host, path)
+			}
+		}
+		for _, hp := range tt.kept {
+			if host, path, _ := strings.Cut(hp, " "); !cached(host, path) {
+				t.Errorf("purging %s dropped %s%s", tt.name, host, path)
+			}
+		}
+	}
+
+	// moving a route's backend throws away what it cached, and only that
+	app.Cache.Purge("", "", "")
+	warm("example.com", "/api/users")
+	warm("example.com", "/")
+	moved, _ := countingBackend(t)
+	if code := h.admin(t, h.Token, http.MethodPut, "/routes/example.com/api", DomainRoute{Port: moved, RouteOptions: RouteOptions{Cache: true}}, nil); code != http.StatusOK {
+		t.Fatalf("moving example.com/api: %d", code)
+	}
+	if !cached("example.com", "/") {
+		t.Error("moving example.com/api dropped example.com's cache")
+	}
+	if resp := h.get(t, "example.com", "/api/users"); resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("example.com/api still served from cache after it moved: X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestHarnessBundleVerify(t *testing.T) {
+	app, h := testHarness(t)
+	addr, _ := countingBackend(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	app.RoutesKey = &routesKey{id: id, key: pub}
+	app.RoutesFile = filepath.Join(t.TempDir(), "routes.json")
+
+	routes := fmt.Sprintf(`[{"domain": "example.com", "port": %q}]`, addr)
+	sig := signRoutes(id, priv, []byte(routes), "routes.json")
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name        string
+		routes, sig string
+		want        int
+	}{
+		{"without a signature", routes, "", http.StatusForbidden},
+		{"signed by another key", routes, string(signRoutes(id, otherPriv, []byte(routes), "routes.json")), http.StatusForbidden},
+		{"changed after signing", strings.Replace(routes, "example.com", "example.org", 1), string(sig), http.StatusForbidden},
+		{"signed", routes, string(sig), http.StatusOK},
+	}
+	for _, tt := range tests {
+		body := map[string]string{"routes": tt.routes, "signature": tt.sig}
+		if code := h.admin(t, h.Token, http.MethodPut, "/routes", body, nil); code != tt.want {
+			t.Errorf("bundle %s: %d, want %d", tt.name, code, tt.want)
+		}
+	}
+
+	if resp := h.get(t, "example.com", "/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("example.com from the bundle: %d", resp.StatusCode)
+	}
+	if resp := h.get(t, "example.org", "/"); resp.StatusCode == http.StatusOK {
+		t.Error("example.org from the tampered bundle is being served")
+	}
+	if code := h.admin(t, h.Token, http.MethodPut, "/routes/example.org", DomainRoute{Port: addr}, nil); code != http.StatusForbidden {
+		t.Errorf("putting a single route with -routes-pubkey: %d, want %d", code, http.StatusForbidden)
+	}
+
+	// the bundle is saved as it was signed, so loading it again checks out
+	loaded, err := LoadRoutes(app.RoutesFile, app.RoutesKey)
+	if err != nil {
+		t.Fatalf("loading the saved bundle: %v", err)
+	}
+	if _, ok := loaded["example.com"]; !ok || len(loaded) != 1 {
+		t.Errorf("the saved bundle has %d routes, want example.com", len(loaded))
+	}
+	if err := os.WriteFile(app.RoutesFile, []byte(strings.Replace(routes, "example.com", "example.org", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRoutes(app.RoutesFile, app.RoutesKey); err == nil {
+		t.Error("loading the saved bundle changed after signing worked")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// headerScrubber strips fingerprinting headers and stamps our own Server
+// header right before the status line goes out, so it catches everything
+// the backend (or we) put on the response.
+type headerScrubber struct {
+	http.ResponseWriter
+	hide   []string
+	server string
+	done   bool
+}
+
+func (s *headerScrubber) scrub() {
+	if s.done {
+		return
+	}
+	s.done = true
+	h := s.ResponseWriter.Header()
+	for _, name := range s.hide {
+		h.Del(name)
+	}
+	if s.server != "" {
+		h.Set("Server", s.server)
+	}
+}
+
+func (s *headerScrubber) WriteHeader(code int) {
+	s.scrub()
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *headerScrubber) Write(b []byte) (int, error) {
+	s.scrub()
+	return s.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the server's sendfile path open for static files.
+func (s *headerScrubber) ReadFrom(r io.Reader) (int64, error) {
+	s.scrub()
+	return io.Copy(s.ResponseWriter, r)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack underneath.
+func (s *headerScrubber) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// splitList turns a comma separated flag value into its trimmed parts.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
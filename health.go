@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// backendDownAfter is how many upstream errors in a row mark a backend down.
+const backendDownAfter = 3
+
+// backendStatus follows whether backends are answering, judged from the
+// requests proxied to them rather than any probing of our own. a backend
+// is down after a few failures in a row and back up on its first answer.
+var backendStatus = &backendHealth{backends: map[string]*backendState{}}
+
+type backendHealth struct {
+	mu       sync.Mutex
+	backends map[string]*backendState
+}
+
+type backendState struct {
+	failures int
+	down     bool
+	since    time.Time
+}
+
+func (h *backendHealth) state(addr string) *backendState {
+	s, ok := h.backends[addr]
+	if !ok {
+		s = &backendState{since: time.Now()}
+		h.backends[addr] = s
+	}
+	return s
+}
+
+// failed notes an upstream error from the backend at addr while serving
+// domain.
+func (h *backendHealth) failed(addr, domain, reason string) {
+	h.mu.Lock()
+	s := h.state(addr)
+	s.failures++
+	wentDown := !s.down && s.failures >= backendDownAfter
+	if wentDown {
+		s.down, s.since = true, time.Now()
+	}
+	h.mu.Unlock()
+
+	if wentDown {
+		log.Printf("Backend for %s at %s is down: %s", domain, addr, reason)
+		emitEvent(eventBackendDown, map[string]interface{}{"backend": addr, "domain": domain, "reason": reason})
+	}
+}
+
+// succeeded notes the backend at addr answering a request for domain.
+func (h *backendHealth) succeeded(addr, domain string) {
+	h.mu.Lock()
+	s := h.state(addr)
+	s.failures = 0
+	cameUp := s.down
+	var downFor time.Duration
+	if cameUp {
+		downFor = time.Since(s.since)
+		s.down, s.since = false, time.Now()
+	}
+	h.mu.Unlock()
+
+	if cameUp {
+		log.Printf("Backend for %s at %s is back up after %s", domain, addr, downFor.Round(time.Second))
+		emitEvent(eventBackendUp, map[string]interface{}{"backend": addr, "domain": domain, "down_seconds": int(downFor.Seconds())})
+	}
+}
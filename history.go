@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// routeChange is one entry in the history of route changes, with the
+// route as it was before and after.
+type routeChange struct {
+	Time     time.Time       `json:"time"`
+	By       string          `json:"by"`
+	Action   string          `json:"action"`
+	Domain   string          `json:"domain"`
+	Config   json.RawMessage `json:"config,omitempty"`
+	Previous json.RawMessage `json:"previous,omitempty"`
+
+	// Changes is what's different between Previous and Config, worked out
+	// when the history is read.
+	Changes []string `json:"changes,omitempty"`
+}
+
+func (c *routeChange) setConfigs(previous, config string) {
+	c.Previous, c.Config = nil, nil
+	if previous != "" {
+		c.Previous = json.RawMessage(previous)
+	}
+	if config != "" {
+		c.Config = json.RawMessage(config)
+	}
+	c.Changes = diffConfigs(previous, config)
+}
+
+// diffConfigs lists what changed between two routes file entries, a
+// setting that's new as +name, one that's gone as -name and one that
+// changed as name: old -> new.
+func diffConfigs(before, after string) []string {
+	var b, a map[string]json.RawMessage
+	if before != "" {
+		json.Unmarshal([]byte(before), &b)
+	}
+	if after != "" {
+		json.Unmarshal([]byte(after), &a)
+	}
+	keys := map[string]bool{}
+	for k := range b {
+		keys[k] = true
+	}
+	for k := range a {
+		keys[k] = true
+	}
+	delete(keys, "domain")
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var changes []string
+	for _, k := range sorted {
+		old, hadOld := b[k]
+		cur, hasCur := a[k]
+		switch {
+		case !hadOld:
+			changes = append(changes, fmt.Sprintf("+%s: %s", k, cur))
+		case !hasCur:
+			changes = append(changes, fmt.Sprintf("-%s: %s", k, old))
+		case !bytes.Equal(old, cur):
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", k, old, cur))
+		}
+	}
+	return changes
+}
+
+// routeConfigs are the saved routes as routes file entries, by domain.
+func routeConfigs(routes map[string]*Proxy) (map[string]string, error) {
+	configs := map[string]string{}
+	for _, route := range savedRoutes(routes) {
+		config, err := json.Marshal(route)
+		if err != nil {
+			return nil, err
+		}
+		configs[route.Domain] = string(config)
+	}
+	return configs, nil
+}
+
+// diffSaved works out which routes differ from the ones last saved, and
+// which are gone.
+func diffSaved(saved, configs map[string]string) (map[string]string, []string) {
+	changed := map[string]string{}
+	for domain, config := range configs {
+		if saved[domain] != config {
+			changed[domain] = config
+		}
+	}
+	var removed []string
+	for domain := range saved {
+		if _, ok := configs[domain]; !ok {
+			removed = append(removed, domain)
+		}
+	}
+	sort.Strings(removed)
+	return changed, removed
+}
+
+// historyFile keeps the history of route changes next to a routes file,
+// a line of json a change. the store keeps its own.
+type historyFile struct {
+	file string
+
+	mu    sync.Mutex
+	saved map[string]string // domain to the config last recorded for it
+}
+
+// newHistoryFile starts recording changes to routes in file, nil when
+// file is empty.
+func newHistoryFile(file string, routes map[string]*Proxy) (*historyFile, error) {
+	if file == "" {
+		return nil, nil
+	}
+	configs, err := routeConfigs(routes)
+	if err != nil {
+		return nil, err
+	}
+	return &historyFile{file: file, saved: configs}, nil
+}
+
+// record adds whatever changed in routes since the last time to the file,
+// by is who changed them. the history can be nil.
+func (h *historyFile) record(routes map[string]*Proxy, by string) error {
+	if h == nil {
+		return nil
+	}
+	configs, err := routeConfigs(routes)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changed, removed := diffSaved(h.saved, configs)
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	domains := make([]string, 0, len(changed))
+	for domain := range changed {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		c := routeChange{Time: now, By: by, Action: "change", Domain: domain, Config: json.RawMessage(changed[domain])}
+		if previous, ok := h.saved[domain]; ok {
+			c.Previous = json.RawMessage(previous)
+		} else {
+			c.Action = "add"
+		}
+		e.Encode(c)
+	}
+	for _, domain := range removed {
+		e.Encode(routeChange{Time: now, By: by, Action: "remove", Domain: domain, Previous: json.RawMessage(h.saved[domain])})
+	}
+
+	f, err := os.OpenFile(h.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	for domain, config := range changed {
+		h.saved[domain] = config
+	}
+	for _, domain := range removed {
+		delete(h.saved, domain)
+	}
+	return nil
+}
+
+// read lists the latest changes in the file, newest first, for one domain
+// or every one when domain is empty.
+func (h *historyFile) read(domain string, limit int) ([]routeChange, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(h.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return []routeChange{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var changes []routeChange
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var c routeChange
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil || (domain != "" && c.Domain != domain) {
+			continue
+		}
+		changes = append(changes, c)
+		if len(changes) > limit {
+			changes = changes[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]routeChange, 0, len(changes))
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		c.setConfigs(string(c.Previous), string(c.Config))
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+var errNoHistory = errors.New("route history is off, -history-file is empty")
+
+// routeHistory lists the latest route changes, newest first, from the
+// store or the history file.
+func (app *App) routeHistory(domain string, limit int) ([]routeChange, error) {
+	if app.Store != nil {
+		return app.Store.history(domain, limit)
+	}
+	if app.History != nil {
+		return app.History.read(domain, limit)
+	}
+	return nil, errNoHistory
+}
+
+// recordRoutes notes a change to the routes that didn't go through
+// saveRoutes in the history file, a load or a bundle.
+func (app *App) recordRoutes(by string) error {
+	app.Mu.RLock()
+	defer app.Mu.RUnlock()
+	return app.History.record(app.Routes, by)
+}
+
+// handleHistoryCommand shows the latest route changes and what each one
+// changed, for one domain or all of them.
+func (app *App) handleHistoryCommand(domain string) {
+	changes, err := app.routeHistory(domain, 20)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(changes) == 0 {
+		fmt.Println("No route changes yet.")
+		return
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		fmt.Printf("%s  %-6s %s by %s\n", c.Time.Local().Format("2006-01-02 15:04:05"), c.Action, listedDomain(c.Domain), c.By)
+		for _, line := range c.Changes {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+}
+
+// adminHistory lists the latest route changes, GET /history, ?domain= for
+// one domain's and ?limit= for more than 100.
+func (app *App) adminHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "limit should be a positive number")
+			return
+		}
+		limit = n
+	}
+	token := tokenFrom(r)
+	domain := NormalizeDomain(r.URL.Query().Get("domain"))
+	if domain != "" && !app.ownsDomain(token, domain) {
+		writeJSONError(w, http.StatusNotFound, errNoSuchDomain.Error())
+		return
+	}
+	changes, err := app.routeHistory(domain, limit)
+	if errors.Is(err, errNoHistory) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := []routeChange{}
+	for _, c := range changes {
+		if app.ownsDomain(token, c.Domain) {
+			out = append(out, c)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
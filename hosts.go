@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// the lines appserve keeps in the hosts file go between these, everything
+// else in the file is left as it is.
+const (
+	hostsBegin = "# appserve begin, managed by appserve hosts sync"
+	hostsEnd   = "# appserve end"
+)
+
+func defaultHostsFile() string {
+	if runtime.GOOS == "windows" {
+		return `C:\Windows\System32\drivers\etc\hosts`
+	}
+	return "/etc/hosts"
+}
+
+// devHostNames are the names dev mode answers for that need a hosts file
+// entry to reach it: every route as <domain>.test, and routes that are
+// .test names already. .localhost resolves here without help and
+// wildcards can't go in a hosts file.
+func devHostNames(domains []string) []string {
+	seen := map[string]bool{}
+	for _, domain := range domains {
+		host, _, _ := strings.Cut(domain, "/")
+		if host == "" || host == "*" || strings.HasPrefix(host, "*.") || strings.HasSuffix(host, ".localhost") {
+			continue
+		}
+		if !strings.HasSuffix(host, ".test") {
+			host += ".test"
+		}
+		seen[host] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// syncHosts rewrites appserve's block in the hosts file to point names at
+// this machine, taking the block out altogether when there are none. it
+// reports whether the file changed.
+func syncHosts(file string, names []string) (bool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	newline := "\n"
+	if strings.Contains(string(data), "\r\n") {
+		newline = "\r\n"
+	}
+
+	var kept []string
+	inBlock := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\r\n"), "\n") {
+		trimmed := strings.TrimRight(line, "\r")
+		switch {
+		case trimmed == hostsBegin:
+			inBlock = true
+		case trimmed == hostsEnd:
+			inBlock = false
+		case !inBlock:
+			kept = append(kept, trimmed)
+		}
+	}
+	if len(names) > 0 {
+		kept = append(kept, hostsBegin)
+		for _, name := range names {
+			kept = append(kept, "127.0.0.1 "+name, "::1 "+name)
+		}
+		kept = append(kept, hostsEnd)
+	}
+
+	updated := strings.Join(kept, newline) + newline
+	if updated == string(data) {
+		return false, nil
+	}
+	// written in place rather than renamed over, the hosts file is often
+	// a bind mount or has attributes a new file wouldn't
+	return true, os.WriteFile(file, []byte(updated), 0o644)
+}
+
+// syncDevHosts keeps the hosts file in step with the routes while dev mode
+// runs, so removed routes don't leave names behind.
+func (app *App) syncDevHosts(file string) {
+	update := func() {
+		if changed, err := syncHosts(file, devHostNames(app.getAllDomains())); err != nil {
+			log.Printf("Error updating %s: %v", file, err)
+		} else if changed {
+			log.Printf("Updated the appserve names in %s", file)
+		}
+	}
+	update()
+	ch := make(chan event, 64)
+	appEvents.subscribe(ch)
+	for e := range ch {
+		if strings.HasPrefix(e.Type, "route.") {
+			update()
+		}
+	}
+}
+
+// runHosts points the routes' dev names at this machine in the hosts file,
+// `sudo appserve hosts sync`.
+func runHosts(args []string) {
+	fs := flag.NewFlagSet("hosts", flag.ExitOnError)
+	routesFile := fs.String("routes", "routes.json", "path to the routes file")
+	hostsFile := fs.String("hosts", defaultHostsFile(), "path to the hosts file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appserve hosts [-routes file] [-hosts file] sync | clean")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var names []string
+	switch fs.Arg(0) {
+	case "sync":
+		routes, err := readRoutes(*routesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		domains := make([]string, 0, len(routes))
+		for _, route := range routes {
+			domains = append(domains, route.Domain)
+		}
+		names = devHostNames(domains)
+	case "clean":
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	changed, err := syncHosts(*hostsFile, names)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	switch {
+	case !changed:
+		fmt.Printf("%s is already up to date.\n", *hostsFile)
+	case len(names) == 0:
+		fmt.Printf("Removed the appserve names from %s\n", *hostsFile)
+	default:
+		fmt.Printf("Pointed %d names at this machine in %s: %s\n", len(names), *hostsFile, strings.Join(names, ", "))
+	}
+}
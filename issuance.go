@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// reservedTLDs never resolve on the public internet, a certificate for
+// one can't be had and asking is a waste of an acme order.
+var reservedTLDs = map[string]bool{
+	"localhost": true, "local": true, "internal": true, "invalid": true, "test": true,
+	"example": true, "onion": true, "arpa": true, "lan": true, "home": true, "corp": true,
+}
+
+// issuanceGuard limits the certificates a wildcard route can be made to
+// request. anyone can send any name in a tls handshake, and every name a
+// wildcard covers is a new certificate, so a scanner spraying random
+// names would otherwise burn through let's encrypt's rate limits.
+type issuanceGuard struct {
+	perHour  int
+	maxHosts int
+	deny     []string
+
+	// cached lists the names with a certificate in the cache
+	cached func() []string
+
+	mu     sync.Mutex
+	recent map[string]time.Time // names let through in the last hour
+}
+
+func newIssuanceGuard(perHour, maxHosts int, deny []string, cached func() []string) *issuanceGuard {
+	g := &issuanceGuard{perHour: perHour, maxHosts: maxHosts, cached: cached, recent: map[string]time.Time{}}
+	for _, name := range deny {
+		if name = NormalizeDomain(strings.TrimSpace(name)); name != "" {
+			g.deny = append(g.deny, name)
+		}
+	}
+	return g
+}
+
+// allow decides whether a name only a wildcard covers may have a new
+// certificate. onDemand tells such names apart from ones with routes of
+// their own when counting what's in the cache.
+func (g *issuanceGuard) allow(host string, onDemand func(string) bool) error {
+	if reason := bogusHost(host); reason != "" {
+		return errors.New(reason)
+	}
+	if g.denied(host) {
+		return errors.New("it's in -cert-deny")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for name, at := range g.recent {
+		if now.Sub(at) >= time.Hour {
+			delete(g.recent, name)
+		}
+	}
+	// handshakes racing for the same new name all ask
+	if _, ok := g.recent[host]; ok {
+		return nil
+	}
+	if g.perHour > 0 && len(g.recent) >= g.perHour {
+		return fmt.Errorf("%d new certificates were requested in the last hour, the most -max-new-certs allows", len(g.recent))
+	}
+	if g.maxHosts > 0 {
+		hosts := map[string]bool{}
+		for name := range g.recent {
+			hosts[name] = true
+		}
+		if g.cached != nil {
+			for _, name := range g.cached() {
+				if onDemand(name) {
+					hosts[name] = true
+				}
+			}
+		}
+		if len(hosts) >= g.maxHosts {
+			return fmt.Errorf("%d names under wildcard routes have certificates, the most -max-cert-hosts allows", len(hosts))
+		}
+	}
+	g.recent[host] = now
+	return nil
+}
+
+// denied reports whether host is in the deny list, *.name covering
+// everything under name.
+func (g *issuanceGuard) denied(host string) bool {
+	for _, name := range g.deny {
+		if rest, ok := strings.CutPrefix(name, "*."); ok {
+			if strings.HasSuffix(host, "."+rest) {
+				return true
+			}
+		} else if host == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bogusHost says what's wrong with a name no certificate could ever be
+// issued for, empty when it looks like a real one.
+func bogusHost(host string) string {
+	if net.ParseIP(host) != nil {
+		return "it's an ip address"
+	}
+	if len(host) > 253 {
+		return "it's too long for a hostname"
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return "it isn't a full domain name"
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "it isn't a valid hostname"
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return "it isn't a valid hostname"
+			}
+		}
+	}
+	if reservedTLDs[labels[len(labels)-1]] {
+		return "." + labels[len(labels)-1] + " is a reserved name"
+	}
+	return ""
+}
+
+// cachedCertNames lists the names there are certificates for in the cache,
+// autocert names its entries for the domain, with +rsa for rsa
+// certificates.
+func cachedCertNames(cache autocert.Cache) func() []string {
+	return func() []string {
+		var entries []string
+		switch c := cache.(type) {
+		case autocert.DirCache:
+			files, err := os.ReadDir(string(c))
+			if err != nil {
+				return nil
+			}
+			for _, f := range files {
+				entries = append(entries, f.Name())
+			}
+		case *vaultCache:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			keys, err := c.list(ctx)
+			if err != nil {
+				logLimited("vault", "Error listing certificates in vault: %v", err)
+				return nil
+			}
+			entries = keys
+		}
+		seen := map[string]bool{}
+		var names []string
+		for _, entry := range entries {
+			name := strings.TrimSuffix(entry, "+rsa")
+			if strings.Contains(name, "+") || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+		return names
+	}
+}
+
+// allowNewCert applies the issuance limits to a name about to get its
+// first certificate. names with a route of their own are the operator's
+// choice and always allowed.
+func (app *App) allowNewCert(host string) error {
+	table := app.routeTable()
+	if app.Issuance == nil || table.explicitHost(host) {
+		return nil
+	}
+	err := app.Issuance.allow(host, func(name string) bool {
+		return table.wantsCert(name) && !table.explicitHost(name)
+	})
+	if err != nil {
+		securityEvent(eventCertRefused, "", host, err.Error())
+		logLimited("cert-refused", "Not requesting a certificate for %s: %v", host, err)
+	}
+	return err
+}
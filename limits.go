@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultQueueTimeout is how long a queued request waits for a slot when the
+// route doesn't say.
+const defaultQueueTimeout = 5 * time.Second
+
+// inflight counts requests currently being served, in total and per client
+// ip, and turns new ones away once a limit is hit. requests over the total
+// limit can wait in a short queue for a slot to free up, which smooths out
+// bursts instead of failing them outright.
+type inflight struct {
+	mu     sync.Mutex
+	total  int
+	perIP  map[string]int
+	queued int
+
+	// freed is closed (and replaced) every time a slot frees up, waking
+	// everyone in the queue to have another go
+	freed chan struct{}
+}
+
+// acquire takes a slot for ip, waiting in the queue for up to timeout when
+// the route is full and the queue has room. a limit of 0 means unlimited.
+// clients over their own per ip limit are never queued.
+func (f *inflight) acquire(ctx context.Context, ip string, max, maxPerIP, depth int, timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	for {
+		f.mu.Lock()
+		if maxPerIP > 0 && f.perIP[ip] >= maxPerIP {
+			// a queued request gives its place back
+			if deadline != nil {
+				f.queued--
+			}
+			f.mu.Unlock()
+			return false
+		}
+		if max <= 0 || f.total < max {
+			if f.perIP == nil {
+				f.perIP = make(map[string]int)
+			}
+			f.total++
+			f.perIP[ip]++
+			if deadline != nil {
+				f.queued--
+			}
+			f.mu.Unlock()
+			return true
+		}
+
+		if deadline == nil {
+			if f.queued >= depth {
+				f.mu.Unlock()
+				return false
+			}
+			f.queued++
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		if f.freed == nil {
+			f.freed = make(chan struct{})
+		}
+		freed := f.freed
+		f.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-deadline:
+			f.leaveQueue()
+			return false
+		case <-ctx.Done():
+			f.leaveQueue()
+			return false
+		}
+	}
+}
+
+func (f *inflight) leaveQueue() {
+	f.mu.Lock()
+	f.queued--
+	f.mu.Unlock()
+}
+
+func (f *inflight) release(ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.total--
+	if f.perIP[ip]--; f.perIP[ip] <= 0 {
+		delete(f.perIP, ip)
+	}
+	if f.freed != nil {
+		close(f.freed)
+		f.freed = nil
+	}
+}
+
+// clientIP is the address of whoever sent the request, which is the real
+// client when the PROXY protocol is on.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// overloaded answers a request we don't have room for.
+func overloaded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+}
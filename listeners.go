@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// defaultListener is the name of the :80 and :443 pair every route is
+// served on unless it says otherwise.
+const defaultListener = "default"
+
+// listenerConfig is an entry in the -listeners file, a port of its own
+// serving the routes that name it.
+type listenerConfig struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	TLS  bool   `json:"tls,omitempty"`
+
+	// TLSHeaders tells backends about the tls connection in X-TLS-* and
+	// X-Client-Cert-* headers.
+	TLSHeaders bool `json:"tls_headers,omitempty"`
+
+	// ClientCA is a pem file of the cas client certificates are checked
+	// against. ClientAuth is "request" (the default) to take a certificate
+	// when there is one or "require" to turn away clients without.
+	ClientCA   string `json:"client_ca,omitempty"`
+	ClientAuth string `json:"client_auth,omitempty"`
+}
+
+// loadListeners reads the -listeners file.
+func loadListeners(file string) ([]listenerConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []listenerConfig
+	if err := json.Unmarshal(data, &listeners); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	seen := map[string]bool{}
+	for _, l := range listeners {
+		switch {
+		case l.Name == "" || l.Addr == "":
+			return nil, fmt.Errorf("%s: every listener needs a name and an addr", file)
+		case l.Name == defaultListener:
+			return nil, fmt.Errorf("%s: %q is the :80 and :443 listeners' name", file, defaultListener)
+		case seen[l.Name]:
+			return nil, fmt.Errorf("%s: there's more than one listener called %q", file, l.Name)
+		case l.ClientCA != "" && !l.TLS:
+			return nil, fmt.Errorf("%s: the %s listener needs tls for client_ca", file, l.Name)
+		case l.ClientAuth != "" && l.ClientAuth != "request" && l.ClientAuth != "require":
+			return nil, fmt.Errorf("%s: the %s listener's client_auth should be request or require", file, l.Name)
+		case l.ClientAuth != "" && l.ClientCA == "":
+			return nil, fmt.Errorf("%s: the %s listener's client_auth needs a client_ca", file, l.Name)
+		}
+		seen[l.Name] = true
+	}
+	return listeners, nil
+}
+
+// onListener is http.Server.ConnContext for a server whose requests are
+// only for the routes served on the named listener, tlsHeaders passing the
+// connection's tls details on to backends.
+func onListener(name string, tlsHeaders bool) func(context.Context, net.Conn) context.Context {
+	return func(ctx context.Context, c net.Conn) context.Context {
+		ctx = withConnInfo(ctx, c)
+		ci := connInfoFrom(ctx)
+		ci.listener = name
+		ci.tlsHeaders = tlsHeaders
+		return ctx
+	}
+}
+
+// listenerOf is the name of the listener a request came in on, empty for
+// servers that answer for every route (dev mode, the harness).
+func listenerOf(r *http.Request) string {
+	if ci := connInfoFrom(r.Context()); ci != nil {
+		return ci.listener
+	}
+	return ""
+}
+
+// servedOn reports whether the route answers on the named listener.
+func (p *Proxy) servedOn(listener string) bool {
+	if listener == "" {
+		return true
+	}
+	if len(p.Listeners) == 0 {
+		return listener == defaultListener
+	}
+	for _, name := range p.Listeners {
+		if name == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// serveListener serves the routes that name l on its port, over https with
+// the usual certificates when it asks for tls.
+func (app *App) serveListener(l listenerConfig) {
+	server := &http.Server{Handler: app.Handler(), ConnContext: onListener(l.Name, l.TLSHeaders)}
+	if l.TLS {
+		if app.Certs == nil {
+			log.Printf("Not starting the %s listener on %s, tls needs certificates, which dev mode doesn't get", l.Name, l.Addr)
+			return
+		}
+		tlsConfig := app.Certs.TLSConfig()
+		tlsConfig.GetCertificate = app.noteCertFailures(app.groupCertificates(tlsConfig.GetCertificate))
+		if err := withClientAuth(tlsConfig, l); err != nil {
+			log.Printf("Not starting the %s listener on %s, client_ca: %v", l.Name, l.Addr, err)
+			return
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	ln, err := app.bind(l.Addr)
+	if err != nil {
+		log.Printf("Error starting the %s listener: %v", l.Name, err)
+		return
+	}
+	if l.TLS {
+		log.Printf("Serving the %s listener's routes over https on %s", l.Name, l.Addr)
+		err = server.ServeTLS(&helloListener{Listener: ln, logFingerprints: app.LogFingerprints}, "", "")
+	} else {
+		log.Printf("Serving the %s listener's routes over http on %s", l.Name, l.Addr)
+		err = server.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("The %s listener on %s stopped: %v", l.Name, l.Addr, err)
+	}
+}
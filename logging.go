@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// setupLogging points the log package wherever -log asks. auto uses the
+// system logger (syslog, or the event log on windows) and falls back to
+// stderr when there isn't one, like in a minimal container.
+func setupLogging(dest string) {
+	switch dest {
+	case "auto", "":
+		w, err := systemLogWriter()
+		if err != nil {
+			log.Printf("System logger unavailable, logging to stderr: %v", err)
+			return
+		}
+		log.SetOutput(w)
+	case "system":
+		w, err := systemLogWriter()
+		if err != nil {
+			log.Fatalf("Failed to initialize the system logger: %v", err)
+		}
+		log.SetOutput(w)
+	case "stderr":
+		log.SetOutput(os.Stderr)
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	default:
+		log.Fatalf("Invalid -log %q, expected auto, system, stderr or stdout", dest)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func systemLogWriter() (io.Writer, error) {
+	return nil, errors.New("no system logger on this platform")
+}
@@ -0,0 +1,38 @@
+//go:build windows
+
+package main
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventLogSource is the source name entries show up under in the windows
+// event log.
+const eventLogSource = "appserve"
+
+// systemLogWriter is the event log on windows. the source is registered
+// the first time round, which needs an administrator; without it windows
+// still records the entries, just with a note about the missing source.
+func systemLogWriter() (io.Writer, error) {
+	eventlog.InstallAsEventCreate(eventLogSource, eventlog.Info|eventlog.Warning|eventlog.Error)
+	l, err := eventlog.Open(eventLogSource)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogWriter{l: l}, nil
+}
+
+type eventLogWriter struct {
+	l *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\r\n")
+	if err := w.l.Info(1, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
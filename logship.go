@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logShipBatch and logShipInterval bound how long a line waits before it's
+// sent, whichever comes first.
+const (
+	logShipBatch    = 500
+	logShipInterval = 2 * time.Second
+	logShipMaxRetry = 30 * time.Second
+)
+
+// logLine is one line of log output waiting to be shipped.
+type logLine struct {
+	time time.Time
+	text string
+	host string // the host the line is about, see logHost
+}
+
+// logSink is somewhere log lines can be sent in batches.
+type logSink interface {
+	send(ctx context.Context, batch []logLine) error
+}
+
+// logShipper copies log output to a remote sink. writes never block the
+// server: lines queue up to a limit and while the sink is down or slow the
+// queue fills and new lines are dropped and counted, then reported once
+// it's caught up.
+type logShipper struct {
+	sink    logSink
+	lines   chan logLine
+	dropped atomic.Uint64
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// newLogShipper sets up shipping to a target like syslog+tls://host:6514,
+// loki+https://host/loki/api/v1/push or a plain http(s) url.
+func newLogShipper(target string, buffer int) (*logShipper, error) {
+	sink, err := newLogSink(target)
+	if err != nil {
+		return nil, err
+	}
+	return &logShipper{
+		sink:  sink,
+		lines: make(chan logLine, buffer),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+func newLogSink(target string) (logSink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	switch u.Scheme {
+	case "syslog+tcp", "syslog+tls":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("%s needs a port", target)
+		}
+		return &syslogSink{addr: u.Host, useTLS: u.Scheme == "syslog+tls", hostname: hostname}, nil
+	case "loki+http", "loki+https":
+		u.Scheme = strings.TrimPrefix(u.Scheme, "loki+")
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/loki/api/v1/push"
+		}
+		return &lokiSink{url: u.String(), hostname: hostname}, nil
+	case "http", "https":
+		return &httpLogSink{url: u.String(), hostname: hostname}, nil
+	}
+	return nil, fmt.Errorf("unsupported log shipping target %q, expected syslog+tcp, syslog+tls, loki+http(s) or http(s)", target)
+}
+
+func (s *logShipper) Write(p []byte) (int, error) {
+	line := logLine{time: time.Now(), text: strings.TrimRight(string(p), "\n")}
+	select {
+	case s.lines <- line:
+	default:
+		s.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// run sends batches until Close, retrying a failed batch with backoff.
+func (s *logShipper) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(logShipInterval)
+	defer ticker.Stop()
+
+	var batch []logLine
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if n := s.dropped.Swap(0); n > 0 {
+			batch = append(batch, logLine{time: time.Now(), text: fmt.Sprintf("log shipping fell behind, dropped %d lines", n)})
+		}
+		backoff := time.Second
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := s.sink.send(ctx, batch)
+			cancel()
+			if err == nil {
+				break
+			}
+			// the local log still works, say so there only
+			fmt.Fprintf(os.Stderr, "Error shipping logs, retrying in %s: %v\n", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				// shutting down, don't hang around for a dead sink
+				batch = batch[:0]
+				return
+			}
+			if backoff *= 2; backoff > logShipMaxRetry {
+				backoff = logShipMaxRetry
+			}
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case line := <-s.lines:
+			batch = append(batch, line)
+			if len(batch) >= logShipBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.stop:
+			for {
+				select {
+				case line := <-s.lines:
+					batch = append(batch, line)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close sends what's queued, giving up after a few seconds.
+func (s *logShipper) Close() {
+	s.once.Do(func() { close(s.stop) })
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// syslogSink sends rfc 5424 messages over tcp or tls, octet counted so
+// multi line messages survive.
+type syslogSink struct {
+	addr     string
+	useTLS   bool
+	hostname string
+	conn     net.Conn
+}
+
+func (s *syslogSink) send(ctx context.Context, batch []logLine) error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		var conn net.Conn
+		var err error
+		if s.useTLS {
+			host, _, _ := net.SplitHostPort(s.addr)
+			conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", s.addr)
+		} else {
+			conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+		}
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	var buf bytes.Buffer
+	pid := os.Getpid()
+	for _, line := range batch {
+		// facility daemon, severity info
+		msg := fmt.Sprintf("<30>1 %s %s appserve %d - - %s", line.time.Format(time.RFC3339Nano), s.hostname, pid, line.text)
+		buf.WriteString(strconv.Itoa(len(msg)))
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// lokiSink pushes to grafana loki's http api.
+type lokiSink struct {
+	url      string
+	hostname string
+}
+
+func (s *lokiSink) send(ctx context.Context, batch []logLine) error {
+	values := make([][2]string, 0, len(batch))
+	for _, line := range batch {
+		values = append(values, [2]string{strconv.FormatInt(line.time.UnixNano(), 10), line.text})
+	}
+	body := map[string]interface{}{
+		"streams": []interface{}{
+			map[string]interface{}{
+				"stream": map[string]string{"job": "appserve", "host": s.hostname},
+				"values": values,
+			},
+		},
+	}
+	return postJSON(ctx, s.url, body)
+}
+
+// httpLogSink posts batches to any endpoint as a json array.
+type httpLogSink struct {
+	url      string
+	hostname string
+}
+
+func (s *httpLogSink) send(ctx context.Context, batch []logLine) error {
+	type entry struct {
+		Time    time.Time `json:"time"`
+		Host    string    `json:"host"`
+		Message string    `json:"message"`
+	}
+	entries := make([]entry, 0, len(batch))
+	for _, line := range batch {
+		entries = append(entries, entry{Time: line.time, Host: s.hostname, Message: line.text})
+	}
+	return postJSON(ctx, s.url, entries)
+}
+
+// postJSON sends v to url, credentials in the url go along as basic auth.
+func postJSON(ctx context.Context, url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u := req.URL.User; u != nil {
+		password, _ := u.Password()
+		req.SetBasicAuth(u.Username(), password)
+		req.URL.User = nil
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// shipLogs starts copying log output to target alongside wherever it goes
+// already.
+func shipLogs(target string, buffer int) (*logShipper, error) {
+	shipper, err := newLogShipper(target, buffer)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(&teeWriter{local: log.Writer(), remote: shipper})
+	go shipper.run()
+	return shipper, nil
+}
+
+// teeWriter writes to the local log and somewhere else, the shipper or the
+// recent lines kept for logs tail. a failing local log doesn't stop lines
+// going out.
+type teeWriter struct {
+	local  io.Writer
+	remote io.Writer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	t.remote.Write(p)
+	return t.local.Write(p)
+}
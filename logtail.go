@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// recentLogSize is how many lines logs tail can look back over.
+const recentLogSize = 1000
+
+// logHub keeps the most recent log lines and hands new ones to whoever is
+// following along, so logs can be watched from the shell or the admin api
+// without getting at the log files.
+type logHub struct {
+	mu     sync.Mutex
+	recent []logLine // a ring, next is the oldest once it's full
+	next   int
+	subs   map[chan logLine]struct{}
+}
+
+var recentLogs = &logHub{subs: map[chan logLine]struct{}{}}
+
+func (h *logHub) Write(p []byte) (int, error) {
+	text := strings.TrimRight(string(p), "\n")
+	line := logLine{time: time.Now(), text: text, host: logHost(text)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.recent) < recentLogSize {
+		h.recent = append(h.recent, line)
+	} else {
+		h.recent[h.next] = line
+		h.next = (h.next + 1) % recentLogSize
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- line:
+		default:
+			// a follower that can't keep up misses lines rather than
+			// holding up logging
+		}
+	}
+	return len(p), nil
+}
+
+// tail returns up to n of the latest lines about domain, or about anything
+// when domain is empty, oldest first.
+func (h *logHub) tail(n int, domain string) []logLine {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var lines []logLine
+	for i := len(h.recent) - 1; i >= 0 && len(lines) < n; i-- {
+		line := h.recent[(h.next+i)%len(h.recent)]
+		if logMatches(line, domain) {
+			lines = append(lines, line)
+		}
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// follow delivers new lines until the returned func is called.
+func (h *logHub) follow() (<-chan logLine, func()) {
+	ch := make(chan logLine, 256)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// logMatches reports whether a line is about domain. it's the exact host,
+// tenants' logs are kept apart by it: a.com mustn't turn up banana.com's
+// lines, nor example.com those of shop.example.com.
+func logMatches(line logLine, domain string) bool {
+	return domain == "" || line.host == domain
+}
+
+// logHost is the host a log line is about, the first word in it that's a
+// host name. lines name their host ahead of anything a client sent, like
+// paths and user agents, so a request can't pass itself off as another
+// host's. ip addresses are the client's and don't count.
+func logHost(text string) string {
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return strings.ContainsRune(" \t\"'(),;[]<>=", r)
+	}) {
+		word, _, _ = strings.Cut(word, "/")
+		word, _, _ = strings.Cut(word, ":")
+		host := strings.TrimPrefix(strings.ToLower(strings.Trim(word, ".")), "www.")
+		if !strings.Contains(host, ".") || net.ParseIP(host) != nil || !hostChars(host) {
+			continue
+		}
+		return host
+	}
+	return ""
+}
+
+// hostChars reports whether s only has the characters a normalized host
+// name can.
+func hostChars(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '*') {
+			return false
+		}
+	}
+	return true
+}
+
+// handleLogsCommand prints recent log lines, and with -f keeps printing
+// new ones until enter is pressed:
+//
+//	logs tail [domain] [-f]
+func handleLogsCommand(args []string, scanner *bufio.Scanner) {
+	if len(args) == 0 || args[0] != "tail" {
+		fmt.Println("Error: Expected: logs tail [domain] [-f]")
+		return
+	}
+	var domain string
+	follow := false
+	for _, arg := range args[1:] {
+		switch {
+		case arg == "-f" || arg == "--follow":
+			follow = true
+		case domain == "" && !strings.HasPrefix(arg, "-"):
+			domain = NormalizeDomain(arg)
+		default:
+			fmt.Println("Error: Expected: logs tail [domain] [-f]")
+			return
+		}
+	}
+
+	var lines <-chan logLine
+	var stop func()
+	if follow {
+		// subscribe before printing the backlog so nothing falls in between
+		lines, stop = recentLogs.follow()
+		defer stop()
+	}
+	for _, line := range recentLogs.tail(20, domain) {
+		fmt.Println(line.text)
+	}
+	if !follow {
+		return
+	}
+
+	fmt.Println("Following, press enter to stop.")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner.Scan()
+	}()
+	for {
+		select {
+		case line := <-lines:
+			if logMatches(line, domain) {
+				fmt.Println(line.text)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// serveLogs answers GET /logs on the admin api with recent lines as text,
+// ?domain= to narrow them down, ?n= for how many and ?follow=1 to keep the
+// response open and stream new lines as they come.
+func serveLogs(w http.ResponseWriter, r *http.Request) {
+	domain := NormalizeDomain(r.URL.Query().Get("domain"))
+	n := 100
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			http.Error(w, "n has to be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	follow := r.URL.Query().Get("follow") == "1"
+
+	var lines <-chan logLine
+	if follow {
+		var stop func()
+		lines, stop = recentLogs.follow()
+		defer stop()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	for _, line := range recentLogs.tail(n, domain) {
+		fmt.Fprintln(w, line.text)
+	}
+	if !follow {
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	for {
+		select {
+		case line := <-lines:
+			if !logMatches(line, domain) {
+				continue
+			}
+			fmt.Fprintln(w, line.text)
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// logsWebSocket streams new log lines on the admin api's /logs/ws as json
+// messages, {"time": ..., "message": ...}, ?domain= to narrow them down.
+var logsWebSocket = websocket.Server{
+	// tools connect from anywhere and often send no Origin, who gets in is
+	// the admin api's job rather than the browser's
+	Handshake: func(*websocket.Config, *http.Request) error { return nil },
+	Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		domain := NormalizeDomain(ws.Request().URL.Query().Get("domain"))
+		lines, stop := recentLogs.follow()
+		defer stop()
+
+		// reading is only to notice the other end going away
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			var discard string
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		type message struct {
+			Time    time.Time `json:"time"`
+			Message string    `json:"message"`
+		}
+		for {
+			select {
+			case line := <-lines:
+				if !logMatches(line, domain) {
+					continue
+				}
+				if err := websocket.JSON.Send(ws, message{line.time, line.text}); err != nil {
+					return
+				}
+			case <-gone:
+				return
+			}
+		}
+	},
+}
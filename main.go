@@ -2,75 +2,912 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
-	"log/syslog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/idna"
 )
 
 type App struct {
-	Server     *http.Server
-	Routes     map[string]*Proxy
-	RoutesFile string
-	Mu         sync.RWMutex
+	Server        *http.Server
+	Routes        map[string]*Proxy
+	RoutesFile    string
+	ProxyProtocol bool
+	HideHeaders   []string
+	ServerHeader  string
+
+	// Compress turns on response compression for routes that don't set
+	// their own preference.
+	Compress        bool
+	CompressMinSize int
+
+	// MaxRequestsPerIP caps how many requests one client can have in
+	// flight across every route.
+	MaxRequestsPerIP int
+	inflight         inflight
+
+	// Cache holds responses for routes that have caching turned on.
+	// PurgeOnChange empties a route's share of it when its port changes.
+	Cache         *ResponseCache
+	PurgeOnChange bool
+
+	Stats Stats
+
+	// AcmeWebroot is where an outside acme client like certbot drops its
+	// http-01 challenge files, served on port 80 next to our own.
+	AcmeWebroot string
+
+	// RobotsTxt and SecurityTxt are answered for /robots.txt and
+	// /.well-known/security.txt on routes without their own.
+	RobotsTxt   []byte
+	SecurityTxt []byte
+
+	// AccessLog logs every request, successful ones only one in
+	// AccessLogSample of them.
+	AccessLog       bool
+	AccessLogSample int
+	accessSeq       atomic.Uint64
+
+	// LogFingerprints logs the TLS fingerprint of every connection and
+	// BlockedFingerprints are turned away on every route.
+	LogFingerprints     bool
+	BlockedFingerprints map[string]bool
+
+	// Store keeps the routes, stats and route history in sqlite instead of
+	// the routes file, nil without -store.
+	Store *routeStore
+
+	// Autosave is when route changes are saved, and unsaved the changes
+	// waiting for it.
+	Autosave autosavePolicy
+	unsaved  unsavedRoutes
+
+	// History keeps each route's changes in a file when there's no Store,
+	// nil when -history-file is empty.
+	History *historyFile
+
+	// TenantBackends are where tenant tokens may point routes, nowhere
+	// without -tenant-backends.
+	TenantBackends backendRules
+
+	// TenantDir holds a directory for each tenant, the only place the
+	// routes a tenant token puts can take files from.
+	TenantDir string
+
+	// StatsFile keeps the stats counters between restarts when there's no
+	// Store.
+	StatsFile string
+
+	// Traffic counts the bytes each domain takes in and sends out a month.
+	Traffic *trafficLedger
+
+	// TLSHeaders passes the tls details of connections on :443 to backends
+	// in X-TLS-* headers.
+	TLSHeaders bool
+
+	// Anomalies watches for sudden jumps in each domain's traffic, nil
+	// when -anomaly-factor is 0.
+	Anomalies *anomalyDetector
+
+	// Tarpit holds blocked and rate limited clients with a slow trickle
+	// response instead of a quick error, nil when -tarpit is off.
+	Tarpit *tarpit
+
+	// BadBots is the shared list of bad bot user agents bot rules with
+	// known_bad check for.
+	BadBots []string
+
+	// Tokens are who may use the admin api, unless AdminCA is set and
+	// client certificates are used instead.
+	Tokens  *tokenStore
+	AdminCA *adminCA
+
+	// AdminGuard limits who can reach the admin api and how often, and
+	// keeps the audit log.
+	AdminGuard *adminGuard
+
+	// HTTPAddr and HTTPSAddr are where the acme challenges and redirects,
+	// and the routes over https, are served, comma separated for more than
+	// one address. IPVersion keeps every listener to "4" or "6", empty for
+	// both.
+	HTTPAddr  string
+	HTTPSAddr string
+	IPVersion string
+
+	// Certs issues and renews certificates, nil in dev mode.
+	Certs *autocert.Manager
+
+	// ACMEDirectory is the ca certificates come from, let's encrypt when
+	// empty. ACMEEmail is the account's contact for expiry notices and
+	// ACMEEAB binds the account to one at cas that want it.
+	ACMEDirectory string
+	ACMEEmail     string
+	ACMEEAB       *acme.ExternalAccountBinding
+
+	// CertCache is where certificates, their keys and the acme account
+	// are kept, the tls directory unless -cert-store says otherwise.
+	CertCache autocert.Cache
+
+	// Groups issues the certificates shared by routes with a cert_group,
+	// nil in dev mode.
+	Groups *certGroups
+
+	// Issuance limits the certificates wildcard routes can be made to
+	// request.
+	Issuance *issuanceGuard
+
+	// certTries keeps domains whose certificate attempts are failing
+	// from asking acme again too soon.
+	certTries certTracker
+
+	// CheckDNS has the shell check a domain points here when it's added.
+	// PublicIPs are this machine's public addresses to check against,
+	// looked up when they're not given.
+	CheckDNS   bool
+	PublicIPs  []string
+	publicOnce sync.Once
+	public     map[string]bool
+
+	// Forwards pass whole tcp and udp ports through to other services.
+	Forwards *forwardSet
+
+	// TunnelHost is the name appserve connect clients open tunnels on,
+	// empty to take none.
+	TunnelHost string
+
+	// Dev serves plain http on a high port with no acme, answering for
+	// every route under .localhost and .test as well.
+	Dev bool
+
+	// RoutesKey, when set, is the key a routes file has to be signed with
+	// to be loaded or pushed through the admin api.
+	RoutesKey *routesKey
+
+	// taps are the requests being captured for the tap command.
+	taps tapSet
+
+	// recordings sample requests for the record command, to replay later.
+	recordings recordingSet
+
+	// Geo finds the country and network of client ips for the access log
+	// and stats, nil without a geoip database.
+	Geo *geoDB
+
+	// Mu guards Routes, which is only touched from the shell. requests are
+	// routed from table, a copy republished after every change so the hot
+	// path never waits on a lock.
+	Mu    sync.RWMutex
+	table atomic.Value // *routeTable
+
+	// published is the routes as of the last publishRoutes, to tell what
+	// changed for route events.
+	published map[string]DomainRoute
 }
 
 type DomainRoute struct {
 	Domain string `json:"domain"`
-	Port   string `json:"port"`
+
+	// Port is a local port, or host:port for a backend elsewhere.
+	Port string `json:"port"`
+
+	// Root makes this a static route, serving files from a directory
+	// instead of proxying to a port.
+	Root string `json:"root,omitempty"`
+
+	// Parked makes this a placeholder route that serves a coming soon page
+	// until there's something to point the domain at.
+	Parked bool `json:"parked,omitempty"`
+	RouteOptions
+}
+
+// RouteOptions are the optional per-route settings that live next to the
+// domain and port in the routes file. Everything here must be safe to leave
+// at its zero value.
+type RouteOptions struct {
+	// Tenant is the team or person the route belongs to. admin api tokens
+	// for a tenant only see and manage its routes.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Tags, Owner and Notes say what a route is for and whose it is, for
+	// list and the admin api to sort through. Owner is an email address.
+	Tags  []string `json:"tags,omitempty"`
+	Owner string   `json:"owner,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+
+	// CookieDomain rewrites the Domain attribute of cookies set by the
+	// backend, keyed by the domain the backend uses ("*" matches any).
+	// An empty value drops the attribute so the cookie becomes host-only.
+	CookieDomain map[string]string `json:"cookie_domain,omitempty"`
+
+	// CookiePath rewrites the Path attribute of cookies set by the backend,
+	// replacing the longest matching prefix.
+	CookiePath map[string]string `json:"cookie_path,omitempty"`
+
+	// HideHeaders are stripped from responses on top of the global list.
+	HideHeaders []string `json:"hide_headers,omitempty"`
+
+	// Transforms rewrite text response bodies, applied in order.
+	Transforms []BodyTransform `json:"transforms,omitempty"`
+
+	// Compress overrides the global -compress setting for this route.
+	Compress *bool `json:"compress,omitempty"`
+
+	// Bandwidth caps the combined response rate of the whole route and
+	// BandwidthPerConn that of each client connection, as a size per
+	// second like "2MB".
+	Bandwidth        string `json:"bandwidth,omitempty"`
+	BandwidthPerConn string `json:"bandwidth_per_conn,omitempty"`
+
+	// MaxRequests caps the requests in flight to the backend, and
+	// MaxRequestsPerIP how many of those one client can hold. Requests
+	// over the limit get a 503.
+	MaxRequests      int `json:"max_requests,omitempty"`
+	MaxRequestsPerIP int `json:"max_requests_per_ip,omitempty"`
+
+	// QueueDepth lets that many requests over MaxRequests wait up to
+	// QueueTimeout (default 5s) for a free slot before getting the 503.
+	QueueDepth   int    `json:"queue_depth,omitempty"`
+	QueueTimeout string `json:"queue_timeout,omitempty"`
+
+	// Streaming passes responses through as the backend sends them, flushed
+	// straight away and never cached or compressed, for long polling,
+	// downloads and video.
+	Streaming bool `json:"streaming,omitempty"`
+
+	// Cache keeps cacheable responses in memory. CacheTTL, like "10m",
+	// replaces whatever freshness the backend's headers ask for.
+	Cache    bool   `json:"cache,omitempty"`
+	CacheTTL string `json:"cache_ttl,omitempty"`
+
+	// CacheStaleWhileRevalidate serves expired responses for this long
+	// while a fresh copy is fetched in the background, CacheStaleIfError
+	// serves them for this long when the backend is failing. both replace
+	// the backend's own stale-* directives.
+	CacheStaleWhileRevalidate string `json:"cache_stale_while_revalidate,omitempty"`
+	CacheStaleIfError         string `json:"cache_stale_if_error,omitempty"`
+
+	// CacheVary lists request headers, beyond Accept-Encoding, that
+	// responses may vary on and still be cached per variant.
+	CacheVary []string `json:"cache_vary,omitempty"`
+
+	// CacheErrors caches 404, 410 and 5xx responses for this long, so
+	// something hammering bad urls doesn't reach the backend every time.
+	CacheErrors string `json:"cache_errors,omitempty"`
+
+	// ContentRules tune caching and compression by media type, the first
+	// matching rule wins.
+	ContentRules []ContentRule `json:"content_rules,omitempty"`
+
+	// SPAFallback serves the root index.html for paths that don't exist on
+	// a static route, for single page apps doing their own routing.
+	SPAFallback bool `json:"spa_fallback,omitempty"`
+
+	// DirectoryListing shows the contents of directories without an
+	// index.html on a static route. off unless asked for.
+	DirectoryListing bool `json:"directory_listing,omitempty"`
+
+	// MimeTypes maps file extensions to the content type a static route
+	// sends for them, ahead of the built in table.
+	MimeTypes map[string]string `json:"mime_types,omitempty"`
+
+	// Charset is added to textual content types on a static route that
+	// don't name one.
+	Charset string `json:"charset,omitempty"`
+
+	// CacheControl picks the Cache-Control header for files on a static
+	// route by path or extension, the first matching rule wins.
+	CacheControl []CacheControlRule `json:"cache_control,omitempty"`
+
+	// ParkedTemplate is an html template file to use for a parked route's
+	// page instead of the built in one.
+	ParkedTemplate string `json:"parked_template,omitempty"`
+
+	// Priority settles which route answers when several match a request,
+	// higher first. without it the most specific host wins, then the
+	// longest path.
+	Priority int `json:"priority,omitempty"`
+
+	// MonthlyQuota is how much traffic, in and out together, the route's
+	// domain may use a month, as a size like "50GB". going over it sends a
+	// quota webhook, and with QuotaAction "block" an over quota page until
+	// the month is out.
+	MonthlyQuota string `json:"monthly_quota,omitempty"`
+	QuotaAction  string `json:"quota_action,omitempty"`
+
+	// BotRules block or challenge requests by their User-Agent, the first
+	// matching rule wins.
+	BotRules []BotRule `json:"bot_rules,omitempty"`
+
+	// Methods are the only request methods the route takes, anything else
+	// gets a 405 without reaching the backend. GET lets HEAD through too.
+	Methods []string `json:"methods,omitempty"`
+
+	// TrailingSlash is "add" or "remove" to redirect paths to the one form,
+	// MergeSlashes redirects paths with // to a single slash and CleanDots
+	// those with . and .. segments to where they point, so the backend only
+	// sees one url for each page.
+	TrailingSlash string `json:"trailing_slash,omitempty"`
+	MergeSlashes  bool   `json:"merge_slashes,omitempty"`
+	CleanDots     bool   `json:"clean_dots,omitempty"`
+
+	// HTTPOnly serves the route over plain http on :80, never redirected
+	// to https and never given a certificate, for internal health checks
+	// and devices that can't speak tls.
+	HTTPOnly bool `json:"http_only,omitempty"`
+
+	// Schedule puts the route in maintenance or turns it off for the
+	// windows its rules give, the first rule in effect wins.
+	// ScheduleTimezone is the zone "every" windows are in, the server's own
+	// without it. MaintenanceTemplate is an html template file for the
+	// maintenance page instead of the built in one.
+	Schedule            []ScheduleRule `json:"schedule,omitempty"`
+	ScheduleTimezone    string         `json:"schedule_timezone,omitempty"`
+	MaintenanceTemplate string         `json:"maintenance_template,omitempty"`
+
+	// CertGroup puts the route's domain on one certificate with every
+	// other domain in the same group, to stay under a ca's rate limits.
+	CertGroup string `json:"cert_group,omitempty"`
+
+	// Listeners are the names of the listeners the route is served on,
+	// from -listeners, with "default" for :80 and :443. without it the
+	// route is only on :80 and :443.
+	Listeners []string `json:"listeners,omitempty"`
+
+	// BackendProtocol is how to talk to the backend: "http" (the
+	// default), "https" to use tls and http/2 when the backend offers it,
+	// "h2c" for http/2 without tls, "fastcgi" for php-fpm and the like, or
+	// "uwsgi" for python apps run by uWSGI.
+	// BackendInsecure skips checking the backend's certificate, for self
+	// signed ones.
+	BackendProtocol string `json:"backend_protocol,omitempty"`
+	BackendInsecure bool   `json:"backend_insecure,omitempty"`
+
+	// SendProxyProtocol starts each backend connection with a PROXY
+	// protocol header, "v1" or "v2", carrying the client's address.
+	SendProxyProtocol string `json:"send_proxy_protocol,omitempty"`
+
+	// FastCGIRoot is the directory a fastcgi backend's scripts are in,
+	// files in it that aren't scripts are served straight from disk.
+	// FastCGIIndex is the script for paths that don't name one,
+	// index.php by default, and FastCGIParams are extra variables to set.
+	FastCGIRoot   string            `json:"fastcgi_root,omitempty"`
+	FastCGIIndex  string            `json:"fastcgi_index,omitempty"`
+	FastCGIParams map[string]string `json:"fastcgi_params,omitempty"`
+
+	// UWSGIScriptName is the path a uwsgi backend's app is mounted at, left
+	// out of PATH_INFO, and UWSGIParams are extra variables to set.
+	UWSGIScriptName string            `json:"uwsgi_script_name,omitempty"`
+	UWSGIParams     map[string]string `json:"uwsgi_params,omitempty"`
+
+	// OwnPool gives the route's backend a connection pool of its own
+	// instead of sharing one with every other route. PoolMaxIdle and
+	// PoolMaxConns cap it, either implies OwnPool.
+	OwnPool      bool `json:"own_pool,omitempty"`
+	PoolMaxIdle  int  `json:"pool_max_idle,omitempty"`
+	PoolMaxConns int  `json:"pool_max_conns,omitempty"`
+
+	// AccessLog turns the access log on or off for this route whatever
+	// -access-log says. AccessLogExclude leaves out paths matching any of
+	// its patterns (health checks), AccessLogMinStatus leaves out anything
+	// below that status and AccessLogSample keeps one in that many
+	// successful requests in place of -access-log-sample.
+	AccessLog          *bool    `json:"access_log,omitempty"`
+	AccessLogExclude   []string `json:"access_log_exclude,omitempty"`
+	AccessLogMinStatus int      `json:"access_log_min_status,omitempty"`
+	AccessLogSample    int      `json:"access_log_sample,omitempty"`
+
+	// BlockTLSFingerprints turns away clients whose TLS fingerprint, a ja3
+	// hash or a ja4 string, is in the list.
+	BlockTLSFingerprints []string `json:"block_tls_fingerprints,omitempty"`
+
+	// RobotsTxt and SecurityTxt are files answered for /robots.txt and
+	// /.well-known/security.txt in place of the global ones.
+	RobotsTxt   string `json:"robots_txt,omitempty"`
+	SecurityTxt string `json:"security_txt,omitempty"`
+
+	// SupplementTextFiles appends those files to the backend's own copy
+	// instead of replacing it.
+	SupplementTextFiles bool `json:"supplement_text_files,omitempty"`
 }
 
 type Proxy struct {
-	Port  string
-	Proxy *httputil.ReverseProxy
+	Port   string
+	Proxy  *httputil.ReverseProxy
+	Root   string
+	Parked bool
+	RouteOptions
+
+	// handler answers requests for the route, the reverse proxy or the
+	// file server of a static route
+	handler http.Handler
+
+	// mock is set while the mock command stands in for the route
+	mock *mockHandler
+
+	// tunnel is set for routes served down a tunnel from appserve connect
+	tunnel *tunnel
+
+	limiter     *bandwidthLimiter
+	connLimitBW int64
+
+	inflight     inflight
+	queueTimeout time.Duration
+
+	cacheTTL             time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	cacheErrors          time.Duration
+	cacheVary            []string
+	robotsTxt            []byte
+	securityTxt          []byte
+	accessSeq            atomic.Uint64
+	contentRules         []contentRule
+
+	methods  map[string]bool
+	allow    string
+	botRules []botRule
+	quota    uint64
+
+	schedule    []scheduleRule
+	scheduleLoc *time.Location
+	scheduled   atomic.Pointer[scheduleState]
+	maintenance *template.Template
 }
 type SerializableProxy struct {
 	Port   string `json:"port"`
 	Domain string `json:"domain"`
+	Root   string `json:"root,omitempty"`
+	Parked bool   `json:"parked,omitempty"`
+	RouteOptions
 }
 
 func main() {
+	// subcommands run on their own and exit, no server involved
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "token":
+			runToken(os.Args[2:])
+			return
+		case "admin-cert":
+			runAdminCert(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "fleet":
+			runFleet(os.Args[2:])
+			return
+		case "bundle":
+			runBundle(os.Args[2:])
+			return
+		case "hosts":
+			runHosts(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "connect":
+			runConnect(os.Args[2:])
+			return
+		case "certs":
+			runCerts(os.Args[2:])
+			return
+		}
+	}
+
+	routesFile := flag.String("routes", "routes.json", "path to the routes file")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "expect a PROXY protocol v1/v2 header on every :80/:443 connection")
+	hideHeaders := flag.String("hide-headers", "", "comma separated response headers to strip, e.g. Server,X-Powered-By")
+	serverHeader := flag.String("server-header", "", "value to send in the Server header of every response")
+	compress := flag.Bool("compress", false, "compress eligible responses with br, zstd or gzip")
+	compressMinSize := flag.Int("compress-min-size", 1024, "smallest response body in bytes worth compressing")
+	maxRequestsPerIP := flag.Int("max-requests-per-ip", 0, "most requests one client ip may have in flight, 0 for no limit")
+	cacheSize := flag.String("cache-size", "64MB", "memory given to the response cache")
+	cacheMaxObject := flag.String("cache-max-object", "1MB", "largest single response the cache will hold")
+	purgeOnChange := flag.Bool("cache-purge-on-change", false, "purge a route's cached responses when its port changes")
+	metricsAddr := flag.String("metrics", "", "address to serve prometheus metrics on, e.g. 127.0.0.1:9100")
+	adminAddr := flag.String("admin", "", "address to serve the admin api on, e.g. 127.0.0.1:2019")
+	dev := flag.Bool("dev", false, "dev mode: serve every route over plain http on -dev-addr, with no acme, answering for <domain>.localhost and <domain>.test too")
+	devAddr := flag.String("dev-addr", "127.0.0.1:8080", "address to serve on in dev mode")
+	devHTTPSAddr := flag.String("dev-https-addr", "127.0.0.1:8443", "address to serve https on in dev mode, with locally trusted certificates, empty for none")
+	devHosts := flag.Bool("dev-hosts", false, "in dev mode, keep <domain>.test names for every route in the hosts file, needs write access to it")
+	devCADir := flag.String("dev-ca-dir", devCADefault, "directory for dev mode's own ca when mkcert isn't installed")
+	harnessMode := flag.Bool("harness", false, "start on free loopback ports with in memory certificates, routes and admin token for integration tests, printing them as json")
+	routesPubkey := flag.String("routes-pubkey", "", "minisign public key routes files have to be signed with before load or the admin api will take them")
+	tokensFile := flag.String("tokens", "tokens.json", "path to the admin api tokens file")
+	adminAuth := flag.String("admin-auth", "token", "how admin api clients prove who they are: token or mtls")
+	adminAllow := flag.String("admin-allow", "", "comma separated addresses and cidr ranges allowed to reach the admin api, anyone when empty")
+	adminRate := flag.Float64("admin-rate", 10, "admin api calls a second allowed from each address, 0 for no limit")
+	adminAuditLog := flag.String("admin-audit-log", "", "file to log every admin api call to, with the token and address it came from")
+	adminTLSDir := flag.String("admin-tls-dir", adminCertDefault, "directory holding the ca for -admin-auth mtls")
+	cacheDir := flag.String("cache-dir", "", "directory for the on-disk cache tier, off when empty")
+	cacheDiskSize := flag.String("cache-disk-size", "1GB", "disk space given to the on-disk cache tier")
+	cacheDiskMaxObject := flag.String("cache-disk-max-object", "256MB", "largest single response the on-disk cache will hold")
+	acmeWebroot := flag.String("acme-webroot", "", "directory to serve /.well-known/acme-challenge/ files from for outside acme clients")
+	robotsTxt := flag.String("robots-txt", "", "file to answer /robots.txt with on every route")
+	securityTxt := flag.String("security-txt", "", "file to answer /.well-known/security.txt with on every route")
+	upstreamMaxIdle := flag.Int("upstream-max-idle", 0, "most idle backend connections kept across all routes, 0 for no limit")
+	upstreamMaxIdlePerHost := flag.Int("upstream-max-idle-per-host", 32, "most idle connections kept to each backend")
+	upstreamMaxConnsPerHost := flag.Int("upstream-max-conns-per-host", 0, "most connections open to each backend, 0 for no limit")
+	upstreamIdleTimeout := flag.Duration("upstream-idle-timeout", 90*time.Second, "how long an idle backend connection is kept")
+	upstreamDialTimeout := flag.Duration("upstream-dial-timeout", 5*time.Second, "how long connecting to a backend may take")
+	upstreamTLSTimeout := flag.Duration("upstream-tls-timeout", 10*time.Second, "how long a tls handshake with a backend may take")
+	upstreamHeaderTimeout := flag.Duration("upstream-header-timeout", 0, "how long to wait for a backend's response headers, 0 for no limit")
+	upstreamDNSTTL := flag.Duration("upstream-dns-ttl", 30*time.Second, "how often to re-resolve backend hostnames, 0 to never")
+	logDest := flag.String("log", "auto", "where to log: auto, system (syslog or the windows event log), stderr or stdout")
+	logShip := flag.String("log-ship", "", "also send logs to syslog+tcp://, syslog+tls://, loki+http(s):// or an http(s) endpoint")
+	logShipBuffer := flag.Int("log-ship-buffer", 10000, "log lines held while the shipping target is slow or down before dropping")
+	accessLog := flag.Bool("access-log", false, "log every request")
+	accessLogSample := flag.Int("access-log-sample", 1, "log only one in this many successful requests, errors are always logged")
+	logFingerprints := flag.Bool("log-tls-fingerprints", false, "log the ja3 and ja4 fingerprint of every tls connection")
+	storeFile := flag.String("store", "", "keep the routes, stats and a history of route changes in this sqlite database instead of the routes file")
+	autosaveFlag := flag.String("autosave", "change", "when route changes are saved: change for every change, off for only with save, or how often like 5m")
+	historyFileFlag := flag.String("history-file", "history.jsonl", "file each change to the routes is kept in, who made it and what it was, empty for none")
+	tenantBackends := flag.String("tenant-backends", "", "backends tenant tokens may point routes at, like 10.0.5.0/24,localhost:3000-3999, none by default")
+	tenantDir := flag.String("tenant-dir", "tenants", "directory with a directory for each tenant, the only files tenant tokens can point routes at")
+	statsFile := flag.String("stats-file", "stats.json", "file the requests, bytes and errors counted for each domain are kept in between restarts, empty for none")
+	trafficFile := flag.String("traffic-file", "traffic.json", "file the traffic each domain used by month is kept in")
+	tlsHeadersFlag := flag.Bool("tls-headers", false, "tell backends the tls version, cipher and server name of requests on :443 in X-TLS-* headers")
+	anomalyFactor := flag.Float64("anomaly-factor", 5, "alert when a domain's requests or clients a minute jump this many times past normal, 0 for off")
+	anomalyMinRequests := flag.Int("anomaly-min-requests", 100, "requests a minute a domain needs before its traffic can be called unusual")
+	tarpitMax := flag.Int("tarpit", 0, "answer up to this many blocked or rate limited clients at once with a slow trickle instead of a quick error, 0 for off")
+	tarpitHold := flag.Duration("tarpit-time", 5*time.Minute, "longest a client is kept in the tarpit")
+	badBots := flag.String("bad-bots", "", "file of user agent patterns to add to the built in list of bad bots, one a line")
+	blockFingerprints := flag.String("block-tls-fingerprints", "", "file of ja3 hashes or ja4 fingerprints to turn away on every route, one a line")
+	geoipDB := flag.String("geoip-db", "", "maxmind format country or city database for tagging requests with a country")
+	geoipASNDB := flag.String("geoip-asn-db", "", "maxmind format asn database for tagging requests with a network")
+	securityLogFile := flag.String("security-log", "", "file to write rate limit hits and blocked requests to, for fail2ban or crowdsec")
+	webhooksFile := flag.String("webhooks", "", "json file of webhooks to call when routes, certificates or backends change")
+	httpAddr := flag.String("http-addr", ":80", "address to answer acme challenges and redirect to https on, comma separated for several")
+	httpsAddr := flag.String("https-addr", ":443", "address to serve the routes over https on, comma separated for several")
+	ipVersion := flag.String("ip-version", "dual", "listen on ipv4 and ipv6 (dual), or only 4 or 6")
+	listenersFile := flag.String("listeners", "", "json file of extra ports, each serving the routes that name it in listeners")
+	forwardsFile := flag.String("forwards", "forwards.json", "file of tcp and udp ports to pass through to other services")
+	checkDNS := flag.Bool("check-dns", false, "warn when a domain added in the shell doesn't point at this machine")
+	publicIPs := flag.String("public-ip", "", "this machine's public addresses, comma separated, for -check-dns (looked up when empty)")
+	maxNewCerts := flag.Int("max-new-certs", 20, "most certificates to request in an hour for names only a wildcard route covers, 0 for no limit")
+	maxCertHosts := flag.Int("max-cert-hosts", 500, "most names only a wildcard route covers to keep certificates for, 0 for no limit")
+	certDeny := flag.String("cert-deny", "", "comma separated names never to request a certificate for under a wildcard route, *.name for everything under it")
+	certStore := flag.String("cert-store", "tls", "where to keep certificates and keys: a directory, or vault:<kv v2 path> like vault:secret/appserve")
+	vaultAddr := flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "address of the vault for -cert-store vault:, the token comes from $VAULT_TOKEN")
+	acmeCA := flag.String("acme-ca", "letsencrypt", "where certificates come from: letsencrypt, letsencrypt-staging, zerossl, google or an acme directory url")
+	acmeEmail := flag.String("acme-email", "", "contact address for the acme account, for expiry notices")
+	acmeEABKid := flag.String("acme-eab-kid", "", "external account binding key id, for cas that need one (zerossl, google)")
+	acmeEABHMAC := flag.String("acme-eab-hmac", "", "external account binding hmac key, $APPSERVE_EAB_HMAC by default")
+	tunnelHost := flag.String("tunnel-host", "", "take tunnels from appserve connect on this name, e.g. edge.example.com")
+	flag.Parse()
 
 	// setting up the logger
-	logger, err := syslog.NewLogger(syslog.LOG_INFO|syslog.LOG_DAEMON, log.LstdFlags)
+	setupLogging(*logDest)
+	if *logShip != "" {
+		shipper, err := shipLogs(*logShip, *logShipBuffer)
+		if err != nil {
+			log.Fatalf("Invalid -log-ship: %v", err)
+		}
+		defer shipper.Close()
+	}
+	// keep the latest lines around for logs tail
+	log.SetOutput(&teeWriter{local: log.Writer(), remote: recentLogs})
+	if *securityLogFile != "" {
+		events, err := openSecurityLog(*securityLogFile)
+		if err != nil {
+			log.Fatalf("Invalid -security-log: %v", err)
+		}
+		securityEvents = events
+	}
+	if *webhooksFile != "" {
+		hooks, err := loadWebhooks(*webhooksFile)
+		if err != nil {
+			log.Fatalf("Invalid -webhooks: %v", err)
+		}
+		for _, hook := range hooks {
+			go hook.run()
+		}
+	}
+
+	maxCache, err := parseSize(*cacheSize)
 	if err != nil {
-		log.Fatalf("Failed to initialize syslog logger: %v", err)
-		return
+		log.Fatalf("Invalid -cache-size: %v", err)
+	}
+	maxCacheObject, err := parseSize(*cacheMaxObject)
+	if err != nil {
+		log.Fatalf("Invalid -cache-max-object: %v", err)
 	}
-	log.SetOutput(logger.Writer())
-	routesFile := "routes.json"
+
+	upstreams = newTransports(transportConfig{
+		MaxIdleConns:          *upstreamMaxIdle,
+		MaxIdleConnsPerHost:   *upstreamMaxIdlePerHost,
+		MaxConnsPerHost:       *upstreamMaxConnsPerHost,
+		IdleConnTimeout:       *upstreamIdleTimeout,
+		DialTimeout:           *upstreamDialTimeout,
+		TLSHandshakeTimeout:   *upstreamTLSTimeout,
+		ResponseHeaderTimeout: *upstreamHeaderTimeout,
+	})
 
 	// initializing a new app object
 	app := &App{
-		Routes:     make(map[string]*Proxy),
-		RoutesFile: routesFile,
+		Routes:        make(map[string]*Proxy),
+		RoutesFile:    *routesFile,
+		TenantDir:     *tenantDir,
+		ProxyProtocol: *proxyProtocol,
+		HideHeaders:   splitList(*hideHeaders),
+		ServerHeader:  *serverHeader,
+
+		Compress:        *compress,
+		CompressMinSize: *compressMinSize,
+
+		MaxRequestsPerIP: *maxRequestsPerIP,
+
+		Cache:         NewResponseCache(maxCache, maxCacheObject),
+		PurgeOnChange: *purgeOnChange,
+
+		AcmeWebroot: *acmeWebroot,
+		ACMEEmail:   *acmeEmail,
+
+		AccessLog:       *accessLog,
+		AccessLogSample: *accessLogSample,
+
+		LogFingerprints: *logFingerprints,
+
+		Tokens: &tokenStore{file: *tokensFile},
+
+		Dev: *dev,
+
+		HTTPAddr:  *httpAddr,
+		HTTPSAddr: *httpsAddr,
+
+		Forwards: &forwardSet{file: *forwardsFile},
+
+		TunnelHost: NormalizeDomain(*tunnelHost),
+
+		CheckDNS: *checkDNS,
+	}
+	app.CertCache = autocert.DirCache(*certStore)
+	if path, ok := strings.CutPrefix(*certStore, "vault:"); ok && !*dev {
+		vault, err := newVaultCache(*vaultAddr, path)
+		if err != nil {
+			log.Fatalf("Invalid -cert-store: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err = vault.list(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("Invalid -cert-store: can't reach vault at %s: %v", *vaultAddr, err)
+		}
+		log.Printf("Keeping certificates and keys in vault at %s, %s", *vaultAddr, path)
+		app.CertCache = vault
+	}
+	if app.ACMEDirectory, err = acmeDirectory(*acmeCA); err != nil {
+		log.Fatalf("Invalid -acme-ca: %v", err)
+	}
+	if *acmeEABHMAC == "" {
+		*acmeEABHMAC = os.Getenv("APPSERVE_EAB_HMAC")
+	}
+	if app.ACMEEAB, err = parseEAB(*acmeEABKid, *acmeEABHMAC); err != nil {
+		log.Fatalf("Invalid -acme-eab-kid or -acme-eab-hmac: %v", err)
+	}
+	if where, ok := eabRequired[app.ACMEDirectory]; ok && app.ACMEEAB == nil && !*dev {
+		log.Fatalf("%s needs external account binding, pass -acme-eab-kid and -acme-eab-hmac from %s", *acmeCA, where)
+	}
+	for _, ip := range strings.Split(*publicIPs, ",") {
+		if ip = strings.TrimSpace(ip); ip == "" {
+			continue
+		}
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			log.Fatalf("Invalid -public-ip: %q isn't an ip address", ip)
+		}
+		app.PublicIPs = append(app.PublicIPs, parsed.String())
+	}
+	if app.IPVersion, err = parseIPVersion(*ipVersion); err != nil {
+		log.Fatalf("Invalid -ip-version: %v", err)
+	}
+	switch *adminAuth {
+	case "token":
+	case "mtls":
+		if app.AdminCA, err = openAdminCA(*adminTLSDir); err != nil {
+			log.Fatalf("Invalid -admin-tls-dir: %v", err)
+		}
+	default:
+		log.Fatalf("Invalid -admin-auth %q, expected token or mtls", *adminAuth)
+	}
+	if *routesPubkey != "" {
+		if app.RoutesKey, err = readRoutesKey(*routesPubkey); err != nil {
+			log.Fatalf("Invalid -routes-pubkey: %v", err)
+		}
+	}
+	if app.TenantBackends, err = parseBackendRules(*tenantBackends); err != nil {
+		log.Fatalf("Invalid -tenant-backends: %v", err)
+	}
+	app.AdminGuard = &adminGuard{rate: *adminRate}
+	if app.AdminGuard.allow, err = parseAllowList(*adminAllow); err != nil {
+		log.Fatalf("Invalid -admin-allow: %v", err)
+	}
+	if *adminAuditLog != "" {
+		if app.AdminGuard.audit, err = openSecurityLog(*adminAuditLog); err != nil {
+			log.Fatalf("Invalid -admin-audit-log: %v", err)
+		}
+	}
+	if *geoipDB != "" || *geoipASNDB != "" {
+		if app.Geo, err = openGeoDB(*geoipDB, *geoipASNDB); err != nil {
+			log.Fatalf("Invalid geoip database: %v", err)
+		}
+	}
+	if *blockFingerprints != "" {
+		if app.BlockedFingerprints, err = loadFingerprints(*blockFingerprints); err != nil {
+			log.Fatalf("Invalid -block-tls-fingerprints: %v", err)
+		}
+	}
+	if app.Autosave, err = parseAutosave(*autosaveFlag); err != nil {
+		log.Fatalf("Invalid -autosave: %v", err)
+	}
+	if app.Traffic, err = loadTrafficLedger(*trafficFile); err != nil {
+		log.Fatalf("Invalid -traffic-file: %v", err)
+	}
+	go app.Traffic.run()
+	app.TLSHeaders = *tlsHeadersFlag
+	if app.Anomalies = newAnomalyDetector(*anomalyFactor, *anomalyMinRequests); app.Anomalies != nil {
+		go app.runAnomalies()
+	}
+	app.Tarpit = newTarpit(*tarpitMax, *tarpitHold)
+	app.BadBots = defaultBadBots
+	if *badBots != "" {
+		extra, err := loadBadBots(*badBots)
+		if err != nil {
+			log.Fatalf("Invalid -bad-bots: %v", err)
+		}
+		app.BadBots = append(app.BadBots[:len(app.BadBots):len(app.BadBots)], extra...)
+	}
+	if *robotsTxt != "" {
+		if app.RobotsTxt, err = os.ReadFile(*robotsTxt); err != nil {
+			log.Fatalf("Invalid -robots-txt: %v", err)
+		}
+	}
+	if *securityTxt != "" {
+		if app.SecurityTxt, err = os.ReadFile(*securityTxt); err != nil {
+			log.Fatalf("Invalid -security-txt: %v", err)
+		}
 	}
 
-	// load the routes we have already
-	loadedRoutes, err := LoadRoutes(routesFile)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Fatal(err)
+	if *cacheDir != "" {
+		maxDisk, err := parseSize(*cacheDiskSize)
+		if err != nil {
+			log.Fatalf("Invalid -cache-disk-size: %v", err)
 		}
-	} else {
-		app.Routes = loadedRoutes
+		maxDiskObject, err := parseSize(*cacheDiskMaxObject)
+		if err != nil {
+			log.Fatalf("Invalid -cache-disk-max-object: %v", err)
+		}
+		if err := app.Cache.EnableDisk(*cacheDir, maxDisk, maxDiskObject); err != nil {
+			log.Fatalf("Failed to set up the disk cache in %s: %v", *cacheDir, err)
+		}
+	}
+
+	// load the routes we have already. the harness starts empty unless it's
+	// given a routes file outright, and never writes it back
+	routesGiven := false
+	flag.Visit(func(f *flag.Flag) { routesGiven = routesGiven || f.Name == "routes" })
+	if *storeFile != "" && !*harnessMode {
+		if err := app.loadStore(*storeFile); err != nil {
+			log.Fatalf("Invalid -store: %v", err)
+		}
+	} else if !*harnessMode || routesGiven {
+		loadedRoutes, err := LoadRoutes(app.RoutesFile, app.RoutesKey)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+		} else {
+			app.Routes = loadedRoutes
+		}
+		if !*harnessMode {
+			if app.History, err = newHistoryFile(*historyFileFlag, app.Routes); err != nil {
+				log.Fatalf("Invalid -history-file: %v", err)
+			}
+		}
+	}
+	app.publishRoutes()
+
+	// counters from before a restart carry on, the harness starts at zero
+	if !*harnessMode {
+		if app.Store == nil {
+			app.StatsFile = *statsFile
+			if err := loadStatsFile(app.StatsFile, &app.Stats); err != nil {
+				log.Fatalf("Invalid -stats-file: %v", err)
+			}
+		}
+		go app.runStats()
+	}
+
+	if *harnessMode {
+		h, err := app.startHarness()
+		if err != nil {
+			log.Fatalf("Failed to start the harness: %v", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(h)
+		select {}
 	}
 
 	// start the server in a goroutine
-	go app.startServer()
+	if app.Dev {
+		go app.startDevServer(*devAddr)
+		if *devHTTPSAddr != "" {
+			ca, err := openDevCA(*devCADir)
+			if err != nil {
+				log.Fatalf("Failed to set up the dev ca: %v", err)
+			}
+			go app.startDevTLSServer(*devHTTPSAddr, ca)
+		}
+		if *devHosts {
+			go app.syncDevHosts(defaultHostsFile())
+		}
+	} else {
+		app.Certs = app.newCertManager()
+		app.Issuance = newIssuanceGuard(*maxNewCerts, *maxCertHosts, strings.Split(*certDeny, ","), cachedCertNames(app.certCache()))
+		app.Groups = newCertGroups(app.certCache())
+		app.Mu.Lock()
+		app.Groups.update(app.Routes)
+		app.Mu.Unlock()
+		go app.runCertGroups()
+		go app.startServer()
+	}
+	if *listenersFile != "" {
+		listeners, err := loadListeners(*listenersFile)
+		if err != nil {
+			log.Fatalf("Invalid -listeners: %v", err)
+		}
+		for _, l := range listeners {
+			go app.serveListener(l)
+		}
+	}
+	forwards, err := loadForwards(app.Forwards.file)
+	if err != nil {
+		log.Fatalf("Invalid -forwards: %v", err)
+	}
+	for _, f := range forwards {
+		if err := app.startForward(f); err != nil {
+			log.Printf("Error starting the forward on %s: %v", f.Listen, err)
+		}
+	}
+	if *upstreamDNSTTL > 0 {
+		go backendHosts.run(context.Background(), *upstreamDNSTTL)
+	}
+	if *metricsAddr != "" {
+		go app.serveMetrics(*metricsAddr)
+	}
+	if *adminAddr != "" {
+		go app.serveAdmin(*adminAddr)
+	}
+	go app.runSchedules()
+	if app.Autosave.every > 0 {
+		go app.runAutosave()
+	}
 
 	// start accepting input from the user interactively
 	scanner := bufio.NewScanner(os.Stdin)
+	exitWarned := false
 	for {
 		fmt.Print("> ")
 		if !scanner.Scan() {
@@ -84,29 +921,126 @@ func main() {
 			continue
 		}
 
+		if app.RoutesKey != nil && signedOnlyCommands[args[0]] {
+			fmt.Printf("Error: %v\n", errSignedRoutes)
+			continue
+		}
+
 		// command handlers for the various things a user might do
 		switch args[0] {
 		case "list":
-			app.handleListCommand()
+			app.handleListCommand(parseListFilter(args[1:]))
 		case "add":
+			if len(args) < 3 {
+				fmt.Println("Error: Incorrect number of arguments. Expected: add <domain> <port> [--tags a,b] [--owner email] [--notes text]")
+				continue
+			}
+			meta, err := parseAddMeta(args[3:])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			app.handleAddCommand(args[1], args[2], meta)
+			app.preflightDNS(args[1])
+		case "edit":
+			app.handleEditCommand(args[1:])
+		case "add-static":
 			if len(args) != 3 {
-				fmt.Println("Error: Incorrect number of arguments. Expected: add <domain> <port>")
+				fmt.Println("Error: Incorrect number of arguments. Expected: add-static <domain> <directory>")
+				continue
+			}
+			app.handleAddStaticCommand(args[1], args[2])
+			app.preflightDNS(args[1])
+		case "park":
+			if len(args) != 2 {
+				fmt.Println("Error: Incorrect number of arguments. Expected: park <domain>")
 				continue
 			}
-			app.handleAddCommand(args[1], args[2])
+			app.handleParkCommand(args[1])
+			app.preflightDNS(args[1])
 		case "remove":
 			if len(args) != 2 {
 				fmt.Println("Error: Incorrect number of arguments. Expected: remove <domain>")
 				continue
 			}
 			app.handleRemoveCommand(NormalizeDomain(args[1]))
+		case "purge":
+			if len(args) < 2 || len(args) > 3 {
+				fmt.Println("Error: Incorrect number of arguments. Expected: purge <domain> [path-pattern]")
+				continue
+			}
+			pattern := ""
+			if len(args) == 3 {
+				pattern = args[2]
+			}
+			app.handlePurgeCommand(NormalizeDomain(args[1]), pattern)
+		case "stats":
+			domain := ""
+			if len(args) > 1 {
+				domain = NormalizeDomain(args[1])
+			}
+			app.handleStatsCommand(domain)
+		case "traffic":
+			domain := ""
+			if len(args) > 1 {
+				domain = NormalizeDomain(args[1])
+			}
+			app.handleTrafficCommand(domain)
+		case "history":
+			domain := ""
+			if len(args) > 1 {
+				domain = NormalizeDomain(args[1])
+			}
+			app.handleHistoryCommand(domain)
+		case "certs":
+			if len(args) > 1 {
+				app.handleCertsBackupCommand(args[1:])
+			} else {
+				app.handleCertsCommand()
+			}
+		case "logs":
+			handleLogsCommand(args[1:], scanner)
+		case "tap":
+			app.handleTapCommand(args[1:])
+		case "record":
+			app.handleRecordCommand(args[1:])
+		case "mock":
+			app.handleMockCommand(args[1:])
+		case "forward":
+			app.handleForwardCommand(args[1:])
+		case "ports":
+			app.handlePortsCommand()
 		case "save":
 			app.handleSaveCommand()
 		case "load":
 			app.handleLoadCommand()
 		case "help":
 			handleHelpCommand()
+		case "backup", "restore":
+			if len(args) != 2 {
+				fmt.Printf("Error: Incorrect number of arguments. Expected: %s <file.tar.gz>\n", args[0])
+				continue
+			}
+			if args[0] == "backup" {
+				app.handleBackupCommand(args[1])
+			} else {
+				app.handleRestoreCommand(args[1])
+			}
+		case "status":
+			app.handleStatusCommand()
 		case "exit":
+			if !app.confirmExit(&exitWarned) {
+				continue
+			}
+			if err := app.Traffic.save(); err != nil {
+				log.Printf("Error saving traffic: %v", err)
+			}
+			if err := app.saveStats(); err != nil {
+				log.Printf("Error saving stats: %v", err)
+			}
+			if err := app.Store.close(); err != nil {
+				log.Printf("Error closing the store: %v", err)
+			}
 			if app.Server != nil {
 				log.Println("Initiating server shutdown...")
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -128,275 +1062,1212 @@ func main() {
 	if err := scanner.Err(); err != nil {
 		log.Printf("Error reading from stdin: %v\n", err)
 	}
+
+	if err := app.saveStats(); err != nil {
+		log.Printf("Error saving stats: %v", err)
+	}
+
+	// stdin closing ends things too, with no chance to ask about changes
+	// that aren't saved
+	if n, _, _ := app.unsaved.state(); n > 0 && app.Autosave.off {
+		log.Printf("Dropping %d route changes that weren't saved, -autosave is off", n)
+	} else if n > 0 {
+		if err := app.saveUnsaved(); err != nil {
+			log.Printf("Error saving routes: %v", err)
+		}
+	}
+}
+
+// certCache is where certificates are kept, the tls directory when nothing
+// else was set up.
+func (app *App) certCache() autocert.Cache {
+	if app.CertCache == nil {
+		return autocert.DirCache("tls")
+	}
+	return app.CertCache
+}
+
+// newCertManager gets certificates for the routes, and for the names tls
+// forwards answer as.
+func (app *App) newCertManager() *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:                 autocert.AcceptTOS,
+		Email:                  app.ACMEEmail,
+		ExternalAccountBinding: app.ACMEEAB,
+		HostPolicy: func(ctx context.Context, host string) error {
+			host = NormalizeDomain(host)
+			if group := app.Groups.groupOf(host); group != "" {
+				return fmt.Errorf("acme/autocert: %s gets its certificate with cert group %s", host, group)
+			}
+			if app.Forwards.hasTLSName(host) || (host != "" && host == app.TunnelHost) {
+				return nil
+			}
+			if app.routeTable().wantsCert(host) {
+				// answering an acme challenge doesn't order anything,
+				// only handshakes count against the limits
+				if ctx.Value(http.ServerContextKey) != nil {
+					return nil
+				}
+				return app.allowNewCert(host)
+			}
+			return fmt.Errorf("acme/autocert: host %q not configured in HostPolicy", host)
+		},
+		Cache: certEvents{app.certCache()},
+	}
+	if app.ACMEDirectory != "" {
+		m.Client = &acme.Client{DirectoryURL: app.ACMEDirectory}
+	}
+	return m
+}
+
+// startServer sets up cerManager and an https api using a goroutine.
+func (app *App) startServer() {
+
+	certManager := app.Certs
+	tlsConfig := certManager.TLSConfig()
+	tlsConfig.GetCertificate = app.noteCertFailures(app.groupCertificates(tlsConfig.GetCertificate))
+
+	server := &http.Server{
+		Addr:      app.HTTPSAddr,
+		TLSConfig: tlsConfig,
+		Handler:   http.HandlerFunc(app.Handler()),
+
+		ConnContext: onListener(defaultListener, app.TLSHeaders),
+	}
+
+	go func() {
+		http.HandleFunc("/", app.Handler())
+		// Serve on HTTP to satisfy the ACME HTTP-01 challenge and then redirect to HTTPS.
+		ln, err := app.listen(app.HTTPAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler := app.Groups.challenges(app.httpOnlyRoutes(certManager.HTTPHandler(nil)))
+		if app.AcmeWebroot != "" {
+			handler = acmeWebrootHandler(app.AcmeWebroot, handler)
+		}
+		plain := &http.Server{Handler: handler, ConnContext: onListener(defaultListener, false)}
+		log.Fatal(plain.Serve(ln))
+	}()
+
+	ln, err := app.listen(server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = &helloListener{Listener: ln, logFingerprints: app.LogFingerprints}
+	log.Fatal(server.ServeTLS(ln, "", ""))
+}
+
+// httpOnlyRoutes answers requests on :80 for http only routes, everything
+// else goes on to next to be redirected to https.
+func (app *App) httpOnlyRoutes(next http.Handler) http.Handler {
+	serve := app.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route, found := app.routeTable().match(NormalizeDomain(r.Host), r.URL.Path)
+		if found && route.HTTPOnly && route.servedOn(defaultListener) {
+			serve(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listen opens a tcp listener on addr, unwrapping PROXY protocol headers
+// when we're sitting behind a load balancer.
+func (app *App) listen(addr string) (net.Listener, error) {
+	ln, err := app.bind(addr)
+	if err != nil {
+		return nil, err
+	}
+	if app.ProxyProtocol {
+		log.Printf("Expecting PROXY protocol headers on %s", addr)
+		ln = &ProxyProtocolListener{Listener: ln}
+	}
+	return ln, nil
+}
+
+// routeTable is the table requests are currently matched against, it's
+// never modified once it's published so no locks are needed to read it.
+func (app *App) routeTable() *routeTable {
+	table, _ := app.table.Load().(*routeTable)
+	return table
+}
+
+// publishRoutes builds a fresh table from Routes for requests to be served
+// from, app.Mu must be held.
+func (app *App) publishRoutes() {
+	app.table.Store(newRouteTable(app.Routes))
+	app.noteRouteChanges()
+}
+
+// getAllDomains will make a list of all the routes for domains and apps
+func (app *App) getAllDomains() []string {
+	app.Mu.RLock()
+	defer app.Mu.RUnlock()
+
+	domains := make([]string, 0, len(app.Routes))
+	for domain := range app.Routes {
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// LoadRoutes will open the config file and add the routes found, only if
+// it's signed with key when there is one.
+func LoadRoutes(file string, key *routesKey) (map[string]*Proxy, error) {
+	data, err := readSignedRoutes(file, key)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := decodeRoutes(bytes.NewReader(data), file)
+	if err != nil {
+		return nil, err
+	}
+	return buildRoutes(routes), nil
+}
+
+// buildRoutes makes the proxies for routes file entries, skipping the ones
+// that won't build.
+func buildRoutes(routes []DomainRoute) map[string]*Proxy {
+	// make the routes
+	var failedRoutes int
+	rp := make(map[string]*Proxy)
+	for _, route := range routes {
+		logRoute(route)
+
+		// create our proxy
+		proxy, err := newRouteProxy(route)
+		if err != nil {
+			log.Printf("Error setting up route for domain %s: %v. Skipping this route.", route.Domain, err)
+			failedRoutes++
+			continue
+		}
+		rp[route.Domain] = proxy
+	}
+
+	// else
+	if failedRoutes > 0 {
+		log.Printf("%d routes failed to load due to errors.", failedRoutes)
+	}
+
+	return rp
+}
+
+// readRoutes decodes the routes file, with the domains normalized.
+func readRoutes(file string) ([]DomainRoute, error) {
+
+	// open the file
+	f, err := os.Open(file)
+	if err != nil {
+		log.Printf("Error opening file %s: %v", file, err)
+		return nil, err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil {
+			log.Printf("Error closing file %s after reading: %v", file, cerr)
+		}
+	}()
+
+	// read the file
+	return decodeRoutes(f, file)
+}
+
+// decodeRoutes reads routes file entries from r, name is where they're from
+// for errors.
+func decodeRoutes(r io.Reader, name string) ([]DomainRoute, error) {
+	var routes []DomainRoute
+	d := json.NewDecoder(r)
+	if err := d.Decode(&routes); err != nil {
+		return nil, fmt.Errorf("error decoding JSON from file %s: %w", name, err)
+	}
+
+	// normalize the domains for dev sanity and wasted weekends
+	for i := range routes {
+		routes[i].Domain = NormalizeDomain(routes[i].Domain)
+	}
+	return routes, nil
+}
+
+func logRoute(route DomainRoute) {
+	domain := listedDomain(route.Domain)
+	if route.Parked {
+		log.Println("-> parked route found: " + domain)
+	} else if route.Root != "" {
+		log.Println("-> static route found: " + domain + " " + route.Root)
+	} else {
+		log.Println("-> route found: " + domain + ":" + route.Port)
+	}
+}
+
+// routeChanges counts what a reload did.
+type routeChanges struct {
+	added, changed, removed, unchanged int
+	moved                              []string // domains whose backend changed
+}
+
+// stageRoutes builds the table a reload would switch to. routes whose
+// settings are the same as before keep their running Proxy, with its warm
+// connections, limiters and counters. if any route fails to build nothing
+// is returned, a half applied reload is worse than none.
+func stageRoutes(routes []DomainRoute, current map[string]*Proxy) (map[string]*Proxy, routeChanges, error) {
+	var changes routeChanges
+	staged := make(map[string]*Proxy, len(routes))
+	for _, route := range routes {
+		if _, dup := staged[route.Domain]; dup {
+			return nil, changes, fmt.Errorf("domain %s is in the routes file more than once", route.Domain)
+		}
+
+		existing, ok := current[route.Domain]
+		if ok && sameRoute(existing.config(route.Domain), route) {
+			staged[route.Domain] = existing
+			changes.unchanged++
+			continue
+		}
+
+		logRoute(route)
+		proxy, err := newRouteProxy(route)
+		if err != nil {
+			return nil, changes, fmt.Errorf("route for domain %s: %w", route.Domain, err)
+		}
+		staged[route.Domain] = proxy
+		if ok {
+			changes.changed++
+			if existing.Port != proxy.Port || existing.Root != proxy.Root {
+				changes.moved = append(changes.moved, route.Domain)
+			}
+		} else {
+			changes.added++
+		}
+	}
+	for domain, proxy := range current {
+		if _, ok := staged[domain]; !ok {
+			// tunnels aren't in the file, they stay until their client
+			// leaves unless the file has a route for the domain
+			if proxy.tunnel != nil {
+				staged[domain] = proxy
+				continue
+			}
+			changes.removed++
+		}
+	}
+	return staged, changes, nil
+}
+
+// config is the routes file entry a running route was built from.
+func (p *Proxy) config(domain string) DomainRoute {
+	return DomainRoute{
+		Domain:       domain,
+		Port:         p.Port,
+		Root:         p.Root,
+		Parked:       p.Parked,
+		RouteOptions: p.RouteOptions,
+	}
+}
+
+// sameRoute compares two routes file entries by what they'd write out.
+func sameRoute(a, b DomainRoute) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
+
+// SaveRoutes will create and write to a config file using json, routes
+// that only live in memory (no file) are left alone.
+func SaveRoutes(file string, routes map[string]*Proxy) error {
+	if file == "" {
+		return nil
+	}
+
+	// in this function we use a temporary file as a way of not clobbering
+	// a good config with incomplete new data like if the process fails of
+	// creating the new incoming config or if something else fails. this
+	// way we dont write a bunch of bs to the config that we have in hand.
+	tempFile := file + ".tmp"
+
+	// create the temporary file
+	f, err := os.Create(tempFile)
+	if err != nil {
+		log.Printf("Failed to create temporary file %s: %v", tempFile, err)
+		return err
+	}
+
+	// make the json with our routes
+	e := json.NewEncoder(f)
+	err = e.Encode(savedRoutes(routes))
+	if err != nil {
+		log.Printf("Error while encoding JSON: %v", err)
+		f.Close()
+		os.Remove(tempFile)
+		return err
+	}
+
+	// close the temp file
+	if err := f.Close(); err != nil {
+		log.Printf("Error while closing temporary file %s: %v", tempFile, err)
+		os.Remove(tempFile)
+		return err
+	}
+
+	// pinnochio.gif
+	if err := os.Rename(tempFile, file); err != nil {
+		log.Printf("Failed to rename temporary file %s to %s: %v", tempFile, file, err)
+		return err
+	}
+
+	return nil
+}
+
+// savedRoutes are the routes as they're written out, without the ones
+// that only live in memory.
+func savedRoutes(routes map[string]*Proxy) []SerializableProxy {
+	var serializableRoutes []SerializableProxy
+	for domain, proxy := range routes {
+		// mocks are never saved, the route they stand in for is
+		if proxy.mock != nil {
+			if proxy = proxy.mock.original; proxy == nil {
+				continue
+			}
+		}
+		// tunnels come and go with their clients
+		if proxy.tunnel != nil {
+			continue
+		}
+		serializableRoutes = append(serializableRoutes, SerializableProxy{
+			Port:         proxy.Port,
+			Domain:       domain,
+			Root:         proxy.Root,
+			Parked:       proxy.Parked,
+			RouteOptions: proxy.RouteOptions,
+		})
+	}
+	return serializableRoutes
+}
+
+// NormalizeDomain will solve all of your problems but it won't bring your weekend back.
+func NormalizeDomain(domain string) string {
+	// route keys can carry a path and start with a wildcard, only the
+	// name itself gets normalized
+	domain, path, hasPath := strings.Cut(domain, "/")
+	wildcard := ""
+	if rest, ok := strings.CutPrefix(domain, "*."); ok {
+		domain, wildcard = rest, "*."
+	}
+
+	domain = strings.ToLower(stripPort(domain))
+	domain = strings.TrimSuffix(domain, ".")
+	// unicode names are matched in their punycode form, so a route added
+	// either way catches both
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	domain = wildcard + strings.TrimPrefix(domain, "www.")
+
+	if path = strings.Trim(path, "/"); hasPath && path != "" {
+		domain += "/" + path
+	}
+	return domain
+}
+
+// displayDomain is a route key as people write it, internationalized names
+// in unicode rather than the punycode they're kept in.
+func displayDomain(domain string) string {
+	name, path, hasPath := strings.Cut(domain, "/")
+	wildcard := ""
+	if rest, ok := strings.CutPrefix(name, "*."); ok {
+		name, wildcard = rest, "*."
+	}
+	if unicode, err := idna.Display.ToUnicode(name); err == nil {
+		name = unicode
+	}
+	name = wildcard + name
+	if hasPath {
+		name += "/" + path
+	}
+	return name
+}
+
+// listedDomain is how the shell shows a route's domain, with the punycode
+// it's matched as alongside for internationalized names.
+func listedDomain(domain string) string {
+	if display := displayDomain(domain); display != domain {
+		return display + " (" + domain + ")"
+	}
+	return domain
+}
+
+// stripPort drops a port from a Host header, which browsers send along
+// for anything but the default one.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// Handler will receive an http request and route it appropriately
+func (app *App) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer recoverPanic(r)
+
+		domain := NormalizeDomain(r.Host)
+		if app.TunnelHost != "" && domain == app.TunnelHost {
+			app.serveTunnel(w, r)
+			return
+		}
+		if app.Dev {
+			domain = app.devDomain(domain)
+		}
+		key, route, found := app.routeTable().match(domain, r.URL.Path)
+
+		var geo *geoInfo
+		if app.Geo != nil {
+			g := app.Geo.lookup(clientIP(r))
+			geo = &g
+		}
+
+		if app.accessLogged(route) {
+			aw := &accessWriter{ResponseWriter: w, geo: geo}
+			defer app.logAccess(aw, r, domain, route, time.Now())
+			w = aw
+		}
+
+		if len(app.HideHeaders) > 0 || app.ServerHeader != "" || (found && len(route.HideHeaders) > 0) {
+			hide := app.HideHeaders
+			if found {
+				hide = append(hide[:len(hide):len(hide)], route.HideHeaders...)
+			}
+			w = &headerScrubber{ResponseWriter: w, hide: hide, server: app.ServerHeader}
+		}
+
+		if fp := fingerprintOf(r); fp != nil && app.fingerprintBlocked(fp, route) {
+			securityEvent(eventFingerprint, clientIP(r), domain, "tls fingerprint "+fp.JA4)
+			if !app.Tarpit.serve(w, r, "blocked-fingerprint", http.StatusForbidden) {
+				clientError(w, "blocked-fingerprint", http.StatusForbidden)
+			}
+			return
+		}
+
+		// a route kept to other listeners doesn't exist as far as this
+		// one is concerned
+		if found && !route.servedOn(listenerOf(r)) {
+			found = false
+		}
+		// nor does an http only route over https
+		if found && route.HTTPOnly && r.TLS != nil && !app.Dev {
+			found = false
+		}
+		// or one its schedule has turned off
+		if found && route.scheduleState().state == stateOff {
+			found = false
+		}
+		if !found {
+			securityEvent(eventUnknownHost, clientIP(r), domain, "no route for host")
+			clientError(w, "unknown-host", http.StatusNotFound)
+			return
+		}
+		// counted against the route rather than the host asked for, so a
+		// wildcard's endless subdomains don't each get counters of their own
+		account := trafficAccount(key)
+		stats := app.Stats.Route(account)
+		stats.Requests.Add(1)
+		if geo != nil {
+			stats.Geo.add(*geo)
+		}
+		if app.overQuota(account, route) {
+			serveOverQuota(w)
+			return
+		}
+		tw := &trafficWriter{ResponseWriter: w}
+		w = tw
+		body := &trafficBody{ReadCloser: r.Body}
+		r.Body = body
+		defer func() {
+			app.countTraffic(account, route, body.in, tw.out)
+			stats.count(body.in, tw.out, tw.status)
+			app.Anomalies.observe(account, clientIP(r), tw.status)
+		}()
+
+		if st := route.scheduleState(); st.state == stateMaintenance {
+			route.serveMaintenance(w, r, st)
+			return
+		}
+		if route.redirectCanonical(w, r) {
+			return
+		}
+		// options is answered here rather than by the backend, so it's
+		// always let through
+		if route.methods != nil && !route.methods[r.Method] && r.Method != http.MethodOptions {
+			w.Header().Set("Allow", route.allow)
+			clientError(w, "method-not-allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(route.botRules) > 0 && !app.checkBots(w, r, domain, route, stats) {
+			return
+		}
+
+		if t, n := app.taps.claim(domain); t != nil {
+			var done func()
+			w, done = t.capture(w, r, n)
+			defer done()
+		}
+		if rec := app.recordings.claim(domain); rec != nil {
+			var done func()
+			w, done = rec.capture(w, r)
+			defer done()
+		}
+
+		ip := clientIP(r)
+		if app.MaxRequestsPerIP > 0 {
+			if !app.inflight.acquire(r.Context(), ip, 0, app.MaxRequestsPerIP, 0, 0) {
+				logLimited("limit", "Too many requests in flight from %s, rejecting request for %s", ip, domain)
+				securityEvent(eventRateLimit, ip, domain, "too many requests in flight from this ip")
+				if !app.Tarpit.serve(w, r, "rate-limit", http.StatusServiceUnavailable) {
+					overloaded(w)
+				}
+				return
+			}
+			defer app.inflight.release(ip)
+		}
+		if route.MaxRequests > 0 || route.MaxRequestsPerIP > 0 {
+			if !route.inflight.acquire(r.Context(), ip, route.MaxRequests, route.MaxRequestsPerIP, route.QueueDepth, route.queueTimeout) {
+				logLimited("limit", "Route %s is at its request limit, rejecting request from %s", domain, ip)
+				securityEvent(eventRateLimit, ip, domain, "route is at its request limit")
+				overloaded(w)
+				return
+			}
+			defer route.inflight.release(ip)
+		}
+
+		if limiters := route.bandwidthLimiters(r.Context(), domain); len(limiters) > 0 {
+			w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters}
+		}
+
+		if route.compress(app.Compress) && r.Method != http.MethodHead && r.Header.Get("Range") == "" {
+			if encoding := negotiateEncoding(r.Header.Get("Accept-Encoding")); encoding != "" {
+				cw := newCompressWriter(w, encoding, app.CompressMinSize, route.compressible)
+				defer cw.Close()
+				w = cw
+			}
+		}
+
+		// why do we even have this if we all *
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		if r.Method == http.MethodOptions {
+			methods := "POST, GET, OPTIONS, PUT, DELETE"
+			if route.methods != nil {
+				methods = route.allow
+				if !route.methods[http.MethodOptions] {
+					methods += ", OPTIONS"
+				}
+			}
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			if body := app.textFile(route, r.URL.Path); body != nil {
+				app.serveTextFile(w, r, route, body)
+				return
+			}
+		}
+
+		setTLSHeaders(r)
+		app.serveProxy(w, r, key, domain, route, stats)
+	}
+}
+
+// compress reports whether responses on this route get compressed.
+func (p *Proxy) compress(global bool) bool {
+	if p.Streaming {
+		return false
+	}
+	if p.Compress != nil {
+		return *p.Compress
+	}
+	return global
+}
+
+// bandwidthLimiters returns the limiters a response on this route has to
+// pass through, if any.
+func (p *Proxy) bandwidthLimiters(ctx context.Context, domain string) []*bandwidthLimiter {
+	var limiters []*bandwidthLimiter
+	if p.limiter != nil {
+		limiters = append(limiters, p.limiter)
+	}
+	if p.connLimitBW > 0 {
+		if ci := connInfoFrom(ctx); ci != nil {
+			limiters = append(limiters, ci.connLimiter(domain, p.connLimitBW))
+		}
+	}
+	return limiters
+}
+
+// NewRoute should probably be part of Handler tbh
+func NewRoute(routes map[string]*Proxy, domain string, port string, mu *sync.RWMutex) error {
+	domain = NormalizeDomain(domain)
+
+	// re-adding a domain just moves it to a new port, keep its options
+	var opts RouteOptions
+	if existing, ok := routes[domain]; ok {
+		opts = existing.RouteOptions
+	}
+
+	proxy, err := newProxy(port, opts)
+	if err != nil {
+		return err
+	}
+	routes[domain] = proxy
+
+	return nil
+}
+
+// NewStaticRoute points a domain at a directory of files, keeping the
+// options of any route it replaces.
+func NewStaticRoute(routes map[string]*Proxy, domain string, root string) error {
+	domain = NormalizeDomain(domain)
+
+	var opts RouteOptions
+	if existing, ok := routes[domain]; ok {
+		opts = existing.RouteOptions
+	}
+
+	proxy, err := newStatic(root, opts)
+	if err != nil {
+		return err
+	}
+	routes[domain] = proxy
+
+	return nil
 }
 
-// startServer sets up cerManager and an https api using a goroutine.
-func (app *App) startServer() {
+// NewParkedRoute puts up a placeholder page for a domain, keeping the
+// options of any route it replaces.
+func NewParkedRoute(routes map[string]*Proxy, domain string) error {
+	domain = NormalizeDomain(domain)
 
-	certManager := autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		HostPolicy: func(ctx context.Context, host string) error {
-			app.Mu.RLock()
-			defer app.Mu.RUnlock()
-			if _, ok := app.Routes[host]; ok {
-				return nil
-			}
-			return fmt.Errorf("acme/autocert: host %q not configured in HostPolicy", host)
-		},
-		Cache: autocert.DirCache("tls"),
+	var opts RouteOptions
+	if existing, ok := routes[domain]; ok {
+		opts = existing.RouteOptions
 	}
 
-	server := &http.Server{
-		Addr:      ":https",
-		TLSConfig: certManager.TLSConfig(),
-		Handler:   http.HandlerFunc(app.Handler()),
+	proxy, err := newParked(opts)
+	if err != nil {
+		return err
 	}
+	routes[domain] = proxy
 
-	go func() {
-		http.HandleFunc("/", app.Handler())
-		// Serve on HTTP to satisfy the ACME HTTP-01 challenge and then redirect to HTTPS.
-		log.Fatal(http.ListenAndServe(":http", certManager.HTTPHandler(nil)))
-	}()
-
-	log.Fatal(server.ListenAndServeTLS("", ""))
+	return nil
 }
 
-// getAllDomains will make a list of all the routes for domains and apps
-func (app *App) getAllDomains() []string {
-	app.Mu.RLock()
-	defer app.Mu.RUnlock()
-
-	domains := make([]string, 0, len(app.Routes))
-	for domain := range app.Routes {
-		domains = append(domains, domain)
+// newRouteProxy builds whichever kind of route an entry in the routes file
+// describes, a reverse proxy to the port unless it's parked or static.
+func newRouteProxy(route DomainRoute) (*Proxy, error) {
+	if route.Parked {
+		return newParked(route.RouteOptions)
 	}
-	return domains
+	if route.Root != "" {
+		return newStatic(route.Root, route.RouteOptions)
+	}
+	return newProxy(route.Port, route.RouteOptions)
 }
 
-// LoadRoutes will open the config file and add the routes found.
-func LoadRoutes(file string) (map[string]*Proxy, error) {
-
-	// open the file
-	f, err := os.Open(file)
+// newProxy builds the reverse proxy for a local port, wiring in whatever
+// extra behaviour the route's options ask for.
+func newProxy(port string, opts RouteOptions) (*Proxy, error) {
+	addr := backendAddr(port)
+	var err error
+	if opts.SendProxyProtocol, err = parseProxyProtocolVersion(opts.SendProxyProtocol); err != nil {
+		return nil, fmt.Errorf("send_proxy_protocol: %w", err)
+	}
+	scheme, transport, err := routeTransports(addr, opts).forRoute(addr, opts)
 	if err != nil {
-		log.Printf("Error opening file %s: %v", file, err)
 		return nil, err
 	}
-	defer func() {
-		if cerr := f.Close(); cerr != nil {
-			log.Printf("Error closing file %s after reading: %v", file, cerr)
+	host := addr
+	if strings.HasPrefix(addr, "unix:") {
+		// only fastcgi and uwsgi dial sockets, the url just needs a host
+		host = "localhost"
+	}
+	target, err := url.Parse(scheme + "://" + host)
+	if err != nil {
+		return nil, err
+	}
+	backendHosts.watch(host)
+	rp := httputil.NewSingleHostReverseProxy(target)
+	rp.Transport = transport
+	rp.BufferPool = proxyBuffers
+	if opts.Streaming {
+		rp.FlushInterval = -1
+	}
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if class, reason, _ := classifyProxyError(r, err); class == errorUpstream {
+			backendStatus.failed(addr, NormalizeDomain(r.Host), reason)
 		}
-	}()
-
-	// read the file
-	var routes []DomainRoute
-	d := json.NewDecoder(f)
-	if err := d.Decode(&routes); err != nil {
-		return nil, fmt.Errorf("error decoding JSON from file %s: %w", file, err)
+		proxyError(w, r, err)
 	}
 
-	// make the routes
-	var failedRoutes int
-	rp := make(map[string]*Proxy)
-	for _, route := range routes {
-
-		// normalize the domains for dev sanity and wasted weekends
-		route.Domain = NormalizeDomain(route.Domain)
-		log.Println("-> route found: " + route.Domain + ":" + route.Port)
-		target, err := url.Parse("http://localhost:" + route.Port)
+	// request and response modifiers run in the order they're added here
+	var directors []func(*http.Request)
+	modifiers := []func(*http.Response) error{func(resp *http.Response) error {
+		backendStatus.succeeded(addr, NormalizeDomain(resp.Request.Host))
+		return nil
+	}}
+	if opts.SendProxyProtocol != "" {
+		directors = append(directors, func(r *http.Request) { *r = *withProxyAddrs(r) })
+	}
+	if len(opts.CookieDomain) > 0 || len(opts.CookiePath) > 0 {
+		modifiers = append(modifiers, opts.rewriteCookies)
+	}
+	if len(opts.Transforms) > 0 {
+		transform, err := newBodyTransformer(opts.Transforms)
 		if err != nil {
-			log.Printf("Error parsing URL for domain %s: %v. Skipping this route.", route.Domain, err)
-			failedRoutes++
-			continue
+			return nil, err
 		}
+		// with no Accept-Encoding the transport asks for gzip itself and
+		// hands us the body already decompressed
+		directors = append(directors, func(r *http.Request) { r.Header.Del("Accept-Encoding") })
+		modifiers = append(modifiers, transform)
+	}
 
-		// create our proxy
-		rp[route.Domain] = &Proxy{
-			Port:  route.Port,
-			Proxy: httputil.NewSingleHostReverseProxy(target),
+	if len(directors) > 0 {
+		director := rp.Director
+		rp.Director = func(r *http.Request) {
+			director(r)
+			for _, direct := range directors {
+				direct(r)
+			}
 		}
 	}
-
-	// else
-	if failedRoutes > 0 {
-		log.Printf("%d routes failed to load due to errors.", failedRoutes)
+	rp.ModifyResponse = func(resp *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(resp); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	return rp, nil
+	proxy := &Proxy{
+		Port:         port,
+		Proxy:        rp,
+		RouteOptions: opts,
+		handler:      rp,
+	}
+	if fcgi, ok := transport.(*fastcgiTransport); ok {
+		proxy.handler = fastcgiFiles(fcgi.root, rp)
+	}
+	if err := proxy.applyOptions(); err != nil {
+		return nil, err
+	}
+	return proxy, nil
 }
 
-// SaveRoutes will create and write to a config file using json
-func SaveRoutes(file string, routes map[string]*Proxy) error {
-
-	// in this function we use a temporary file as a way of not clobbering
-	// a good config with incomplete new data like if the process fails of
-	// creating the new incoming config or if something else fails. this
-	// way we dont write a bunch of bs to the config that we have in hand.
-	tempFile := file + ".tmp"
+// applyOptions sets up everything the route's options ask for that doesn't
+// depend on what kind of route it is.
+func (proxy *Proxy) applyOptions() error {
+	opts := proxy.RouteOptions
+	var err error
 
-	// create the temporary file
-	f, err := os.Create(tempFile)
-	if err != nil {
-		log.Printf("Failed to create temporary file %s: %v", tempFile, err)
-		return err
+	if opts.Bandwidth != "" {
+		bw, err := parseSize(opts.Bandwidth)
+		if err != nil {
+			return fmt.Errorf("bandwidth: %w", err)
+		}
+		if bw > 0 {
+			proxy.limiter = newBandwidthLimiter(bw)
+		}
 	}
-
-	var serializableRoutes []SerializableProxy
-	for domain, proxy := range routes {
-		serializableRoutes = append(serializableRoutes, SerializableProxy{
-			Port:   proxy.Port,
-			Domain: domain,
-		})
+	if opts.BandwidthPerConn != "" {
+		bw, err := parseSize(opts.BandwidthPerConn)
+		if err != nil {
+			return fmt.Errorf("bandwidth_per_conn: %w", err)
+		}
+		proxy.connLimitBW = bw
 	}
 
-	// make the json with our routes
-	e := json.NewEncoder(f)
-	err = e.Encode(serializableRoutes)
-	if err != nil {
-		log.Printf("Error while encoding JSON: %v", err)
-		f.Close()
-		os.Remove(tempFile)
-		return err
+	proxy.queueTimeout = defaultQueueTimeout
+	if opts.QueueTimeout != "" {
+		proxy.queueTimeout, err = time.ParseDuration(opts.QueueTimeout)
+		if err != nil {
+			return fmt.Errorf("queue_timeout: %w", err)
+		}
 	}
 
-	// close the temp file
-	if err := f.Close(); err != nil {
-		log.Printf("Error while closing temporary file %s: %v", tempFile, err)
-		os.Remove(tempFile)
-		return err
+	if opts.CacheTTL != "" {
+		proxy.cacheTTL, err = time.ParseDuration(opts.CacheTTL)
+		if err != nil {
+			return fmt.Errorf("cache_ttl: %w", err)
+		}
 	}
-
-	// pinnochio.gif
-	if err := os.Rename(tempFile, file); err != nil {
-		log.Printf("Failed to rename temporary file %s to %s: %v", tempFile, file, err)
-		return err
+	if opts.CacheStaleWhileRevalidate != "" {
+		proxy.staleWhileRevalidate, err = time.ParseDuration(opts.CacheStaleWhileRevalidate)
+		if err != nil {
+			return fmt.Errorf("cache_stale_while_revalidate: %w", err)
+		}
+	}
+	if opts.CacheStaleIfError != "" {
+		proxy.staleIfError, err = time.ParseDuration(opts.CacheStaleIfError)
+		if err != nil {
+			return fmt.Errorf("cache_stale_if_error: %w", err)
+		}
 	}
 
-	return nil
-}
+	proxy.cacheVary = append(append([]string(nil), defaultCacheVary...), opts.CacheVary...)
 
-// NormalizeDomain will solve all of your problems but it won't bring your weekend back.
-func NormalizeDomain(domain string) string {
-	return strings.TrimPrefix(strings.ToLower(domain), "www.")
-}
+	if opts.CacheErrors != "" {
+		proxy.cacheErrors, err = time.ParseDuration(opts.CacheErrors)
+		if err != nil {
+			return fmt.Errorf("cache_errors: %w", err)
+		}
+	}
 
-// Handler will receive an http request and route it appropriately
-func (app *App) Handler() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		app.Mu.RLock()
-		domain := NormalizeDomain(r.Host)
-		route, found := app.Routes[domain]
-		app.Mu.RUnlock()
+	if opts.CertGroup != "" && !validGroupName.MatchString(opts.CertGroup) {
+		return fmt.Errorf("cert_group: %q should be lowercase letters, digits, - and _", opts.CertGroup)
+	}
 
-		if !found {
-			http.Error(w, "Not found", http.StatusNotFound)
-			return
+	if len(opts.Methods) > 0 {
+		proxy.methods = map[string]bool{}
+		var allow []string
+		for _, m := range opts.Methods {
+			m = strings.ToUpper(strings.TrimSpace(m))
+			if !validMethod(m) {
+				return fmt.Errorf("methods: %q isn't a request method", m)
+			}
+			if !proxy.methods[m] {
+				proxy.methods[m] = true
+				allow = append(allow, m)
+			}
+		}
+		if proxy.methods[http.MethodGet] && !proxy.methods[http.MethodHead] {
+			proxy.methods[http.MethodHead] = true
+			allow = append(allow, http.MethodHead)
 		}
+		proxy.allow = strings.Join(allow, ", ")
+	}
 
-		// why do we even have this if we all *
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+	if opts.MonthlyQuota != "" {
+		quota, err := parseSize(opts.MonthlyQuota)
+		if err != nil {
+			return fmt.Errorf("monthly_quota: %w", err)
+		}
+		proxy.quota = uint64(quota)
+	}
+	if opts.QuotaAction != "" && opts.QuotaAction != "warn" && opts.QuotaAction != "block" {
+		return fmt.Errorf("quota_action: %q should be warn or block", opts.QuotaAction)
+	}
 
-		if r.Method == http.MethodOptions {
-			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			w.WriteHeader(http.StatusOK)
-			return
+	if opts.Streaming {
+		switch {
+		case opts.Cache:
+			return errors.New("streaming: responses can't be cached as well")
+		case opts.Compress != nil && *opts.Compress:
+			return errors.New("streaming: responses can't be compressed as well")
+		case len(opts.Transforms) > 0:
+			return errors.New("streaming: transforms need the whole body, they can't be used together")
 		}
+	}
 
-		route.Proxy.ServeHTTP(w, r)
+	if err := checkMetadata(opts); err != nil {
+		return err
+	}
+	if err := checkCanonicalOptions(opts); err != nil {
+		return err
 	}
-}
 
-// NewRoute should probably be part of Handler tbh
-func NewRoute(routes map[string]*Proxy, domain string, port string, mu *sync.RWMutex) error {
-	domain = NormalizeDomain(domain)
+	proxy.botRules, err = compileBotRules(opts.BotRules)
+	if err != nil {
+		return err
+	}
+
+	proxy.schedule, err = compileSchedule(opts.Schedule)
+	if err != nil {
+		return err
+	}
+	proxy.scheduleLoc = time.Local
+	if opts.ScheduleTimezone != "" {
+		if proxy.scheduleLoc, err = time.LoadLocation(opts.ScheduleTimezone); err != nil {
+			return fmt.Errorf("schedule_timezone: %w", err)
+		}
+	}
+	if len(proxy.schedule) > 0 {
+		proxy.scheduled.Store(proxy.scheduleAt(time.Now()))
+	}
+	if opts.MaintenanceTemplate != "" {
+		if proxy.maintenance, err = template.ParseFiles(opts.MaintenanceTemplate); err != nil {
+			return fmt.Errorf("maintenance_template: %w", err)
+		}
+	}
 
-	target, err := url.Parse("http://localhost:" + port)
+	proxy.contentRules, err = compileContentRules(opts.ContentRules)
 	if err != nil {
 		return err
 	}
 
-	routes[domain] = &Proxy{
-		Port:  port,
-		Proxy: httputil.NewSingleHostReverseProxy(target),
+	if opts.RobotsTxt != "" {
+		if proxy.robotsTxt, err = os.ReadFile(opts.RobotsTxt); err != nil {
+			return fmt.Errorf("robots_txt: %w", err)
+		}
+	}
+	if opts.SecurityTxt != "" {
+		if proxy.securityTxt, err = os.ReadFile(opts.SecurityTxt); err != nil {
+			return fmt.Errorf("security_txt: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// validMethod reports whether m could be a request method, an http token.
+func validMethod(m string) bool {
+	if m == "" {
+		return false
+	}
+	for _, c := range m {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", c) {
+			return false
+		}
+	}
+	return true
+}
+
 func handleHelpCommand() {
 	fmt.Printf(`
 
 Commands:
-- list: List all of the domain-port mappings.
-- add <domain> <port>: Add a mapping for the domain on the specified port.
+- list [tag:<tag>] [owner:<email>] [text]: List all of the domain-port mappings, or only those with the tag,
+    owner or text in their domain, tags, owner or notes.
+- add <domain> <port> [--tags a,b] [--owner email] [--notes text]: Add a mapping for the domain on the specified
+    port, or host:port for a backend on another machine, with tags, an owner and notes to tell it apart.
     ex: add example.com 3000
+- edit <domain> tags|owner|notes [value]: Change a route's tags (a,b to set, +tag or -tag to add or drop one),
+    owner or notes, clearing them with no value.
+    ex: edit example.com tags +shop
+- add-static <domain> <directory>: Serve the files in a directory for the domain.
+    ex: add-static example.com /var/www/example
+- park <domain>: Show a coming soon page for the domain.
+    ex: park example.com
+- mock [domain] [--status CODE] [--body TEXT] [--header "Name: value"] [--responses FILE]: Answer for the domain
+    with a built in upstream that echoes requests back, or sends canned responses, until mock <domain> off.
+    Mocks aren't saved. mock on its own lists them.
+    ex: mock example.com --status 503 --body "back soon"
 - remove <domain>: Remove a mapping for the domain.
     ex: remove example.com
+- purge <domain> [path-pattern]: Drop cached responses for the domain, optionally only matching paths.
+    ex: purge example.com /assets/*
+- stats [domain]: Show request, traffic, error and cache counters, kept across restarts, for a single domain along with its most served cached paths.
+- traffic [domain]: Show the bytes each domain took in and sent out this month and how much of its quota that is,
+    or every month on record for one domain.
+- history [domain]: Show the latest route changes, who made them and what each one changed, for every domain
+    or one.
+- certs [export|import <file.tar.gz>]: Show each domain's certificate and when it runs out, or why it couldn't
+    be had and when it's tried again. export and import move the certificates and acme account between machines.
+    ex: certs export /root/certs.tar.gz
+- backup <file.tar.gz>: Save the routes, admin tokens, certificates and acme account to one file.
+- restore <file.tar.gz>: Bring back everything in a backup, replacing the routes and tokens there are.
+- tap [domain] [--count N] [--bodies SIZE] [--out FILE]: Write the next N requests to the domain and their
+    responses to a file, bodies up to SIZE each. tap <domain> off stops it, tap on its own lists them.
+    ex: tap example.com --count 20 --bodies 64KB
+- record [domain] [--count N] [--sample PERCENT] [--bodies SIZE] [--out FILE]: Save a sample of requests to the
+    domain, without credentials, for appserve replay. record <domain> off stops it, record on its own lists them.
+    ex: record example.com --count 500 --sample 10%%
+- logs tail [domain] [-f]: Show the latest log lines, only those about the domain if one is given.
+    -f keeps showing new lines until enter is pressed.
+    ex: logs tail example.com -f
+- forward [add <listen> <target> [--tls domain] [--udp [--idle DURATION]] | remove <listen> [--udp]]: Pass a
+    whole tcp port through to a local port or host:port, terminating tls as the domain with --tls, or relay
+    udp with --udp, dropping client sessions after --idle without packets. --sni name=target (repeatable)
+    sends tls connections on by the name they ask for instead, with --terminate to terminate it here.
+    --proxy-protocol v1|v2 tells the target the client's address. forward on its own lists them.
+    ex: forward add 5432 15432
+    ex: forward add 993 --sni mail.a.com=10.0.0.2:993 --sni mail.b.com=1993
+- ports: List the tcp ports listening on this machine, the process on each and the routes pointing at it.
 - save [filepath]: Save the routes to the specified filepath or default path if not specified.
 - load [filepath]: Load routes from the specified filepath or default path if not specified.
+- status: Show where the routes are saved, how often, and whether there are changes that aren't saved yet.
 - help: Show this help.
 - exit: Exit the program.
 
 `)
 }
 
-func (app *App) handleListCommand() {
+func (app *App) handleListCommand(filter routeFilter) {
 	app.Mu.RLock()
 	defer app.Mu.RUnlock()
-	for domain, proxy := range app.Routes {
-		fmt.Printf("Domain: %s, Port: %s\n", domain, proxy.Port)
+	for key, proxy := range app.Routes {
+		if !filter.matches(key, &proxy.RouteOptions) {
+			continue
+		}
+		domain := listedDomain(key)
+		var extra string
+		if proxy.Tenant != "" {
+			extra = ", Tenant: " + proxy.Tenant
+		}
+		if proxy.HTTPOnly {
+			extra += ", HTTP only"
+		}
+		extra += proxy.scheduleNote()
+		extra += proxy.metadataNote()
+		if proxy.mock != nil {
+			fmt.Printf("Domain: %s, Mocked%s\n", domain, extra)
+			continue
+		}
+		if t := proxy.tunnel; t != nil {
+			fmt.Printf("Domain: %s, Tunnel: from %s, token %s, for %s\n", domain, t.remote, t.token, time.Since(t.since).Round(time.Second))
+			continue
+		}
+		if proxy.Parked {
+			fmt.Printf("Domain: %s, Parked%s\n", domain, extra)
+			continue
+		}
+		if proxy.Root != "" {
+			fmt.Printf("Domain: %s, Root: %s%s\n", domain, proxy.Root, extra)
+			continue
+		}
+		fmt.Printf("Domain: %s, Port: %s%s\n", domain, proxy.Port, extra)
 	}
 }
 
-func (app *App) handleAddCommand(domain, port string) {
+func (app *App) handleAddCommand(domain, port string, meta routeMeta) {
 	app.Mu.Lock()
 	defer app.Mu.Unlock()
 
+	previous, existed := app.Routes[NormalizeDomain(domain)]
 	err := NewRoute(app.Routes, domain, port, &app.Mu)
 
 	if err != nil {
 		fmt.Printf("Error adding route: %v\n", err)
 		return
 	}
+	// checked when the command was read, it can't fail here
+	proxy := app.Routes[NormalizeDomain(domain)]
+	opts, _ := meta.apply(proxy.RouteOptions)
+	proxy.Tags, proxy.Owner, proxy.Notes = opts.Tags, opts.Owner, opts.Notes
+	app.publishRoutes()
 
-	err = SaveRoutes(app.RoutesFile, app.Routes)
+	err = app.saveRoutes("shell")
 	if err != nil {
 		log.Println("Failed to save routes after adding:", err)
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
+	if existed && previous.Port != port {
+		app.purgeChangedRoute(NormalizeDomain(domain))
+	}
+
 	fmt.Printf("Added new route for domain: %s on port: %s\n", domain, port)
+	warnIfNotListening(port)
 }
 
-func (app *App) handleRemoveCommand(domain string) {
+func (app *App) handleAddStaticCommand(domain, dir string) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Printf("Error adding route: %v\n", err)
+		return
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		fmt.Printf("Error: %s is not a directory\n", root)
+		return
+	}
+
 	app.Mu.Lock()
 	defer app.Mu.Unlock()
-	if _, exists := app.Routes[domain]; !exists {
-		fmt.Printf("Error: No such domain: %s\n", domain)
+
+	if err := NewStaticRoute(app.Routes, domain, root); err != nil {
+		fmt.Printf("Error adding route: %v\n", err)
 		return
 	}
-	delete(app.Routes, domain)
-	err := SaveRoutes(app.RoutesFile, app.Routes)
-	if err != nil {
+	app.publishRoutes()
+
+	if err := app.saveRoutes("shell"); err != nil {
+		log.Println("Failed to save routes after adding:", err)
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Added static route for domain: %s serving: %s\n", domain, root)
+}
+
+func (app *App) handleParkCommand(domain string) {
+	app.Mu.Lock()
+	defer app.Mu.Unlock()
+
+	if err := NewParkedRoute(app.Routes, domain); err != nil {
+		fmt.Printf("Error adding route: %v\n", err)
+		return
+	}
+	app.publishRoutes()
+
+	if err := app.saveRoutes("shell"); err != nil {
+		log.Println("Failed to save routes after adding:", err)
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Parked domain: %s\n", domain)
+}
+
+func (app *App) handlePurgeCommand(domain, pattern string) {
+	routeKey, host := purgeScope(domain)
+	n := app.Cache.Purge(routeKey, host, pattern)
+	fmt.Printf("Purged %d cached responses for domain: %s\n", n, domain)
+}
+
+// purgeScope reads what a purge was asked for: a route key with a path or a
+// wildcard purges what that route served, a plain name everything cached
+// for the host whichever of its routes it came through.
+func purgeScope(domain string) (routeKey, host string) {
+	if strings.ContainsAny(domain, "/*") {
+		return domain, ""
+	}
+	return "", domain
+}
+
+// purgeChangedRoute drops a route's cached responses after its backend
+// moved, if we've been asked to. domain is the route's key.
+func (app *App) purgeChangedRoute(domain string) {
+	if !app.PurgeOnChange {
+		return
+	}
+	if n := app.Cache.Purge(domain, "", ""); n > 0 {
+		log.Printf("Purged %d cached responses for %s after its backend changed", n, domain)
+	}
+}
+
+func (app *App) handleRemoveCommand(domain string) {
+	err := app.removeRoute(nil, domain)
+	if errors.Is(err, errNoSuchDomain) {
+		fmt.Printf("Error: No such domain: %s\n", domain)
+	} else if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
-		fmt.Printf("Removed route for domain: %s\n", domain)
+		fmt.Printf("Removed route for domain: %s\n", listedDomain(domain))
 	}
 }
 
 func (app *App) handleSaveCommand() {
-	err := SaveRoutes(app.RoutesFile, app.Routes)
+	err := app.saveUnsaved()
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
-		fmt.Printf("Routes saved to: %s\n", app.RoutesFile)
+		fmt.Printf("Routes saved to: %s\n", app.routesLocation())
 	}
 }
 
 func (app *App) handleLoadCommand() error {
-	routes, err := LoadRoutes(app.RoutesFile)
+	if app.Store != nil {
+		return app.handleStoreLoadCommand()
+	}
+	data, err := readSignedRoutes(app.RoutesFile, app.RoutesKey)
 	if err != nil {
 		if os.IsNotExist(err) {
 			fmt.Printf("Error: No such file: %s\n", app.RoutesFile)
@@ -406,9 +2277,50 @@ func (app *App) handleLoadCommand() error {
 			return err
 		}
 	}
-	fmt.Printf("Routes loaded from: %s\n", app.RoutesFile)
+	routes, err := decodeRoutes(bytes.NewReader(data), app.RoutesFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return err
+	}
+
+	changes, err := app.replaceRoutes(routes)
+	if err != nil {
+		fmt.Printf("Error: %v. Keeping the current routes.\n", err)
+		return err
+	}
+	app.dropUnsaved()
+	if err := app.recordRoutes("load"); err != nil {
+		log.Printf("Error recording the route history: %v", err)
+	}
+	fmt.Printf("Routes loaded from: %s (%d added, %d changed, %d removed, %d unchanged)\n",
+		app.RoutesFile, changes.added, changes.changed, changes.removed, changes.unchanged)
+	return nil
+}
+
+// replaceRoutes swaps every route for routes, leaving the current ones be
+// if any of them is no good.
+func (app *App) replaceRoutes(routes []DomainRoute) (routeChanges, error) {
+	// requests keep being served from the old table until the new one is
+	// complete, then switch over in one go
 	app.Mu.Lock()
-	app.Routes = routes
+	staged, changes, err := stageRoutes(routes, app.Routes)
+	if err != nil {
+		app.Mu.Unlock()
+		return changes, err
+	}
+	previous := app.Routes
+	app.Routes = staged
+	app.publishRoutes()
 	app.Mu.Unlock()
-	return nil
+
+	for domain, proxy := range previous {
+		if proxy.tunnel != nil && staged[domain] != proxy {
+			proxy.tunnel.close()
+		}
+	}
+
+	for _, domain := range changes.moved {
+		app.purgeChangedRoute(domain)
+	}
+	return changes, nil
 }
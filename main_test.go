@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"example.com.", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"EXAMPLE.com.:443", "example.com"},
+		{"www.example.com", "example.com"},
+		{"WWW.Example.com.:80", "example.com"},
+		{"*.Example.com", "*.example.com"},
+		{"example.com/api/", "example.com/api"},
+		{"Example.com:8080/api", "example.com/api"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"[::1]:8080", "::1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeDomain(tt.in); got != tt.want {
+			t.Errorf("NormalizeDomain(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"Example.com:443", "Example.com"},
+		{"example.com.:80", "example.com."},
+		{"127.0.0.1:3000", "127.0.0.1"},
+		{"[::1]:3000", "::1"},
+		{"::1", "::1"},
+	}
+	for _, tt := range tests {
+		if got := stripPort(tt.in); got != tt.want {
+			t.Errorf("stripPort(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
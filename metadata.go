@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// checkMetadata checks a route's tags and owner. notes can be anything.
+func checkMetadata(opts RouteOptions) error {
+	for _, tag := range opts.Tags {
+		if tag == "" || strings.ContainsAny(tag, ", \t\r\n") {
+			return fmt.Errorf("tags: %q can't be empty or have spaces or commas", tag)
+		}
+	}
+	if opts.Owner != "" {
+		if _, err := mail.ParseAddress(opts.Owner); err != nil {
+			return fmt.Errorf("owner: %q isn't an email address", opts.Owner)
+		}
+	}
+	return nil
+}
+
+// hasTag reports whether the route is tagged tag, ignoring case.
+func (opts *RouteOptions) hasTag(tag string) bool {
+	for _, t := range opts.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataNote is a route's tags, owner and notes for list.
+func (opts *RouteOptions) metadataNote() string {
+	var note string
+	if len(opts.Tags) > 0 {
+		note += ", Tags: " + strings.Join(opts.Tags, " ")
+	}
+	if opts.Owner != "" {
+		note += ", Owner: " + opts.Owner
+	}
+	if opts.Notes != "" {
+		note += ", Notes: " + strconv.Quote(opts.Notes)
+	}
+	return note
+}
+
+// routeFilter picks routes by their metadata for list and GET /routes. a
+// route has to have every tag, the owner if one is given, and the text
+// somewhere in its domain, tags, owner or notes.
+type routeFilter struct {
+	tags  []string
+	owner string
+	text  string
+}
+
+// parseListFilter reads list's arguments, tag:<tag> and owner:<email> with
+// anything else searched for.
+func parseListFilter(args []string) routeFilter {
+	var f routeFilter
+	var words []string
+	for _, arg := range args {
+		if tag, ok := strings.CutPrefix(arg, "tag:"); ok {
+			f.tags = append(f.tags, tag)
+		} else if owner, ok := strings.CutPrefix(arg, "owner:"); ok {
+			f.owner = owner
+		} else {
+			words = append(words, arg)
+		}
+	}
+	f.text = strings.ToLower(strings.Join(words, " "))
+	return f
+}
+
+// queryFilter reads GET /routes' ?tag=, ?owner= and ?q=.
+func queryFilter(q url.Values) routeFilter {
+	return routeFilter{tags: q["tag"], owner: q.Get("owner"), text: strings.ToLower(q.Get("q"))}
+}
+
+func (f routeFilter) matches(domain string, opts *RouteOptions) bool {
+	for _, tag := range f.tags {
+		if !opts.hasTag(tag) {
+			return false
+		}
+	}
+	if f.owner != "" && !strings.EqualFold(f.owner, opts.Owner) {
+		return false
+	}
+	if f.text == "" {
+		return true
+	}
+	for _, s := range append([]string{domain, opts.Owner, opts.Notes}, opts.Tags...) {
+		if strings.Contains(strings.ToLower(s), f.text) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeMeta is a change to a route's metadata, what's nil stays as it is.
+// it's the body of PATCH /routes/<domain>.
+type routeMeta struct {
+	Tags  *[]string `json:"tags"`
+	Owner *string   `json:"owner"`
+	Notes *string   `json:"notes"`
+}
+
+// apply makes the change on a copy of opts, checking the result.
+func (m routeMeta) apply(opts RouteOptions) (RouteOptions, error) {
+	if m.Tags != nil {
+		opts.Tags = append([]string(nil), *m.Tags...)
+	}
+	if m.Owner != nil {
+		opts.Owner = strings.TrimSpace(*m.Owner)
+	}
+	if m.Notes != nil {
+		opts.Notes = strings.TrimSpace(*m.Notes)
+	}
+	return opts, checkMetadata(opts)
+}
+
+// parseAddMeta reads the --tags, --owner and --notes that can follow add's
+// domain and port. --notes takes the rest of the line.
+func parseAddMeta(args []string) (routeMeta, error) {
+	var m routeMeta
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--tags":
+			if i+1 >= len(args) {
+				return m, errors.New("--tags needs a comma separated list")
+			}
+			i++
+			tags := splitTags(args[i])
+			m.Tags = &tags
+		case "--owner":
+			if i+1 >= len(args) {
+				return m, errors.New("--owner needs an email address")
+			}
+			i++
+			m.Owner = &args[i]
+		case "--notes":
+			notes := strings.Join(args[i+1:], " ")
+			m.Notes = &notes
+			i = len(args)
+		default:
+			return m, fmt.Errorf("unknown option %s, expected --tags, --owner or --notes", args[i])
+		}
+	}
+	_, err := m.apply(RouteOptions{})
+	return m, err
+}
+
+func splitTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+var errNotSaved = errors.New("tunnel routes aren't saved, they have no metadata")
+
+// editRoute changes a route's metadata and saves the routes. the rest of
+// the route is left running as it is. token is nil from the shell.
+func (app *App) editRoute(token *adminToken, domain string, m routeMeta) (DomainRoute, error) {
+	app.Mu.Lock()
+	defer app.Mu.Unlock()
+	proxy, ok := app.Routes[domain]
+	if !ok || (token != nil && !token.owns(proxy)) {
+		return DomainRoute{}, errNoSuchDomain
+	}
+	if proxy.tunnel != nil {
+		return DomainRoute{}, errNotSaved
+	}
+	opts, err := m.apply(proxy.RouteOptions)
+	if err != nil {
+		return DomainRoute{}, err
+	}
+	// a mock stands in for the route that's saved, both get it
+	for _, p := range []*Proxy{proxy, mockedRoute(proxy)} {
+		if p != nil {
+			p.Tags, p.Owner, p.Notes = opts.Tags, opts.Owner, opts.Notes
+		}
+	}
+	return proxy.config(domain), app.saveRoutes(changedBy(token))
+}
+
+func mockedRoute(proxy *Proxy) *Proxy {
+	if proxy.mock == nil {
+		return nil
+	}
+	return proxy.mock.original
+}
+
+// handleEditCommand changes a route's metadata:
+//
+//	edit <domain> tags <tag,tag>   sets them, +tag and -tag add and drop one
+//	edit <domain> owner <email>
+//	edit <domain> notes <text>
+//
+// with nothing after the field, it's cleared.
+func (app *App) handleEditCommand(args []string) {
+	if len(args) < 2 {
+		fmt.Println("Error: Incorrect number of arguments. Expected: edit <domain> tags|owner|notes [value]")
+		return
+	}
+	domain, field, values := NormalizeDomain(args[0]), args[1], args[2:]
+	var m routeMeta
+	switch field {
+	case "tags":
+		app.Mu.RLock()
+		proxy, ok := app.Routes[domain]
+		var tags []string
+		if ok {
+			tags = proxy.Tags
+		}
+		app.Mu.RUnlock()
+		tags = editTags(tags, values)
+		m.Tags = &tags
+	case "owner":
+		owner := strings.Join(values, " ")
+		m.Owner = &owner
+	case "notes":
+		notes := strings.Join(values, " ")
+		m.Notes = &notes
+	default:
+		fmt.Printf("Error: unknown field %s, expected tags, owner or notes\n", field)
+		return
+	}
+	route, err := app.editRoute(nil, domain, m)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	note := strings.TrimPrefix(route.metadataNote(), ", ")
+	if note == "" {
+		note = "no tags, owner or notes"
+	}
+	fmt.Printf("Updated %s: %s\n", listedDomain(domain), note)
+}
+
+// editTags works out a route's new tags from edit's arguments, a list to
+// replace them with or +tag and -tag changes to what they are.
+func editTags(current, args []string) []string {
+	adjust := len(args) > 0
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "+") && !strings.HasPrefix(arg, "-") {
+			adjust = false
+		}
+	}
+	if !adjust {
+		return splitTags(strings.Join(args, ","))
+	}
+	tags := append([]string(nil), current...)
+	for _, arg := range args {
+		for _, tag := range splitTags(arg[1:]) {
+			kept := tags[:0]
+			for _, t := range tags {
+				if !strings.EqualFold(t, tag) {
+					kept = append(kept, t)
+				}
+			}
+			tags = kept
+			if arg[0] == '+' {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// adminPatchRoute changes a route's metadata, PATCH /routes/<domain> with
+// any of {"tags": [...], "owner": "...", "notes": "..."}.
+func (app *App) adminPatchRoute(w http.ResponseWriter, r *http.Request, token *adminToken, domain string) {
+	var m routeMeta
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&m); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	route, err := app.editRoute(token, domain, m)
+	if errors.Is(err, errNoSuchDomain) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("Admin api changed the metadata of route for domain: %s", domain)
+	writeJSON(w, http.StatusOK, route)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// serveMetrics exposes our counters in the Prometheus text format on addr.
+func (app *App) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", app.metricsHandler)
+	ln, err := app.bind(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Serving metrics on %s/metrics", addr)
+	log.Fatal(http.Serve(ln, mux))
+}
+
+func (app *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	domains := app.Stats.Domains()
+
+	fmt.Fprintln(w, "# HELP appserve_requests_total Requests for each routed domain.")
+	fmt.Fprintln(w, "# TYPE appserve_requests_total counter")
+	for _, d := range domains {
+		fmt.Fprintf(w, "appserve_requests_total{domain=%q} %d\n", d, app.Stats.Route(d).Requests.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP appserve_bytes_total Request and response body bytes for each routed domain.")
+	fmt.Fprintln(w, "# TYPE appserve_bytes_total counter")
+	for _, d := range domains {
+		rs := app.Stats.Route(d)
+		fmt.Fprintf(w, "appserve_bytes_total{domain=%q,direction=\"in\"} %d\n", d, rs.BytesIn.Load())
+		fmt.Fprintf(w, "appserve_bytes_total{domain=%q,direction=\"out\"} %d\n", d, rs.BytesOut.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP appserve_error_responses_total 4xx and 5xx responses for each routed domain.")
+	fmt.Fprintln(w, "# TYPE appserve_error_responses_total counter")
+	for _, d := range domains {
+		rs := app.Stats.Route(d)
+		fmt.Fprintf(w, "appserve_error_responses_total{domain=%q,class=\"4xx\"} %d\n", d, rs.ClientErrors.Load())
+		fmt.Fprintf(w, "appserve_error_responses_total{domain=%q,class=\"5xx\"} %d\n", d, rs.ServerErrors.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP appserve_cache_requests_total Cache lookups by result.")
+	fmt.Fprintln(w, "# TYPE appserve_cache_requests_total counter")
+	for _, d := range domains {
+		rs := app.Stats.Route(d)
+		fmt.Fprintf(w, "appserve_cache_requests_total{domain=%q,result=\"hit\"} %d\n", d, rs.CacheHits.Load())
+		fmt.Fprintf(w, "appserve_cache_requests_total{domain=%q,result=\"stale\"} %d\n", d, rs.CacheStale.Load())
+		fmt.Fprintf(w, "appserve_cache_requests_total{domain=%q,result=\"miss\"} %d\n", d, rs.CacheMisses.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP appserve_cache_served_bytes_total Response body bytes served from the cache.")
+	fmt.Fprintln(w, "# TYPE appserve_cache_served_bytes_total counter")
+	for _, d := range domains {
+		fmt.Fprintf(w, "appserve_cache_served_bytes_total{domain=%q} %d\n", d, app.Stats.Route(d).CacheBytes.Load())
+	}
+
+	if app.Geo != nil {
+		fmt.Fprintln(w, "# HELP appserve_requests_by_country_total Requests by the country the client ip is in.")
+		fmt.Fprintln(w, "# TYPE appserve_requests_by_country_total counter")
+		for _, d := range domains {
+			countries, _ := app.Stats.Route(d).Geo.top(0)
+			for _, c := range countries {
+				fmt.Fprintf(w, "appserve_requests_by_country_total{domain=%q,country=%q} %d\n", d, c.Name, c.Requests)
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP appserve_bot_rule_hits_total Requests blocked or challenged by each of a route's bot rules.")
+	fmt.Fprintln(w, "# TYPE appserve_bot_rule_hits_total counter")
+	for _, d := range domains {
+		for _, c := range app.Stats.Route(d).Bots.counts() {
+			fmt.Fprintf(w, "appserve_bot_rule_hits_total{domain=%q,rule=%q} %d\n", d, c.Rule, c.Hits)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP appserve_errors_total Failed requests by whose fault it was (client, upstream, internal) and why.")
+	fmt.Fprintln(w, "# TYPE appserve_errors_total counter")
+	for _, c := range requestErrors.snapshot() {
+		fmt.Fprintf(w, "appserve_errors_total{class=%q,reason=%q} %d\n", c.Class, c.Reason, c.Count)
+	}
+
+	if app.Tarpit != nil {
+		fmt.Fprintln(w, "# HELP appserve_tarpitted_total Blocked or rate limited clients answered with a slow trickle.")
+		fmt.Fprintln(w, "# TYPE appserve_tarpitted_total counter")
+		fmt.Fprintf(w, "appserve_tarpitted_total %d\n", app.Tarpit.total.Load())
+		fmt.Fprintln(w, "# HELP appserve_tarpit_connections Clients in the tarpit right now.")
+		fmt.Fprintln(w, "# TYPE appserve_tarpit_connections gauge")
+		fmt.Fprintf(w, "appserve_tarpit_connections %d\n", app.Tarpit.active.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP appserve_log_suppressed_lines_total Log lines held back by rate limiting or access log sampling.")
+	fmt.Fprintln(w, "# TYPE appserve_log_suppressed_lines_total counter")
+	for _, c := range noisyLogs.suppressed() {
+		fmt.Fprintf(w, "appserve_log_suppressed_lines_total{category=%q} %d\n", c.Category, c.Lines)
+	}
+
+	if app.Cache != nil {
+		memEntries, memSize, diskEntries, diskSize := app.Cache.Usage()
+		fmt.Fprintln(w, "# HELP appserve_cache_entries Responses currently held by the cache.")
+		fmt.Fprintln(w, "# TYPE appserve_cache_entries gauge")
+		fmt.Fprintf(w, "appserve_cache_entries{tier=\"memory\"} %d\n", memEntries)
+		fmt.Fprintf(w, "appserve_cache_entries{tier=\"disk\"} %d\n", diskEntries)
+		fmt.Fprintln(w, "# HELP appserve_cache_size_bytes Space used by the cache.")
+		fmt.Fprintln(w, "# TYPE appserve_cache_size_bytes gauge")
+		fmt.Fprintf(w, "appserve_cache_size_bytes{tier=\"memory\"} %d\n", memSize)
+		fmt.Fprintf(w, "appserve_cache_size_bytes{tier=\"disk\"} %d\n", diskSize)
+	}
+}
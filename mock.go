@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mockResponse is a canned answer for requests a mock route gets, the
+// first one whose method and path match is sent.
+type mockResponse struct {
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"` // exact, or a prefix ending in *
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+func (m mockResponse) matches(r *http.Request) bool {
+	if m.Method != "" && !strings.EqualFold(m.Method, r.Method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(m.Path, "*"); ok {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+	return m.Path == "" || m.Path == r.URL.Path
+}
+
+// mockHandler answers for a route while it's mocked, with a canned
+// response or, when none match, a description of the request as json.
+type mockHandler struct {
+	responses []mockResponse
+
+	// original is the route the mock stands in for, put back when the
+	// mock is turned off and saved in its place meanwhile. nil when the
+	// domain had no route.
+	original *Proxy
+	started  time.Time
+}
+
+func (m *mockHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, resp := range m.responses {
+		if !resp.matches(r) {
+			continue
+		}
+		for name, value := range resp.Headers {
+			w.Header().Set(name, value)
+		}
+		status := resp.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.WriteString(w, resp.Body)
+		}
+		return
+	}
+
+	// the echo, showing what made it through dns, tls and the route's
+	// header rules
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	echo := map[string]interface{}{
+		"method":    r.Method,
+		"host":      r.Host,
+		"uri":       r.URL.RequestURI(),
+		"proto":     r.Proto,
+		"remote":    r.RemoteAddr,
+		"client_ip": clientIP(r),
+		"headers":   r.Header,
+		"time":      time.Now().UTC(),
+	}
+	if len(body) > 0 {
+		echo["body"] = string(body)
+	}
+	if r.TLS != nil {
+		echo["tls"] = map[string]string{
+			"version":     tls.VersionName(r.TLS.Version),
+			"cipher":      tls.CipherSuiteName(r.TLS.CipherSuite),
+			"server_name": r.TLS.ServerName,
+			"alpn":        r.TLS.NegotiatedProtocol,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(echo)
+}
+
+// newMock builds a mock route for a domain, keeping the options of the
+// route it replaces so headers, limits and certificates behave as they
+// will for real.
+func newMock(existing *Proxy, responses []mockResponse) (*Proxy, error) {
+	// mocking a mock replaces its responses, the real route stays put
+	if existing != nil && existing.mock != nil {
+		existing = existing.mock.original
+	}
+	var opts RouteOptions
+	if existing != nil {
+		opts = existing.RouteOptions
+	}
+	m := &mockHandler{responses: responses, original: existing, started: time.Now()}
+	proxy := &Proxy{RouteOptions: opts, handler: m, mock: m}
+	if err := proxy.applyOptions(); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// handleMockCommand points a domain at the built in mock upstream, puts
+// the route back, or lists the mocks:
+//
+//	mock example.com
+//	mock example.com --status 503 --body "back soon" --header "Retry-After: 60"
+//	mock example.com --responses mock.json
+//	mock example.com off
+//	mock
+func (app *App) handleMockCommand(args []string) {
+	if len(args) == 0 {
+		app.Mu.RLock()
+		defer app.Mu.RUnlock()
+		var domains []string
+		for domain, proxy := range app.Routes {
+			if proxy.mock != nil {
+				domains = append(domains, domain)
+			}
+		}
+		if len(domains) == 0 {
+			fmt.Println("No routes are mocked.")
+		}
+		sort.Strings(domains)
+		for _, domain := range domains {
+			m := app.Routes[domain].mock
+			was := "no route"
+			if m.original != nil {
+				was = describeRoute(m.original)
+			}
+			fmt.Printf("Mock: %s, for %s, was %s\n", domain, time.Since(m.started).Round(time.Second), was)
+		}
+		return
+	}
+
+	domain := NormalizeDomain(args[0])
+	if len(args) == 2 && args[1] == "off" {
+		app.Mu.Lock()
+		defer app.Mu.Unlock()
+		proxy, ok := app.Routes[domain]
+		if !ok || proxy.mock == nil {
+			fmt.Printf("Error: %s isn't mocked.\n", domain)
+			return
+		}
+		if proxy.mock.original != nil {
+			app.Routes[domain] = proxy.mock.original
+		} else {
+			delete(app.Routes, domain)
+		}
+		app.publishRoutes()
+		fmt.Printf("Stopped mocking %s\n", domain)
+		return
+	}
+
+	fs := flag.NewFlagSet("mock", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	status := fs.Int("status", 0, "")
+	body := fs.String("body", "", "")
+	var headers []string
+	fs.Func("header", "", func(h string) error {
+		headers = append(headers, h)
+		return nil
+	})
+	responsesFile := fs.String("responses", "", "")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 {
+		fmt.Println("Error: Expected: mock <domain> [--status CODE] [--body TEXT] [--header \"Name: value\"] [--responses FILE] or mock <domain> off")
+		return
+	}
+
+	var responses []mockResponse
+	if *responsesFile != "" {
+		data, err := os.ReadFile(*responsesFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if err := json.Unmarshal(data, &responses); err != nil {
+			fmt.Printf("Error: %s: %v\n", *responsesFile, err)
+			return
+		}
+	}
+	if *status != 0 || *body != "" || len(headers) > 0 {
+		resp := mockResponse{Status: *status, Body: *body, Headers: map[string]string{}}
+		for _, h := range headers {
+			name, value, ok := strings.Cut(h, ":")
+			if !ok {
+				fmt.Printf("Error: --header %q should look like \"Name: value\"\n", h)
+				return
+			}
+			resp.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+		// the catch all goes after any from the file
+		responses = append(responses, resp)
+	}
+
+	app.Mu.Lock()
+	defer app.Mu.Unlock()
+	proxy, err := newMock(app.Routes[domain], responses)
+	if err != nil {
+		fmt.Printf("Error mocking route: %v\n", err)
+		return
+	}
+	app.Routes[domain] = proxy
+	app.publishRoutes()
+
+	what := "echoing requests back"
+	if len(responses) > 0 {
+		what = "with canned responses"
+	}
+	fmt.Printf("Mocking %s %s, mock %s off puts the route back\n", domain, what, domain)
+}
+
+// describeRoute says where a route sends requests, for listings.
+func describeRoute(p *Proxy) string {
+	switch {
+	case p.Parked:
+		return "parked"
+	case p.Root != "":
+		return "static " + p.Root
+	case p.tunnel != nil:
+		return "a tunnel from " + p.tunnel.remote
+	default:
+		return "port " + p.Port
+	}
+}
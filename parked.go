@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/idna"
+)
+
+// defaultParkedTemplate is the coming soon page for parked routes without a
+// template of their own.
+var defaultParkedTemplate = template.Must(template.New("parked").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Domain}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center; color: #222; background: #fafafa; }
+main { text-align: center; padding: 2em; }
+h1 { font-size: 2em; font-weight: normal; margin: 0 0 .3em; }
+p { color: #777; margin: 0; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Domain}}</h1>
+<p>coming soon</p>
+</main>
+</body>
+</html>
+`))
+
+// parkedHandler serves the placeholder page for a parked route.
+type parkedHandler struct {
+	tmpl *template.Template
+}
+
+func newParked(opts RouteOptions) (*Proxy, error) {
+	tmpl := defaultParkedTemplate
+	if opts.ParkedTemplate != "" {
+		var err error
+		tmpl, err = template.ParseFiles(opts.ParkedTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("parked_template: %w", err)
+		}
+	}
+
+	proxy := &Proxy{
+		Parked:       true,
+		RouteOptions: opts,
+		handler:      &parkedHandler{tmpl: tmpl},
+	}
+	if err := proxy.applyOptions(); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+func (p *parkedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// render first so a broken template is a clean 500 instead of half a page
+	domain := NormalizeDomain(r.Host)
+	if name, err := idna.Display.ToUnicode(domain); err == nil {
+		domain = name
+	}
+	var buf bytes.Buffer
+	err := p.tmpl.Execute(&buf, struct{ Domain string }{domain})
+	if err != nil {
+		internalError(w, r, "template", err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	h.Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// listener is a tcp port something on this machine is listening on.
+type listener struct {
+	Addr    string // the address it's bound to, 0.0.0.0 or :: for all of them
+	Port    int
+	PID     int // 0 when we can't tell whose it is
+	Process string
+}
+
+// handlePortsCommand lists what's listening locally and which of them
+// routes point at, to find the port an app came up on.
+func (app *App) handlePortsCommand() {
+	listeners, err := listeningPorts()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(listeners) == 0 {
+		fmt.Println("Nothing is listening.")
+		return
+	}
+
+	routed := map[string][]string{}
+	app.Mu.RLock()
+	for domain, proxy := range app.Routes {
+		if proxy.Port != "" {
+			routed[proxy.Port] = append(routed[proxy.Port], domain)
+		}
+	}
+	app.Mu.RUnlock()
+
+	sort.Slice(listeners, func(i, j int) bool {
+		if listeners[i].Port != listeners[j].Port {
+			return listeners[i].Port < listeners[j].Port
+		}
+		return listeners[i].Addr < listeners[j].Addr
+	})
+	for _, l := range listeners {
+		process := "?"
+		if l.Process != "" {
+			process = fmt.Sprintf("%s (%d)", l.Process, l.PID)
+		}
+		line := fmt.Sprintf("Port: %d, Address: %s, Process: %s", l.Port, l.Addr, process)
+		if domains := routed[fmt.Sprint(l.Port)]; len(domains) > 0 {
+			sort.Strings(domains)
+			line += fmt.Sprintf(", Routes: %v", domains)
+		}
+		fmt.Println(line)
+	}
+}
+
+// warnIfNotListening points out a route added for a backend that isn't
+// running, the usual reason a new route answers 502.
+func warnIfNotListening(port string) {
+	addr := backendAddr(port)
+	network := "tcp"
+	if socket, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", socket
+	}
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		fmt.Printf("Warning: Nothing is listening on %s yet, is the app running?\n", addr)
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listeningPorts reads the kernel's socket tables, and which process has
+// each socket open from /proc. sockets of other users' processes show
+// without a name unless we're root.
+func listeningPorts() ([]listener, error) {
+	byInode := map[string]listener{}
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // the header
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || fields[3] != "0A" { // 0A is LISTEN
+				continue
+			}
+			addr, port, ok := parseProcAddr(fields[1])
+			if ok {
+				byInode[fields[9]] = listener{Addr: addr, Port: port}
+			}
+		}
+		f.Close()
+	}
+
+	procs, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range procs {
+		target, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(target, "socket:[") {
+			continue
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")
+		l, ok := byInode[inode]
+		if !ok || l.PID != 0 {
+			continue
+		}
+		pidDir := filepath.Dir(filepath.Dir(fd))
+		l.PID, _ = strconv.Atoi(filepath.Base(pidDir))
+		if comm, err := os.ReadFile(filepath.Join(pidDir, "comm")); err == nil {
+			l.Process = strings.TrimSpace(string(comm))
+		}
+		byInode[inode] = l
+	}
+
+	listeners := make([]listener, 0, len(byInode))
+	for _, l := range byInode {
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// parseProcAddr reads an address from /proc/net/tcp, hex ip and port with
+// the ip in host byte order, 32 bits at a time.
+func parseProcAddr(s string) (string, int, bool) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", 0, false
+	}
+	raw, err := hex.DecodeString(ipHex)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return "", 0, false
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return "", 0, false
+	}
+	return net.IP(raw).String(), int(port), true
+}
@@ -0,0 +1,54 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listeningPorts asks lsof, which macos and the bsds have out of the box.
+func listeningPorts() ([]listener, error) {
+	if _, err := exec.LookPath("lsof"); err != nil {
+		return nil, errors.New("listing ports needs lsof on this platform")
+	}
+	out, err := exec.Command("lsof", "-nP", "-iTCP", "-sTCP:LISTEN", "-F", "pcn").Output()
+	if err != nil && len(out) == 0 {
+		// lsof exits 1 when it finds nothing
+		return nil, nil
+	}
+
+	// -F prints a field per line: p<pid>, c<command>, then n<address> for
+	// each of the process's sockets
+	var listeners []listener
+	var pid int
+	var process string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			pid, _ = strconv.Atoi(line[1:])
+		case 'c':
+			process = line[1:]
+		case 'n':
+			host, port, err := net.SplitHostPort(line[1:])
+			if err != nil {
+				continue
+			}
+			n, err := strconv.Atoi(port)
+			if err != nil {
+				continue
+			}
+			if host == "*" {
+				host = "0.0.0.0"
+			}
+			listeners = append(listeners, listener{Addr: strings.Trim(host, "[]"), Port: n, PID: pid, Process: process})
+		}
+	}
+	return listeners, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolSignature is the fixed 12 byte preamble of a v2 header.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeaderTimeout bounds how long a fresh connection may take to send its
+// PROXY header before we give up on it.
+const proxyHeaderTimeout = 10 * time.Second
+
+// ProxyProtocolListener wraps a listener whose connections are all expected to
+// start with a HAProxy PROXY protocol (v1 or v2) header, as sent by an L4 load
+// balancer. The header is stripped and the client address it carries becomes
+// the RemoteAddr of the connection.
+type ProxyProtocolListener struct {
+	net.Listener
+}
+
+// Accept hands back the connection straight away, the header is parsed on
+// first use so one slow client can't hold up the accept loop.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.local, c.err = readProxyHeader(c.r)
+	if c.err != nil {
+		c.err = fmt.Errorf("proxy protocol from %s: %w", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+}
+
+// readProxyHeader consumes a v1 or v2 header from r. A nil source address with
+// a nil error means the sender asked us to use the real connection addresses
+// (v1 UNKNOWN or v2 LOCAL, typically the balancer's own health checks).
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	peek, err := r.Peek(len(proxyProtocolSignature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(peek, proxyProtocolSignature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil, errors.New("missing PROXY header")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// the spec caps a v1 line at 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("malformed v1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("malformed v1 header")
+	}
+
+	src, err := proxyTCPAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := proxyTCPAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func proxyTCPAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL command, keep the real addresses
+	if hdr[12]&0x0f == 0 {
+		return nil, nil, nil
+	}
+
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, nil, errors.New("short v2 ipv4 address block")
+		}
+		src := &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		dst := &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+		return src, dst, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, nil, errors.New("short v2 ipv6 address block")
+		}
+		src := &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		dst := &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+		return src, dst, nil
+	default:
+		// unix sockets and unspecified families carry nothing useful to us
+		return nil, nil, nil
+	}
+}
+
+// proxyHeader is the header to send a backend for a connection from src to
+// dst, in version "v1" or "v2". addresses that aren't tcp ones make it a
+// v1 UNKNOWN or a v2 LOCAL, telling the backend to use what it sees.
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	ok := sok && dok
+	v4 := ok && s.IP.To4() != nil && d.IP.To4() != nil
+
+	if version == "v1" {
+		switch {
+		case !ok:
+			return []byte("PROXY UNKNOWN\r\n")
+		case v4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", s.IP.To16(), d.IP.To16(), s.Port, d.Port))
+		}
+	}
+
+	hdr := append([]byte(nil), proxyProtocolSignature...)
+	if !ok {
+		return append(hdr, 0x20, 0x00, 0, 0) // LOCAL, no addresses
+	}
+	var addrs []byte
+	if v4 {
+		hdr = append(hdr, 0x21, 0x11) // PROXY, TCP over ipv4
+		addrs = append(append(addrs, s.IP.To4()...), d.IP.To4()...)
+	} else {
+		hdr = append(hdr, 0x21, 0x21) // PROXY, TCP over ipv6
+		addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+// parseProxyProtocolVersion checks a send_proxy_protocol setting.
+func parseProxyProtocolVersion(v string) (string, error) {
+	switch strings.ToLower(v) {
+	case "":
+		return "", nil
+	case "v1", "1":
+		return "v1", nil
+	case "v2", "2":
+		return "v2", nil
+	}
+	return "", fmt.Errorf("expected v1 or v2, got %q", v)
+}
+
+type proxyAddrsKey struct{}
+
+// proxyAddrs are the addresses a backend connection's PROXY header carries.
+type proxyAddrs struct {
+	src, dst net.Addr
+}
+
+// withProxyAddrs notes the client and local address of r's connection in
+// its context, for the dialer to put in the header.
+func withProxyAddrs(r *http.Request) *http.Request {
+	var addrs proxyAddrs
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if src, err := proxyTCPAddr(host, port); err == nil {
+			addrs.src = src
+		}
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		addrs.dst = local
+	}
+	return r.WithContext(context.WithValue(r.Context(), proxyAddrsKey{}, addrs))
+}
+
+// dialWithProxyHeader wraps dial to start every connection with a PROXY
+// header for the request it's for.
+func dialWithProxyHeader(version string, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, _ := ctx.Value(proxyAddrsKey{}).(proxyAddrs)
+		if _, err := conn.Write(proxyHeader(version, addrs.src, addrs.dst)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordedRequest is one line of a recording, enough to send the request
+// again and see whether the answer still matches.
+type recordedRequest struct {
+	Time     time.Time   `json:"time"`
+	Method   string      `json:"method"`
+	Host     string      `json:"host"`
+	URI      string      `json:"uri"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     []byte      `json:"body,omitempty"`
+	BodySize int64       `json:"body_size,omitempty"` // the whole body, Body may be cut short
+	Status   int         `json:"status"`
+	Duration float64     `json:"duration_ms"`
+}
+
+// recordHeaders never make it into a recording, they carry credentials or
+// say who the client was.
+var recordHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Api-Key":           true,
+	"X-Auth-Token":        true,
+	"X-Csrf-Token":        true,
+	"X-Xsrf-Token":        true,
+	"X-Forwarded-For":     true,
+	"X-Real-Ip":           true,
+	"Forwarded":           true,
+}
+
+// recordParams are query parameters whose values are swapped for a
+// placeholder, matched on any part of the name.
+var recordParams = []string{"token", "key", "secret", "password", "passwd", "auth", "session", "signature", "sig", "code"}
+
+// sanitizeURI redacts the values of query parameters that look like
+// credentials.
+func sanitizeURI(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return path
+	}
+	for name := range values {
+		lower := strings.ToLower(name)
+		for _, p := range recordParams {
+			if strings.Contains(lower, p) {
+				values[name] = []string{"redacted"}
+				break
+			}
+		}
+	}
+	return path + "?" + values.Encode()
+}
+
+// recording samples requests to a domain into a file for replay, like a
+// tap but kept to what can be sent again safely.
+type recording struct {
+	domain  string
+	count   int
+	sample  float64
+	maxBody int64
+	file    string
+
+	mu      sync.Mutex
+	out     *os.File
+	claimed int
+	written int
+}
+
+// recordingSet holds the recordings that are running, one per domain at
+// most.
+type recordingSet struct {
+	mu   sync.Mutex
+	recs map[string]*recording
+}
+
+func (rs *recordingSet) start(rec *recording) error {
+	f, err := os.OpenFile(rec.file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	rec.out = f
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.recs == nil {
+		rs.recs = make(map[string]*recording)
+	}
+	if old, ok := rs.recs[rec.domain]; ok {
+		old.close()
+	}
+	rs.recs[rec.domain] = rec
+	return nil
+}
+
+func (rs *recordingSet) stop(domain string) bool {
+	rs.mu.Lock()
+	rec, ok := rs.recs[domain]
+	delete(rs.recs, domain)
+	rs.mu.Unlock()
+	if ok {
+		rec.close()
+	}
+	return ok
+}
+
+// claim decides whether this request to domain is part of the sample.
+func (rs *recordingSet) claim(domain string) *recording {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rec, ok := rs.recs[domain]
+	if !ok || (rec.sample < 1 && rand.Float64() >= rec.sample) {
+		return nil
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.claimed >= rec.count {
+		return nil
+	}
+	rec.claimed++
+	if rec.claimed == rec.count {
+		delete(rs.recs, domain)
+	}
+	return rec
+}
+
+func (rs *recordingSet) list() []*recording {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	recs := make([]*recording, 0, len(rs.recs))
+	for _, rec := range rs.recs {
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].domain < recs[j].domain })
+	return recs
+}
+
+func (rec *recording) close() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.out == nil {
+		return
+	}
+	if err := rec.out.Close(); err != nil {
+		log.Printf("Error closing recording %s: %v", rec.file, err)
+	}
+	rec.out = nil
+	log.Printf("Recording of %s finished, %d requests written to %s", rec.domain, rec.written, rec.file)
+}
+
+// capture records r, the returned func writes it out with the status once
+// the response is done. only the request body is kept, the response is
+// what replay compares against.
+func (rec *recording) capture(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	body := &cappedBuffer{max: rec.maxBody}
+	if rec.maxBody > 0 && r.Body != nil && r.Body != http.NoBody {
+		r.Body = &tapBody{ReadCloser: r.Body, buf: body}
+	}
+	tw := &tapWriter{ResponseWriter: w}
+	start := time.Now()
+
+	entry := recordedRequest{
+		Time:   start.UTC(),
+		Method: r.Method,
+		Host:   r.Host,
+		URI:    sanitizeURI(r.URL.RequestURI()),
+		Header: http.Header{},
+	}
+	for name, values := range r.Header {
+		if !recordHeaders[http.CanonicalHeaderKey(name)] {
+			entry.Header[name] = append([]string(nil), values...)
+		}
+	}
+
+	return tw, func() {
+		entry.Body = body.buf.Bytes()
+		entry.BodySize = body.total
+		entry.Status = tw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Duration = float64(time.Since(start).Microseconds()) / 1000
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+
+		rec.mu.Lock()
+		if rec.out != nil {
+			if _, err := rec.out.Write(append(line, '\n')); err != nil {
+				log.Printf("Error writing to recording %s: %v", rec.file, err)
+			}
+			rec.written++
+		}
+		finished := rec.written == rec.count
+		rec.mu.Unlock()
+		if finished {
+			rec.close()
+		}
+	}
+}
+
+// handleRecordCommand starts, stops or lists recordings:
+//
+//	record example.com --count 500 --sample 10% --bodies 64KB --out example.jsonl
+//	record example.com off
+//	record
+func (app *App) handleRecordCommand(args []string) {
+	if len(args) == 0 {
+		recs := app.recordings.list()
+		if len(recs) == 0 {
+			fmt.Println("No recordings running.")
+		}
+		for _, rec := range recs {
+			rec.mu.Lock()
+			fmt.Printf("Recording: %s, %d of %d requests written to %s\n", rec.domain, rec.written, rec.count, rec.file)
+			rec.mu.Unlock()
+		}
+		return
+	}
+
+	domain := NormalizeDomain(args[0])
+	if len(args) == 2 && args[1] == "off" {
+		if !app.recordings.stop(domain) {
+			fmt.Printf("Error: No recording running on %s.\n", domain)
+		}
+		return
+	}
+
+	fs := flag.NewFlagSet("record", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	count := fs.Int("count", 100, "")
+	sample := fs.String("sample", "100%", "")
+	bodies := fs.String("bodies", "0", "")
+	out := fs.String("out", "", "")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 {
+		fmt.Println("Error: Expected: record <domain> [--count N] [--sample PERCENT] [--bodies SIZE] [--out FILE] or record <domain> off")
+		return
+	}
+	if *count < 1 {
+		fmt.Println("Error: --count has to be at least 1.")
+		return
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(*sample, "%"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		fmt.Println("Error: --sample has to be a percentage above 0, like 10%.")
+		return
+	}
+	maxBody, err := parseSize(*bodies)
+	if err != nil {
+		fmt.Printf("Error: Invalid --bodies: %v\n", err)
+		return
+	}
+	if _, _, found := app.routeTable().match(domain, "/"); !found {
+		fmt.Printf("Error: No route for %s.\n", domain)
+		return
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("record-%s-%s.jsonl", domain, time.Now().Format("20060102-150405"))
+	}
+
+	rec := &recording{domain: domain, count: *count, sample: percent / 100, maxBody: maxBody, file: *out}
+	if err := app.recordings.start(rec); err != nil {
+		fmt.Printf("Error: Couldn't create %s: %v\n", *out, err)
+		return
+	}
+	fmt.Printf("Recording %d requests to %s (%g%% of them) in %s\n", *count, domain, percent, *out)
+}
+
+// replayResult is how one recorded request went the second time.
+type replayResult struct {
+	req     recordedRequest
+	status  int
+	latency time.Duration
+	err     error
+}
+
+// runReplay sends a recording to another upstream and reports where its
+// answers differ from the ones recorded, `appserve replay example.jsonl
+// 127.0.0.1:3001`.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	concurrency := fs.Int("c", 4, "requests in flight at once")
+	speed := fs.Float64("speed", 0, "keep the recorded pacing, sped up this many times, 0 sends as fast as -c allows")
+	showDiffs := fs.Int("show", 20, "how many mismatched requests to list")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appserve replay [flags] <recording> <port | host:port | url>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 || *concurrency < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	reqs, err := readRecording(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	target := fs.Arg(1)
+	if _, err := strconv.Atoi(target); err == nil {
+		target = "127.0.0.1:" + target
+	}
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	base, err := url.Parse(target)
+	if err != nil || base.Host == "" {
+		fmt.Fprintf(os.Stderr, "Error: invalid target %q\n", fs.Arg(1))
+		os.Exit(1)
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		// the redirects are part of what's compared, don't follow them
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	results := make([]replayResult, len(reqs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j] = replayRequest(client, base, reqs[j])
+			}
+		}()
+	}
+	start := time.Now()
+	for i, req := range reqs {
+		if *speed > 0 {
+			if wait := time.Duration(float64(req.Time.Sub(reqs[0].Time))/(*speed)) - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if printReplayReport(results, base.Host, *showDiffs) {
+		os.Exit(1)
+	}
+}
+
+// readRecording reads the requests in a file written by the record command.
+func readRecording(file string) ([]recordedRequest, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var reqs []recordedRequest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var req recordedRequest
+		if err := dec.Decode(&req); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		reqs = append(reqs, req)
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("%s has no requests in it", file)
+	}
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].Time.Before(reqs[j].Time) })
+	return reqs, nil
+}
+
+func replayRequest(client *http.Client, base *url.URL, rec recordedRequest) replayResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, rec.Method, base.Scheme+"://"+base.Host+rec.URI, bytes.NewReader(rec.Body))
+	if err != nil {
+		return replayResult{req: rec, err: err}
+	}
+	req.Header = rec.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Host = rec.Host
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return replayResult{req: rec, err: err}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return replayResult{req: rec, status: resp.StatusCode, latency: time.Since(start)}
+}
+
+// printReplayReport lists how the replay compared with the recording,
+// reporting whether anything came back differently.
+func printReplayReport(results []replayResult, target string, show int) bool {
+	var matched, errored, truncated int
+	var diffs []replayResult
+	var before, after []time.Duration
+	for _, res := range results {
+		if int64(len(res.req.Body)) < res.req.BodySize {
+			truncated++
+		}
+		switch {
+		case res.err != nil:
+			errored++
+			diffs = append(diffs, res)
+		case res.status == res.req.Status:
+			matched++
+			before = append(before, time.Duration(res.req.Duration*float64(time.Millisecond)))
+			after = append(after, res.latency)
+		default:
+			diffs = append(diffs, res)
+		}
+	}
+
+	fmt.Printf("Replayed %d requests against %s\n", len(results), target)
+	fmt.Printf("  same status:      %d\n", matched)
+	fmt.Printf("  different status: %d\n", len(diffs)-errored)
+	fmt.Printf("  errors:           %d\n", errored)
+	if truncated > 0 {
+		fmt.Printf("  %d requests had their bodies cut short by --bodies when recorded, they may fail for that alone\n", truncated)
+	}
+	if len(before) > 0 {
+		sort.Slice(before, func(i, j int) bool { return before[i] < before[j] })
+		sort.Slice(after, func(i, j int) bool { return after[i] < after[j] })
+		fmt.Println("Latency of matching requests, recorded -> replayed:")
+		for _, p := range []float64{50, 90, 99} {
+			fmt.Printf("  %-4s %s -> %s\n", fmt.Sprintf("p%g", p),
+				percentile(before, p).Round(time.Microsecond), percentile(after, p).Round(time.Microsecond))
+		}
+	}
+	if len(diffs) > 0 {
+		fmt.Println("Mismatches:")
+		for i, res := range diffs {
+			if i == show {
+				fmt.Printf("  ... and %d more\n", len(diffs)-show)
+				break
+			}
+			got := strconv.Itoa(res.status)
+			if res.err != nil {
+				got = res.err.Error()
+			}
+			fmt.Printf("  %s %s%s: %d -> %s\n", res.req.Method, res.req.Host, res.req.URI, res.req.Status, got)
+		}
+	}
+	return len(diffs) > 0
+}
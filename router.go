@@ -0,0 +1,265 @@
+package main
+
+import "strings"
+
+// routeTable is an immutable index of the routes, built whenever they
+// change and read without locks by every request. route keys are a host,
+// optionally a path prefix after it:
+//
+//	example.com        just that host
+//	*.example.com      any subdomain, at any depth
+//	*                  every host nothing more specific matches
+//	example.com/api    /api and everything under it on example.com
+//
+// hosts sit in a tree keyed on their labels from the right, so
+// *.example.com hangs off com → example, and each host keeps a tree of
+// path segments. a lookup is one walk down each, however many routes
+// there are.
+type routeTable struct {
+	root *hostNode
+}
+
+type hostNode struct {
+	children map[string]*hostNode
+	exact    *pathNode // routes for exactly this name
+	wildcard *pathNode // routes for *.this name
+}
+
+type pathNode struct {
+	children map[string]*pathNode
+	key      string
+	route    *Proxy
+}
+
+// routeMatch is a candidate route for a request. when several match the
+// highest priority wins, then the most specific host, then the longest
+// path.
+type routeMatch struct {
+	key      string
+	route    *Proxy
+	hostRank int
+	pathLen  int
+}
+
+func (m routeMatch) beats(other routeMatch) bool {
+	if other.route == nil {
+		return true
+	}
+	if m.route.Priority != other.route.Priority {
+		return m.route.Priority > other.route.Priority
+	}
+	if m.hostRank != other.hostRank {
+		return m.hostRank > other.hostRank
+	}
+	return m.pathLen > other.pathLen
+}
+
+func newRouteTable(routes map[string]*Proxy) *routeTable {
+	t := &routeTable{root: &hostNode{}}
+	for key, route := range routes {
+		t.insert(key, route)
+	}
+	return t
+}
+
+func (t *routeTable) insert(key string, route *Proxy) {
+	host, path, _ := strings.Cut(key, "/")
+
+	wildcard := false
+	if host == "*" {
+		host, wildcard = "", true
+	} else if rest, ok := strings.CutPrefix(host, "*."); ok {
+		host, wildcard = rest, true
+	}
+
+	node := t.root
+	labels := splitLabels(host)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = map[string]*hostNode{}
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &hostNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	paths := &node.exact
+	if wildcard {
+		paths = &node.wildcard
+	}
+	if *paths == nil {
+		*paths = &pathNode{}
+	}
+
+	pn := *paths
+	for _, seg := range splitSegments(path) {
+		if pn.children == nil {
+			pn.children = map[string]*pathNode{}
+		}
+		child, ok := pn.children[seg]
+		if !ok {
+			child = &pathNode{}
+			pn.children[seg] = child
+		}
+		pn = child
+	}
+	pn.key = key
+	pn.route = route
+}
+
+// match finds the route for a normalized host and request path.
+func (t *routeTable) match(host, path string) (string, *Proxy, bool) {
+	if t == nil {
+		return "", nil, false
+	}
+
+	var best routeMatch
+	consider := func(paths *pathNode, hostRank int) {
+		if paths == nil {
+			return
+		}
+		if m, ok := paths.match(path); ok {
+			m.hostRank = hostRank
+			if m.beats(best) {
+				best = m
+			}
+		}
+	}
+
+	labels := splitLabels(host)
+	node := t.root
+	depth := 0
+	for i := len(labels) - 1; i >= 0; i-- {
+		// a wildcard here covers every name below it
+		consider(node.wildcard, 2*depth)
+		node = node.children[labels[i]]
+		if node == nil {
+			break
+		}
+		depth++
+	}
+	if node != nil {
+		consider(node.exact, 2*depth+1)
+	}
+
+	return best.key, best.route, best.route != nil
+}
+
+// match walks down the path segments, remembering the deepest route on the
+// way.
+func (n *pathNode) match(path string) (routeMatch, bool) {
+	var m routeMatch
+	found := false
+	if n.route != nil {
+		m, found = routeMatch{key: n.key, route: n.route}, true
+	}
+
+	depth := 0
+	for _, seg := range splitSegments(path) {
+		n = n.children[seg]
+		if n == nil {
+			break
+		}
+		depth++
+		if n.route != nil {
+			m, found = routeMatch{key: n.key, route: n.route, pathLen: depth}, true
+		}
+	}
+	return m, found
+}
+
+// hasHost reports whether any route at all would answer for a host, which
+// is what matters when deciding to get it a certificate.
+func (t *routeTable) hasHost(host string) bool {
+	if t == nil {
+		return false
+	}
+	labels := splitLabels(host)
+	node := t.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.wildcard != nil {
+			return true
+		}
+		node = node.children[labels[i]]
+		if node == nil {
+			return false
+		}
+	}
+	return node.exact != nil
+}
+
+// wantsCert reports whether a host needs a certificate, whether any route
+// answering for it is served over https. http only routes aren't.
+func (t *routeTable) wantsCert(host string) bool {
+	if t == nil {
+		return false
+	}
+	labels := splitLabels(host)
+	node := t.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.wildcard.hasTLS() {
+			return true
+		}
+		node = node.children[labels[i]]
+		if node == nil {
+			return false
+		}
+	}
+	return node.exact.hasTLS()
+}
+
+// explicitHost reports whether a host has an https route of its own,
+// rather than only being covered by a wildcard.
+func (t *routeTable) explicitHost(host string) bool {
+	if t == nil {
+		return false
+	}
+	labels := splitLabels(host)
+	node := t.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.children[labels[i]]
+		if node == nil {
+			return false
+		}
+	}
+	return node.exact.hasTLS()
+}
+
+// hasTLS reports whether any route in the path tree is served over https.
+func (n *pathNode) hasTLS() bool {
+	if n == nil {
+		return false
+	}
+	if n.route != nil && !n.route.HTTPOnly {
+		return true
+	}
+	for _, child := range n.children {
+		if child.hasTLS() {
+			return true
+		}
+	}
+	return false
+}
+
+func splitLabels(host string) []string {
+	if host == "" {
+		return nil
+	}
+	return strings.Split(host, ".")
+}
+
+// splitSegments breaks a path into its non empty segments.
+func splitSegments(path string) []string {
+	var segs []string
+	for path != "" {
+		var seg string
+		seg, path, _ = strings.Cut(path, "/")
+		if seg != "" {
+			segs = append(segs, seg)
+		}
+	}
+	return segs
+}
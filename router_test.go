@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRouteTableMatch(t *testing.T) {
+	routes := map[string]*Proxy{
+		"example.com":             {},
+		"example.com/api":         {},
+		"example.com/api/v2":      {},
+		"*.example.com":           {},
+		"*.eu.example.com":        {},
+		"shop.example.com":        {},
+		"*.shop.example.com/cart": {},
+		"*":                       {},
+		"priority.test":           {},
+		"*.priority.test":         {RouteOptions: RouteOptions{Priority: 10}},
+		"a.priority.test/admin":   {RouteOptions: RouteOptions{Priority: 20}},
+		"a.priority.test":         {},
+	}
+	table := newRouteTable(routes)
+
+	tests := []struct {
+		host, path, want string
+	}{
+		// exact hosts, then the longest path prefix on them
+		{"example.com", "/", "example.com"},
+		{"example.com", "/about", "example.com"},
+		{"example.com", "/api", "example.com/api"},
+		{"example.com", "/api/users", "example.com/api"},
+		{"example.com", "/api/v2/users", "example.com/api/v2"},
+		{"example.com", "/apiary", "example.com"},
+		{"example.com", "//api//v2", "example.com/api/v2"},
+
+		// wildcards cover any depth, the most specific one wins
+		{"blog.example.com", "/", "*.example.com"},
+		{"a.b.example.com", "/", "*.example.com"},
+		{"fr.eu.example.com", "/", "*.eu.example.com"},
+		{"eu.example.com", "/", "*.example.com"},
+		{"shop.example.com", "/", "shop.example.com"},
+
+		// a more specific wildcard only takes its own path
+		{"x.shop.example.com", "/cart", "*.shop.example.com/cart"},
+		{"x.shop.example.com", "/", "*.example.com"},
+
+		// the catch all takes what nothing else does
+		{"other.org", "/", "*"},
+		{"localhost", "/api", "*"},
+
+		// priority comes before host and path
+		{"priority.test", "/", "priority.test"},
+		{"b.priority.test", "/", "*.priority.test"},
+		{"a.priority.test", "/", "*.priority.test"},
+		{"a.priority.test", "/admin", "a.priority.test/admin"},
+	}
+	for _, tt := range tests {
+		key, route, found := table.match(tt.host, tt.path)
+		if !found || key != tt.want || route != routes[tt.want] {
+			t.Errorf("match(%q, %q) = %q, %v, want %q", tt.host, tt.path, key, found, tt.want)
+		}
+	}
+
+	if _, _, found := newRouteTable(map[string]*Proxy{"example.com": {}}).match("other.org", "/"); found {
+		t.Error("match found a route for a host without one")
+	}
+	var empty *routeTable
+	if _, _, found := empty.match("example.com", "/"); found {
+		t.Error("a nil table matched")
+	}
+}
+
+func TestRouteMatchBeats(t *testing.T) {
+	low, high := &Proxy{}, &Proxy{RouteOptions: RouteOptions{Priority: 5}}
+	tests := []struct {
+		name    string
+		m, than routeMatch
+		want    bool
+	}{
+		{"anything beats nothing", routeMatch{route: low}, routeMatch{}, true},
+		{"higher priority", routeMatch{route: high}, routeMatch{route: low, hostRank: 9, pathLen: 9}, true},
+		{"lower priority", routeMatch{route: low, hostRank: 9, pathLen: 9}, routeMatch{route: high}, false},
+		{"more specific host", routeMatch{route: low, hostRank: 3}, routeMatch{route: low, hostRank: 2, pathLen: 5}, true},
+		{"less specific host", routeMatch{route: low, hostRank: 2, pathLen: 5}, routeMatch{route: low, hostRank: 3}, false},
+		{"longer path", routeMatch{route: low, hostRank: 3, pathLen: 2}, routeMatch{route: low, hostRank: 3, pathLen: 1}, true},
+		{"same everything", routeMatch{route: low, hostRank: 3, pathLen: 1}, routeMatch{route: low, hostRank: 3, pathLen: 1}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.m.beats(tt.than); got != tt.want {
+			t.Errorf("%s: beats = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkRouteTableMatch(b *testing.B) {
+	routes := map[string]*Proxy{"*": {}}
+	for i := 0; i < 5000; i++ {
+		routes[fmt.Sprintf("site%d.example.com", i)] = &Proxy{}
+		routes[fmt.Sprintf("site%d.example.com/api", i)] = &Proxy{}
+		if i%10 == 0 {
+			routes[fmt.Sprintf("*.tenant%d.example.net", i)] = &Proxy{}
+		}
+	}
+	table := newRouteTable(routes)
+	requests := []struct{ host, path string }{
+		{"site4321.example.com", "/"},
+		{"site4321.example.com", "/api/v1/users"},
+		{"app.tenant420.example.net", "/"},
+		{"unknown.example.org", "/"},
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := requests[i%len(requests)]
+		if _, _, found := table.match(r.host, r.path); !found {
+			b.Fatalf("no route for %s%s", r.host, r.path)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"time"
+)
+
+// ContentRule tunes caching and compression for responses of some media
+// types, like "cache images for a day" or "never compress text/html".
+type ContentRule struct {
+	// Types are media types, "image/*" matches a whole family and "*"
+	// matches anything.
+	Types []string `json:"types"`
+
+	// CacheTTL replaces the cache lifetime for matching responses,
+	// NoCache keeps them out of the cache entirely.
+	CacheTTL string `json:"cache_ttl,omitempty"`
+	NoCache  bool   `json:"no_cache,omitempty"`
+
+	// Compress forces compression on or off for matching responses on
+	// routes that compress.
+	Compress *bool `json:"compress,omitempty"`
+}
+
+// CacheControlRule sets the Cache-Control header a static route sends for
+// files matching it, like a year and immutable for hashed assets.
+type CacheControlRule struct {
+	// Paths are patterns like "/assets/*", Extensions are like ".js".
+	// either one matching is enough.
+	Paths      []string `json:"paths,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+
+	// Value is the Cache-Control header sent, e.g. "public, max-age=31536000, immutable".
+	Value string `json:"value"`
+}
+
+func checkCacheControlRules(rules []CacheControlRule) error {
+	for i, rule := range rules {
+		if rule.Value == "" {
+			return fmt.Errorf("cache control rule %d: no value", i)
+		}
+		if len(rule.Paths) == 0 && len(rule.Extensions) == 0 {
+			return fmt.Errorf("cache control rule %d: no paths or extensions", i)
+		}
+	}
+	return nil
+}
+
+// cacheControlFor finds the Cache-Control value of the first rule matching
+// a file, "" if none do.
+func cacheControlFor(rules []CacheControlRule, name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	for _, rule := range rules {
+		for _, e := range rule.Extensions {
+			if !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			if strings.ToLower(e) == ext {
+				return rule.Value
+			}
+		}
+		for _, pattern := range rule.Paths {
+			if matchPathPattern(pattern, name) {
+				return rule.Value
+			}
+		}
+	}
+	return ""
+}
+
+type contentRule struct {
+	ContentRule
+	cacheTTL time.Duration
+}
+
+func compileContentRules(rules []ContentRule) ([]contentRule, error) {
+	compiled := make([]contentRule, 0, len(rules))
+	for i, rule := range rules {
+		cr := contentRule{ContentRule: rule}
+		if rule.CacheTTL != "" {
+			ttl, err := time.ParseDuration(rule.CacheTTL)
+			if err != nil {
+				return nil, fmt.Errorf("content rule %d: cache_ttl: %w", i, err)
+			}
+			cr.cacheTTL = ttl
+		}
+		compiled = append(compiled, cr)
+	}
+	return compiled, nil
+}
+
+// contentRule finds the first rule matching a Content-Type header.
+func (p *Proxy) contentRule(contentType string) *contentRule {
+	if len(p.contentRules) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	for i := range p.contentRules {
+		for _, pattern := range p.contentRules[i].Types {
+			if matchMediaType(pattern, mediaType) {
+				return &p.contentRules[i]
+			}
+		}
+	}
+	return nil
+}
+
+func matchMediaType(pattern, mediaType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "*" || pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	if family, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, family+"/")
+	}
+	return false
+}
+
+// compressible decides whether a response of this type gets compressed,
+// rules first and then the default list of text-ish types.
+func (p *Proxy) compressible(contentType string) bool {
+	if rule := p.contentRule(contentType); rule != nil && rule.Compress != nil {
+		return *rule.Compress
+	}
+	return compressible(contentType, defaultCompressTypes)
+}
+
+// cacheOverride says how a response of this type should be cached: skip
+// means never, otherwise a non-zero ttl replaces the backend's lifetime.
+func (p *Proxy) cacheOverride(contentType string) (ttl time.Duration, skip bool) {
+	if rule := p.contentRule(contentType); rule != nil {
+		if rule.NoCache {
+			return 0, true
+		}
+		if rule.cacheTTL > 0 {
+			return rule.cacheTTL, false
+		}
+	}
+	return p.cacheTTL, false
+}
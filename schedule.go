@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// states a schedule can put a route in
+const (
+	stateMaintenance = "maintenance"
+	stateOff         = "off"
+)
+
+// ScheduleRule puts a route in a state for a while. Every is a weekly
+// window like "sunday 02:00-03:00", "weekdays 22:00-06:00" or "daily", and
+// From and Until (RFC 3339) bound it, or on their own are a one-off window.
+type ScheduleRule struct {
+	State string `json:"state"`
+	Every string `json:"every,omitempty"`
+	From  string `json:"from,omitempty"`
+	Until string `json:"until,omitempty"`
+}
+
+// scheduleRule is a ScheduleRule ready to check against the clock.
+type scheduleRule struct {
+	state  string
+	weekly bool
+	days   [7]bool
+	start  int // minutes into the day
+	end    int // past 24h for windows running into the next day
+	from   time.Time
+	until  time.Time
+}
+
+// scheduleState is what a route's schedule says right now, set by the
+// scheduler. until is zero for a state with no end in sight.
+type scheduleState struct {
+	state string
+	until time.Time
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compileSchedule checks a route's schedule rules.
+func compileSchedule(rules []ScheduleRule) ([]scheduleRule, error) {
+	var compiled []scheduleRule
+	for i, rule := range rules {
+		c, err := compileScheduleRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: rule %d: %w", i+1, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func compileScheduleRule(rule ScheduleRule) (scheduleRule, error) {
+	c := scheduleRule{state: strings.ToLower(rule.State)}
+	if c.state != stateMaintenance && c.state != stateOff {
+		return c, fmt.Errorf("state %q should be maintenance or off", rule.State)
+	}
+	var err error
+	if rule.From != "" {
+		if c.from, err = time.Parse(time.RFC3339, rule.From); err != nil {
+			return c, fmt.Errorf("from: %q isn't a time like 2024-06-01T09:00:00Z", rule.From)
+		}
+	}
+	if rule.Until != "" {
+		if c.until, err = time.Parse(time.RFC3339, rule.Until); err != nil {
+			return c, fmt.Errorf("until: %q isn't a time like 2024-06-01T09:00:00Z", rule.Until)
+		}
+	}
+	if !c.from.IsZero() && !c.until.IsZero() && !c.until.After(c.from) {
+		return c, fmt.Errorf("until is before from")
+	}
+	if rule.Every == "" {
+		if c.from.IsZero() && c.until.IsZero() {
+			return c, fmt.Errorf("needs every, from or until")
+		}
+		return c, nil
+	}
+	c.weekly = true
+	if err := c.parseEvery(rule.Every); err != nil {
+		return c, fmt.Errorf("every: %w", err)
+	}
+	return c, nil
+}
+
+// parseEvery reads "days [HH:MM-HH:MM]", days being daily, weekdays,
+// weekends or names of days separated by commas. without the times it's
+// the whole day.
+func (c *scheduleRule) parseEvery(every string) error {
+	fields := strings.Fields(strings.ToLower(every))
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("%q should be like sunday 02:00-03:00", every)
+	}
+	for _, day := range strings.Split(fields[0], ",") {
+		switch day {
+		case "daily":
+			c.days = [7]bool{true, true, true, true, true, true, true}
+		case "weekdays":
+			for d := time.Monday; d <= time.Friday; d++ {
+				c.days[d] = true
+			}
+		case "weekends":
+			c.days[time.Saturday], c.days[time.Sunday] = true, true
+		default:
+			d, ok := weekdayNames[day]
+			if !ok {
+				return fmt.Errorf("%q isn't a day", day)
+			}
+			c.days[d] = true
+		}
+	}
+	c.start, c.end = 0, 24*60
+	if len(fields) == 1 {
+		return nil
+	}
+	from, to, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return fmt.Errorf("%q should be a range like 02:00-03:00", fields[1])
+	}
+	var err error
+	if c.start, err = parseClock(from); err != nil {
+		return err
+	}
+	if c.end, err = parseClock(to); err != nil {
+		return err
+	}
+	if c.end <= c.start {
+		c.end += 24 * 60
+	}
+	return nil
+}
+
+// parseClock turns HH:MM into minutes into the day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("%q isn't a time like 02:00", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// windows gives the weekly windows starting from the day before t up to a
+// week after, in order.
+func (c *scheduleRule) windows(t time.Time, loc *time.Location) [][2]time.Time {
+	t = t.In(loc)
+	var windows [][2]time.Time
+	for i := -1; i <= 7; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+i, 0, 0, 0, 0, loc)
+		if !c.days[day.Weekday()] {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, c.start, 0, 0, loc)
+		end := time.Date(day.Year(), day.Month(), day.Day(), 0, c.end, 0, 0, loc)
+		windows = append(windows, [2]time.Time{start, end})
+	}
+	return windows
+}
+
+// active reports whether the rule is in effect at t and until when.
+func (c *scheduleRule) active(t time.Time, loc *time.Location) (bool, time.Time) {
+	if !c.from.IsZero() && t.Before(c.from) {
+		return false, time.Time{}
+	}
+	if !c.until.IsZero() && !t.Before(c.until) {
+		return false, time.Time{}
+	}
+	if !c.weekly {
+		return true, c.until
+	}
+	// back to back windows, like daily 00:00-24:00, run together
+	var until time.Time
+	for _, w := range c.windows(t, loc) {
+		if until.IsZero() {
+			if !t.Before(w[0]) && t.Before(w[1]) {
+				until = w[1]
+			}
+		} else if !w[0].After(until) && w[1].After(until) {
+			until = w[1]
+		}
+	}
+	if until.IsZero() {
+		return false, time.Time{}
+	}
+	if !c.until.IsZero() && c.until.Before(until) {
+		until = c.until
+	}
+	return true, until
+}
+
+// next is the first time after t the rule starts or stops applying, zero
+// if it never will.
+func (c *scheduleRule) next(t time.Time, loc *time.Location) time.Time {
+	var next time.Time
+	consider := func(at time.Time) {
+		if at.After(t) && (next.IsZero() || at.Before(next)) {
+			next = at
+		}
+	}
+	consider(c.from)
+	consider(c.until)
+	if c.weekly {
+		for _, w := range c.windows(t, loc) {
+			consider(w[0])
+			consider(w[1])
+		}
+	}
+	return next
+}
+
+// scheduleAt works out the route's state at t, the first rule in effect
+// wins.
+func (p *Proxy) scheduleAt(t time.Time) *scheduleState {
+	for _, rule := range p.schedule {
+		if ok, until := rule.active(t, p.scheduleLoc); ok {
+			return &scheduleState{state: rule.state, until: until}
+		}
+	}
+	return &scheduleState{}
+}
+
+// scheduleState is the state the scheduler last put the route in.
+func (p *Proxy) scheduleState() scheduleState {
+	if st := p.scheduled.Load(); st != nil {
+		return *st
+	}
+	return scheduleState{}
+}
+
+// nextStart is when the rule next comes into effect after t, zero if it
+// won't.
+func (c *scheduleRule) nextStart(t time.Time, loc *time.Location) time.Time {
+	base := t
+	if c.from.After(t) {
+		if ok, _ := c.active(c.from, loc); ok {
+			return c.from
+		}
+		base = c.from
+	}
+	if !c.weekly {
+		return time.Time{}
+	}
+	for _, w := range c.windows(base, loc) {
+		if w[0].After(base) {
+			if !c.until.IsZero() && !w[0].Before(c.until) {
+				return time.Time{}
+			}
+			return w[0]
+		}
+	}
+	return time.Time{}
+}
+
+// nextScheduled finds the next state the route's schedule puts it in and
+// when, for list.
+func (p *Proxy) nextScheduled(t time.Time) (string, time.Time) {
+	var state string
+	var at time.Time
+	for _, rule := range p.schedule {
+		if start := rule.nextStart(t, p.scheduleLoc); !start.IsZero() && (at.IsZero() || start.Before(at)) {
+			state, at = rule.state, start
+		}
+	}
+	return state, at
+}
+
+// runSchedules moves routes in and out of their scheduled states as the
+// time comes, waking for the next change or at least once a minute to
+// pick up routes added since.
+func (app *App) runSchedules() {
+	for {
+		next := app.checkSchedules(time.Now())
+		wait := time.Minute
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// checkSchedules updates every scheduled route's state for t, logging the
+// ones that changed, and says when the next change is due.
+func (app *App) checkSchedules(t time.Time) time.Time {
+	type change struct {
+		domain string
+		from   scheduleState
+		to     scheduleState
+	}
+	var changes []change
+	var next time.Time
+	app.Mu.RLock()
+	for key, proxy := range app.Routes {
+		if len(proxy.schedule) == 0 {
+			continue
+		}
+		st := proxy.scheduleAt(t)
+		var from scheduleState
+		if old := proxy.scheduled.Swap(st); old != nil {
+			from = *old
+		}
+		if from.state != st.state {
+			changes = append(changes, change{key, from, *st})
+		}
+		for _, rule := range proxy.schedule {
+			if at := rule.next(t, proxy.scheduleLoc); !at.IsZero() && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
+		}
+	}
+	app.Mu.RUnlock()
+
+	for _, c := range changes {
+		data := map[string]interface{}{"domain": c.domain, "state": c.to.state, "previous": c.from.state}
+		switch {
+		case c.to.state == "":
+			data["state"] = "on"
+			log.Printf("Route %s is back on after its scheduled %s", c.domain, c.from.state)
+		case c.to.until.IsZero():
+			log.Printf("Route %s is %s by its schedule", c.domain, c.to.state)
+		default:
+			data["until"] = c.to.until.UTC()
+			log.Printf("Route %s is %s by its schedule until %s", c.domain, c.to.state, c.to.until.Format(time.RFC3339))
+		}
+		if c.from.state == "" {
+			data["previous"] = "on"
+		}
+		emitEvent(eventRouteScheduled, data)
+	}
+	return next
+}
+
+// defaultMaintenanceTemplate is the page a route in maintenance answers
+// with when it has no template of its own.
+var defaultMaintenanceTemplate = template.Must(template.New("maintenance").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Domain}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center; color: #222; background: #fafafa; }
+main { text-align: center; padding: 2em; }
+h1 { font-size: 2em; font-weight: normal; margin: 0 0 .3em; }
+p { color: #777; margin: 0; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Domain}}</h1>
+<p>down for maintenance{{if .Until}}, back by {{.Until}}{{end}}</p>
+</main>
+</body>
+</html>
+`))
+
+// serveMaintenance answers for a route in maintenance with a 503 and the
+// maintenance page, telling clients when to come back if that's known.
+func (p *Proxy) serveMaintenance(w http.ResponseWriter, r *http.Request, st scheduleState) {
+	domain := NormalizeDomain(r.Host)
+	if name, err := idna.Display.ToUnicode(domain); err == nil {
+		domain = name
+	}
+	var until string
+	if !st.until.IsZero() {
+		until = st.until.In(p.scheduleLoc).Format("Mon Jan 2 15:04 MST")
+	}
+	tmpl := p.maintenance
+	if tmpl == nil {
+		tmpl = defaultMaintenanceTemplate
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, struct{ Domain, Until string }{domain, until})
+	if err != nil {
+		internalError(w, r, "template", err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	h.Set("Cache-Control", "no-store")
+	if wait := time.Until(st.until); !st.until.IsZero() && wait > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// scheduleNote describes a scheduled route's state for list.
+func (p *Proxy) scheduleNote() string {
+	if len(p.schedule) == 0 {
+		return ""
+	}
+	const layout = "2006-01-02 15:04 MST"
+	st := p.scheduleState()
+	if st.state != "" {
+		note := ", " + strings.ToUpper(st.state[:1]) + st.state[1:]
+		if !st.until.IsZero() {
+			note += " until " + st.until.In(p.scheduleLoc).Format(layout)
+		}
+		return note
+	}
+	state, at := p.nextScheduled(time.Now())
+	if state == "" {
+		return ", Schedule over"
+	}
+	return fmt.Sprintf(", Scheduled %s from %s", state, at.In(p.scheduleLoc).Format(layout))
+}
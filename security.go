@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// kinds of security event, part of the log format so jails can pick the
+// ones they care about
+const (
+	eventRateLimit    = "rate-limit"
+	eventBlockedPath  = "blocked-path"
+	eventUnknownHost  = "unknown-host"
+	eventFingerprint  = "blocked-fingerprint"
+	eventAuthFailure  = "auth-failure"
+	eventAdminDenied  = "admin-not-allowed"
+	eventBadSignature = "bad-signature"
+	eventCertRefused  = "cert-refused"
+	eventBlockedBot   = "blocked-bot"
+)
+
+// securityLog writes security events one per line to their own file for
+// fail2ban or crowdsec to watch:
+//
+//	2023-10-01T12:00:00Z appserve security: event=rate-limit ip=203.0.113.7 host=example.com detail="route is at its request limit"
+//
+// the format is stable, fields only ever get added on the end. nothing here
+// is rate limited, the jail needs to see every hit to count them.
+type securityLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// securityEvents is nil unless -security-log is set.
+var securityEvents *securityLog
+
+func openSecurityLog(path string) (*securityLog, error) {
+	s := &securityLog{path: path}
+	if err := s.reopen(); err != nil {
+		return nil, err
+	}
+
+	// logrotate moves the file away and sends a HUP to have us start a new one
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := s.reopen(); err != nil {
+				log.Printf("Error reopening security log %s: %v", s.path, err)
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *securityLog) reopen() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	old := s.f
+	s.f = f
+	s.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// securityEvent records something a client did that a firewall might want
+// to know about.
+func securityEvent(event, ip, host, detail string) {
+	s := securityEvents
+	if s == nil {
+		return
+	}
+	s.write(fmt.Sprintf("%s appserve security: event=%s ip=%s host=%s detail=%s\n",
+		time.Now().UTC().Format(time.RFC3339), event, ip, logField(host), strconv.Quote(detail)))
+}
+
+// write appends a line to the file, the admin audit log is written this
+// way too.
+func (s *securityLog) write(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.WriteString(line); err != nil {
+		logLimited("security-log", "Error writing to %s: %v", s.path, err)
+	}
+}
+
+// logField keeps a client supplied value from breaking the line format.
+func logField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	for _, c := range v {
+		if c <= ' ' || c == '"' || c == 0x7f {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
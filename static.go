@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// staticMaxAge is how long browsers may hold on to static assets without
+// checking back. html always revalidates so a deploy shows up straight away.
+const staticMaxAge = 3600
+
+// staticHandler serves the files under a directory for a static route.
+type staticHandler struct {
+	root      http.Dir
+	fallback  bool
+	listing   bool
+	mimeTypes map[string]string
+	charset   string
+
+	cacheControl []CacheControlRule
+}
+
+func newStatic(root string, opts RouteOptions) (*Proxy, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	handler := &staticHandler{
+		root:      http.Dir(root),
+		fallback:  opts.SPAFallback,
+		listing:   opts.DirectoryListing,
+		mimeTypes: map[string]string{},
+		charset:   opts.Charset,
+
+		cacheControl: opts.CacheControl,
+	}
+	if err := checkCacheControlRules(opts.CacheControl); err != nil {
+		return nil, err
+	}
+	for ext, ct := range opts.MimeTypes {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return nil, fmt.Errorf("mime_types: %s: %w", ext, err)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		handler.mimeTypes[strings.ToLower(ext)] = ct
+	}
+
+	proxy := &Proxy{
+		Root:         root,
+		RouteOptions: opts,
+		handler:      handler,
+	}
+	if err := proxy.applyOptions(); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+func (s *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if hiddenPath(name) {
+		securityEvent(eventBlockedPath, clientIP(r), NormalizeDomain(r.Host), "dotfile request for "+name)
+		http.NotFound(w, r)
+		return
+	}
+
+	f, info, name, err := s.open(name)
+	if errors.Is(err, fs.ErrNotExist) && s.fallback && path.Ext(name) == "" {
+		// a route the app handles client side, missing assets still 404
+		f, info, name, err = s.open("/index.html")
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		internalError(w, r, "static", err)
+		return
+	}
+	defer f.Close()
+
+	if info.IsDir() {
+		s.list(w, r, f)
+		return
+	}
+
+	h := w.Header()
+	ct := s.contentType(info.Name())
+	if ct != "" {
+		h.Set("Content-Type", ct)
+	}
+	if cc := cacheControlFor(s.cacheControl, name); cc != "" {
+		h.Set("Cache-Control", cc)
+	} else if h.Get("Cache-Control") == "" {
+		if path.Ext(info.Name()) == ".html" {
+			h.Set("Cache-Control", "no-cache")
+		} else {
+			h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", staticMaxAge))
+		}
+	}
+	// strong, so If-Range works and an interrupted download can resume
+	etag := fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+
+	body := f
+	sc, encoding, hasSidecar := s.sidecar(name, info, r.Header.Get("Accept-Encoding"))
+	if hasSidecar {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if sc != nil {
+		defer sc.Close()
+		if ct == "" {
+			// ServeContent would sniff the compressed bytes, the type is
+			// whatever's in them once they're unpacked
+			var buf [512]byte
+			n, _ := io.ReadFull(f, buf[:])
+			h.Set("Content-Type", http.DetectContentType(buf[:n]))
+		}
+		body = sc
+		h.Set("Content-Encoding", encoding)
+		etag += "-" + encoding
+	}
+	h.Set("ETag", `"`+etag+`"`)
+
+	// ServeContent takes care of sniffing the content type if we don't
+	// know it, Last-Modified, conditional and Range
+	// requests. the file is copied straight to the connection (sendfile
+	// where the os has it), never read into memory.
+	http.ServeContent(w, r, info.Name(), info.ModTime(), body)
+}
+
+// contentType works out the type for a file from the route's overrides and
+// the built in table, "" leaves it to sniffing.
+func (s *staticHandler) contentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	ct, ok := s.mimeTypes[ext]
+	if !ok {
+		ct = mime.TypeByExtension(ext)
+	}
+	if ct == "" || s.charset == "" {
+		return ct
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil || params["charset"] != "" || !textual(mediaType) {
+		return ct
+	}
+	return ct + "; charset=" + s.charset
+}
+
+// textual reports whether a media type is text that a charset applies to.
+func textual(mediaType string) bool {
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// sidecarEncodings are the pre-compressed files we look for next to the
+// requested one, in order of preference.
+var sidecarEncodings = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+// sidecar finds a build-time compressed copy of a file the client can take.
+// varies reports whether any copies exist at all, since then the response
+// depends on Accept-Encoding either way.
+func (s *staticHandler) sidecar(name string, info fs.FileInfo, accept string) (f http.File, encoding string, varies bool) {
+	accepted := acceptedEncodings(accept)
+	for _, sc := range sidecarEncodings {
+		candidate, err := s.root.Open(name + sc.ext)
+		if err != nil {
+			continue
+		}
+		scInfo, err := candidate.Stat()
+		// a sidecar older than its file is left over from a previous build
+		if err != nil || scInfo.IsDir() || scInfo.ModTime().Before(info.ModTime()) {
+			candidate.Close()
+			continue
+		}
+		varies = true
+		if f != nil || !accepted[sc.encoding] {
+			candidate.Close()
+			continue
+		}
+		f, encoding = candidate, sc.encoding
+	}
+	return f, encoding, varies
+}
+
+// open finds the file for a request path along with its name, a directory
+// is served through its index.html. without one the directory itself comes
+// back when listings are on, otherwise it doesn't exist as far as the client
+// is concerned.
+func (s *staticHandler) open(name string) (http.File, fs.FileInfo, string, error) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return nil, nil, name, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, name, err
+	}
+	if !info.IsDir() {
+		return f, info, name, nil
+	}
+
+	indexName := path.Join(name, "index.html")
+	index, err := s.root.Open(indexName)
+	if err == nil {
+		indexInfo, err := index.Stat()
+		if err == nil && !indexInfo.IsDir() {
+			f.Close()
+			return index, indexInfo, indexName, nil
+		}
+		index.Close()
+	}
+	if s.listing {
+		return f, info, name, nil
+	}
+	f.Close()
+	return nil, nil, name, fs.ErrNotExist
+}
+
+// listingEntry is one row of a directory listing.
+type listingEntry struct {
+	Name    string
+	URL     string
+	Size    string
+	ModTime string
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; color: #222; }
+h1 { font-size: 1.3em; font-weight: normal; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: .3em .6em; border-bottom: 1px solid #eee; }
+td.size, td.time { color: #777; white-space: nowrap; }
+td.size { text-align: right; }
+a { color: #0366d6; text-decoration: none; }
+a:hover { text-decoration: underline; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td class="size"></td><td class="time"></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td class="size">{{.Size}}</td><td class="time">{{.ModTime}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// list renders the contents of a directory, folders first then files, with
+// hidden entries left out.
+func (s *staticHandler) list(w http.ResponseWriter, r *http.Request, dir http.File) {
+	// relative links only work from behind a trailing slash
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		target := r.URL.Path + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		internalError(w, r, "static", err)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].IsDir() != infos[j].IsDir() {
+			return infos[i].IsDir()
+		}
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	var entries []listingEntry
+	for _, info := range infos {
+		if hiddenPath(info.Name()) {
+			continue
+		}
+		e := listingEntry{
+			Name:    info.Name(),
+			URL:     (&url.URL{Path: info.Name()}).String(),
+			ModTime: info.ModTime().UTC().Format("2006-01-02 15:04"),
+		}
+		if info.IsDir() {
+			e.Name += "/"
+			e.URL += "/"
+		} else {
+			e.Size = formatSize(uint64(info.Size()))
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	listingTemplate.Execute(w, struct {
+		Path    string
+		Entries []listingEntry
+	}{path.Clean(r.URL.Path), entries})
+}
+
+// hiddenPath reports whether a path goes through a dotfile or dot directory,
+// things like .git and .env shouldn't leak out of a webroot. .well-known is
+// the exception.
+func hiddenPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
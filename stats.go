@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RouteStats are the counters kept for each domain. they live on the app
+// rather than the route so re-adding a route doesn't zero them.
+type RouteStats struct {
+	Requests     atomic.Uint64
+	BytesIn      atomic.Uint64
+	BytesOut     atomic.Uint64
+	ClientErrors atomic.Uint64
+	ServerErrors atomic.Uint64
+	CacheHits    atomic.Uint64
+	CacheMisses  atomic.Uint64
+	CacheStale   atomic.Uint64
+	CacheBytes   atomic.Uint64
+
+	Geo  geoStats
+	Bots botHits
+}
+
+// Stats holds the counters for every domain we've seen traffic for.
+type Stats struct {
+	mu     sync.RWMutex
+	routes map[string]*RouteStats
+}
+
+// Route returns the counters for domain, creating them on first use.
+func (s *Stats) Route(domain string) *RouteStats {
+	s.mu.RLock()
+	rs, ok := s.routes[domain]
+	s.mu.RUnlock()
+	if ok {
+		return rs
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rs, ok := s.routes[domain]; ok {
+		return rs
+	}
+	if s.routes == nil {
+		s.routes = make(map[string]*RouteStats)
+	}
+	rs = &RouteStats{}
+	s.routes[domain] = rs
+	return rs
+}
+
+// Domains lists the domains we have counters for, sorted.
+func (s *Stats) Domains() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	domains := make([]string, 0, len(s.routes))
+	for domain := range s.routes {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// routeCounts are a domain's counters as they're saved between restarts.
+type routeCounts struct {
+	Requests     uint64 `json:"requests"`
+	BytesIn      uint64 `json:"bytes_in"`
+	BytesOut     uint64 `json:"bytes_out"`
+	ClientErrors uint64 `json:"client_errors"`
+	ServerErrors uint64 `json:"server_errors"`
+	CacheHits    uint64 `json:"cache_hits"`
+	CacheStale   uint64 `json:"cache_stale"`
+	CacheMisses  uint64 `json:"cache_misses"`
+	CacheBytes   uint64 `json:"cache_bytes"`
+}
+
+func (rs *RouteStats) counts() routeCounts {
+	return routeCounts{
+		Requests:     rs.Requests.Load(),
+		BytesIn:      rs.BytesIn.Load(),
+		BytesOut:     rs.BytesOut.Load(),
+		ClientErrors: rs.ClientErrors.Load(),
+		ServerErrors: rs.ServerErrors.Load(),
+		CacheHits:    rs.CacheHits.Load(),
+		CacheStale:   rs.CacheStale.Load(),
+		CacheMisses:  rs.CacheMisses.Load(),
+		CacheBytes:   rs.CacheBytes.Load(),
+	}
+}
+
+// add puts counts saved before a restart back on top of what's been
+// counted since.
+func (rs *RouteStats) add(c routeCounts) {
+	rs.Requests.Add(c.Requests)
+	rs.BytesIn.Add(c.BytesIn)
+	rs.BytesOut.Add(c.BytesOut)
+	rs.ClientErrors.Add(c.ClientErrors)
+	rs.ServerErrors.Add(c.ServerErrors)
+	rs.CacheHits.Add(c.CacheHits)
+	rs.CacheStale.Add(c.CacheStale)
+	rs.CacheMisses.Add(c.CacheMisses)
+	rs.CacheBytes.Add(c.CacheBytes)
+}
+
+// count adds up a finished request's bytes and whether it failed.
+func (rs *RouteStats) count(in, out uint64, status int) {
+	rs.BytesIn.Add(in)
+	rs.BytesOut.Add(out)
+	switch {
+	case status >= 500:
+		rs.ServerErrors.Add(1)
+	case status >= 400:
+		rs.ClientErrors.Add(1)
+	}
+}
+
+// snapshot is every domain's counters.
+func (s *Stats) snapshot() map[string]routeCounts {
+	counts := map[string]routeCounts{}
+	for _, domain := range s.Domains() {
+		counts[domain] = s.Route(domain).counts()
+	}
+	return counts
+}
+
+// loadStatsFile adds the counters kept in file back onto stats, there's
+// nothing to do when it doesn't exist yet.
+func loadStatsFile(file string, stats *Stats) error {
+	if file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var counts map[string]routeCounts
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for domain, c := range counts {
+		stats.Route(domain).add(c)
+	}
+	return nil
+}
+
+// saveStats writes the counters out so a restart picks up where they
+// were, to the store when there is one and -stats-file otherwise.
+func (app *App) saveStats() error {
+	if app.Store != nil {
+		return app.Store.saveStats(&app.Stats)
+	}
+	if app.StatsFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(app.Stats.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(app.StatsFile, data)
+}
+
+// runStats saves the counters every minute.
+func (app *App) runStats() {
+	for range time.Tick(time.Minute) {
+		if err := app.saveStats(); err != nil {
+			logLimited("stats", "Error saving stats: %v", err)
+		}
+	}
+}
+
+// hitRatio is the share of cache lookups that were answered from the cache.
+func (rs *RouteStats) hitRatio() float64 {
+	hits := rs.CacheHits.Load() + rs.CacheStale.Load()
+	total := hits + rs.CacheMisses.Load()
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+func (app *App) handleStatsCommand(domain string) {
+	domains := app.Stats.Domains()
+	if domain != "" {
+		domains = []string{domain}
+	} else {
+		for _, c := range requestErrors.snapshot() {
+			fmt.Printf("Errors (%s): %d\n", c.errorKind, c.Count)
+		}
+		if app.Tarpit != nil {
+			fmt.Printf("Tarpitted: %d, %d right now\n", app.Tarpit.total.Load(), app.Tarpit.active.Load())
+		}
+		for _, c := range noisyLogs.suppressed() {
+			if c.Lines > 0 {
+				fmt.Printf("Log lines suppressed (%s): %d\n", c.Category, c.Lines)
+			}
+		}
+	}
+	if len(domains) == 0 {
+		fmt.Println("No stats yet.")
+		return
+	}
+
+	alerts := app.Anomalies.alerts()
+	for _, d := range domains {
+		rs := app.Stats.Route(d)
+		fmt.Printf("Domain: %s\n", d)
+		fmt.Printf("  requests: %d\n", rs.Requests.Load())
+		fmt.Printf("  traffic: %s in, %s out\n", formatSize(rs.BytesIn.Load()), formatSize(rs.BytesOut.Load()))
+		fmt.Printf("  errors: %d client (4xx), %d server (5xx)\n", rs.ClientErrors.Load(), rs.ServerErrors.Load())
+		if kinds := alerts[d]; len(kinds) > 0 {
+			fmt.Printf("  unusual traffic: %s\n", strings.Join(kinds, ", "))
+		}
+		fmt.Printf("  cache: %d hits, %d stale, %d misses (%.1f%% hit ratio), %s served from cache\n",
+			rs.CacheHits.Load(), rs.CacheStale.Load(), rs.CacheMisses.Load(), rs.hitRatio()*100, formatSize(rs.CacheBytes.Load()))
+		for _, c := range rs.Bots.counts() {
+			fmt.Printf("  bot rule %s: %d requests\n", c.Rule, c.Hits)
+		}
+		if domain != "" {
+			for _, k := range app.Cache.TopKeys(d, 10) {
+				fmt.Printf("    %6d hits  %s\n", k.Hits, k.Path)
+			}
+			if app.Geo != nil {
+				countries, networks := rs.Geo.top(10)
+				fmt.Println("  top countries:")
+				for _, c := range countries {
+					fmt.Printf("    %6d requests  %s\n", c.Requests, c.Name)
+				}
+				fmt.Println("  top networks:")
+				for _, n := range networks {
+					fmt.Printf("    %6d requests  %s\n", n.Requests, n.Name)
+				}
+			}
+		}
+	}
+}
+
+// formatSize prints a byte count the way people read them.
+func formatSize(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// storeVersion is the layout of the tables below, kept in meta so an older
+// appserve doesn't trip over a newer one's database.
+const storeVersion = 2
+
+// storeMigrations bring a database made by an older appserve up to date,
+// the one at i going from version i+1 to i+2.
+var storeMigrations = []string{
+	`ALTER TABLE stats ADD COLUMN bytes_in INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE stats ADD COLUMN bytes_out INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE stats ADD COLUMN client_errors INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE stats ADD COLUMN server_errors INTEGER NOT NULL DEFAULT 0;`,
+}
+
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS meta (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS routes (domain TEXT PRIMARY KEY, config TEXT NOT NULL, updated TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS stats (
+	domain TEXT PRIMARY KEY,
+	requests INTEGER NOT NULL,
+	cache_hits INTEGER NOT NULL,
+	cache_stale INTEGER NOT NULL,
+	cache_misses INTEGER NOT NULL,
+	cache_bytes INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	domain TEXT NOT NULL,
+	config TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_domain ON audit (domain, id);
+`
+
+// routeStore keeps the routes, each domain's counters and a history of
+// every route change in an sqlite database, for -store. a change only
+// writes the rows it touches, in one transaction with its history.
+type routeStore struct {
+	path string
+	db   *sql.DB
+
+	mu    sync.Mutex
+	saved map[string]string // domain to the config last written for it
+}
+
+// openStore opens the database at path, creating it and its tables the
+// first time.
+func openStore(path string) (*routeStore, error) {
+	if err := sqliteBuilt(); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite has one writer anyway, one connection keeps it from ever
+	// waiting on itself
+	db.SetMaxOpenConns(1)
+	s := &routeStore{path: path, db: db, saved: map[string]string{}}
+	if err := s.init(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *routeStore) init() error {
+	if _, err := s.db.Exec(storeSchema); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	// the tables above are the first version's, a new database goes through
+	// every migration like an old one
+	if _, err := s.db.Exec(`INSERT OR IGNORE INTO meta (key, value) VALUES ('schema_version', '1'), ('created', ?)`, now); err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(s.meta("schema_version"))
+	if err != nil {
+		return fmt.Errorf("bad schema_version: %w", err)
+	}
+	if version > storeVersion {
+		return fmt.Errorf("made by a newer appserve (schema version %d, this one knows %d)", version, storeVersion)
+	}
+	for ; version < storeVersion; version++ {
+		if err := s.migrate(version); err != nil {
+			return fmt.Errorf("updating to schema version %d: %w", version+1, err)
+		}
+	}
+
+	rows, err := s.db.Query(`SELECT domain, config FROM routes`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var domain, config string
+		if err := rows.Scan(&domain, &config); err != nil {
+			return err
+		}
+		s.saved[domain] = config
+	}
+	return rows.Err()
+}
+
+// migrate takes the database from version to the next in one
+// transaction.
+func (s *routeStore) migrate(version int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(storeMigrations[version-1]); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE meta SET value = ? WHERE key = 'schema_version'`, strconv.Itoa(version+1)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// meta is a value from the meta table, empty when it isn't there.
+func (s *routeStore) meta(key string) string {
+	var value string
+	s.db.QueryRow(`SELECT value FROM meta WHERE key = ?`, key).Scan(&value)
+	return value
+}
+
+// importFile fills an empty store with the routes in a routes file the
+// first time it's opened, so moving to -store keeps the routes there are.
+// it returns how many routes came over.
+func (s *routeStore) importFile(file string, key *routesKey) (int, error) {
+	s.mu.Lock()
+	empty := len(s.saved) == 0
+	s.mu.Unlock()
+	if file == "" || !empty || s.meta("imported_from") != "" {
+		return 0, nil
+	}
+	data, err := readSignedRoutes(file, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	routes, err := decodeRoutes(bytes.NewReader(data), file)
+	if err != nil {
+		return 0, err
+	}
+	configs := map[string]string{}
+	for _, route := range routes {
+		config, err := json.Marshal(SerializableProxy{
+			Port:         route.Port,
+			Domain:       route.Domain,
+			Root:         route.Root,
+			Parked:       route.Parked,
+			RouteOptions: route.RouteOptions,
+		})
+		if err != nil {
+			return 0, err
+		}
+		configs[route.Domain] = string(config)
+	}
+	if err := s.write(configs, nil, "import "+file, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO meta (key, value) VALUES ('imported_from', ?)`, file)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return len(configs), nil
+}
+
+// routes reads every route in the store.
+func (s *routeStore) routes() ([]DomainRoute, error) {
+	rows, err := s.db.Query(`SELECT domain, config FROM routes ORDER BY domain`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var routes []DomainRoute
+	for rows.Next() {
+		var domain, config string
+		if err := rows.Scan(&domain, &config); err != nil {
+			return nil, err
+		}
+		var route DomainRoute
+		if err := json.Unmarshal([]byte(config), &route); err != nil {
+			return nil, fmt.Errorf("route for domain %s: %w", domain, err)
+		}
+		route.Domain = NormalizeDomain(domain)
+		routes = append(routes, route)
+	}
+	return routes, rows.Err()
+}
+
+// saveRoutes writes the routes that differ from what the store has, by is
+// who changed them for the history.
+func (s *routeStore) saveRoutes(routes map[string]*Proxy, by string) error {
+	configs, err := routeConfigs(routes)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	changed, removed := diffSaved(s.saved, configs)
+	s.mu.Unlock()
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+	return s.write(changed, removed, by, nil)
+}
+
+// write adds or replaces the changed routes and deletes the removed ones
+// in one transaction along with their history, and anything extra.
+func (s *routeStore) write(changed map[string]string, removed []string, by string, extra func(*sql.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	domains := make([]string, 0, len(changed))
+	for domain := range changed {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		action := "change"
+		if _, ok := s.saved[domain]; !ok {
+			action = "add"
+		}
+		if _, err := tx.Exec(`INSERT INTO routes (domain, config, updated) VALUES (?, ?, ?)
+			ON CONFLICT (domain) DO UPDATE SET config = excluded.config, updated = excluded.updated`, domain, changed[domain], now); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO audit (time, actor, action, domain, config) VALUES (?, ?, ?, ?, ?)`, now, by, action, domain, changed[domain]); err != nil {
+			return err
+		}
+	}
+	sort.Strings(removed)
+	for _, domain := range removed {
+		if _, err := tx.Exec(`DELETE FROM routes WHERE domain = ?`, domain); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO audit (time, actor, action, domain) VALUES (?, ?, 'remove', ?)`, now, by, domain); err != nil {
+			return err
+		}
+	}
+	if extra != nil {
+		if err := extra(tx); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for domain, config := range changed {
+		s.saved[domain] = config
+	}
+	for _, domain := range removed {
+		delete(s.saved, domain)
+	}
+	return nil
+}
+
+// loadStats adds the counters saved before a restart back onto stats.
+func (s *routeStore) loadStats(stats *Stats) error {
+	rows, err := s.db.Query(`SELECT domain, requests, bytes_in, bytes_out, client_errors, server_errors,
+		cache_hits, cache_stale, cache_misses, cache_bytes FROM stats`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var domain string
+		var c routeCounts
+		if err := rows.Scan(&domain, &c.Requests, &c.BytesIn, &c.BytesOut, &c.ClientErrors, &c.ServerErrors,
+			&c.CacheHits, &c.CacheStale, &c.CacheMisses, &c.CacheBytes); err != nil {
+			return err
+		}
+		stats.Route(domain).add(c)
+	}
+	return rows.Err()
+}
+
+// saveStats writes each domain's counters.
+func (s *routeStore) saveStats(stats *Stats) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for domain, c := range stats.snapshot() {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO stats (domain, requests, bytes_in, bytes_out, client_errors, server_errors,
+			cache_hits, cache_stale, cache_misses, cache_bytes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			domain, c.Requests, c.BytesIn, c.BytesOut, c.ClientErrors, c.ServerErrors,
+			c.CacheHits, c.CacheStale, c.CacheMisses, c.CacheBytes); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// history lists the latest route changes, newest first, for one domain or
+// every one when domain is empty. each comes with the route as it was
+// before.
+func (s *routeStore) history(domain string, limit int) ([]routeChange, error) {
+	query := `SELECT time, actor, action, domain, config, previous FROM (
+		SELECT id, time, actor, action, domain, config, LAG(config, 1, '') OVER (PARTITION BY domain ORDER BY id) AS previous
+		FROM audit WHERE ? = '' OR domain = ?
+	) ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(query, domain, domain, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []routeChange{}
+	for rows.Next() {
+		var c routeChange
+		var when, config, previous string
+		if err := rows.Scan(&when, &c.By, &c.Action, &c.Domain, &config, &previous); err != nil {
+			return nil, err
+		}
+		c.Time, _ = time.Parse(time.RFC3339Nano, when)
+		c.setConfigs(previous, config)
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// close closes the database, the store can be nil.
+func (s *routeStore) close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// writeRoutes saves the routes to the store when there is one, the routes
+// file otherwise. by is who changed them, for the history.
+func (app *App) writeRoutes(by string) error {
+	if app.Store != nil {
+		return app.Store.saveRoutes(app.Routes, by)
+	}
+	// an unsigned file would be turned away on the next start
+	if app.RoutesKey != nil {
+		return errSignedRoutes
+	}
+	if err := SaveRoutes(app.RoutesFile, app.Routes); err != nil {
+		return err
+	}
+	return app.History.record(app.Routes, by)
+}
+
+// routesLocation is where the routes are kept, for messages.
+func (app *App) routesLocation() string {
+	if app.Store != nil {
+		return app.Store.path
+	}
+	return app.RoutesFile
+}
+
+// changedBy names who's making a change through the admin api for the
+// history, a nil token is the shell.
+func changedBy(token *adminToken) string {
+	if token == nil {
+		return "shell"
+	}
+	return "token " + token.Name
+}
+
+// loadStore opens -store and builds the routes kept in it, bringing the
+// routes file over the first time.
+func (app *App) loadStore(path string) error {
+	store, err := openStore(path)
+	if err != nil {
+		return err
+	}
+	if n, err := store.importFile(app.RoutesFile, app.RoutesKey); err != nil {
+		store.db.Close()
+		return fmt.Errorf("importing %s: %w", app.RoutesFile, err)
+	} else if n > 0 {
+		log.Printf("Imported %d routes from %s into %s", n, app.RoutesFile, path)
+	}
+	routes, err := store.routes()
+	if err != nil {
+		store.db.Close()
+		return err
+	}
+	if err := store.loadStats(&app.Stats); err != nil {
+		store.db.Close()
+		return err
+	}
+	app.Store = store
+	app.Routes = buildRoutes(routes)
+	return nil
+}
+
+// handleStoreLoadCommand reloads the routes from the store, for changes
+// made to the database by hand.
+func (app *App) handleStoreLoadCommand() error {
+	routes, err := app.Store.routes()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return err
+	}
+	changes, err := app.replaceRoutes(routes)
+	if err != nil {
+		fmt.Printf("Error: %v. Keeping the current routes.\n", err)
+		return err
+	}
+	app.dropUnsaved()
+	fmt.Printf("Routes loaded from: %s (%d added, %d changed, %d removed, %d unchanged)\n",
+		app.Store.path, changes.added, changes.changed, changes.removed, changes.unchanged)
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build cgo
+
+package main
+
+import _ "github.com/mattn/go-sqlite3"
+
+// sqliteBuilt reports whether the sqlite driver behind -store is in this
+// binary, it needs cgo.
+func sqliteBuilt() error {
+	return nil
+}
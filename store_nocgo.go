@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package main
+
+import "errors"
+
+func sqliteBuilt() error {
+	return errors.New("the store needs appserve built with cgo, this one was built with CGO_ENABLED=0")
+}
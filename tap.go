@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tap writes out the next few requests to a domain in full, headers and
+// optionally bodies, for working out what a misbehaving client is actually
+// sending without reaching for tcpdump.
+type tap struct {
+	domain  string
+	count   int
+	maxBody int64
+	file    string
+
+	mu      sync.Mutex
+	out     *os.File
+	claimed int
+	written int
+}
+
+// tapSet holds the taps that are running, one per domain at most.
+type tapSet struct {
+	mu   sync.Mutex
+	taps map[string]*tap
+}
+
+func (ts *tapSet) start(t *tap) error {
+	f, err := os.OpenFile(t.file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	t.out = f
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.taps == nil {
+		ts.taps = make(map[string]*tap)
+	}
+	if old, ok := ts.taps[t.domain]; ok {
+		old.close()
+	}
+	ts.taps[t.domain] = t
+	return nil
+}
+
+func (ts *tapSet) stop(domain string) bool {
+	ts.mu.Lock()
+	t, ok := ts.taps[domain]
+	delete(ts.taps, domain)
+	ts.mu.Unlock()
+	if ok {
+		t.close()
+	}
+	return ok
+}
+
+// claim takes a slot in the domain's tap for a request, returning its
+// number or 0 if there's no tap or it's already full.
+func (ts *tapSet) claim(domain string) (*tap, int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.taps[domain]
+	if !ok {
+		return nil, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.claimed >= t.count {
+		return nil, 0
+	}
+	t.claimed++
+	if t.claimed == t.count {
+		// the rest of the requests go past untouched while the last few
+		// finish writing
+		delete(ts.taps, domain)
+	}
+	return t, t.claimed
+}
+
+func (ts *tapSet) list() []*tap {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	taps := make([]*tap, 0, len(ts.taps))
+	for _, t := range ts.taps {
+		taps = append(taps, t)
+	}
+	sort.Slice(taps, func(i, j int) bool { return taps[i].domain < taps[j].domain })
+	return taps
+}
+
+// close finishes the capture file, whatever made it in.
+func (t *tap) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.out == nil {
+		return
+	}
+	if err := t.out.Close(); err != nil {
+		log.Printf("Error closing tap file %s: %v", t.file, err)
+	}
+	t.out = nil
+	log.Printf("Tap on %s finished, %d requests written to %s", t.domain, t.written, t.file)
+}
+
+// capture wraps a request and its response writer so both get recorded,
+// the returned func writes the entry out once the response is done.
+func (t *tap) capture(w http.ResponseWriter, r *http.Request, n int) (http.ResponseWriter, func()) {
+	reqBody := &cappedBuffer{max: t.maxBody}
+	if t.maxBody > 0 && r.Body != nil && r.Body != http.NoBody {
+		r.Body = &tapBody{ReadCloser: r.Body, buf: reqBody}
+	}
+	tw := &tapWriter{ResponseWriter: w, body: cappedBuffer{max: t.maxBody}}
+	start := time.Now()
+
+	// the request is copied now, handlers further in may change it
+	reqHeader := r.Header.Clone()
+	requestLine := fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), r.Proto)
+	host := r.Host
+	remote := clientIP(r)
+	var tlsInfo string
+	if fp := fingerprintOf(r); fp != nil {
+		tlsInfo = " ja4=" + fp.JA4
+	}
+
+	return tw, func() {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "=== %d/%d %s %s%s\n", n, t.count, start.UTC().Format(time.RFC3339Nano), remote, tlsInfo)
+		fmt.Fprintf(&buf, "%s\nHost: %s\n", requestLine, host)
+		reqHeader.Write(&buf)
+		writeTapBody(&buf, reqBody)
+
+		status := tw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		fmt.Fprintf(&buf, "--- %d %s (%s)\n", status, http.StatusText(status), time.Since(start).Round(time.Microsecond))
+		if tw.header == nil {
+			tw.header = tw.Header().Clone()
+		}
+		tw.header.Write(&buf)
+		writeTapBody(&buf, &tw.body)
+		buf.WriteString("\n")
+
+		t.mu.Lock()
+		if t.out != nil {
+			if _, err := t.out.Write(buf.Bytes()); err != nil {
+				log.Printf("Error writing to tap file %s: %v", t.file, err)
+			}
+			t.written++
+		}
+		finished := t.written == t.count
+		t.mu.Unlock()
+		if finished {
+			t.close()
+		}
+	}
+}
+
+func writeTapBody(buf *bytes.Buffer, body *cappedBuffer) {
+	buf.WriteString("\n")
+	if body.max == 0 || body.total == 0 {
+		return
+	}
+	buf.Write(body.buf.Bytes())
+	if body.total > int64(body.buf.Len()) {
+		fmt.Fprintf(buf, "\n[%d of %d bytes]", body.buf.Len(), body.total)
+	}
+	buf.WriteString("\n\n")
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest.
+type cappedBuffer struct {
+	max   int64
+	buf   bytes.Buffer
+	total int64
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+	if room := c.max - int64(c.buf.Len()); room > 0 {
+		if int64(len(p)) > room {
+			c.buf.Write(p[:room])
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+type tapBody struct {
+	io.ReadCloser
+	buf *cappedBuffer
+}
+
+func (b *tapBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+// tapWriter records the response on its way out. bodies are as sent, so
+// compressed ones stay compressed.
+type tapWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   cappedBuffer
+}
+
+func (t *tapWriter) WriteHeader(code int) {
+	if t.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		t.status = code
+		t.header = t.ResponseWriter.Header().Clone()
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *tapWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	n, err := t.ResponseWriter.Write(b)
+	if t.body.max > 0 {
+		t.body.Write(b[:n])
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack underneath.
+func (t *tapWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// handleTapCommand starts, stops or lists taps:
+//
+//	tap example.com --count 20 --bodies 64KB --out example.txt
+//	tap example.com off
+//	tap
+func (app *App) handleTapCommand(args []string) {
+	if len(args) == 0 {
+		taps := app.taps.list()
+		if len(taps) == 0 {
+			fmt.Println("No taps running.")
+		}
+		for _, t := range taps {
+			t.mu.Lock()
+			fmt.Printf("Tap: %s, %d of %d requests captured to %s\n", t.domain, t.written, t.count, t.file)
+			t.mu.Unlock()
+		}
+		return
+	}
+
+	domain := NormalizeDomain(args[0])
+	if len(args) == 2 && args[1] == "off" {
+		if !app.taps.stop(domain) {
+			fmt.Printf("Error: No tap running on %s.\n", domain)
+		}
+		return
+	}
+
+	fs := flag.NewFlagSet("tap", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	count := fs.Int("count", 10, "")
+	bodies := fs.String("bodies", "0", "")
+	out := fs.String("out", "", "")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 {
+		fmt.Println("Error: Expected: tap <domain> [--count N] [--bodies SIZE] [--out FILE] or tap <domain> off")
+		return
+	}
+	if *count < 1 {
+		fmt.Println("Error: --count has to be at least 1.")
+		return
+	}
+	maxBody, err := parseSize(*bodies)
+	if err != nil {
+		fmt.Printf("Error: Invalid --bodies: %v\n", err)
+		return
+	}
+	if _, _, found := app.routeTable().match(domain, "/"); !found {
+		fmt.Printf("Error: No route for %s.\n", domain)
+		return
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("tap-%s-%s.txt", domain, time.Now().Format("20060102-150405"))
+	}
+
+	t := &tap{domain: domain, count: *count, maxBody: maxBody, file: *out}
+	if err := app.taps.start(t); err != nil {
+		fmt.Printf("Error: Couldn't create %s: %v\n", *out, err)
+		return
+	}
+	fmt.Printf("Capturing the next %d requests to %s in %s\n", *count, domain, *out)
+}
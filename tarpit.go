@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// tarpitEvery is how often a tarpitted client gets another byte, slow
+// enough to waste its time and quick enough that it doesn't time out and
+// move on.
+const tarpitEvery = 2 * time.Second
+
+// tarpit answers blocked and rate limited clients a byte at a time instead
+// of with a quick error, tying up scanners and scrapers that would
+// otherwise go straight on to the next request. max caps how many it
+// holds at once, anything past that gets the quick error.
+type tarpit struct {
+	max    int64
+	hold   time.Duration
+	active atomic.Int64
+	total  atomic.Uint64
+}
+
+func newTarpit(max int, hold time.Duration) *tarpit {
+	if max <= 0 {
+		return nil
+	}
+	return &tarpit{max: int64(max), hold: hold}
+}
+
+// serve trickles a response with status to the client until it gives up
+// or hold runs out, returning false without writing anything when the
+// tarpit is off or full.
+func (t *tarpit) serve(w http.ResponseWriter, r *http.Request, reason string, status int) bool {
+	if t == nil {
+		return false
+	}
+	if t.active.Add(1) > t.max {
+		t.active.Add(-1)
+		return false
+	}
+	defer t.active.Add(-1)
+	t.total.Add(1)
+	requestErrors.add(errorClient, reason)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("Connection", "close")
+	w.WriteHeader(status)
+	rc := http.NewResponseController(w)
+	ticker := time.NewTicker(tarpitEvery)
+	defer ticker.Stop()
+	deadline := time.NewTimer(t.hold)
+	defer deadline.Stop()
+	for {
+		if _, err := w.Write([]byte(" ")); err != nil {
+			return true
+		}
+		if err := rc.Flush(); err != nil {
+			return true
+		}
+		select {
+		case <-r.Context().Done():
+			return true
+		case <-deadline.C:
+			return true
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errTenantLimit = errors.New("not for tenant tokens")
+
+// checkTenantRoute keeps a route a tenant token puts to what's the
+// tenant's: no wildcards, no hosts anyone else has routes on, no priority
+// to jump ahead of other routes with, and files only from the tenant's
+// directory under -tenant-dir. the caller holds app.Mu.
+func (app *App) checkTenantRoute(token *adminToken, route DomainRoute) error {
+	host, _, _ := strings.Cut(route.Domain, "/")
+	if host == "*" || strings.HasPrefix(host, "*.") {
+		return fmt.Errorf("%w: wildcard routes like %s", errTenantLimit, host)
+	}
+	// logs are kept to a tenant by host, a name like localhost or an ip
+	// turns up in lines that aren't about any one route
+	if !strings.Contains(host, ".") || net.ParseIP(host) != nil {
+		return fmt.Errorf("%w: %s isn't a domain name", errTenantLimit, host)
+	}
+	for key, proxy := range app.Routes {
+		if token.owns(proxy) {
+			continue
+		}
+		other, _, _ := strings.Cut(key, "/")
+		if other == host {
+			return errNotOwned
+		}
+		if parent, ok := strings.CutPrefix(other, "*."); ok && strings.HasSuffix(host, "."+parent) {
+			return errNotOwned
+		}
+	}
+	if route.Priority != 0 {
+		return fmt.Errorf("%w: priority", errTenantLimit)
+	}
+
+	// how the box itself is wired up is the operator's business
+	infra := []struct {
+		name string
+		set  bool
+	}{
+		{"listeners", len(route.Listeners) > 0},
+		{"cert_group", route.CertGroup != ""},
+		{"backend_insecure", route.BackendInsecure},
+		{"own_pool", route.OwnPool},
+		{"pool_max_idle", route.PoolMaxIdle != 0},
+		{"pool_max_conns", route.PoolMaxConns != 0},
+		{"send_proxy_protocol", route.SendProxyProtocol != ""},
+	}
+	for _, o := range infra {
+		if o.set {
+			return fmt.Errorf("%w: %s", errTenantLimit, o.name)
+		}
+	}
+	if route.Root == "" && !route.Parked {
+		addr := backendAddr(route.Port)
+		if strings.HasPrefix(addr, "unix:") {
+			return fmt.Errorf("%w: unix socket backends", errTenantLimit)
+		}
+		if !app.TenantBackends.allows(addr) {
+			return fmt.Errorf("%w: backend %s isn't in -tenant-backends", errTenantLimit, addr)
+		}
+	}
+
+	files := []struct{ name, path string }{
+		{"root", route.Root},
+		{"fastcgi_root", route.FastCGIRoot},
+		{"parked_template", route.ParkedTemplate},
+		{"maintenance_template", route.MaintenanceTemplate},
+		{"robots_txt", route.RobotsTxt},
+		{"security_txt", route.SecurityTxt},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if app.TenantDir == "" {
+			return fmt.Errorf("%w: %s, there's no -tenant-dir", errTenantLimit, f.name)
+		}
+		if !inDir(filepath.Join(app.TenantDir, token.Tenant), f.path) {
+			return fmt.Errorf("%s: %s isn't in %s", f.name, f.path, filepath.Join(app.TenantDir, token.Tenant))
+		}
+	}
+	return nil
+}
+
+// backendRule is one entry of -tenant-backends: an ip, a network or a host
+// name, with any port, one port or a range of them.
+type backendRule struct {
+	network        *net.IPNet
+	host           string
+	portLo, portHi int
+}
+
+// backendRules are the backends tenant routes may proxy to, nothing when
+// there aren't any.
+type backendRules []backendRule
+
+// parseBackendRules reads -tenant-backends, a comma separated list like
+// 10.0.5.0/24,localhost:3000-3999,app.internal:8080.
+func parseBackendRules(s string) (backendRules, error) {
+	var rules backendRules
+	for _, entry := range splitList(s) {
+		r := backendRule{portLo: 1, portHi: 65535}
+		host := entry
+		if h, ports, err := net.SplitHostPort(entry); err == nil {
+			host = h
+			lo, hi, isRange := strings.Cut(ports, "-")
+			if !isRange {
+				hi = lo
+			}
+			var err1, err2 error
+			r.portLo, err1 = strconv.Atoi(lo)
+			r.portHi, err2 = strconv.Atoi(hi)
+			if err1 != nil || err2 != nil || r.portLo < 1 || r.portHi > 65535 || r.portLo > r.portHi {
+				return nil, fmt.Errorf("%q has a bad port or range of ports", entry)
+			}
+		}
+		if _, network, err := net.ParseCIDR(host); err == nil {
+			r.network = network
+		} else if ip := net.ParseIP(host); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if host != "" {
+			r.host = strings.ToLower(host)
+		} else {
+			return nil, fmt.Errorf("%q has no host", entry)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// allows reports whether a backend's host:port is covered by a rule. names
+// are taken as they are and never resolved, so one can't be pointed
+// somewhere else after it's been let through.
+func (rules backendRules) allows(addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, r := range rules {
+		if port < r.portLo || port > r.portHi {
+			continue
+		}
+		if r.network != nil && ip != nil && r.network.Contains(ip) {
+			return true
+		}
+		if r.host != "" && ip == nil && strings.EqualFold(r.host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// inDir reports whether file is dir or somewhere under it, after following
+// any symlinks in either.
+func inDir(dir, file string) bool {
+	dir, file = resolvePath(dir), resolvePath(file)
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath is the absolute path with symlinks followed, as far as they
+// exist yet.
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	// whatever doesn't exist yet can't be a link, resolve its parent
+	parent, base := filepath.Split(abs)
+	if parent = filepath.Clean(parent); parent != abs && base != "" {
+		return filepath.Join(resolvePath(parent), base)
+	}
+	return abs
+}
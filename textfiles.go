@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// paths of the text files appserve can answer for itself instead of the
+// backend
+const (
+	robotsTxtPath   = "/robots.txt"
+	securityTxtPath = "/.well-known/security.txt"
+)
+
+// maxSupplementedFile is as much of the backend's own file as we'll read
+// when adding ours to it.
+const maxSupplementedFile = 64 << 10
+
+// textFile returns our content for a request path, the route's own file
+// taking priority over the global one, or nil to leave it to the backend.
+func (app *App) textFile(route *Proxy, path string) []byte {
+	switch path {
+	case robotsTxtPath:
+		if route.robotsTxt != nil {
+			return route.robotsTxt
+		}
+		return app.RobotsTxt
+	case securityTxtPath:
+		if route.securityTxt != nil {
+			return route.securityTxt
+		}
+		return app.SecurityTxt
+	}
+	return nil
+}
+
+// serveTextFile answers with our file, tacked on to the end of the
+// backend's when the route supplements rather than replaces it.
+func (app *App) serveTextFile(w http.ResponseWriter, r *http.Request, route *Proxy, body []byte) {
+	if route.SupplementTextFiles {
+		// ask for the plain, whole file so there's something to append to
+		br := r.Clone(r.Context())
+		br.Method = http.MethodGet
+		for _, name := range []string{"Accept-Encoding", "Range", "If-None-Match", "If-Modified-Since"} {
+			br.Header.Del(name)
+		}
+
+		rec := &textRecorder{header: http.Header{}, status: http.StatusOK}
+		route.handler.ServeHTTP(rec, br)
+		if rec.status == http.StatusOK && !rec.overflow && rec.header.Get("Content-Encoding") == "" {
+			if backend := bytes.TrimRight(rec.buf.Bytes(), "\r\n"); len(backend) > 0 {
+				body = append(append(backend, '\n', '\n'), body...)
+			}
+		}
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+// textRecorder catches a small backend response in memory.
+type textRecorder struct {
+	header   http.Header
+	status   int
+	wrote    bool
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (t *textRecorder) Header() http.Header {
+	return t.header
+}
+
+func (t *textRecorder) WriteHeader(code int) {
+	if t.wrote {
+		return
+	}
+	t.wrote = true
+	t.status = code
+}
+
+func (t *textRecorder) Write(b []byte) (int, error) {
+	t.WriteHeader(http.StatusOK)
+	if t.buf.Len()+len(b) > maxSupplementedFile {
+		t.overflow = true
+		return len(b), nil
+	}
+	return t.buf.Write(b)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// tlsHeaders are what backends get told about the tls connection appserve
+// terminated. whatever a client sends under these names is dropped, so a
+// backend can trust them.
+var tlsHeaders = []string{
+	"X-TLS-Version",
+	"X-TLS-Cipher",
+	"X-TLS-Server-Name",
+	"X-Client-Cert-Subject",
+	"X-Client-Cert-Issuer",
+	"X-Client-Cert-Fingerprint",
+	"X-Client-Cert",
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// setTLSHeaders drops any tls headers the client sent and, on a listener
+// with tls_headers, fills them in from the connection.
+func setTLSHeaders(r *http.Request) {
+	for _, name := range tlsHeaders {
+		r.Header.Del(name)
+	}
+	ci := connInfoFrom(r.Context())
+	if ci == nil || !ci.tlsHeaders || r.TLS == nil {
+		return
+	}
+	version, ok := tlsVersionNames[r.TLS.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", r.TLS.Version)
+	}
+	r.Header.Set("X-TLS-Version", version)
+	r.Header.Set("X-TLS-Cipher", tls.CipherSuiteName(r.TLS.CipherSuite))
+	if r.TLS.ServerName != "" {
+		r.Header.Set("X-TLS-Server-Name", r.TLS.ServerName)
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	r.Header.Set("X-Client-Cert-Subject", cert.Subject.String())
+	r.Header.Set("X-Client-Cert-Issuer", cert.Issuer.String())
+	r.Header.Set("X-Client-Cert-Fingerprint", hex.EncodeToString(sum[:]))
+	// headers can't hold newlines, escaped like nginx's $ssl_client_escaped_cert
+	r.Header.Set("X-Client-Cert", url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))))
+}
+
+// clientCertPool reads the certificates a listener's client_ca trusts.
+func clientCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates in " + file)
+	}
+	return pool, nil
+}
+
+// withClientAuth asks clients on a listener for certificates signed by
+// its client_ca, leaving acme's tls-alpn-01 handshakes alone as the ca
+// doesn't have one.
+func withClientAuth(config *tls.Config, l listenerConfig) error {
+	if l.ClientCA == "" {
+		return nil
+	}
+	pool, err := clientCertPool(l.ClientCA)
+	if err != nil {
+		return err
+	}
+	auth := tls.VerifyClientCertIfGiven
+	if l.ClientAuth == "require" {
+		auth = tls.RequireAndVerifyClientCert
+	}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if isALPNChallenge(hello) {
+			return nil, nil
+		}
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.ClientAuth = auth
+		c.ClientCAs = pool
+		return c, nil
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenPrefix marks appserve admin tokens so they're easy to spot in a
+// leaked config or a secret scanner.
+const tokenPrefix = "appserve_"
+
+// token roles: read tokens can look at routes, stats and logs, write tokens
+// can change routes too. tunnel tokens can't use the admin api at all, only
+// open tunnels for their domains.
+const (
+	roleRead   = "read"
+	roleWrite  = "write"
+	roleTunnel = "tunnel"
+)
+
+// adminToken is a named credential for the admin api. only a hash of the
+// token is kept, it's shown once when it's created and never again.
+type adminToken struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Role    string    `json:"role,omitempty"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Domains []string  `json:"domains,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// role is what the token may do, tokens from before there were roles can
+// do everything.
+func (t *adminToken) role() string {
+	if t.Role == "" {
+		return roleWrite
+	}
+	return t.Role
+}
+
+// allows reports whether the token may make a request. anything that isn't
+// a read needs a write token.
+func (t *adminToken) allows(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	}
+	return t.role() == roleWrite
+}
+
+// canTunnel reports whether a tunnel token may serve domain, one of its
+// domains or a name under one of its *.wildcards.
+func (t *adminToken) canTunnel(domain string) bool {
+	for _, d := range t.Domains {
+		if d == domain {
+			return true
+		}
+		if parent, ok := strings.CutPrefix(d, "*."); ok && strings.HasSuffix(domain, "."+parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// owns reports whether a route is the token's to see and manage, tokens
+// without a tenant have every route.
+func (t *adminToken) owns(route *Proxy) bool {
+	return t.Tenant == "" || route.Tenant == t.Tenant
+}
+
+type adminTokenKey struct{}
+
+// tokenFrom returns the token an admin api request was made with.
+func tokenFrom(r *http.Request) *adminToken {
+	t, _ := r.Context().Value(adminTokenKey{}).(*adminToken)
+	return t
+}
+
+// tokenStore checks admin api requests against the tokens file, picking up
+// tokens created or revoked by `appserve token` without a restart. with no
+// file it just has the tokens it was made with.
+type tokenStore struct {
+	file string
+
+	mu      sync.Mutex
+	modTime time.Time
+	tokens  []adminToken
+}
+
+func (s *tokenStore) current() ([]adminToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == "" {
+		return s.tokens, nil
+	}
+	info, err := os.Stat(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		s.tokens, s.modTime = nil, time.Time{}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.ModTime().Equal(s.modTime) {
+		tokens, err := readTokens(s.file)
+		if err != nil {
+			return nil, err
+		}
+		s.tokens, s.modTime = tokens, info.ModTime()
+	}
+	return s.tokens, nil
+}
+
+// authenticate finds the token a request's bearer credential belongs to.
+func (s *tokenStore) authenticate(r *http.Request) (*adminToken, bool) {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || secret == "" {
+		return nil, false
+	}
+	tokens, err := s.current()
+	if err != nil {
+		logLimited("admin", "Error reading tokens file %s: %v", s.file, err)
+		return nil, false
+	}
+	hash := hashToken(strings.TrimSpace(secret))
+	for i := range tokens {
+		if subtle.ConstantTimeCompare([]byte(tokens[i].Hash), []byte(hash)) == 1 {
+			return &tokens[i], true
+		}
+	}
+	return nil, false
+}
+
+// newTokenSecret makes the secret half of a token, the part handed out.
+func newTokenSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func readTokens(file string) ([]adminToken, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []adminToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return tokens, nil
+}
+
+// writeTokens replaces the tokens file, readable by us alone.
+func writeTokens(file string, tokens []adminToken) error {
+	data, err := json.MarshalIndent(tokens, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tokens-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// runToken manages admin api tokens, `appserve token create ci`.
+func runToken(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	file := fs.String("tokens", "tokens.json", "path to the tokens file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appserve token [-tokens file] create [-role read|write|tunnel] [-tenant name] [-domain name]... <name> | list | revoke <name>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	tokens, err := readTokens(*file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case fs.NArg() >= 2 && fs.Arg(0) == "create":
+		cfs := flag.NewFlagSet("token create", flag.ExitOnError)
+		role := cfs.String("role", roleWrite, "read to only look at routes, stats and logs, write to change routes too, tunnel to only open tunnels")
+		tenant := cfs.String("tenant", "", "only let the token see and manage this tenant's routes")
+		var domains []string
+		cfs.Func("domain", "a domain a tunnel token can serve, *.wildcards allowed, repeat for more", func(v string) error {
+			for _, d := range strings.Split(v, ",") {
+				if d = NormalizeDomain(strings.TrimSpace(d)); d != "" {
+					domains = append(domains, d)
+				}
+			}
+			return nil
+		})
+		cfs.Usage = fs.Usage
+		cfs.Parse(fs.Args()[1:])
+		if cfs.NArg() != 1 || (*role != roleRead && *role != roleWrite && *role != roleTunnel) {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if (*role == roleTunnel) != (len(domains) > 0) {
+			fmt.Fprintln(os.Stderr, "Error: Tunnel tokens need at least one -domain, and only they take one.")
+			os.Exit(2)
+		}
+		name := cfs.Arg(0)
+		for _, t := range tokens {
+			if t.Name == name {
+				fmt.Fprintf(os.Stderr, "Error: There's already a token called %s, revoke it first.\n", name)
+				os.Exit(1)
+			}
+		}
+		secret, err := newTokenSecret()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		tokens = append(tokens, adminToken{Name: name, Hash: hashToken(secret), Role: *role, Tenant: *tenant, Domains: domains, Created: time.Now().UTC()})
+		if err := writeTokens(*file, tokens); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		scope := ""
+		if *tenant != "" {
+			scope = " for tenant " + *tenant
+		}
+		if len(domains) > 0 {
+			scope = " for " + strings.Join(domains, ", ")
+		}
+		fmt.Printf("Created %s token %s%s, it won't be shown again:\n%s\n", *role, name, scope, secret)
+
+	case fs.NArg() == 1 && fs.Arg(0) == "list":
+		if len(tokens) == 0 {
+			fmt.Println("No tokens.")
+		}
+		for _, t := range tokens {
+			tenant := t.Tenant
+			if tenant == "" {
+				tenant = "all"
+			}
+			if t.role() == roleTunnel {
+				fmt.Printf("Token: %s, Role: %s, Domains: %s, created %s\n", t.Name, t.role(), strings.Join(t.Domains, ", "), t.Created.Format(time.RFC3339))
+				continue
+			}
+			fmt.Printf("Token: %s, Role: %s, Tenant: %s, created %s\n", t.Name, t.role(), tenant, t.Created.Format(time.RFC3339))
+		}
+
+	case fs.NArg() == 2 && fs.Arg(0) == "revoke":
+		name := fs.Arg(1)
+		kept := tokens[:0]
+		for _, t := range tokens {
+			if t.Name != name {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == len(tokens) {
+			fmt.Fprintf(os.Stderr, "Error: No token called %s.\n", name)
+			os.Exit(1)
+		}
+		if err := writeTokens(*file, kept); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Revoked token %s\n", name)
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trafficMonths is how many months of traffic are kept, a year and the
+// current one.
+const trafficMonths = 13
+
+// quotaWarnAt is the share of a quota that gets the first warning.
+const quotaWarnAt = 80
+
+// trafficLedger counts the bytes each domain takes in and sends out by
+// month, kept in a file so a restart doesn't lose what's been used.
+type trafficLedger struct {
+	file string
+
+	mu     sync.Mutex
+	months map[string]map[string]*trafficCount // month, like 2024-06, then domain
+	dirty  bool
+}
+
+// trafficCount is a domain's traffic for a month. Warned is the share of
+// its quota it's been warned about, so a restart doesn't warn again.
+type trafficCount struct {
+	In     uint64 `json:"in"`
+	Out    uint64 `json:"out"`
+	Warned int    `json:"warned,omitempty"`
+}
+
+func trafficMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// loadTrafficLedger reads the ledger kept in file, an empty one when it
+// doesn't exist yet.
+func loadTrafficLedger(file string) (*trafficLedger, error) {
+	l := &trafficLedger{file: file, months: map[string]map[string]*trafficCount{}}
+	if file == "" {
+		return l, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.months); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return l, nil
+}
+
+// add counts a request's bytes against domain for this month, and returns
+// the month's total so far.
+func (l *trafficLedger) add(domain string, in, out uint64) trafficCount {
+	month := trafficMonth(time.Now())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	domains, ok := l.months[month]
+	if !ok {
+		domains = map[string]*trafficCount{}
+		l.months[month] = domains
+	}
+	c, ok := domains[domain]
+	if !ok {
+		c = &trafficCount{}
+		domains[domain] = c
+	}
+	c.In += in
+	c.Out += out
+	l.dirty = true
+	return *c
+}
+
+// used is domain's traffic this month.
+func (l *trafficLedger) used(domain string) trafficCount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.months[trafficMonth(time.Now())][domain]; ok {
+		return *c
+	}
+	return trafficCount{}
+}
+
+// warn notes that domain has been warned about reaching percent of its
+// quota this month, false if it already had been.
+func (l *trafficLedger) warn(domain string, percent int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.months[trafficMonth(time.Now())][domain]
+	if !ok || c.Warned >= percent {
+		return false
+	}
+	c.Warned = percent
+	l.dirty = true
+	return true
+}
+
+// save writes the ledger out if anything changed, dropping months past
+// trafficMonths.
+func (l *trafficLedger) save() error {
+	l.mu.Lock()
+	if !l.dirty || l.file == "" {
+		l.mu.Unlock()
+		return nil
+	}
+	months := make([]string, 0, len(l.months))
+	for month := range l.months {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+	for len(months) > trafficMonths {
+		delete(l.months, months[0])
+		months = months[1:]
+	}
+	data, err := json.MarshalIndent(l.months, "", "  ")
+	l.dirty = false
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := l.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
+
+// run saves the ledger every minute.
+func (l *trafficLedger) run() {
+	for range time.Tick(time.Minute) {
+		if err := l.save(); err != nil {
+			logLimited("traffic", "Error saving traffic to %s: %v", l.file, err)
+		}
+	}
+}
+
+// trafficMonthJSON is a domain's traffic for one month.
+type trafficMonthJSON struct {
+	Month string `json:"month"`
+	In    uint64 `json:"in"`
+	Out   uint64 `json:"out"`
+}
+
+// history lists domain's traffic by month, newest first.
+func (l *trafficLedger) history(domain string) []trafficMonthJSON {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var months []trafficMonthJSON
+	for month, domains := range l.months {
+		if c, ok := domains[domain]; ok {
+			months = append(months, trafficMonthJSON{month, c.In, c.Out})
+		}
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Month > months[j].Month })
+	return months
+}
+
+// domains lists every domain with traffic this month, sorted.
+func (l *trafficLedger) domains() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var domains []string
+	for domain := range l.months[trafficMonth(time.Now())] {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// trafficWriter counts the response bytes sent and notes the status.
+type trafficWriter struct {
+	http.ResponseWriter
+	out    uint64
+	status int
+}
+
+func (t *trafficWriter) WriteHeader(code int) {
+	if t.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		t.status = code
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *trafficWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	n, err := t.ResponseWriter.Write(b)
+	t.out += uint64(n)
+	return n, err
+}
+
+func (t *trafficWriter) ReadFrom(r io.Reader) (int64, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	n, err := io.Copy(t.ResponseWriter, r)
+	t.out += uint64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack underneath.
+func (t *trafficWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// trafficBody counts the request body bytes read.
+type trafficBody struct {
+	io.ReadCloser
+	in uint64
+}
+
+func (t *trafficBody) Read(b []byte) (int, error) {
+	n, err := t.ReadCloser.Read(b)
+	t.in += uint64(n)
+	return n, err
+}
+
+// trafficAccount is what a route's traffic is counted under, its host so
+// a site's paths and a wildcard's names add up to one figure.
+func trafficAccount(key string) string {
+	host, _, _ := strings.Cut(key, "/")
+	return host
+}
+
+// countTraffic adds up a finished request against its account and warns
+// about the account's quota as it's reached.
+func (app *App) countTraffic(account string, route *Proxy, in, out uint64) {
+	used := app.Traffic.add(account, in, out)
+	if route.quota == 0 {
+		return
+	}
+	total := used.In + used.Out
+	percent := int(total * 100 / route.quota)
+	level := 0
+	switch {
+	case percent >= 100:
+		level = 100
+	case percent >= quotaWarnAt:
+		level = quotaWarnAt
+	}
+	if level == 0 || !app.Traffic.warn(account, level) {
+		return
+	}
+	data := map[string]interface{}{"domain": account, "used": total, "quota": route.quota, "month": trafficMonth(time.Now())}
+	if level == 100 {
+		log.Printf("%s is over its monthly quota of %s", account, formatSize(route.quota))
+		emitEvent(eventQuotaExceeded, data)
+		return
+	}
+	log.Printf("%s has used %d%% of its monthly quota of %s", account, percent, formatSize(route.quota))
+	emitEvent(eventQuotaWarning, data)
+}
+
+// overQuota reports whether requests for the account should get the over
+// quota page.
+func (app *App) overQuota(account string, route *Proxy) bool {
+	if route.quota == 0 || route.QuotaAction != "block" {
+		return false
+	}
+	used := app.Traffic.used(account)
+	return used.In+used.Out >= route.quota
+}
+
+// serveOverQuota answers for a site that's used up its traffic for the
+// month, until the next one starts.
+func serveOverQuota(w http.ResponseWriter) {
+	requestErrors.add(errorClient, "over-quota")
+	now := time.Now().UTC()
+	next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	w.Header().Set("Retry-After", fmt.Sprint(int(next.Sub(now).Seconds())+1))
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "This site has used up its traffic for the month, it's back on "+next.Format("January 2")+".", http.StatusServiceUnavailable)
+}
+
+// handleTrafficCommand shows this month's traffic for every domain, or the
+// months on record for one.
+func (app *App) handleTrafficCommand(domain string) {
+	quotas := map[string]uint64{}
+	app.Mu.RLock()
+	for key, proxy := range app.Routes {
+		if proxy.quota > 0 {
+			quotas[trafficAccount(key)] = proxy.quota
+		}
+	}
+	app.Mu.RUnlock()
+
+	if domain != "" {
+		months := app.Traffic.history(domain)
+		if len(months) == 0 {
+			fmt.Printf("No traffic for %s yet.\n", domain)
+			return
+		}
+		fmt.Printf("Domain: %s\n", domain)
+		for _, m := range months {
+			fmt.Printf("  %s: %s in, %s out\n", m.Month, formatSize(m.In), formatSize(m.Out))
+		}
+		return
+	}
+	domains := app.Traffic.domains()
+	if len(domains) == 0 {
+		fmt.Println("No traffic this month yet.")
+		return
+	}
+	for _, d := range domains {
+		used := app.Traffic.used(d)
+		line := fmt.Sprintf("Domain: %s, %s in, %s out", listedDomain(d), formatSize(used.In), formatSize(used.Out))
+		if quota := quotas[d]; quota > 0 {
+			line += fmt.Sprintf(", %d%% of %s", (used.In+used.Out)*100/quota, formatSize(quota))
+		}
+		fmt.Println(line)
+	}
+}
+
+// adminTraffic lists each domain's traffic by month, GET /traffic.
+func (app *App) adminTraffic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	type domainJSON struct {
+		Domain string             `json:"domain"`
+		Months []trafficMonthJSON `json:"months"`
+	}
+	out := []domainJSON{}
+	token := tokenFrom(r)
+	seen := map[string]bool{}
+	app.Traffic.mu.Lock()
+	for _, domains := range app.Traffic.months {
+		for d := range domains {
+			seen[d] = true
+		}
+	}
+	app.Traffic.mu.Unlock()
+	for d := range seen {
+		if app.ownsDomain(token, d) {
+			out = append(out, domainJSON{d, app.Traffic.history(d)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Domain < out[j].Domain })
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxTransformBody is the largest response body we'll buffer to rewrite,
+// anything bigger is passed through untouched.
+const maxTransformBody = 8 << 20
+
+// BodyTransform is one rewrite applied to text responses of a route.
+type BodyTransform struct {
+	// ContentTypes the transform applies to, text/html when empty.
+	ContentTypes []string `json:"content_types,omitempty"`
+
+	// Find is a regular expression, every match is swapped for Replace
+	// which may refer to groups as $1, ${name} etc.
+	Find    string `json:"find,omitempty"`
+	Replace string `json:"replace,omitempty"`
+
+	// Inject is inserted right before the closing </body> tag, or at the
+	// end of the document if there isn't one.
+	Inject string `json:"inject,omitempty"`
+}
+
+type compiledTransform struct {
+	BodyTransform
+	find *regexp.Regexp
+}
+
+var closingBody = regexp.MustCompile(`(?i)</body\s*>`)
+
+// newBodyTransformer compiles the transforms of a route into a response
+// modifier.
+func newBodyTransformer(transforms []BodyTransform) (func(*http.Response) error, error) {
+	compiled := make([]compiledTransform, 0, len(transforms))
+	for i, t := range transforms {
+		ct := compiledTransform{BodyTransform: t}
+		if len(ct.ContentTypes) == 0 {
+			ct.ContentTypes = []string{"text/html"}
+		}
+		if t.Find != "" {
+			re, err := regexp.Compile(t.Find)
+			if err != nil {
+				return nil, fmt.Errorf("transform %d: %w", i, err)
+			}
+			ct.find = re
+		}
+		compiled = append(compiled, ct)
+	}
+
+	return func(resp *http.Response) error {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+		var active []compiledTransform
+		for _, t := range compiled {
+			if t.appliesTo(mediaType) {
+				active = append(active, t)
+			}
+		}
+		if len(active) == 0 || resp.Body == nil || resp.StatusCode == http.StatusNoContent {
+			return nil
+		}
+
+		// the director asked for an uncompressed body, if the backend sent
+		// one anyway we can't safely rewrite it
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+			return nil
+		}
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxTransformBody+1))
+		if err != nil {
+			return err
+		}
+		if len(body) > maxTransformBody {
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return nil
+		}
+		resp.Body.Close()
+
+		original := body
+		for _, t := range active {
+			body = t.apply(body)
+		}
+		if !bytes.Equal(body, original) {
+			// the backend's validators were for the bytes it sent, a strong
+			// etag or an md5 of them would be a lie now
+			if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				resp.Header.Set("ETag", "W/"+etag)
+			}
+			resp.Header.Del("Content-MD5")
+		}
+
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}, nil
+}
+
+func (t compiledTransform) appliesTo(mediaType string) bool {
+	for _, ct := range t.ContentTypes {
+		if strings.EqualFold(ct, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t compiledTransform) apply(body []byte) []byte {
+	if t.find != nil {
+		body = t.find.ReplaceAll(body, []byte(t.Replace))
+	}
+	if t.Inject != "" {
+		loc := closingBody.FindAllIndex(body, -1)
+		at := len(body)
+		if len(loc) > 0 {
+			at = loc[len(loc)-1][0]
+		}
+		out := make([]byte, 0, len(body)+len(t.Inject))
+		out = append(out, body[:at]...)
+		out = append(out, t.Inject...)
+		body = append(out, body[at:]...)
+	}
+	return body
+}
+
+// readCloser glues a replacement reader to the original body's Close.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
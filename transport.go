@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// upstreams carry every proxied request to its backend, pools of
+// connections shared by all routes. main sets them up from the flags before
+// any routes are built.
+var upstreams = newTransports(transportConfig{
+	MaxIdleConnsPerHost: 32,
+	IdleConnTimeout:     90 * time.Second,
+	DialTimeout:         5 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+})
+
+// transportConfig is the tunable part of the upstream transports.
+type transportConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// SendProxyProtocol starts every connection with a PROXY header, "v1"
+	// or "v2". connections can't be reused for another client's requests
+	// then, so there's no keep alive.
+	SendProxyProtocol string
+}
+
+// transports are the ways we know of talking to a backend.
+type transports struct {
+	cfg transportConfig
+
+	// plain speaks http/1.1, or over tls whatever the backend picks
+	// through alpn, h2 included.
+	plain *http.Transport
+	// insecure is plain without checking the backend's certificate.
+	insecure *http.Transport
+	// h2c is http/2 over a plain tcp connection, for backends that are
+	// known to speak it.
+	h2c *http2.Transport
+}
+
+func newTransports(cfg transportConfig) *transports {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if cfg.SendProxyProtocol != "" {
+		dial = dialWithProxyHeader(cfg.SendProxyProtocol, dial)
+	}
+	plain := &http.Transport{
+		Proxy:                 nil, // backends are local, never go through HTTP_PROXY
+		DialContext:           dial,
+		DisableKeepAlives:     cfg.SendProxyProtocol != "",
+		ForceAttemptHTTP2:     cfg.SendProxyProtocol == "", // h2 would share a connection between clients
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	insecure := plain.Clone()
+	insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	h2c := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout: cfg.IdleConnTimeout,
+	}
+
+	return &transports{cfg: cfg, plain: plain, insecure: insecure, h2c: h2c}
+}
+
+// pools are the connection pools of routes that keep their own, so a
+// backend that leaks slow connections only uses up its own. they're kept
+// by backend and limits, a reload picks the same warm pool back up.
+var pools = struct {
+	sync.Mutex
+	m map[string]*transports
+}{m: map[string]*transports{}}
+
+// routeTransports returns the pool a route's requests go through, the
+// shared one unless the route asks for limits of its own.
+func routeTransports(addr string, opts RouteOptions) *transports {
+	if !opts.OwnPool && opts.PoolMaxIdle == 0 && opts.PoolMaxConns == 0 && opts.SendProxyProtocol == "" {
+		return upstreams
+	}
+
+	key := fmt.Sprintf("%s|%d|%d|%s", addr, opts.PoolMaxIdle, opts.PoolMaxConns, opts.SendProxyProtocol)
+	pools.Lock()
+	defer pools.Unlock()
+	if t, ok := pools.m[key]; ok {
+		return t
+	}
+
+	cfg := upstreams.cfg
+	if opts.PoolMaxIdle > 0 {
+		cfg.MaxIdleConns = opts.PoolMaxIdle
+		cfg.MaxIdleConnsPerHost = opts.PoolMaxIdle
+	}
+	if opts.PoolMaxConns > 0 {
+		cfg.MaxConnsPerHost = opts.PoolMaxConns
+	}
+	cfg.SendProxyProtocol = opts.SendProxyProtocol
+	t := newTransports(cfg)
+	pools.m[key] = t
+	return t
+}
+
+// closeAllIdle drops the idle connections of the shared pool and every
+// route's own.
+func closeAllIdle() {
+	upstreams.closeIdle()
+	pools.Lock()
+	defer pools.Unlock()
+	for _, t := range pools.m {
+		t.closeIdle()
+	}
+}
+
+// closeIdle drops every idle backend connection, the next requests dial
+// afresh.
+func (t *transports) closeIdle() {
+	t.plain.CloseIdleConnections()
+	t.insecure.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
+
+// backend protocols a route can ask for
+const (
+	backendHTTP    = "http"
+	backendHTTPS   = "https"
+	backendH2C     = "h2c"
+	backendFastCGI = "fastcgi"
+	backendUWSGI   = "uwsgi"
+)
+
+// forRoute picks the scheme and transport for a route's backend at addr.
+func (t *transports) forRoute(addr string, opts RouteOptions) (string, http.RoundTripper, error) {
+	if opts.SendProxyProtocol != "" {
+		switch opts.BackendProtocol {
+		case "", backendHTTP, backendHTTPS:
+		default:
+			return "", nil, fmt.Errorf("send_proxy_protocol only goes with http and https backends, not %s", opts.BackendProtocol)
+		}
+	}
+	switch opts.BackendProtocol {
+	case "", backendHTTP:
+		return "http", t.plain, nil
+	case backendHTTPS:
+		if opts.BackendInsecure {
+			return "https", t.insecure, nil
+		}
+		return "https", t.plain, nil
+	case backendH2C:
+		return "http", t.h2c, nil
+	case backendFastCGI:
+		fcgi, err := newFastCGITransport(addr, opts, t.cfg)
+		return "http", fcgi, err
+	case backendUWSGI:
+		return "http", newUWSGITransport(addr, opts, t.cfg), nil
+	}
+	return "", nil, fmt.Errorf("backend_protocol: unknown protocol %q", opts.BackendProtocol)
+}
+
+// proxyBufferSize matches what httputil.ReverseProxy allocates for itself.
+const proxyBufferSize = 32 << 10
+
+// proxyBuffers recycles the buffers reverse proxies copy response bodies
+// through, instead of a fresh 32KB for every request.
+var proxyBuffers = &bufferPool{}
+
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func (b *bufferPool) Get() []byte {
+	if buf, ok := b.pool.Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, proxyBufferSize)
+}
+
+func (b *bufferPool) Put(buf []byte) {
+	if cap(buf) != proxyBufferSize {
+		return
+	}
+	buf = buf[:proxyBufferSize]
+	b.pool.Put(&buf)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
+)
+
+// tunnelDomainHeader is the domain a tunnel client asks to serve.
+const tunnelDomainHeader = "X-Tunnel-Domain"
+
+// tunnelTransport speaks http/2 down tunnels, the edge is the client and
+// the machine at the other end answers.
+var tunnelTransport = &http2.Transport{
+	ReadIdleTimeout: 30 * time.Second,
+	PingTimeout:     15 * time.Second,
+}
+
+// tunnel is a connected appserve connect, serving a domain from wherever
+// it runs. requests for the domain go down it as http/2 streams.
+type tunnel struct {
+	domain string
+	token  string
+	remote string
+	since  time.Time
+
+	cc   *http2.ClientConn
+	ws   *websocket.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (t *tunnel) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.cc.RoundTrip(r)
+}
+
+// close hangs up on the client, which will reconnect if it's still
+// running.
+func (t *tunnel) close() {
+	t.once.Do(func() {
+		close(t.done)
+		t.cc.Close()
+		t.ws.Close()
+	})
+}
+
+// wait returns once the tunnel is closed, or has stopped answering pings.
+func (t *tunnel) wait() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastPing := time.Now()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			if t.cc.State().Closed {
+				return
+			}
+			if now.Sub(lastPing) < 30*time.Second {
+				continue
+			}
+			lastPing = now
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			err := t.cc.Ping(ctx)
+			cancel()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// newTunnelProxy is the route for a tunnel's domain.
+func newTunnelProxy(t *tunnel) (*Proxy, error) {
+	rp := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: t.domain})
+	rp.Transport = t
+	rp.BufferPool = proxyBuffers
+	rp.ErrorHandler = proxyError
+	proxy := &Proxy{
+		Port:    "tunnel",
+		Proxy:   rp,
+		handler: rp,
+		tunnel:  t,
+	}
+	if err := proxy.applyOptions(); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// serveTunnel takes a tunnel from appserve connect on the -tunnel-host
+// name. the token has to be a tunnel token for the domain asked for, and
+// the domain can't already have a route of its own.
+func (app *App) serveTunnel(w http.ResponseWriter, r *http.Request) {
+	token, ok := app.Tokens.authenticate(r)
+	if !ok {
+		securityEvent(eventAuthFailure, clientIP(r), app.TunnelHost, "bad or missing tunnel token")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="appserve"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	domain := NormalizeDomain(r.Header.Get(tunnelDomainHeader))
+	switch {
+	case token.role() != roleTunnel:
+		http.Error(w, "token "+token.Name+" isn't a tunnel token", http.StatusForbidden)
+		return
+	case domain == "":
+		http.Error(w, "no domain asked for, send "+tunnelDomainHeader, http.StatusBadRequest)
+		return
+	case !token.canTunnel(domain):
+		securityEvent(eventAuthFailure, clientIP(r), domain, "tunnel token "+token.Name+" isn't for this domain")
+		http.Error(w, "token "+token.Name+" can't tunnel "+domain, http.StatusForbidden)
+		return
+	}
+	app.Mu.RLock()
+	existing, taken := app.Routes[domain]
+	app.Mu.RUnlock()
+	if taken && existing.tunnel == nil {
+		http.Error(w, domain+" already has a route", http.StatusConflict)
+		return
+	}
+
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			cc, err := tunnelTransport.NewClientConn(ws)
+			if err != nil {
+				log.Printf("Error starting the tunnel for %s: %v", domain, err)
+				return
+			}
+			t := &tunnel{domain: domain, token: token.Name, remote: clientIP(r), since: time.Now(), cc: cc, ws: ws, done: make(chan struct{})}
+			defer t.close()
+			if err := app.openTunnel(t); err != nil {
+				log.Printf("Error opening the tunnel for %s: %v", domain, err)
+				return
+			}
+			log.Printf("Tunnel for %s connected from %s (token %s)", domain, t.remote, t.token)
+			t.wait()
+			app.closeTunnel(t)
+			log.Printf("Tunnel for %s from %s closed", domain, t.remote)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// openTunnel routes the tunnel's domain down it, taking over from an older
+// tunnel for the same domain, a client reconnecting before the edge has
+// noticed it left.
+func (app *App) openTunnel(t *tunnel) error {
+	proxy, err := newTunnelProxy(t)
+	if err != nil {
+		return err
+	}
+	app.Mu.Lock()
+	defer app.Mu.Unlock()
+	existing, ok := app.Routes[t.domain]
+	if ok && existing.tunnel == nil {
+		return errors.New(t.domain + " has a route of its own now")
+	}
+	if ok {
+		existing.tunnel.close()
+	}
+	app.Routes[t.domain] = proxy
+	app.publishRoutes()
+	return nil
+}
+
+// closeTunnel removes the tunnel's route, if it's still the one there.
+func (app *App) closeTunnel(t *tunnel) {
+	app.Mu.Lock()
+	defer app.Mu.Unlock()
+	if proxy, ok := app.Routes[t.domain]; ok && proxy.tunnel == t {
+		delete(app.Routes, t.domain)
+		app.publishRoutes()
+	}
+}
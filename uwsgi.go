@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// uwsgiTransport sends requests to a uWSGI server over its own protocol,
+// one connection per request, for python apps that don't run an http
+// server of their own.
+type uwsgiTransport struct {
+	network, addr string
+	scriptName    string
+	params        map[string]string
+	dialer        net.Dialer
+}
+
+// newUWSGITransport talks to addr, a host:port or unix:/path/to.sock.
+func newUWSGITransport(addr string, opts RouteOptions, cfg transportConfig) *uwsgiTransport {
+	t := &uwsgiTransport{network: "tcp", addr: addr, scriptName: strings.TrimSuffix(opts.UWSGIScriptName, "/"), params: opts.UWSGIParams}
+	if socket, ok := strings.CutPrefix(addr, "unix:"); ok {
+		t.network, t.addr = "unix", socket
+	}
+	t.dialer.Timeout = cfg.DialTimeout
+	return t
+}
+
+// env builds the wsgi environment for r. the app is mounted at the script
+// name, PATH_INFO is whatever's under it.
+func (t *uwsgiTransport) env(r *http.Request) map[string]string {
+	env := cgiEnv(r)
+	pathInfo := r.URL.Path
+	if t.scriptName != "" {
+		if rest, ok := strings.CutPrefix(pathInfo, t.scriptName); ok && (rest == "" || rest[0] == '/') {
+			pathInfo = rest
+		}
+	}
+	env["SCRIPT_NAME"] = t.scriptName
+	env["PATH_INFO"] = pathInfo
+	if r.TLS != nil {
+		env["UWSGI_SCHEME"] = "https"
+	}
+	for name, value := range t.params {
+		env[name] = value
+	}
+	return env
+}
+
+// packet encodes the vars block uwsgi starts every request with, sizes
+// are little endian and none of them can be over 64KB.
+func (t *uwsgiTransport) packet(env map[string]string) ([]byte, error) {
+	var vars bytes.Buffer
+	var size [2]byte
+	for name, value := range env {
+		if len(name) > 0xffff || len(value) > 0xffff {
+			return nil, fmt.Errorf("uwsgi: %s is too long to send", name)
+		}
+		binary.LittleEndian.PutUint16(size[:], uint16(len(name)))
+		vars.Write(size[:])
+		vars.WriteString(name)
+		binary.LittleEndian.PutUint16(size[:], uint16(len(value)))
+		vars.Write(size[:])
+		vars.WriteString(value)
+	}
+	if vars.Len() > 0xffff {
+		return nil, errors.New("uwsgi: request headers are too large to send")
+	}
+	h := [4]byte{0, 0, 0, 0} // modifier1 0 is a wsgi request
+	binary.LittleEndian.PutUint16(h[1:3], uint16(vars.Len()))
+	return append(h[:], vars.Bytes()...), nil
+}
+
+func (t *uwsgiTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// wsgi apps read CONTENT_LENGTH bytes and no more, a chunked body has
+	// to be read first to know how long it is
+	body := r.Body
+	if body != nil && r.ContentLength < 0 {
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r = r.Clone(r.Context())
+		r.ContentLength = int64(len(data))
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		body = r.Body
+	}
+
+	packet, err := t.packet(t.env(r))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.dialer.DialContext(r.Context(), t.network, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	rc := &uwsgiConn{Conn: conn, done: make(chan struct{})}
+	// a cancelled request takes the connection with it
+	go func() {
+		select {
+		case <-r.Context().Done():
+			conn.Close()
+		case <-rc.done:
+		}
+	}()
+	if _, err := conn.Write(packet); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if body != nil && r.ContentLength > 0 {
+		go io.Copy(conn, body)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), r)
+	if err != nil {
+		rc.Close()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("uwsgi: %s sent no response", t.addr)
+		}
+		return nil, fmt.Errorf("uwsgi: %w", err)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{resp.Body, rc}
+	return resp, nil
+}
+
+// uwsgiConn closes the connection once the response has been read.
+type uwsgiConn struct {
+	net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *uwsgiConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+	return nil
+}
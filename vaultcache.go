@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// vaultCache keeps certificates, their keys and the acme account in a
+// hashicorp vault kv v2 secrets engine instead of files in tls, one secret
+// per cache entry under the path.
+type vaultCache struct {
+	addr      string
+	mount     string
+	path      string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+// newVaultCache talks to the vault at addr, keeping entries at
+// mount/path, "secret/appserve" puts them under appserve in the secret
+// engine. the token comes from $VAULT_TOKEN.
+func newVaultCache(addr, path string) (*vaultCache, error) {
+	if addr == "" {
+		return nil, errors.New("no vault address, pass -vault-addr or set VAULT_ADDR")
+	}
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid vault address %q, expected https://host:8200", addr)
+	}
+	mount, rest, _ := strings.Cut(strings.Trim(path, "/"), "/")
+	if mount == "" {
+		return nil, errors.New("no vault path, expected something like secret/appserve")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		return nil, errors.New("no vault token, set VAULT_TOKEN")
+	}
+	return &vaultCache{
+		addr:      strings.TrimSuffix(addr, "/"),
+		mount:     mount,
+		path:      rest,
+		token:     token,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// url is where kind ("data" or "metadata") is kept for an entry, or the
+// whole path for an empty key.
+func (c *vaultCache) url(kind, key string) string {
+	u := c.addr + "/v1/" + c.mount + "/" + kind
+	if c.path != "" {
+		u += "/" + c.path
+	}
+	if key == "" {
+		return u + "/"
+	}
+	return u + "/" + url.PathEscape(key)
+}
+
+func (c *vaultCache) do(ctx context.Context, method, url string, body interface{}, out interface{}) (int, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+		if len(e.Errors) > 0 {
+			return resp.StatusCode, fmt.Errorf("vault: %s", strings.Join(e.Errors, ", "))
+		}
+		return resp.StatusCode, fmt.Errorf("vault answered %s", resp.Status)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("vault: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *vaultCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Data struct {
+				Value string `json:"value"`
+			} `json:"data"`
+		} `json:"data"`
+	}
+	status, err := c.do(ctx, http.MethodGet, c.url("data", key), nil, &out)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound || out.Data.Data.Value == "" {
+		return nil, autocert.ErrCacheMiss
+	}
+	return base64.StdEncoding.DecodeString(out.Data.Data.Value)
+}
+
+func (c *vaultCache) Put(ctx context.Context, key string, data []byte) error {
+	body := map[string]interface{}{"data": map[string]string{"value": base64.StdEncoding.EncodeToString(data)}}
+	_, err := c.do(ctx, http.MethodPost, c.url("data", key), body, nil)
+	return err
+}
+
+// Delete removes every version of the entry, a challenge token or a
+// certificate autocert gave up on has no history worth keeping.
+func (c *vaultCache) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, c.url("metadata", key), nil, nil)
+	return err
+}
+
+// list names the entries under the path.
+func (c *vaultCache) list(ctx context.Context) ([]string, error) {
+	var out struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	status, err := c.do(ctx, "LIST", c.url("metadata", ""), nil, &out)
+	if err != nil || status == http.StatusNotFound {
+		return nil, err
+	}
+	var keys []string
+	for _, k := range out.Data.Keys {
+		// folders, something else keeping secrets under the same path
+		if !strings.HasSuffix(k, "/") {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// webhookAttempts is how many times a delivery is tried before it's given
+// up on, waiting twice as long after each failure.
+const webhookAttempts = 5
+
+// webhook is an endpoint told about events as they happen, from the
+// -webhooks file:
+//
+//	[{"url": "https://example.com/hook", "secret": "...", "events": ["route.*", "cert.failed"]}]
+//
+// events are names or a prefix ending in *, no events means all of them.
+type webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+
+	queue chan event
+}
+
+func loadWebhooks(file string) ([]*webhook, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []*webhook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for _, hook := range hooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: webhook url %q has to be http:// or https://", file, hook.URL)
+		}
+		hook.queue = make(chan event, 1000)
+	}
+	return hooks, nil
+}
+
+// wants reports whether the hook asked to hear about events of typ.
+func (h *webhook) wants(typ string) bool {
+	return eventMatches(h.Events, typ)
+}
+
+// run delivers events to the hook one at a time, in the order they
+// happened. events that pile up while the endpoint is down are dropped
+// once the queue is full.
+func (h *webhook) run() {
+	stop := appEvents.subscribe(h.queue)
+	defer stop()
+	for e := range h.queue {
+		if !h.wants(e.Type) {
+			continue
+		}
+		wait := time.Second
+		for attempt := 1; ; attempt++ {
+			err := h.deliver(e)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				// webhook urls often have a secret in the path, the host will do
+				u, _ := url.Parse(h.URL)
+				log.Printf("Giving up on webhook to %s for %s event %s: %v", u.Host, e.Type, e.ID, err)
+				break
+			}
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
+
+// deliver posts one event. the body is signed with the hook's secret so the
+// endpoint can check it came from us:
+//
+//	X-Appserve-Signature: sha256=<hex hmac-sha256 of the body>
+func (h *webhook) deliver(e event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "appserve-webhook")
+	req.Header.Set("X-Appserve-Event", e.Type)
+	req.Header.Set("X-Appserve-Delivery", e.ID)
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Appserve-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if urlErr, ok := err.(*url.Error); ok {
+		// without the url, for the same reason as above
+		return urlErr.Err
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}